@@ -201,6 +201,10 @@ fli synchronizes metadata with FlockerHub and can push and pull snapshots of vol
 		newVersionCmd(ctx, h),
 		newInfoCmd(ctx, h),
 		newDiagnosticsCmd(ctx, h),
+		newFsckCmd(ctx, h),
+		newPruneCmd(ctx, h),
+		newDaemonCmd(ctx, h),
+		newDiffCmd(ctx, h),
 		complCmd,
 	}
 
@@ -303,12 +307,19 @@ func newConfigCmd(ctx context.Context, h CommandHandler) *cobra.Command {
 			"[OPTIONS]",
 		}),
 		Short: "Read and update the commonly used parameters",
+		Long: `Reads and updates the parameters commonly used by other commands, they are kept in the configuration file.
+Snapshots pushed with an encryption key are always sent in full, not as the changes since the previous snapshot, because FlockerHub can't read them to apply changes. Each encrypted snapshot takes its full size to push, to store on FlockerHub and to pull.
+`,
 		Run: func(cmd *cobra.Command, args []string) {
 			var (
-				err         error
-				urlFlag     string
-				tokenFlag   string
-				offlineFlag bool
+				err             error
+				urlFlag         string
+				tokenFlag       string
+				compressionFlag string
+				hashFlag        string
+				differFlag      string
+				encryptionFlag  string
+				offlineFlag     bool
 			)
 
 			urlFlag, err = cmd.Flags().GetString("url")
@@ -323,6 +334,30 @@ func newConfigCmd(ctx context.Context, h CommandHandler) *cobra.Command {
 				os.Exit(1)
 			}
 
+			compressionFlag, err = cmd.Flags().GetString("compression")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
+			hashFlag, err = cmd.Flags().GetString("hash")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
+			differFlag, err = cmd.Flags().GetString("differ")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
+			encryptionFlag, err = cmd.Flags().GetString("encryption-key")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
 			offlineFlag, err = cmd.Flags().GetBool("offline")
 			if err != nil {
 				cmd.Println(err)
@@ -332,15 +367,23 @@ func newConfigCmd(ctx context.Context, h CommandHandler) *cobra.Command {
 			logger, err := newLogger()
 			handleError(cmd, err)
 
-			logger.Printf("fli config --url '%v' --token '%v' --offline '%v' '%v'",
+			logger.Printf("fli config --url '%v' --token '%v' --compression '%v' --hash '%v' --differ '%v' --encryption-key '%v' --offline '%v' '%v'",
 				urlFlag,
 				tokenFlag,
+				compressionFlag,
+				hashFlag,
+				differFlag,
+				redactKey(encryptionFlag),
 				offlineFlag,
 				strings.Join(args, " "),
 			)
-			log.Printf("fli config --url '%v' --token '%v' --offline '%v' '%v'",
+			log.Printf("fli config --url '%v' --token '%v' --compression '%v' --hash '%v' --differ '%v' --encryption-key '%v' --offline '%v' '%v'",
 				urlFlag,
 				tokenFlag,
+				compressionFlag,
+				hashFlag,
+				differFlag,
+				redactKey(encryptionFlag),
 				offlineFlag,
 				strings.Join(args, " "),
 			)
@@ -349,6 +392,10 @@ func newConfigCmd(ctx context.Context, h CommandHandler) *cobra.Command {
 			res, err = h.Config(
 				urlFlag,
 				tokenFlag,
+				compressionFlag,
+				hashFlag,
+				differFlag,
+				encryptionFlag,
 				offlineFlag,
 				args,
 			)
@@ -384,6 +431,54 @@ func newConfigCmd(ctx context.Context, h CommandHandler) *cobra.Command {
 		tokenDefVal,
 		"Absolute path of the authentication token file")
 
+	compressionDefVal := "none"
+	if v := ctx.Value(compressionKey); v != nil {
+		compressionDefVal = ctx.Value(compressionKey).(string)
+	}
+
+	cmd.Flags().StringP(
+		"compression",
+		"",
+		compressionDefVal,
+		"Default compression of pushed and pulled snapshots (none, gzip, zstd or s2)")
+
+	hashDefVal := "adler32"
+	if v := ctx.Value(hashKey); v != nil {
+		hashDefVal = ctx.Value(hashKey).(string)
+	}
+
+	cmd.Flags().StringP(
+		"hash",
+		"",
+		hashDefVal,
+		"Default hash of record checksums of pushed and pulled snapshots "+
+			"(none, adler32, xxhash64, xxh3, md5, sha256, blake2b or blake3)")
+
+	differDefVal := "variableblk"
+	if v := ctx.Value(differKey); v != nil {
+		differDefVal = ctx.Value(differKey).(string)
+	}
+
+	cmd.Flags().StringP(
+		"differ",
+		"",
+		differDefVal,
+		"File differ of pushed snapshots (variableblk or cdc), cdc cuts files into content-defined chunks "+
+			"so data inserted or deleted in the middle of a file doesn't resend the rest of it")
+
+	encryptionDefVal := ""
+	if v := ctx.Value(encryptionKey); v != nil {
+		encryptionDefVal = ctx.Value(encryptionKey).(string)
+	}
+
+	cmd.Flags().StringP(
+		"encryption-key",
+		"",
+		encryptionDefVal,
+		"ID of the key pushed snapshots are encrypted with, a new key is generated if there is none with the ID. "+
+			"Use ID=KEY to add a key exported from another client or none to stop encrypting. "+
+			"Encrypted snapshots are pushed and pulled in full")
+
 	cmd.Flags().BoolP(
 		"offline",
 		"",
@@ -704,10 +799,13 @@ The following example explains how to pull a single snapshot of a volume
 `,
 		Run: func(cmd *cobra.Command, args []string) {
 			var (
-				err       error
-				urlFlag   string
-				tokenFlag string
-				fullFlag  bool
+				err             error
+				urlFlag         string
+				tokenFlag       string
+				compressionFlag string
+				hashFlag        string
+				dryRunFlag      bool
+				fullFlag        bool
 			)
 
 			urlFlag, err = cmd.Flags().GetString("url")
@@ -722,6 +820,24 @@ The following example explains how to pull a single snapshot of a volume
 				os.Exit(1)
 			}
 
+			compressionFlag, err = cmd.Flags().GetString("compression")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
+			hashFlag, err = cmd.Flags().GetString("hash")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
+			dryRunFlag, err = cmd.Flags().GetBool("dry-run")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
 			fullFlag, err = cmd.Flags().GetBool("full")
 			if err != nil {
 				cmd.Println(err)
@@ -731,15 +847,21 @@ The following example explains how to pull a single snapshot of a volume
 			logger, err := newLogger()
 			handleError(cmd, err)
 
-			logger.Printf("fli pull --url '%v' --token '%v' --full '%v' '%v'",
+			logger.Printf("fli pull --url '%v' --token '%v' --compression '%v' --hash '%v' --dry-run '%v' --full '%v' '%v'",
 				urlFlag,
 				tokenFlag,
+				compressionFlag,
+				hashFlag,
+				dryRunFlag,
 				fullFlag,
 				strings.Join(args, " "),
 			)
-			log.Printf("fli pull --url '%v' --token '%v' --full '%v' '%v'",
+			log.Printf("fli pull --url '%v' --token '%v' --compression '%v' --hash '%v' --dry-run '%v' --full '%v' '%v'",
 				urlFlag,
 				tokenFlag,
+				compressionFlag,
+				hashFlag,
+				dryRunFlag,
 				fullFlag,
 				strings.Join(args, " "),
 			)
@@ -748,6 +870,9 @@ The following example explains how to pull a single snapshot of a volume
 			res, err = h.Pull(
 				urlFlag,
 				tokenFlag,
+				compressionFlag,
+				hashFlag,
+				dryRunFlag,
 				fullFlag,
 				args,
 			)
@@ -783,6 +908,35 @@ The following example explains how to pull a single snapshot of a volume
 		tokenDefVal,
 		"Absolute path of the authentication token file")
 
+	compressionDefVal := "none"
+	if v := ctx.Value(compressionKey); v != nil {
+		compressionDefVal = ctx.Value(compressionKey).(string)
+	}
+
+	cmd.Flags().StringP(
+		"compression",
+		"",
+		compressionDefVal,
+		"Compression of the transferred data (none, gzip, zstd or s2)")
+
+	hashDefVal := "adler32"
+	if v := ctx.Value(hashKey); v != nil {
+		hashDefVal = ctx.Value(hashKey).(string)
+	}
+
+	cmd.Flags().StringP(
+		"hash",
+		"",
+		hashDefVal,
+		"Hash of record checksums of the transferred data "+
+			"(none, adler32, xxhash64, xxh3, md5, sha256, blake2b or blake3)")
+
+	cmd.Flags().BoolP(
+		"dry-run",
+		"",
+		false,
+		"Show the snapshots which would be pulled and their sizes without pulling")
+
 	cmd.Flags().BoolP(
 		"full",
 		"",
@@ -809,13 +963,20 @@ The FlockerHub URL and token filepath can be set one time using 'fli config' for
 The following example explains how to push a single snapshot of a volume
 
     $ fli push exampleVolSetName:exampleSnapName --url https://example.flockerhub.com --token /home/demoUser/auth.token
+
+The following example shows how much data a push of all snapshots of a volume would send
+
+    $ fli push exampleVolSetName --dry-run
 `,
 		Run: func(cmd *cobra.Command, args []string) {
 			var (
-				err       error
-				urlFlag   string
-				tokenFlag string
-				fullFlag  bool
+				err             error
+				urlFlag         string
+				tokenFlag       string
+				compressionFlag string
+				hashFlag        string
+				dryRunFlag      bool
+				fullFlag        bool
 			)
 
 			urlFlag, err = cmd.Flags().GetString("url")
@@ -830,6 +991,24 @@ The following example explains how to push a single snapshot of a volume
 				os.Exit(1)
 			}
 
+			compressionFlag, err = cmd.Flags().GetString("compression")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
+			hashFlag, err = cmd.Flags().GetString("hash")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
+			dryRunFlag, err = cmd.Flags().GetBool("dry-run")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
 			fullFlag, err = cmd.Flags().GetBool("full")
 			if err != nil {
 				cmd.Println(err)
@@ -839,15 +1018,21 @@ The following example explains how to push a single snapshot of a volume
 			logger, err := newLogger()
 			handleError(cmd, err)
 
-			logger.Printf("fli push --url '%v' --token '%v' --full '%v' '%v'",
+			logger.Printf("fli push --url '%v' --token '%v' --compression '%v' --hash '%v' --dry-run '%v' --full '%v' '%v'",
 				urlFlag,
 				tokenFlag,
+				compressionFlag,
+				hashFlag,
+				dryRunFlag,
 				fullFlag,
 				strings.Join(args, " "),
 			)
-			log.Printf("fli push --url '%v' --token '%v' --full '%v' '%v'",
+			log.Printf("fli push --url '%v' --token '%v' --compression '%v' --hash '%v' --dry-run '%v' --full '%v' '%v'",
 				urlFlag,
 				tokenFlag,
+				compressionFlag,
+				hashFlag,
+				dryRunFlag,
 				fullFlag,
 				strings.Join(args, " "),
 			)
@@ -856,6 +1041,9 @@ The following example explains how to push a single snapshot of a volume
 			res, err = h.Push(
 				urlFlag,
 				tokenFlag,
+				compressionFlag,
+				hashFlag,
+				dryRunFlag,
 				fullFlag,
 				args,
 			)
@@ -891,6 +1079,35 @@ The following example explains how to push a single snapshot of a volume
 		tokenDefVal,
 		"Absolute path of the authentication token file")
 
+	compressionDefVal := "none"
+	if v := ctx.Value(compressionKey); v != nil {
+		compressionDefVal = ctx.Value(compressionKey).(string)
+	}
+
+	cmd.Flags().StringP(
+		"compression",
+		"",
+		compressionDefVal,
+		"Compression of the transferred data (none, gzip, zstd or s2)")
+
+	hashDefVal := "adler32"
+	if v := ctx.Value(hashKey); v != nil {
+		hashDefVal = ctx.Value(hashKey).(string)
+	}
+
+	cmd.Flags().StringP(
+		"hash",
+		"",
+		hashDefVal,
+		"Hash of record checksums of the transferred data "+
+			"(none, adler32, xxhash64, xxh3, md5, sha256, blake2b or blake3)")
+
+	cmd.Flags().BoolP(
+		"dry-run",
+		"",
+		false,
+		"Show the snapshots which would be pushed and the estimated size of each transfer without pushing")
+
 	cmd.Flags().BoolP(
 		"full",
 		"",
@@ -972,9 +1189,10 @@ func newSetupCmd(ctx context.Context, h CommandHandler) *cobra.Command {
 `,
 		Run: func(cmd *cobra.Command, args []string) {
 			var (
-				err       error
-				zpoolFlag string
-				forceFlag bool
+				err         error
+				zpoolFlag   string
+				storageFlag string
+				forceFlag   bool
 			)
 
 			zpoolFlag, err = cmd.Flags().GetString("zpool")
@@ -983,6 +1201,12 @@ func newSetupCmd(ctx context.Context, h CommandHandler) *cobra.Command {
 				os.Exit(1)
 			}
 
+			storageFlag, err = cmd.Flags().GetString("storage")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
 			forceFlag, err = cmd.Flags().GetBool("force")
 			if err != nil {
 				cmd.Println(err)
@@ -992,13 +1216,15 @@ func newSetupCmd(ctx context.Context, h CommandHandler) *cobra.Command {
 			logger, err := newLogger()
 			handleError(cmd, err)
 
-			logger.Printf("fli setup --zpool '%v' --force '%v' '%v'",
+			logger.Printf("fli setup --zpool '%v' --storage '%v' --force '%v' '%v'",
 				zpoolFlag,
+				storageFlag,
 				forceFlag,
 				strings.Join(args, " "),
 			)
-			log.Printf("fli setup --zpool '%v' --force '%v' '%v'",
+			log.Printf("fli setup --zpool '%v' --storage '%v' --force '%v' '%v'",
 				zpoolFlag,
+				storageFlag,
 				forceFlag,
 				strings.Join(args, " "),
 			)
@@ -1006,6 +1232,7 @@ func newSetupCmd(ctx context.Context, h CommandHandler) *cobra.Command {
 			var res Result
 			res, err = h.Setup(
 				zpoolFlag,
+				storageFlag,
 				forceFlag,
 				args,
 			)
@@ -1028,7 +1255,18 @@ func newSetupCmd(ctx context.Context, h CommandHandler) *cobra.Command {
 		"zpool",
 		"z",
 		zpoolDefVal,
-		"ZFS zpool name that is to be used by fli")
+		"ZFS zpool name or directory of the storage that is to be used by fli")
+
+	storageDefVal := ""
+	if v := ctx.Value(storageKey); v != nil {
+		storageDefVal = ctx.Value(storageKey).(string)
+	}
+
+	cmd.Flags().StringP(
+		"storage",
+		"",
+		storageDefVal,
+		"Storage type: zfs, btrfs, overlay or linkfs (default zfs, btrfs if --zpool is an absolute path)")
 
 	cmd.Flags().BoolP(
 		"force",
@@ -1192,14 +1430,19 @@ The FlockerHub URL and token filepath can be set one time using 'fli config' for
 		Example: `The following example explains how to synchronize a volumeset with the FlockerHub
 
     $ fli sync exampleVolSetName --url https://example.flockerhub.com --token /home/demoUser/auth.token
+
+Metadata changed both locally and on the FlockerHub since the last sync is overwritten with the FlockerHub's version by default. Keep the local version, merge attributes and descriptions field by field or choose for each conflict with --resolve
+
+    $ fli sync exampleVolSetName --resolve merge
 `,
 		Run: func(cmd *cobra.Command, args []string) {
 			var (
-				err       error
-				urlFlag   string
-				tokenFlag string
-				allFlag   bool
-				fullFlag  bool
+				err         error
+				urlFlag     string
+				tokenFlag   string
+				resolveFlag string
+				allFlag     bool
+				fullFlag    bool
 			)
 
 			urlFlag, err = cmd.Flags().GetString("url")
@@ -1214,6 +1457,12 @@ The FlockerHub URL and token filepath can be set one time using 'fli config' for
 				os.Exit(1)
 			}
 
+			resolveFlag, err = cmd.Flags().GetString("resolve")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
 			allFlag, err = cmd.Flags().GetBool("all")
 			if err != nil {
 				cmd.Println(err)
@@ -1229,16 +1478,18 @@ The FlockerHub URL and token filepath can be set one time using 'fli config' for
 			logger, err := newLogger()
 			handleError(cmd, err)
 
-			logger.Printf("fli sync --url '%v' --token '%v' --all '%v' --full '%v' '%v'",
+			logger.Printf("fli sync --url '%v' --token '%v' --resolve '%v' --all '%v' --full '%v' '%v'",
 				urlFlag,
 				tokenFlag,
+				resolveFlag,
 				allFlag,
 				fullFlag,
 				strings.Join(args, " "),
 			)
-			log.Printf("fli sync --url '%v' --token '%v' --all '%v' --full '%v' '%v'",
+			log.Printf("fli sync --url '%v' --token '%v' --resolve '%v' --all '%v' --full '%v' '%v'",
 				urlFlag,
 				tokenFlag,
+				resolveFlag,
 				allFlag,
 				fullFlag,
 				strings.Join(args, " "),
@@ -1248,6 +1499,7 @@ The FlockerHub URL and token filepath can be set one time using 'fli config' for
 			res, err = h.Sync(
 				urlFlag,
 				tokenFlag,
+				resolveFlag,
 				allFlag,
 				fullFlag,
 				args,
@@ -1284,6 +1536,12 @@ The FlockerHub URL and token filepath can be set one time using 'fli config' for
 		tokenDefVal,
 		"Absolute path of the authentication token file")
 
+	cmd.Flags().StringP(
+		"resolve",
+		"",
+		"keep-remote",
+		"Resolve metadata changed both locally and on FlockerHub with a strategy (keep-remote, keep-local, merge, interactive)")
+
 	cmd.Flags().BoolP(
 		"all",
 		"a",
@@ -1437,14 +1695,23 @@ The VOLUMESET, SNAPSHOT and VOLUME can be name or uuid. The BRANCH is always a n
     $ fli update exampleVolSetName:exampleSnapshot --description 'This is an updated descriptions' --attributes For=AfterUpdate --name newNameForExSnapName
 
     $ fli update exampleVolSetName:exampleVol --attributes For=AfterUpdate --name newNameForExVolName
+
+    $ fli update exampleVolSetName --retention last=10,daily=7,attr=release
+
+    $ fli update exampleVolSetName --hooks @hooks.json
+
+    $ fli update exampleVolSetName --approve-hooks
 `,
 		Run: func(cmd *cobra.Command, args []string) {
 			var (
-				err             error
-				nameFlag        string
-				attributesFlag  string
-				descriptionFlag string
-				fullFlag        bool
+				err              error
+				nameFlag         string
+				attributesFlag   string
+				descriptionFlag  string
+				retentionFlag    string
+				hooksFlag        string
+				approveHooksFlag bool
+				fullFlag         bool
 			)
 
 			nameFlag, err = cmd.Flags().GetString("name")
@@ -1465,6 +1732,24 @@ The VOLUMESET, SNAPSHOT and VOLUME can be name or uuid. The BRANCH is always a n
 				os.Exit(1)
 			}
 
+			retentionFlag, err = cmd.Flags().GetString("retention")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
+			hooksFlag, err = cmd.Flags().GetString("hooks")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
+			approveHooksFlag, err = cmd.Flags().GetBool("approve-hooks")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
 			fullFlag, err = cmd.Flags().GetBool("full")
 			if err != nil {
 				cmd.Println(err)
@@ -1474,17 +1759,23 @@ The VOLUMESET, SNAPSHOT and VOLUME can be name or uuid. The BRANCH is always a n
 			logger, err := newLogger()
 			handleError(cmd, err)
 
-			logger.Printf("fli update --name '%v' --attributes '%v' --description '%v' --full '%v' '%v'",
+			logger.Printf("fli update --name '%v' --attributes '%v' --description '%v' --retention '%v' --hooks '%v' --approve-hooks '%v' --full '%v' '%v'",
 				nameFlag,
 				attributesFlag,
 				descriptionFlag,
+				retentionFlag,
+				hooksFlag,
+				approveHooksFlag,
 				fullFlag,
 				strings.Join(args, " "),
 			)
-			log.Printf("fli update --name '%v' --attributes '%v' --description '%v' --full '%v' '%v'",
+			log.Printf("fli update --name '%v' --attributes '%v' --description '%v' --retention '%v' --hooks '%v' --approve-hooks '%v' --full '%v' '%v'",
 				nameFlag,
 				attributesFlag,
 				descriptionFlag,
+				retentionFlag,
+				hooksFlag,
+				approveHooksFlag,
 				fullFlag,
 				strings.Join(args, " "),
 			)
@@ -1494,6 +1785,9 @@ The VOLUMESET, SNAPSHOT and VOLUME can be name or uuid. The BRANCH is always a n
 				nameFlag,
 				attributesFlag,
 				descriptionFlag,
+				retentionFlag,
+				hooksFlag,
+				approveHooksFlag,
 				fullFlag,
 				args,
 			)
@@ -1540,6 +1834,24 @@ The VOLUMESET, SNAPSHOT and VOLUME can be name or uuid. The BRANCH is always a n
 		descriptionDefVal,
 		"Update the description for VOLUMESET and SNAPSHOT only. This option is ignored for VOLUME and BRANCH")
 
+	cmd.Flags().StringP(
+		"retention",
+		"",
+		"",
+		"Retention policy of a volumeset's snapshots used by prune, a comma separated list of last=N, hourly=N, daily=N, weekly=N, attr=KEY or attr=KEY:VALUE rules, none removes the policy")
+
+	cmd.Flags().StringP(
+		"hooks",
+		"",
+		"",
+		"Hooks run before and after snapshots of a volumeset's volumes, as JSON or @FILE to read the JSON from a file, none removes the hooks. Hooks set here are approved to run on this host")
+
+	cmd.Flags().BoolP(
+		"approve-hooks",
+		"",
+		false,
+		"Approve the volumeset's current hooks to run on this host, hooks changed by sync or pull don't run until they are approved")
+
 	cmd.Flags().BoolP(
 		"full",
 		"",
@@ -1656,22 +1968,300 @@ func newDiagnosticsCmd(ctx context.Context, h CommandHandler) *cobra.Command {
 	return cmd
 }
 
+func newFsckCmd(ctx context.Context, h CommandHandler) *cobra.Command {
+	var cmd = &cobra.Command{
+		Use: getMultiUseLine("fsck", []string{
+			"[OPTIONS]",
+		}),
+		Short: "Checks the metadata store against the storage",
+		Long: `Fsck reports snapshots whose blobs are missing from the storage, volumes which are missing or not mounted, and blobs and volumes in the storage the metadata store doesn't know about. With --repair missing snapshots are marked missing, missing volumes are removed, unmounted volumes are mounted again and orphan blobs and volumes are destroyed.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			var (
+				err        error
+				repairFlag bool
+				fullFlag   bool
+			)
+
+			repairFlag, err = cmd.Flags().GetBool("repair")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
+			fullFlag, err = cmd.Flags().GetBool("full")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
+			logger, err := newLogger()
+			handleError(cmd, err)
+
+			logger.Printf("fli fsck --repair '%v' --full '%v' '%v'",
+				repairFlag,
+				fullFlag,
+				strings.Join(args, " "),
+			)
+			log.Printf("fli fsck --repair '%v' --full '%v' '%v'",
+				repairFlag,
+				fullFlag,
+				strings.Join(args, " "),
+			)
+
+			var res Result
+			res, err = h.Fsck(
+				repairFlag,
+				fullFlag,
+				args,
+			)
+			if err != nil {
+				logger.Printf("ERROR: %v", err.Error())
+				log.Printf("[ERROR] %v", err.Error())
+			}
+
+			handleError(cmd, err)
+			displayOutput(cmd, res)
+		},
+	}
+
+	cmd.Flags().BoolP(
+		"repair",
+		"",
+		false,
+		"Repair the problems found")
+
+	cmd.Flags().BoolP(
+		"full",
+		"",
+		false,
+		"Report full UUIDs for objects instead of short UUIDs")
+
+	return cmd
+}
+
+func newDiffCmd(ctx context.Context, h CommandHandler) *cobra.Command {
+	var cmd = &cobra.Command{
+		Use: getMultiUseLine("diff", []string{
+			"[OPTIONS] VOLUMESET:SNAPSHOT VOLUMESET:SNAPSHOT",
+		}),
+		Short: "Shows what changed between two snapshots",
+		Long: `Diff compares the data of two snapshots and lists the files and directories added, removed, modified or renamed, and those whose attributes changed, in the second snapshot. With --records the records which turn the first snapshot into the second one are shown instead, as they are sent by push. Both snapshots must have their data locally.
+`,
+		Example: `The following example shows what changed between two snapshots of a volumeset
+
+    $ fli diff exampleVolSetName:snap1 exampleVolSetName:snap2
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			var (
+				err         error
+				recordsFlag bool
+				fullFlag    bool
+			)
+
+			recordsFlag, err = cmd.Flags().GetBool("records")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
+			fullFlag, err = cmd.Flags().GetBool("full")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
+			logger, err := newLogger()
+			handleError(cmd, err)
+
+			logger.Printf("fli diff --records '%v' --full '%v' '%v'",
+				recordsFlag,
+				fullFlag,
+				strings.Join(args, " "),
+			)
+			log.Printf("fli diff --records '%v' --full '%v' '%v'",
+				recordsFlag,
+				fullFlag,
+				strings.Join(args, " "),
+			)
+
+			var res Result
+			res, err = h.Diff(
+				recordsFlag,
+				fullFlag,
+				args,
+			)
+			if err != nil {
+				logger.Printf("ERROR: %v", err.Error())
+				log.Printf("[ERROR] %v", err.Error())
+			}
+
+			handleError(cmd, err)
+			displayOutput(cmd, res)
+		},
+	}
+
+	cmd.Flags().BoolP(
+		"records",
+		"",
+		false,
+		"Show the records which turn the first snapshot into the second one")
+
+	cmd.Flags().BoolP(
+		"full",
+		"",
+		false,
+		"Report full UUIDs for objects instead of short UUIDs")
+
+	return cmd
+}
+
+func newPruneCmd(ctx context.Context, h CommandHandler) *cobra.Command {
+	var cmd = &cobra.Command{
+		Use: getMultiUseLine("prune", []string{
+			"[OPTIONS]",
+			"[OPTIONS] VOLUMESET",
+		}),
+		Short: "Deletes snapshots expired by the volumeset's retention policy",
+		Long: `Prune deletes the data of the snapshots which are not kept by the retention policy of their volumeset, all volumesets with a retention policy are pruned if no volumeset is given. The policy is set with fli update --retention. Pruned snapshots which other snapshots are based on keep their metadata and can be pulled again, the others are deleted. Branch tips and snapshots volumes are created from are never pruned.
+`,
+		Example: `The following example lists the snapshots that would be pruned and then prunes them
+
+    $ fli prune exampleVolSetName --dry-run
+
+    $ fli prune exampleVolSetName
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			var (
+				err        error
+				dryrunFlag bool
+				fullFlag   bool
+			)
+
+			dryrunFlag, err = cmd.Flags().GetBool("dry-run")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
+			fullFlag, err = cmd.Flags().GetBool("full")
+			if err != nil {
+				cmd.Println(err)
+				os.Exit(1)
+			}
+
+			logger, err := newLogger()
+			handleError(cmd, err)
+
+			logger.Printf("fli prune --dry-run '%v' --full '%v' '%v'",
+				dryrunFlag,
+				fullFlag,
+				strings.Join(args, " "),
+			)
+			log.Printf("fli prune --dry-run '%v' --full '%v' '%v'",
+				dryrunFlag,
+				fullFlag,
+				strings.Join(args, " "),
+			)
+
+			var res Result
+			res, err = h.Prune(
+				dryrunFlag,
+				fullFlag,
+				args,
+			)
+			if err != nil {
+				logger.Printf("ERROR: %v", err.Error())
+				log.Printf("[ERROR] %v", err.Error())
+			}
+
+			handleError(cmd, err)
+			displayOutput(cmd, res)
+		},
+	}
+
+	cmd.Flags().BoolP(
+		"dry-run",
+		"",
+		false,
+		"List the snapshots that would be pruned without deleting them")
+
+	cmd.Flags().BoolP(
+		"full",
+		"",
+		false,
+		"Report full UUIDs for objects instead of short UUIDs")
+
+	return cmd
+}
+
+func newDaemonCmd(ctx context.Context, h CommandHandler) *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "daemon",
+		Short: "Takes snapshots on the schedules in the configuration",
+		Long: `Daemon runs until it is interrupted and snapshots volumes on the cron schedules in the schedules section of the fli configuration file. Each schedule has a volume, a cron schedule (minute hour day-of-month month day-of-week, or @hourly, @daily, @weekly, @monthly), and optionally a branch, a snapshot name prefix, attributes and push. Schedules with push set sync and push the volumeset to FlockerHub after each snapshot. Progress is logged to the fli log file.
+`,
+		Example: `The configuration below snapshots a volume every hour and pushes a nightly snapshot
+
+    schedules:
+    - volume: my-volumeset:my-volume
+      cron: "@hourly"
+    - volume: my-volumeset:my-volume
+      cron: "30 2 * * *"
+      prefix: nightly
+      push: true
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			var (
+				err error
+			)
+			logger, err := newLogger()
+			handleError(cmd, err)
+
+			logger.Printf("fli daemon '%v'",
+				strings.Join(args, " "),
+			)
+			log.Printf("fli daemon '%v'",
+				strings.Join(args, " "),
+			)
+
+			var res Result
+			res, err = h.Daemon(
+				args,
+			)
+			if err != nil {
+				logger.Printf("ERROR: %v", err.Error())
+				log.Printf("[ERROR] %v", err.Error())
+			}
+
+			handleError(cmd, err)
+			displayOutput(cmd, res)
+		},
+	}
+
+	return cmd
+}
+
 // CommandHandler inteface that implements handlers for cli commands
 type CommandHandler interface {
 	Clone(attributes string, full bool, args []string) (Result, error)
-	Config(url string, token string, offline bool, args []string) (Result, error)
+	Config(url string, token string, compression string, hash string, differ string, keyID string, offline bool, args []string) (Result, error)
 	Create(attributes string, full bool, args []string) (Result, error)
 	Init(attributes string, description string, args []string) (Result, error)
 	List(all bool, volume bool, snapshot bool, branch bool, full bool, args []string) (Result, error)
-	Pull(url string, token string, full bool, args []string) (Result, error)
-	Push(url string, token string, full bool, args []string) (Result, error)
+	Pull(url string, token string, compression string, hash string, dryrun bool, full bool, args []string) (Result, error)
+	Push(url string, token string, compression string, hash string, dryrun bool, full bool, args []string) (Result, error)
 	Remove(full bool, args []string) (Result, error)
-	Setup(zpool string, force bool, args []string) (Result, error)
+	Setup(zpool string, storage string, force bool, args []string) (Result, error)
 	Snapshot(branch string, newbranch bool, attributes string, description string, full bool, args []string) (Result, error)
-	Sync(url string, token string, all bool, full bool, args []string) (Result, error)
+	Sync(url string, token string, resolve string, all bool, full bool, args []string) (Result, error)
 	Fetch(url string, token string, all bool, full bool, args []string) (Result, error)
-	Update(name string, attributes string, description string, full bool, args []string) (Result, error)
+	Update(name string, attributes string, description string, retention string, hooks string, approveHooks bool, full bool, args []string) (Result, error)
 	Version(args []string) (Result, error)
 	Info(args []string) (Result, error)
 	Diagnostics(args []string) (Result, error)
+	Fsck(repair bool, full bool, args []string) (Result, error)
+	Prune(dryrun bool, full bool, args []string) (Result, error)
+	Daemon(args []string) (Result, error)
+	Diff(records bool, full bool, args []string) (Result, error)
 }
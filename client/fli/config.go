@@ -20,18 +20,50 @@ import (
 	"io/ioutil"
 	"os"
 
+	"github.com/ClusterHQ/fli/dp/hooks"
 	"github.com/go-yaml/yaml"
 )
 
 type (
 	// ConfigParams ...
 	ConfigParams struct {
-		SQLMdsCurrent string `yaml:"current,omitempty"`
-		SQLMdsInitial string `yaml:"initial,omitempty"`
-		FlockerHubURL string `yaml:"url,omitempty"`
-		AuthTokenFile string `yaml:"token,omitempty"`
-		Zpool         string `yaml:"zpool,omitempty"`
-		Version       string `yaml:"version,omitempty"`
+		SQLMdsCurrent string             `yaml:"current,omitempty"`
+		SQLMdsInitial string             `yaml:"initial,omitempty"`
+		FlockerHubURL string             `yaml:"url,omitempty"`
+		AuthTokenFile string             `yaml:"token,omitempty"`
+		Compression   string             `yaml:"compression,omitempty"`
+		Hash          string             `yaml:"hash,omitempty"`
+		Differ        string             `yaml:"differ,omitempty"`
+		EncryptionKey string             `yaml:"encryption-key,omitempty"`
+		Zpool         string             `yaml:"zpool,omitempty"`
+		Storage       string             `yaml:"storage,omitempty"`
+		Digests       bool               `yaml:"digests,omitempty"`
+		Version       string             `yaml:"version,omitempty"`
+		Schedules     []SnapshotSchedule `yaml:"schedules,omitempty"`
+
+		// ApprovedHooks are the volume set hooks approved to run on this host, see hooks.Approvals
+		ApprovedHooks hooks.Approvals `yaml:"approved-hooks,omitempty"`
+	}
+
+	// SnapshotSchedule is a volume snapshotted by fli daemon
+	SnapshotSchedule struct {
+		// Volume is the volume as given to fli snapshot, it must match a single volume
+		Volume string `yaml:"volume"`
+
+		// Cron is when the snapshots are taken, see miscutils/cron
+		Cron string `yaml:"cron"`
+
+		// Branch is the branch snapshots are added to, the volume's branch is used if it is empty
+		Branch string `yaml:"branch,omitempty"`
+
+		// Prefix of the snapshot names, the time of the snapshot is appended
+		Prefix string `yaml:"prefix,omitempty"`
+
+		// Attributes are added to the snapshots, key=value,key=value
+		Attributes string `yaml:"attributes,omitempty"`
+
+		// Push syncs and pushes the volume set to the hub after each snapshot
+		Push bool `yaml:"push,omitempty"`
 	}
 
 	// Config ...
@@ -0,0 +1,203 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fli
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ClusterHQ/fli/dp/dataplane"
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/dp/sync"
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/miscutils/cron"
+)
+
+type (
+	// scheduled is a snapshot schedule with the time it fires next
+	scheduled struct {
+		SnapshotSchedule
+		cron *cron.Schedule
+		next time.Time
+	}
+)
+
+const (
+	// defaultSchedulePrefix is the prefix of the scheduled snapshot names if the schedule has none
+	defaultSchedulePrefix = "scheduled"
+
+	// Attributes added to the scheduled snapshots
+	attrSchedule    = "schedule"
+	attrScheduledAt = "scheduled-at"
+)
+
+// Daemon takes the snapshots of the schedules in the configuration until it is interrupted. The metadata store is
+// only opened while a snapshot is taken so other fli commands can run in between.
+func (c *Handler) Daemon(args []string) (Result, error) {
+	cmdOut := CmdOutput{}
+
+	if len(args) != 0 {
+		return cmdOut, ErrInvalidArgs{}
+	}
+
+	if len(c.CfgParams.Schedules) == 0 {
+		return cmdOut, errors.Errorf("No snapshot schedules in %s", c.ConfigFile)
+	}
+
+	now := time.Now()
+	var scheds []*scheduled
+	for _, s := range c.CfgParams.Schedules {
+		if s.Volume == "" {
+			return cmdOut, errors.New("Snapshot schedule without a volume")
+		}
+
+		cs, err := cron.Parse(s.Cron)
+		if err != nil {
+			return cmdOut, errors.Errorf("Invalid schedule of volume %s: %v", s.Volume, err)
+		}
+
+		if s.Prefix != "" {
+			if err := validateName(s.Prefix); err != nil {
+				return cmdOut, err
+			}
+		}
+
+		if _, err := convStrToAttr(s.Attributes); err != nil {
+			return cmdOut, err
+		}
+
+		next := cs.Next(now)
+		if next.IsZero() {
+			return cmdOut, errors.Errorf("Schedule '%s' of volume %s never fires", s.Cron, s.Volume)
+		}
+
+		scheds = append(scheds, &scheduled{SnapshotSchedule: s, cron: cs, next: next})
+	}
+
+	// Recovery at start up opened the metadata store
+	c.closeMds()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	log.Printf("Daemon started with %d snapshot schedules", len(scheds))
+
+	for {
+		next := scheds[0].next
+		for _, s := range scheds[1:] {
+			if s.next.Before(next) {
+				next = s.next
+			}
+		}
+
+		timer := time.NewTimer(next.Sub(time.Now()))
+		select {
+		case sig := <-sigs:
+			timer.Stop()
+			log.Printf("Daemon stopped by %v", sig)
+			return cmdOut, nil
+		case <-timer.C:
+		}
+
+		// Schedules are run one at a time, runs missed while a snapshot was taken are skipped
+		for _, s := range scheds {
+			if s.next.After(time.Now()) {
+				continue
+			}
+
+			if err := c.runSchedule(s); err != nil {
+				log.Printf("[ERROR] Scheduled snapshot of volume %s failed: %v", s.Volume, err)
+			}
+			s.next = s.cron.Next(time.Now())
+		}
+	}
+}
+
+// runSchedule takes the snapshot of a schedule which fired and pushes it if the schedule asks for it. The metadata
+// store is closed before returning.
+func (c *Handler) runSchedule(s *scheduled) error {
+	defer c.closeMds()
+
+	mds, err := c.getMdsCurrent()
+	if err != nil {
+		return err
+	}
+
+	store, err := getStorage(c.CfgParams)
+	if err != nil {
+		return err
+	}
+
+	vols, err := FindVolumes(mds, s.Volume)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(vols) == 0:
+		return errors.Errorf("Volume %s not found", s.Volume)
+	case len(vols) > 1:
+		return errors.Errorf("Ambigous matches found for - %s", s.Volume)
+	}
+
+	attr, err := convStrToAttr(s.Attributes)
+	if err != nil {
+		return err
+	}
+	attr[attrSchedule] = s.Cron
+	attr[attrScheduledAt] = s.next.UTC().Format(time.RFC3339)
+
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = defaultSchedulePrefix
+	}
+	name := prefix + "-" + s.next.UTC().Format("20060102-150405")
+
+	mode := metastore.AutoSync
+	if s.Branch != "" {
+		mode = metastore.ManualSync
+	}
+
+	snap, err := dataplane.SnapshotWithHooks(mds, store, c.CfgParams.ApprovedHooks, vols[0].ID, s.Branch, mode, name,
+		attr, "")
+	if err != nil {
+		return err
+	}
+	log.Printf("Took snapshot %s (%v) of volume %s", name, snap.ID, s.Volume)
+
+	if !s.Push {
+		return nil
+	}
+
+	// Meta data conflicts can't be asked about, the hub's version is kept
+	vsid := vols[0].VolSetID.String()
+	_, err = c.sync("", "", false, false, []string{vsid}, twoWay, sync.Resolver{Strategy: sync.KeepRemote})
+	if err != nil {
+		return errors.Errorf("Failed to sync volumeset %s: %v", vsid, err)
+	}
+
+	_, err = c.Push("", "", c.CfgParams.Compression, c.CfgParams.Hash, false, false, []string{vsid})
+	if err != nil {
+		return errors.Errorf("Failed to push volumeset %s: %v", vsid, err)
+	}
+	log.Printf("Pushed volumeset %s", vsid)
+
+	return nil
+}
@@ -18,6 +18,7 @@ package fli
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/user"
@@ -25,12 +26,19 @@ import (
 	"strings"
 
 	"github.com/ClusterHQ/fli/dl/blobdiffer"
+	"github.com/ClusterHQ/fli/dl/btrfs"
+	"github.com/ClusterHQ/fli/dl/compress"
 	"github.com/ClusterHQ/fli/dl/datalayer"
 	"github.com/ClusterHQ/fli/dl/encdec"
 	"github.com/ClusterHQ/fli/dl/executor"
+	"github.com/ClusterHQ/fli/dl/filediffer/cdc"
 	"github.com/ClusterHQ/fli/dl/filediffer/variableblk"
 	dlhash "github.com/ClusterHQ/fli/dl/hash"
+	"github.com/ClusterHQ/fli/dl/linkfs"
+	"github.com/ClusterHQ/fli/dl/overlay"
+	"github.com/ClusterHQ/fli/dl/progress"
 	"github.com/ClusterHQ/fli/dl/zfs"
+	"github.com/ClusterHQ/fli/dp/hooks"
 	"github.com/ClusterHQ/fli/dp/metastore"
 	"github.com/ClusterHQ/fli/errors"
 	"github.com/ClusterHQ/fli/mdsimpls/sqlite3storage"
@@ -62,6 +70,8 @@ const (
 	configFile     = "config"
 	mdsFileCurrent = "mds_current"
 	mdsFileInitial = "mds_initial"
+	transfersDir   = "transfers"
+	keysFile       = "keys"
 
 	byteSz     = 1.0
 	kilobyteSz = 1024 * byteSz
@@ -69,12 +79,33 @@ const (
 	gigabyteSz = 1024 * megabyteSz
 	terabyteSz = 1024 * gigabyteSz
 
+	// Storage types, all but ZFS keep their data in the directory given in place of a zpool
+	storageZFS     = "zfs"
+	storageBtrfs   = "btrfs"
+	storageOverlay = "overlay"
+	storageLinkFS  = "linkfs"
+
+	// File differs, they pick the ranges of changed files which are pushed
+	differVariableBlk = "variableblk"
+	differCDC         = "cdc"
+
+	// noRetention removes the retention policy of a volume set
+	noRetention = "none"
+
+	// noHooks removes the snapshot hooks of a volume set
+	noHooks = "none"
+
 	// CommandCtxKeys
 	urlKey         cmdCtxKey = "url"
 	tokenKey       cmdCtxKey = "token"
+	compressionKey cmdCtxKey = "compression"
+	hashKey        cmdCtxKey = "hash"
+	differKey      cmdCtxKey = "differ"
+	encryptionKey  cmdCtxKey = "encryption-key"
 	attributesKey  cmdCtxKey = "attributes"
 	descriptionKey cmdCtxKey = "description"
 	zpoolKey       cmdCtxKey = "zpool"
+	storageKey     cmdCtxKey = "storage"
 	branchKey      cmdCtxKey = "branch"
 	nameKey        cmdCtxKey = "name"
 )
@@ -91,6 +122,11 @@ type (
 		store datalayer.Storage
 		ed    encdec.Factory
 		hf    dlhash.Factory
+		cps   datalayer.CheckpointStore
+
+		// mds and progress are used to report the progress of transfers, progress can be nil
+		mds      metastore.Client
+		progress progress.Reporter
 	}
 
 	cmdCtxKey string
@@ -125,9 +161,17 @@ Run '{{.CommandPath}} COMMAND --help' for more information on a command.
 )
 
 // UploadBlobDiff ...
-func (b blobDiff) UploadBlobDiff(vsid volumeset.ID, base blob.ID, targetBlobID blob.ID, t string,
+func (b blobDiff) UploadBlobDiff(vsid volumeset.ID, ssid snapshot.ID, base blob.ID, targetBlobID blob.ID, t string,
 	dspuburl string) error {
-	return datalayer.UploadBlobDiff(b.store, b.ed, b.hf, vsid, base, targetBlobID, t, dspuburl)
+	tr := b.startProgress(ssid, base)
+	err := datalayer.UploadBlobDiff(b.store, b.ed, b.hf, vsid, base, targetBlobID, t, dspuburl, tr)
+	tr.Finish()
+	return err
+}
+
+// EstimateBlobDiff ...
+func (b blobDiff) EstimateBlobDiff(vsid volumeset.ID, base blob.ID, targetBlobID blob.ID) (uint64, uint64, error) {
+	return datalayer.EstimateBlobDiff(b.store, b.ed, b.hf, vsid, base, targetBlobID)
 }
 
 // DownloadBlobDiff ...
@@ -138,6 +182,9 @@ func (b blobDiff) DownloadBlobDiff(
 	token string,
 	dspuburl string,
 ) (blob.ID, uint64, uint64, error) {
+	tr := b.startProgress(ssid, base)
+	defer tr.Finish()
+
 	return datalayer.DownloadBlobDiff(
 		b.store,
 		b.ed,
@@ -148,9 +195,34 @@ func (b blobDiff) DownloadBlobDiff(
 		executor.NewCommonExecutor(),
 		b.hf,
 		dspuburl,
+		b.cps,
+		tr,
 	)
 }
 
+// startProgress starts tracking the transfer of a snapshot, nil is returned if progress isn't reported. The size
+// expected is only known if the whole snapshot is transferred.
+func (b blobDiff) startProgress(ssid snapshot.ID, base blob.ID) *progress.Tracker {
+	if b.progress == nil {
+		return nil
+	}
+
+	name := uuid.ShrinkUUID(ssid.String())
+	var total uint64
+	if b.mds != nil {
+		if sn, err := metastore.GetSnapshot(b.mds, ssid); err == nil {
+			if sn.Name != "" {
+				name = sn.Name
+			}
+			if base.IsNilID() {
+				total = sn.Size
+			}
+		}
+	}
+
+	return progress.Start(name, total, b.progress)
+}
+
 // getHomeDir gets the full path of the current user's home dir, if unable to fetch the user home dir path then
 // returns alias to home dir "~"
 // We first consult $HOME which could be overriden for various purposes like testing.
@@ -234,6 +306,19 @@ func convAttrToStr(attr attrs.Attrs) string {
 	return strings.Join(kvList, ",")
 }
 
+// parseHooks parses snapshot hooks given as JSON or as @FILE to read the JSON from a file
+func parseHooks(spec string) (*hooks.Hooks, error) {
+	if strings.HasPrefix(spec, "@") {
+		buf, err := ioutil.ReadFile(spec[1:])
+		if err != nil {
+			return nil, err
+		}
+		spec = string(buf)
+	}
+
+	return hooks.Parse(spec)
+}
+
 // updateAttributes does a union of two attr.Attrs into a single attr.Attrs where key is case-insensitive
 // and matching keys update the value from nAttr struct
 func updateAttributes(nAttr attrs.Attrs, oAttr attrs.Attrs) attrs.Attrs {
@@ -277,19 +362,74 @@ func getMds(mdsPath string) (metastore.Client, error) {
 	}
 
 	if !exists {
-		return nil, errors.Errorf("Metadata store not found\nRun 'fli setup --zpool=<ZFS ZPOOL>' to setup the environment")
+		return nil, errors.Errorf("Metadata store not found\nRun 'fli setup --zpool=<ZFS ZPOOL or directory>' to setup the environment")
 	}
 
 	return sqlite3storage.Open(pathCur)
 }
 
-func getStorage(zpool string) (datalayer.Storage, error) {
-	store, err := zfs.New(zpool, blobdiffer.Factory{FileDiffer: variableblk.Factory{}})
+// storageType returns the configured storage type. Configurations without one use a btrfs mount point if an
+// absolute path is given in place of a zpool, zpool names are never absolute paths.
+func storageType(params ConfigParams) string {
+	if params.Storage != "" {
+		return params.Storage
+	}
+
+	if filepath.IsAbs(params.Zpool) {
+		return storageBtrfs
+	}
+
+	return storageZFS
+}
+
+// getFileDiffer returns the file differ with the given name, an empty name is the variable block differ
+func getFileDiffer(name string) (blobdiffer.FileDiffer, error) {
+	switch name {
+	case "", differVariableBlk:
+		return variableblk.Factory{}, nil
+	case differCDC:
+		return cdc.Factory{}, nil
+	}
+
+	return nil, errors.Errorf("Unknown differ %s, valid differs are %s and %s", name, differVariableBlk, differCDC)
+}
+
+func getStorage(params ConfigParams) (datalayer.Storage, error) {
+	fd, err := getFileDiffer(params.Differ)
 	if err != nil {
-		return store, handleZFSErr(err)
+		return nil, err
 	}
 
-	return store, err
+	bdf := blobdiffer.Factory{FileDiffer: fd, Digests: params.Digests}
+	switch storageType(params) {
+	case storageZFS:
+		store, err := zfs.New(params.Zpool, bdf)
+		if err != nil {
+			return store, handleZFSErr(err)
+		}
+
+		return store, err
+	case storageBtrfs:
+		store, err := btrfs.New(params.Zpool, bdf)
+		if err != nil {
+			return store, handleBtrfsErr(err)
+		}
+
+		return store, nil
+	case storageOverlay, storageLinkFS:
+		path, err := securefilepath.New(params.Zpool)
+		if err != nil {
+			return nil, err
+		}
+
+		if storageType(params) == storageOverlay {
+			return overlay.New(path, overlay.DefaultMaxDepth, bdf)
+		}
+		return linkfs.New(path, bdf)
+	}
+
+	return nil, errors.Errorf("Unknown storage type %s, valid types are %s, %s, %s and %s", params.Storage,
+		storageZFS, storageBtrfs, storageOverlay, storageLinkFS)
 }
 
 func validateName(name string) error {
@@ -344,6 +484,17 @@ Visit %s for instructions to create ZPOOL`, err.Error(), version.ZFSReferenceURL
 	return err
 }
 
+func handleBtrfsErr(err error) error {
+	switch err.(type) {
+	case *btrfs.ErrBtrfsUtilsNotFound:
+		return errors.Errorf("Missing btrfs utilities, install btrfs-progs")
+	case *btrfs.ErrNotBtrfs:
+		return errors.Errorf("%s\nMount a btrfs file system there or use a ZFS zpool", err.Error())
+	}
+
+	return err
+}
+
 // Execute ...
 func Execute() {
 	os.MkdirAll(LogDir, (os.ModeDir | 0755))
@@ -408,6 +559,25 @@ func Execute() {
 	ctx := context.WithValue(context.Background(), urlKey, url)
 	ctx = context.WithValue(ctx, tokenKey, params.AuthTokenFile)
 
+	compression := compress.None.String()
+	if params.Compression != "" {
+		compression = params.Compression
+	}
+	ctx = context.WithValue(ctx, compressionKey, compression)
+
+	hash := dlhash.Default.String()
+	if params.Hash != "" {
+		hash = params.Hash
+	}
+	ctx = context.WithValue(ctx, hashKey, hash)
+
+	differ := differVariableBlk
+	if params.Differ != "" {
+		differ = params.Differ
+	}
+	ctx = context.WithValue(ctx, differKey, differ)
+	ctx = context.WithValue(ctx, encryptionKey, params.EncryptionKey)
+
 	cmd := newFliCmd(ctx, handler)
 
 	cmd.SetUsageTemplate(usageTemplate)
@@ -18,6 +18,7 @@ package fli
 
 import (
 	"archive/tar"
+	"bufio"
 	"compress/gzip"
 	"fmt"
 	"io"
@@ -31,10 +32,18 @@ import (
 	"strings"
 	"time"
 
+	"github.com/ClusterHQ/fli/dl/compress"
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dl/encdec"
+	"github.com/ClusterHQ/fli/dl/encdec/aesgcm"
 	dlbin "github.com/ClusterHQ/fli/dl/encdec/binary"
-	dladler32 "github.com/ClusterHQ/fli/dl/hash/adler32"
+	dlhash "github.com/ClusterHQ/fli/dl/hash"
+	"github.com/ClusterHQ/fli/dl/progress"
+	"github.com/ClusterHQ/fli/dl/record"
 	"github.com/ClusterHQ/fli/dp/dataplane"
+	"github.com/ClusterHQ/fli/dp/hooks"
 	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/dp/retention"
 	"github.com/ClusterHQ/fli/dp/sync"
 	"github.com/ClusterHQ/fli/errors"
 	"github.com/ClusterHQ/fli/mdsimpls/restfulstorage"
@@ -132,7 +141,9 @@ func (c *Handler) upgradeVersion(ver string) error {
 }
 
 func (c *Handler) upgrade() error {
-	if c.CfgParams.Zpool == "" || c.CfgParams.Version == version.Version() {
+	c.recover()
+
+	if c.CfgParams.Zpool == "" || c.CfgParams.Version == version.Version() || storageType(c.CfgParams) != storageZFS {
 		return nil
 	}
 
@@ -150,6 +161,41 @@ func (c *Handler) upgrade() error {
 	return nil
 }
 
+// recover rolls forward or back the operations interrupted by a crash. Failures are logged, the operations are
+// recovered again on the next start.
+func (c *Handler) recover() {
+	if c.CfgParams.Zpool == "" || c.CfgParams.SQLMdsCurrent == "" {
+		return
+	}
+
+	mds, err := c.getMdsCurrent()
+	if err != nil {
+		log.Printf("Skipping recovery, failed to open the metadata store: %v", err)
+		return
+	}
+
+	intents, err := mds.GetIntents()
+	if err != nil {
+		log.Printf("Skipping recovery, failed to read intents: %v", err)
+		return
+	}
+
+	if len(intents) == 0 {
+		return
+	}
+
+	store, err := getStorage(c.CfgParams)
+	if err != nil {
+		log.Printf("Skipping recovery, failed to open the storage: %v", err)
+		return
+	}
+
+	err = dataplane.Recover(mds, store)
+	if err != nil {
+		log.Printf("Recovery failed: %v", err)
+	}
+}
+
 // getMdsCurrent opens the DB connection if it has not been opened before; otherwise returns the existing
 // connection.
 func (c *Handler) getMdsCurrent() (metastore.Client, error) {
@@ -182,6 +228,21 @@ func (c *Handler) getMdsInitial() (metastore.Client, error) {
 	return mds, nil
 }
 
+// closeMds closes the opened DB connections, the DBs are locked exclusively while they are open. The next
+// getMdsCurrent or getMdsInitial opens them again.
+func (c *Handler) closeMds() {
+	for _, mds := range []metastore.Client{c.mdsCurrent, c.mdsInitial} {
+		if closer, ok := mds.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Printf("Failed to close the metadata store: %v", err)
+			}
+		}
+	}
+
+	c.mdsCurrent = nil
+	c.mdsInitial = nil
+}
+
 // Clone create a volume from source which could be a snapshot or a branch if more than 1 match found for branch & snapshot together
 // should return the matching result found
 func (c *Handler) Clone(attributes string, full bool, args []string) (Result, error) {
@@ -196,7 +257,7 @@ func (c *Handler) Clone(attributes string, full bool, args []string) (Result, er
 		return cmdOut, err
 	}
 
-	store, err := getStorage(c.CfgParams.Zpool)
+	store, err := getStorage(c.CfgParams)
 	if err != nil {
 		return cmdOut, err
 	}
@@ -292,7 +353,7 @@ func (c *Handler) Snapshot(branchName string, newBranch bool, attributes string,
 		return cmdOut, err
 	}
 
-	store, err := getStorage(c.CfgParams.Zpool)
+	store, err := getStorage(c.CfgParams)
 	if err != nil {
 		return cmdOut, err
 	}
@@ -338,7 +399,8 @@ func (c *Handler) Snapshot(branchName string, newBranch bool, attributes string,
 			return cmdOut, ErrInvalidArgs{}
 		}
 
-		snap, err := dataplane.Snapshot(mds, store, vols[0].ID, branchName, mode, snapName, attr, description)
+		snap, err := dataplane.SnapshotWithHooks(mds, store, c.CfgParams.ApprovedHooks, vols[0].ID, branchName, mode,
+			snapName, attr, description)
 
 		if err != nil {
 			return cmdOut, err
@@ -363,7 +425,7 @@ func (c *Handler) Create(attributes string, full bool, args []string) (Result, e
 		return cmdOut, err
 	}
 
-	store, err := getStorage(c.CfgParams.Zpool)
+	store, err := getStorage(c.CfgParams)
 	if err != nil {
 		return cmdOut, err
 	}
@@ -444,7 +506,7 @@ func (c *Handler) Init(attributes string, description string, args []string) (Re
 		return cmdOut, err
 	}
 
-	if _, err := getStorage(c.CfgParams.Zpool); err != nil {
+	if _, err := getStorage(c.CfgParams); err != nil {
 		return cmdOut, err
 	}
 
@@ -510,7 +572,8 @@ func (c *Handler) getRestfulMds(fHub, tokenfile string) (*restfulstorage.Metadat
 	return restfulstorage.Create(protocols.GetClient(), fHubURL, fhut)
 }
 
-func (c *Handler) sync(url string, token string, all bool, full bool, args []string, syncDirection bool) (Result, error) {
+func (c *Handler) sync(url string, token string, all bool, full bool, args []string, syncDirection bool,
+	resolver sync.Resolver) (Result, error) {
 	cmdOut := CmdOutput{}
 
 	if (len(args) != 1 && !all) || (all && len(args) != 0) {
@@ -522,7 +585,7 @@ func (c *Handler) sync(url string, token string, all bool, full bool, args []str
 		return cmdOut, err
 	}
 
-	if _, err := getStorage(c.CfgParams.Zpool); err != nil {
+	if _, err := getStorage(c.CfgParams); err != nil {
 		return cmdOut, err
 	}
 
@@ -593,25 +656,31 @@ func (c *Handler) sync(url string, token string, all bool, full bool, args []str
 		}
 	}
 
+	var volsetConflicts []syncConflicts
 	for _, volset := range volsets {
 		mdsInit, err := c.getMdsInitial()
 		if err != nil {
 			return cmdOut, err
 		}
 
-		conflicts, err := sync.Do(fhMds, mdsCurr, mdsInit, volset.ID, syncDirection)
+		conflicts, err := sync.Do(fhMds, mdsCurr, mdsInit, volset.ID, syncDirection, resolver)
 		if err != nil {
 			return cmdOut, err
 		}
 
 		if conflicts.HasConflicts() {
+			volsetConflicts = append(volsetConflicts, syncConflicts{VolumeSetID: volset.ID, MetaConflicts: conflicts})
 			cmdOut.Op = append(cmdOut.Op, CmdResult{Str: fmt.Sprintf("Volumeset  %v has conflicts", volset.ID.String())})
 			for _, v := range conflicts.VsC {
 				res := CmdResult{}
 				res.Str = "VolumeSet conflict:"
 				res.Tab = append(res.Tab, []string{"Initial version:", fmt.Sprintf("%v", v.Init)})
-				res.Tab = append(res.Tab, []string{"Current version (overwritten by target one):", fmt.Sprintf("%v", v.Cur)})
+				res.Tab = append(res.Tab, []string{"Current version:", fmt.Sprintf("%v", v.Cur)})
 				res.Tab = append(res.Tab, []string{"Target version:", fmt.Sprintf("%v", v.Tgt)})
+				if v.Resolution != "" {
+					res.Tab = append(res.Tab, []string{fmt.Sprintf("Resolved version (%s):", v.Resolution),
+						fmt.Sprintf("%v", v.Resolved)})
+				}
 
 				cmdOut.Op = append(cmdOut.Op, res)
 			}
@@ -620,39 +689,78 @@ func (c *Handler) sync(url string, token string, all bool, full bool, args []str
 				res := CmdResult{}
 				res.Str = "Snapshot conflict:"
 				res.Tab = append(res.Tab, []string{"Initial version:", fmt.Sprintf("%v", s.Init)})
-				res.Tab = append(res.Tab, []string{"Current version (overwritten by target one):", fmt.Sprintf("%v", s.Cur)})
+				res.Tab = append(res.Tab, []string{"Current version:", fmt.Sprintf("%v", s.Cur)})
 				res.Tab = append(res.Tab, []string{"Target version:", fmt.Sprintf("%v", s.Tgt)})
+				if s.Resolution != "" {
+					res.Tab = append(res.Tab, []string{fmt.Sprintf("Resolved version (%s):", s.Resolution),
+						fmt.Sprintf("%v", s.Resolved)})
+				}
 
 				cmdOut.Op = append(cmdOut.Op, res)
 			}
 
 			for _, b := range conflicts.BrC {
 				res := CmdResult{}
-				res.Str = "Branch conflict:"
-				res.Tab = append(res.Tab, []string{"Initial version:", fmt.Sprintf("%v", b.Init)})
-				res.Tab = append(res.Tab, []string{"Current version (overwritten by target one):", fmt.Sprintf("%v", b.Cur)})
-				res.Tab = append(res.Tab, []string{"Target version:", fmt.Sprintf("%v", b.Tgt)})
+				res.Str = fmt.Sprintf("Branch conflict (%s):", branchConflictStr(b.Conflicts))
+				res.Tab = append(res.Tab, []string{"Initial version:", branchVersion(b.Init, full)})
+				res.Tab = append(res.Tab, []string{"Current version:", branchVersion(b.Cur, full)})
+				res.Tab = append(res.Tab, []string{"Target version:", branchVersion(b.Tgt, full)})
 
 				cmdOut.Op = append(cmdOut.Op, res)
 			}
 		}
 	}
 
-	return cmdOut, nil
+	return SyncResult{CmdOutput: cmdOut, conflicts: volsetConflicts}, nil
 }
 
 // Sync ...
-func (c *Handler) Sync(url string, token string, all bool, full bool, args []string) (Result, error) {
-	return c.sync(url, token, all, full, args, twoWay)
+func (c *Handler) Sync(url string, token string, resolve string, all bool, full bool, args []string) (Result, error) {
+	strategy, err := sync.ParseStrategy(resolve)
+	if err != nil {
+		return CmdOutput{}, err
+	}
+
+	resolver := sync.Resolver{Strategy: strategy, Prompt: promptConflict(os.Stdin, os.Stdout)}
+	return c.sync(url, token, all, full, args, twoWay, resolver)
 }
 
 // Fetch ...
 func (c *Handler) Fetch(url string, token string, all bool, full bool, args []string) (Result, error) {
-	return c.sync(url, token, all, full, args, oneWay)
+	return c.sync(url, token, all, full, args, oneWay, sync.Resolver{})
+}
+
+// promptConflict returns a prompter which shows a conflict on out and reads the strategy used for it from in
+func promptConflict(in io.Reader, out io.Writer) sync.Prompter {
+	r := bufio.NewReader(in)
+	return func(kind string, init, cur, tgt interface{}) (sync.Strategy, error) {
+		fmt.Fprintf(out, "Conflicting changes to %s:\n", kind)
+		fmt.Fprintf(out, "  Initial version: %v\n", init)
+		fmt.Fprintf(out, "  Current version: %v\n", cur)
+		fmt.Fprintf(out, "  Target version:  %v\n", tgt)
+
+		for {
+			fmt.Fprintf(out, "Keep [l]ocal, keep [r]emote or [m]erge? ")
+			answer, err := r.ReadString('\n')
+			if err != nil && (err != io.EOF || answer == "") {
+				return "", errors.Errorf("Failed to read an answer: %v", err)
+			}
+
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "l", "local", string(sync.KeepLocal):
+				return sync.KeepLocal, nil
+			case "r", "remote", string(sync.KeepRemote):
+				return sync.KeepRemote, nil
+			case "m", "merge":
+				return sync.Merge, nil
+			}
+		}
+	}
 }
 
 // Push ...
-func (c *Handler) Push(url string, token string, full bool, args []string) (Result, error) {
+func (c *Handler) Push(url string, token string, compression string, hash string, dryRun bool, full bool,
+	args []string) (Result, error) {
 	cmdOut := CmdOutput{}
 
 	if len(args) != 1 {
@@ -664,7 +772,7 @@ func (c *Handler) Push(url string, token string, full bool, args []string) (Resu
 		return cmdOut, err
 	}
 
-	store, err := getStorage(c.CfgParams.Zpool)
+	store, err := getStorage(c.CfgParams)
 	if err != nil {
 		return cmdOut, err
 	}
@@ -713,17 +821,43 @@ func (c *Handler) Push(url string, token string, full bool, args []string) (Resu
 		return cmdOut, err
 	}
 
-	// TODO: Make record encoder/decoder configurable
-	encdec := dlbin.Factory{}
-	hf := dladler32.Factory{}
+	cps, err := c.getCheckpointStore()
+	if err != nil {
+		return cmdOut, err
+	}
+
+	encdec, err := c.getEncDec(compression)
+	if err != nil {
+		return cmdOut, err
+	}
+
+	hf, err := getHash(hash)
+	if err != nil {
+		return cmdOut, err
+	}
+
+	if dryRun {
+		var estimates []*sync.Estimate
+		if len(snaps) == 1 {
+			estimates, err = sync.EstimatePushForCertainSnapshots(mds,
+				&blobDiff{store: store, ed: encdec, hf: hf, cps: cps}, fhMds, []snapshot.ID{snaps[0].ID})
+		} else {
+			estimates, err = sync.EstimatePushForAllSnapshots(mds, volsets[0].ID,
+				&blobDiff{store: store, ed: encdec, hf: hf, cps: cps}, fhMds)
+		}
+		if err != nil {
+			return cmdOut, err
+		}
+		return TransferEstimateResult{full: full, estimates: estimates}, nil
+	}
+
+	sender := &blobDiff{store: store, ed: encdec, hf: hf, cps: cps, mds: mds, progress: c.progressReporter()}
 	if len(snaps) == 1 {
-		if err = sync.PushDataForCertainSnapshots(mds, &blobDiff{store: store, ed: encdec, hf: hf}, fhMds,
-			[]snapshot.ID{snaps[0].ID}); err != nil {
+		if err = sync.PushDataForCertainSnapshots(mds, sender, fhMds, []snapshot.ID{snaps[0].ID}); err != nil {
 			return cmdOut, err
 		}
 	} else {
-		if err = sync.PushDataForAllSnapshots(mds, volsets[0].ID, &blobDiff{store: store, ed: encdec, hf: hf},
-			fhMds); err != nil {
+		if err = sync.PushDataForAllSnapshots(mds, volsets[0].ID, sender, fhMds); err != nil {
 			return cmdOut, err
 		}
 	}
@@ -732,7 +866,8 @@ func (c *Handler) Push(url string, token string, full bool, args []string) (Resu
 }
 
 // Pull ...
-func (c *Handler) Pull(url string, token string, full bool, args []string) (Result, error) {
+func (c *Handler) Pull(url string, token string, compression string, hash string, dryRun bool, full bool,
+	args []string) (Result, error) {
 	cmdOut := CmdOutput{}
 
 	if len(args) != 1 {
@@ -744,7 +879,7 @@ func (c *Handler) Pull(url string, token string, full bool, args []string) (Resu
 		return cmdOut, err
 	}
 
-	store, err := getStorage(c.CfgParams.Zpool)
+	store, err := getStorage(c.CfgParams)
 	if err != nil {
 		return cmdOut, err
 	}
@@ -793,17 +928,41 @@ func (c *Handler) Pull(url string, token string, full bool, args []string) (Resu
 		return cmdOut, err
 	}
 
-	// TODO: Make record encoder/decoder configurable
-	encdec := dlbin.Factory{}
-	hf := dladler32.Factory{}
+	cps, err := c.getCheckpointStore()
+	if err != nil {
+		return cmdOut, err
+	}
+
+	encdec, err := c.getEncDec(compression)
+	if err != nil {
+		return cmdOut, err
+	}
+
+	hf, err := getHash(hash)
+	if err != nil {
+		return cmdOut, err
+	}
+
+	if dryRun {
+		var estimates []*sync.Estimate
+		if len(snaps) == 1 {
+			estimates, err = sync.EstimatePullForCertainSnapshots(fhMds, mds, []snapshot.ID{snaps[0].ID})
+		} else {
+			estimates, err = sync.EstimatePullForAllSnapshots(fhMds, mds, volsets[0].ID)
+		}
+		if err != nil {
+			return cmdOut, err
+		}
+		return TransferEstimateResult{full: full, pull: true, estimates: estimates}, nil
+	}
+
+	receiver := &blobDiff{store: store, ed: encdec, hf: hf, cps: cps, mds: mds, progress: c.progressReporter()}
 	if len(snaps) == 1 {
-		if err = sync.PullDataForCertainSnapshots(fhMds, mds, &blobDiff{store: store, ed: encdec, hf: hf},
-			[]snapshot.ID{snaps[0].ID}); err != nil {
+		if err = sync.PullDataForCertainSnapshots(fhMds, mds, receiver, []snapshot.ID{snaps[0].ID}); err != nil {
 			return cmdOut, err
 		}
 	} else {
-		if err = sync.PullDataForAllSnapshots(fhMds, mds, volsets[0].ID,
-			&blobDiff{store: store, ed: encdec, hf: hf}); err != nil {
+		if err = sync.PullDataForAllSnapshots(fhMds, mds, volsets[0].ID, receiver); err != nil {
 			return cmdOut, err
 		}
 	}
@@ -812,7 +971,8 @@ func (c *Handler) Pull(url string, token string, full bool, args []string) (Resu
 }
 
 // Update ...
-func (c *Handler) Update(name string, attributes string, description string, full bool, args []string) (Result, error) {
+func (c *Handler) Update(name string, attributes string, description string, policy string, hookSpec string,
+	approveHooks bool, full bool, args []string) (Result, error) {
 	cmdOut := CmdOutput{}
 
 	if len(args) != 1 {
@@ -824,7 +984,7 @@ func (c *Handler) Update(name string, attributes string, description string, ful
 		return cmdOut, err
 	}
 
-	if _, err := getStorage(c.CfgParams.Zpool); err != nil {
+	if _, err := getStorage(c.CfgParams); err != nil {
 		return cmdOut, err
 	}
 
@@ -871,6 +1031,11 @@ func (c *Handler) Update(name string, attributes string, description string, ful
 		}
 
 	default:
+		// Only volume sets have a retention policy and hooks
+		if (policy != "" || hookSpec != "" || approveHooks) && len(volsetFound) != 1 {
+			return cmdOut, ErrInvalidArgs{}
+		}
+
 		switch {
 		case len(volsetFound) == 1:
 			if name != "" {
@@ -892,11 +1057,38 @@ func (c *Handler) Update(name string, attributes string, description string, ful
 			if description != "" {
 				volsetFound[0].Description = description
 			}
+			if policy == noRetention {
+				volsetFound[0].Retention = ""
+			} else if policy != "" {
+				p, err := retention.Parse(policy)
+				if err != nil {
+					return cmdOut, err
+				}
+
+				volsetFound[0].Retention = p.String()
+			}
+			if hookSpec == noHooks {
+				volsetFound[0].Hooks = ""
+			} else if hookSpec != "" {
+				h, err := parseHooks(hookSpec)
+				if err != nil {
+					return cmdOut, err
+				}
+
+				volsetFound[0].Hooks = h.String()
+			}
 
 			if err := metastore.UpdateVolumeSet(mds, volsetFound[0]); err != nil {
 				return cmdOut, err
 			}
 
+			// Hooks set here are approved, hooks changed by a sync are approved explicitly
+			if hookSpec != "" || approveHooks {
+				if err := c.approveHooks(volsetFound[0]); err != nil {
+					return cmdOut, err
+				}
+			}
+
 		case len(snapFound) == 1:
 			if name != "" {
 				if err := validateName(name); err != nil {
@@ -968,6 +1160,20 @@ func (c *Handler) Update(name string, attributes string, description string, ful
 	return cmdOut, nil
 }
 
+// approveHooks approves the current hooks of a volume set to run on this host
+func (c *Handler) approveHooks(vs *volumeset.VolumeSet) error {
+	if vs.Hooks == "" {
+		delete(c.CfgParams.ApprovedHooks, vs.ID.String())
+	} else {
+		if c.CfgParams.ApprovedHooks == nil {
+			c.CfgParams.ApprovedHooks = hooks.Approvals{}
+		}
+		c.CfgParams.ApprovedHooks[vs.ID.String()] = hooks.Digest(vs.Hooks)
+	}
+
+	return NewConfig(c.ConfigFile).UpdateConfig(c.CfgParams)
+}
+
 // Remove ...
 func (c *Handler) Remove(full bool, args []string) (Result, error) {
 	cmdOut := CmdOutput{}
@@ -981,7 +1187,7 @@ func (c *Handler) Remove(full bool, args []string) (Result, error) {
 		return cmdOut, err
 	}
 
-	store, err := getStorage(c.CfgParams.Zpool)
+	store, err := getStorage(c.CfgParams)
 	if err != nil {
 		return cmdOut, err
 	}
@@ -1052,6 +1258,142 @@ func (c *Handler) Remove(full bool, args []string) (Result, error) {
 	return cmdOut, nil
 }
 
+// Fsck checks the metadata store against the storage, the problems found are repaired if repair is set
+func (c *Handler) Fsck(repair bool, full bool, args []string) (Result, error) {
+	if len(args) != 0 {
+		return CmdOutput{}, ErrInvalidArgs{}
+	}
+
+	mds, err := c.getMdsCurrent()
+	if err != nil {
+		return CmdOutput{}, err
+	}
+
+	store, err := getStorage(c.CfgParams)
+	if err != nil {
+		return CmdOutput{}, err
+	}
+
+	problems, err := dataplane.Fsck(mds, store, repair)
+	if err != nil {
+		return CmdOutput{}, err
+	}
+
+	return FsckResult{full: full, repair: repair, problems: problems}, nil
+}
+
+// Diff shows what changed between two snapshots, or the records which turn the first snapshot into the second one if
+// records is set. Both snapshots must have their data locally.
+func (c *Handler) Diff(records bool, full bool, args []string) (Result, error) {
+	if len(args) != 2 {
+		return CmdOutput{}, ErrInvalidArgs{}
+	}
+
+	mds, err := c.getMdsCurrent()
+	if err != nil {
+		return CmdOutput{}, err
+	}
+
+	store, err := getStorage(c.CfgParams)
+	if err != nil {
+		return CmdOutput{}, err
+	}
+
+	var ids []snapshot.ID
+	for _, arg := range args {
+		snaps, err := FindSnapshots(mds, arg)
+		if err != nil {
+			return CmdOutput{}, err
+		}
+
+		switch {
+		case len(snaps) == 0:
+			return CmdOutput{}, errors.Errorf("No matching snapshots found for '%s'", arg)
+		case len(snaps) > 1:
+			return CmdOutput{Op: []CmdResult{
+				{Str: "Ambigous matches found for - " + arg},
+				{Tab: snapshotTable(0, full, snaps)},
+			}}, nil
+		}
+
+		ids = append(ids, snaps[0].ID)
+	}
+
+	hf, err := getHash(c.CfgParams.Hash)
+	if err != nil {
+		return CmdOutput{}, err
+	}
+
+	if records {
+		res := DiffResult{}
+		err = dataplane.Diff(mds, store, ids[0], ids[1], hf, func(r record.Record) error {
+			res.records = append(res.records, r.String())
+			return nil
+		})
+		return res, err
+	}
+
+	sum := datalayer.NewDiffSummarizer()
+	err = dataplane.Diff(mds, store, ids[0], ids[1], hf, func(r record.Record) error {
+		sum.Add(r)
+		return nil
+	})
+	if err != nil {
+		return CmdOutput{}, err
+	}
+
+	return DiffResult{summary: sum.Summary()}, nil
+}
+
+// Prune deletes the snapshots expired by the retention policy of the given volume set, or of all volume sets if none
+// is given. Nothing is deleted if dryRun is set.
+func (c *Handler) Prune(dryRun bool, full bool, args []string) (Result, error) {
+	if len(args) > 1 {
+		return CmdOutput{}, ErrInvalidArgs{}
+	}
+
+	mds, err := c.getMdsCurrent()
+	if err != nil {
+		return CmdOutput{}, err
+	}
+
+	store, err := getStorage(c.CfgParams)
+	if err != nil {
+		return CmdOutput{}, err
+	}
+
+	var volsets []*volumeset.VolumeSet
+	if len(args) == 1 {
+		volsets, err = FindVolumesets(mds, args[0])
+		if err != nil {
+			return CmdOutput{}, err
+		}
+		if len(volsets) > 1 {
+			return CmdOutput{Op: []CmdResult{
+				{Str: "Ambigous matches found for - " + args[0]},
+				{Tab: volumesetTable(0, full, volsets)},
+			}}, nil
+		}
+	} else {
+		volsets, err = mds.GetVolumeSets(volumeset.Query{})
+		if err != nil {
+			return CmdOutput{}, err
+		}
+	}
+
+	res := PruneResult{full: full, dryRun: dryRun}
+	now := time.Now()
+	for _, vs := range volsets {
+		pruned, err := dataplane.Prune(mds, store, vs.ID, now, dryRun)
+		if err != nil {
+			return CmdOutput{}, err
+		}
+		res.pruned = append(res.pruned, pruned...)
+	}
+
+	return res, nil
+}
+
 // List ...
 func (c *Handler) List(
 	all bool,
@@ -1077,7 +1419,7 @@ func (c *Handler) List(
 		return cmdOut, err
 	}
 
-	if _, err := getStorage(c.CfgParams.Zpool); err != nil {
+	if _, err := getStorage(c.CfgParams); err != nil {
 		return cmdOut, err
 	}
 
@@ -1254,7 +1596,7 @@ func (c *Handler) List(
 }
 
 // Setup is called when fli is setting up the system
-func (c *Handler) Setup(zpool string, force bool, args []string) (Result, error) {
+func (c *Handler) Setup(zpool string, storage string, force bool, args []string) (Result, error) {
 	if len(args) > 0 {
 		return CmdOutput{}, ErrInvalidArgs{}
 	}
@@ -1292,15 +1634,28 @@ func (c *Handler) Setup(zpool string, force bool, args []string) (Result, error)
 
 	if zpool == "" {
 		// Without ZPOOL fli can't proceed
-		return CmdOutput{}, errors.Errorf("zpool not set for the fli client. Use --zpool to set the zpool")
+		return CmdOutput{}, errors.Errorf("zpool not set for the fli client. Use --zpool to set the zpool or " +
+			"the directory of the storage")
+	}
+
+	switch storage {
+	case "", storageZFS, storageBtrfs:
+	case storageOverlay, storageLinkFS:
+		if !filepath.IsAbs(zpool) {
+			return CmdOutput{}, errors.Errorf("%s storage needs an absolute path, got %s", storage, zpool)
+		}
+	default:
+		return CmdOutput{}, errors.Errorf("Unknown storage type %s, valid types are %s, %s, %s and %s", storage,
+			storageZFS, storageBtrfs, storageOverlay, storageLinkFS)
 	}
 
 	c.CfgParams.Version = version.Version()
 	c.CfgParams.SQLMdsInitial = mdsInitialFPath.Path()
 	c.CfgParams.SQLMdsCurrent = mdsCurrentFPath.Path()
 	c.CfgParams.Zpool = zpool
+	c.CfgParams.Storage = storage
 
-	if _, err := getStorage(c.CfgParams.Zpool); err != nil {
+	if _, err := getStorage(c.CfgParams); err != nil {
 		return CmdOutput{}, err
 	}
 
@@ -1321,7 +1676,8 @@ func (c *Handler) Setup(zpool string, force bool, args []string) (Result, error)
 }
 
 // Config ...
-func (c *Handler) Config(url string, token string, offline bool, args []string) (Result, error) {
+func (c *Handler) Config(url string, token string, compression string, hash string, differ string, keyID string,
+	offline bool, args []string) (Result, error) {
 	cmdOut := CmdOutput{}
 
 	if len(args) > 0 {
@@ -1348,6 +1704,50 @@ func (c *Handler) Config(url string, token string, offline bool, args []string)
 		c.CfgParams.AuthTokenFile = token
 	}
 
+	if compression != "" {
+		if _, err := compress.ParseType(compression); err != nil {
+			return cmdOut, err
+		}
+
+		c.CfgParams.Compression = compression
+	}
+
+	if hash != "" {
+		if _, err := dlhash.ParseType(hash); err != nil {
+			return cmdOut, err
+		}
+
+		c.CfgParams.Hash = hash
+	}
+
+	if differ != "" {
+		if _, err := getFileDiffer(differ); err != nil {
+			return cmdOut, err
+		}
+
+		c.CfgParams.Differ = differ
+	}
+
+	if keyID == "none" {
+		c.CfgParams.EncryptionKey = ""
+	} else if keyID != "" {
+		id, generated, err := NewKeys(c.keysFile()).AddKey(keyID)
+		if err != nil {
+			return cmdOut, err
+		}
+
+		// The key is only shown here, it is not logged
+		if generated != "" {
+			cmdOut.Op = append(cmdOut.Op,
+				CmdResult{Str: "Generated encryption key " + id + ", it is only shown once:"},
+				CmdResult{Str: generated},
+				CmdResult{Str: "Add it to other clients with 'fli config --encryption-key " + id + "=KEY', " +
+					"where KEY is the key above"})
+		}
+
+		c.CfgParams.EncryptionKey = id
+	}
+
 	cfg := NewConfig(c.ConfigFile)
 	if err := cfg.UpdateConfig(c.CfgParams); err != nil {
 		return CmdOutput{}, err
@@ -1418,8 +1818,17 @@ func addFileToTarball(tw *tar.Writer, path string) error {
 	return nil
 }
 
-func dumpZfsStats(pool, filepath string) error {
-	output, err := exec.Command("zfs", "list", "-rt", "all", pool).Output()
+func dumpZfsStats(params ConfigParams, filepath string) error {
+	pool := params.Zpool
+	cmd := exec.Command("zfs", "list", "-rt", "all", pool)
+	switch storageType(params) {
+	case storageBtrfs:
+		cmd = exec.Command("btrfs", "subvolume", "list", "-o", pool)
+	case storageOverlay, storageLinkFS:
+		cmd = exec.Command("du", "-a", pool)
+	}
+
+	output, err := cmd.Output()
 	if err != nil {
 		return err
 	}
@@ -1431,8 +1840,17 @@ func dumpZfsStats(pool, filepath string) error {
 	return nil
 }
 
-func dumpZpoolHistory(pool, filepath string) error {
-	output, err := exec.Command("zpool", "history", "-li", pool).Output()
+func dumpZpoolHistory(params ConfigParams, filepath string) error {
+	pool := params.Zpool
+	cmd := exec.Command("zpool", "history", "-li", pool)
+	switch storageType(params) {
+	case storageBtrfs:
+		cmd = exec.Command("btrfs", "qgroup", "show", "--raw", pool)
+	case storageOverlay, storageLinkFS:
+		cmd = exec.Command("findmnt", "-t", "overlay")
+	}
+
+	output, err := cmd.Output()
 	if err != nil {
 		return err
 	}
@@ -1483,14 +1901,14 @@ func (c *Handler) Diagnostics(args []string) (Result, error) {
 	}()
 
 	// dump zfs stats to a temp file
-	if err := dumpZfsStats(c.CfgParams.Zpool, zfsDumpPath); err != nil {
+	if err := dumpZfsStats(c.CfgParams, zfsDumpPath); err != nil {
 		os.Remove(zfsDumpPath) //paranoid
 		return CmdOutput{}, err
 	}
 	defer os.Remove(zfsDumpPath)
 
 	// dump zpool history to a temp file
-	if err := dumpZpoolHistory(c.CfgParams.Zpool, zpoolDumpPath); err != nil {
+	if err := dumpZpoolHistory(c.CfgParams, zpoolDumpPath); err != nil {
 		os.Remove(zpoolDumpPath) //paranoid
 		return CmdOutput{}, err
 	}
@@ -1568,20 +1986,87 @@ func (c *Handler) Info(args []string) (Result, error) {
 		tab = append(tab, []string{"Auth Token File:", c.CfgParams.AuthTokenFile})
 	}
 
-	if c.CfgParams.Zpool != "" {
+	zfs := storageType(c.CfgParams) == storageZFS
+	if zfs && c.CfgParams.Zpool != "" {
 		tab = append(tab, []string{"ZPOOL:", c.CfgParams.Zpool})
+	} else if c.CfgParams.Zpool != "" {
+		tab = append(tab, []string{"Storage:", storageType(c.CfgParams) + " " + c.CfgParams.Zpool})
 	}
 
-	if store, err := getStorage(c.CfgParams.Zpool); err == nil { // Error here is ignored
-		zfsVer := store.Version()
-		if zfsVer != "" {
-			tab = append(tab, []string{"ZFS Version:", zfsVer})
+	if store, err := getStorage(c.CfgParams); err == nil { // Error here is ignored
+		ver := store.Version()
+		if ver != "" && zfs {
+			tab = append(tab, []string{"ZFS Version:", ver})
+		} else if ver != "" {
+			tab = append(tab, []string{"Storage Version:", ver})
 		}
 	}
 
 	return CmdOutput{Op: []CmdResult{{Tab: tab}}}, nil
 }
 
+// getHash returns the hash factory of record checksums with the given name, an empty name is the default hash
+func getHash(name string) (dlhash.Factory, error) {
+	t, err := dlhash.ParseType(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return datalayer.HashFactory(t)
+}
+
+// getEncDec returns the record encoder/decoder of pushes and pulls, records are compressed with the compression
+// given and encrypted with the configured encryption key if there is one.
+func (c *Handler) getEncDec(compression string) (encdec.Factory, error) {
+	t, err := compress.ParseType(compression)
+	if err != nil {
+		return nil, err
+	}
+
+	cf, err := datalayer.CompressionFactory(t)
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO: Make record encoder/decoder configurable
+	ed := compress.Wrap(dlbin.Factory{}, cf)
+	if c.CfgParams.EncryptionKey == "" {
+		return ed, nil
+	}
+
+	keys, err := NewKeys(c.keysFile()).ReadKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := keys[c.CfgParams.EncryptionKey]; !ok {
+		return nil, &aesgcm.ErrUnknownKey{KeyID: c.CfgParams.EncryptionKey}
+	}
+
+	return aesgcm.Factory{Inner: ed, KeyID: c.CfgParams.EncryptionKey, Keys: keys}, nil
+}
+
+// keysFile returns the path of the encryption keys file
+func (c *Handler) keysFile() string {
+	return filepath.Join(filepath.Dir(c.ConfigFile), keysFile)
+}
+
+// getCheckpointStore returns the store of interrupted downloads, it is kept next to the config file.
+// progressReporter returns the reporter of push and pull progress, a progress bar if stderr is a terminal and JSON
+// lines otherwise.
+func (c *Handler) progressReporter() progress.Reporter {
+	return progress.New(os.Stderr)
+}
+
+func (c *Handler) getCheckpointStore() (datalayer.CheckpointStore, error) {
+	dir, err := securefilepath.New(filepath.Join(filepath.Dir(c.ConfigFile), transfersDir))
+	if err != nil {
+		return nil, err
+	}
+
+	return datalayer.NewFileCheckpointStore(dir)
+}
+
 // NewHandler ...
 func NewHandler(params ConfigParams, cfgFile, mdsCurr, mdsInit string) *Handler {
 	return &Handler{
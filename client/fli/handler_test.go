@@ -72,7 +72,7 @@ func (s *HandlerSuite) SetupTest() {
 
 	s.handler = fli.NewHandler(params, s.cfgFile, s.mdsCurrent, s.mdsInitial)
 
-	_, err = s.handler.Setup("chq", true, []string{})
+	_, err = s.handler.Setup("chq", "", true, []string{})
 	s.Require().NoError(err, "Failed first time setup")
 }
 
@@ -84,33 +84,37 @@ func (s *HandlerSuite) TestSetup() {
 	os.RemoveAll(s.cfgFile)
 
 	// first time setup without zpool
-	_, err = s.handler.Setup("", false, []string{})
+	_, err = s.handler.Setup("", "", false, []string{})
 	s.Require().Error(err, "Expected error because no zpool passed")
 
+	// unknown storage type
+	_, err = s.handler.Setup("chq", "nfs", false, []string{})
+	s.Require().Error(err, "Expected error because the storage type is unknown")
+
 	// valid setup without force
-	_, err = s.handler.Setup("chq", false, []string{})
+	_, err = s.handler.Setup("chq", "", false, []string{})
 	s.Require().NoError(err, "Failed first time setup")
 
 	// remove one mds file
 	os.RemoveAll(s.mdsCurrent)
 
 	// setup with existing mds files
-	_, err = s.handler.Setup("chq", false, []string{})
+	_, err = s.handler.Setup("chq", "", false, []string{})
 	s.Require().Error(err, "Expected error because mds files exists")
 
 	// valid setup with force
-	_, err = s.handler.Setup("chq", true, []string{})
+	_, err = s.handler.Setup("chq", "", true, []string{})
 	s.Require().NoError(err, "Failed to setup with existing mdsfile")
 
 	// remove one mds file
 	os.RemoveAll(s.mdsInitial)
 
 	// setup with existing mds files
-	_, err = s.handler.Setup("chq", false, []string{})
+	_, err = s.handler.Setup("chq", "", false, []string{})
 	s.Require().Error(err, "Expected error because mds files exists")
 
 	// valid setup with force
-	_, err = s.handler.Setup("chq", true, []string{})
+	_, err = s.handler.Setup("chq", "", true, []string{})
 	s.Require().NoError(err, "Failed to setup with existing mdsfile")
 }
 
@@ -122,24 +126,64 @@ func (s *HandlerSuite) TestConfig() {
 	fp.Close()
 
 	// Update tokenfile in configuration
-	_, err = s.handler.Config("", tokenfile, true, []string{})
+	_, err = s.handler.Config("", tokenfile, "", "", "", "", true, []string{})
 	s.Require().NoError(err, "Config update failed")
 
 	// Tokenfile does not exists
 	os.RemoveAll(tokenfile)
-	_, err = s.handler.Config("", tokenfile, true, []string{})
+	_, err = s.handler.Config("", tokenfile, "", "", "", "", true, []string{})
 	s.Require().Error(err, "Expected an error")
 
 	// Tokenfile is not an absolute path
-	_, err = s.handler.Config("", "token", true, []string{})
+	_, err = s.handler.Config("", "token", "", "", "", "", true, []string{})
 	s.Require().Error(err, "Expected an error")
 
 	// Configure URL
-	_, err = s.handler.Config("localhost", "", true, []string{})
+	_, err = s.handler.Config("localhost", "", "", "", "", "", true, []string{})
 	s.Require().NoError(err, "Failed to set flockerhub URL")
 
+	// Configure compression
+	_, err = s.handler.Config("", "", "zstd", "", "", "", true, []string{})
+	s.Require().NoError(err, "Failed to set compression")
+
+	// Unknown compression
+	_, err = s.handler.Config("", "", "lz5", "", "", "", true, []string{})
+	s.Require().Error(err, "Expected an error")
+
+	// Configure hash
+	_, err = s.handler.Config("", "", "", "blake3", "", "", true, []string{})
+	s.Require().NoError(err, "Failed to set hash")
+	s.Require().Equal("blake3", s.handler.CfgParams.Hash)
+
+	// Unknown hash
+	_, err = s.handler.Config("", "", "", "crc32", "", "", true, []string{})
+	s.Require().Error(err, "Expected an error")
+
+	// Configure differ
+	_, err = s.handler.Config("", "", "", "", "cdc", "", true, []string{})
+	s.Require().NoError(err, "Failed to set differ")
+	s.Require().Equal("cdc", s.handler.CfgParams.Differ)
+
+	// Unknown differ
+	_, err = s.handler.Config("", "", "", "", "rsync", "", true, []string{})
+	s.Require().Error(err, "Expected an error")
+
+	// Generate an encryption key
+	_, err = s.handler.Config("", "", "", "", "", "k1", true, []string{})
+	s.Require().NoError(err, "Failed to generate encryption key")
+	s.Require().Equal("k1", s.handler.CfgParams.EncryptionKey)
+
+	// Imported key of the wrong size
+	_, err = s.handler.Config("", "", "", "", "", "k2=c2hvcnQ=", true, []string{})
+	s.Require().Error(err, "Expected an error")
+
+	// Stop encrypting
+	_, err = s.handler.Config("", "", "", "", "", "none", true, []string{})
+	s.Require().NoError(err, "Failed to stop encrypting")
+	s.Require().Equal("", s.handler.CfgParams.EncryptionKey)
+
 	// Without args
-	_, err = s.handler.Config("", "", true, []string{})
+	_, err = s.handler.Config("", "", "", "", "", "", true, []string{})
 	s.Require().NoError(err, "Failed to just show configurations")
 }
 
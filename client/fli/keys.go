@@ -0,0 +1,143 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fli
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/ClusterHQ/fli/dl/encdec/aesgcm"
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/go-yaml/yaml"
+)
+
+type (
+	// Keys is a YAML based file of encryption keys, keys are base64 encoded by key ID
+	Keys struct {
+		filename string
+	}
+)
+
+// NewKeys creates a YAML based file of encryption keys
+func NewKeys(filepath string) *Keys {
+	return &Keys{filename: filepath}
+}
+
+// ReadKeys reads the keys, there is no key if the file doesn't exist
+func (k *Keys) ReadKeys() (aesgcm.Keyring, error) {
+	keys := aesgcm.Keyring{}
+
+	buf, err := ioutil.ReadFile(k.filename)
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := map[string]string{}
+	err = yaml.Unmarshal(buf, &encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	for id, e := range encoded {
+		key, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return nil, errors.Errorf("Invalid encryption key %s in %s: %v", id, k.filename, err)
+		}
+		keys[id] = key
+	}
+
+	return keys, nil
+}
+
+// UpdateKeys writes the keys, the file is only readable by the user
+func (k *Keys) UpdateKeys(keys aesgcm.Keyring) error {
+	encoded := map[string]string{}
+	for id, key := range keys {
+		encoded[id] = base64.StdEncoding.EncodeToString(key)
+	}
+
+	buf, err := yaml.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(k.filename, buf, 0600)
+}
+
+// AddKey adds a key given as ID or ID=KEY, where KEY is a base64 encoded key exported from another client. A new key
+// is generated if only the ID is given and there is no key with the ID. Returns the key ID and the base64 encoded key
+// if a new key is generated.
+func (k *Keys) AddKey(arg string) (string, string, error) {
+	id := arg
+	encoded := ""
+	if i := strings.Index(arg, "="); i != -1 {
+		id, encoded = arg[:i], arg[i+1:]
+	}
+
+	if id == "" {
+		return "", "", errors.New("Encryption key ID is empty")
+	}
+
+	keys, err := k.ReadKeys()
+	if err != nil {
+		return "", "", err
+	}
+
+	var generated string
+	if encoded != "" {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", "", errors.Errorf("Invalid encryption key %s: %v", id, err)
+		}
+
+		if len(key) != aesgcm.KeySize {
+			return "", "", errors.Errorf("Encryption key %s is %d bytes, expected %d", id, len(key),
+				aesgcm.KeySize)
+		}
+
+		if old, ok := keys[id]; ok && string(old) != string(key) {
+			return "", "", errors.Errorf("A different encryption key %s exists", id)
+		}
+
+		keys[id] = key
+	} else if _, ok := keys[id]; !ok {
+		key, err := aesgcm.NewKey()
+		if err != nil {
+			return "", "", err
+		}
+
+		keys[id] = key
+		generated = base64.StdEncoding.EncodeToString(key)
+	} else {
+		return id, "", nil
+	}
+
+	return id, generated, k.UpdateKeys(keys)
+}
+
+// redactKey returns an ID or ID=KEY argument without the key, so it can be logged
+func redactKey(arg string) string {
+	if i := strings.Index(arg, "="); i != -1 {
+		return arg[:i+1] + "REDACTED"
+	}
+	return arg
+}
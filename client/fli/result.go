@@ -19,8 +19,15 @@ package fli
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dp/dataplane"
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/dp/sync"
 	"github.com/ClusterHQ/fli/meta/branch"
 	"github.com/ClusterHQ/fli/meta/snapshot"
 	"github.com/ClusterHQ/fli/meta/volume"
@@ -315,6 +322,12 @@ func volumesetTableJSON(vss []*volumeset.VolumeSet) []map[string]string {
 		m["DESCRIPTION"] = vs.Description
 		m["ATTRIBUTES"] = convAttrToStr(vs.Attrs)
 		m["NAME"] = vs.Name
+		if vs.Retention != "" {
+			m["RETENTION"] = vs.Retention
+		}
+		if vs.Hooks != "" {
+			m["HOOKS"] = vs.Hooks
+		}
 		resultMap = append(resultMap, m)
 	}
 
@@ -427,3 +440,395 @@ func (r ListResult) JSON() string {
 
 	return ""
 }
+
+type (
+	// SyncResult represents the result of sync and fetch commands.
+	SyncResult struct {
+		CmdOutput
+		conflicts []syncConflicts
+	}
+
+	// syncConflicts are the conflicts found by syncing a volume set
+	syncConflicts struct {
+		VolumeSetID volumeset.ID `json:"volumeset_id"`
+		sync.MetaConflicts
+	}
+)
+
+var _ Result = &SyncResult{}
+
+// JSON translates the conflicts of the synced volume sets to JSON string.
+func (r SyncResult) JSON() string {
+	conflicts := r.conflicts
+	if conflicts == nil {
+		conflicts = []syncConflicts{}
+	}
+
+	b, _ := json.Marshal(conflicts)
+	return string(b[:])
+}
+
+// branchVersion returns the name and tip of a branch in a conflict
+func branchVersion(b *branch.Branch, full bool) string {
+	if b == nil {
+		return "deleted"
+	}
+
+	tip := b.Tip.ID.String()
+	if !full {
+		tip = uuid.ShrinkUUID(tip)
+	}
+	return fmt.Sprintf("%s (tip %s)", b.Name, tip)
+}
+
+func branchConflictStr(conflicts []metastore.BranchConflict) string {
+	var strs []string
+	for _, c := range conflicts {
+		strs = append(strs, string(c))
+	}
+	return strings.Join(strs, ", ")
+}
+
+type (
+	// FsckResult represents the result of the fsck command.
+	FsckResult struct {
+		full     bool
+		repair   bool
+		problems []*dataplane.Problem
+	}
+
+	// fsckProblem is a problem found by fsck in JSON output
+	fsckProblem struct {
+		Kind        dataplane.ProblemKind `json:"kind"`
+		VolumeSetID string                `json:"volumeset_id,omitempty"`
+		SnapshotID  string                `json:"snapshot_id,omitempty"`
+		VolumeID    string                `json:"volume_id,omitempty"`
+		BlobID      string                `json:"blob_id,omitempty"`
+		Name        string                `json:"name,omitempty"`
+		Repair      string                `json:"repair,omitempty"`
+		Repaired    bool                  `json:"repaired"`
+		Error       string                `json:"error,omitempty"`
+	}
+)
+
+var _ Result = &FsckResult{}
+
+func (r FsckResult) String() string {
+	if len(r.problems) == 0 {
+		return "No problems found\n"
+	}
+
+	shrink := func(id string) string {
+		if r.full {
+			return id
+		}
+		return uuid.ShrinkUUID(id)
+	}
+
+	tab := [][]string{{"PROBLEM", "VOLUMESET", "OBJECT", "NAME", "REPAIR"}}
+	repaired := 0
+	for _, p := range r.problems {
+		object := p.SnapshotID.String()
+		if object == "" {
+			object = p.VolumeID.String()
+		}
+
+		repair := p.Repair
+		switch {
+		case repair == "":
+			repair = "-"
+		case p.Err != nil:
+			repair = fmt.Sprintf("%s failed: %v", repair, p.Err)
+		case p.Repaired:
+			repair += " (done)"
+			repaired++
+		}
+
+		tab = append(tab, []string{string(p.Kind), shrink(p.VolSetID.String()), shrink(object), p.Name, repair})
+	}
+
+	summary := fmt.Sprintf("%d problems found", len(r.problems))
+	if r.repair {
+		summary = fmt.Sprintf("%d of %d problems repaired", repaired, len(r.problems))
+	}
+
+	return CmdOutput{Op: []CmdResult{{Tab: tab}, {Str: summary}}}.String()
+}
+
+// JSON translates the problems found by fsck to JSON string.
+func (r FsckResult) JSON() string {
+	problems := []fsckProblem{}
+	for _, p := range r.problems {
+		fp := fsckProblem{
+			Kind:        p.Kind,
+			VolumeSetID: p.VolSetID.String(),
+			SnapshotID:  p.SnapshotID.String(),
+			VolumeID:    p.VolumeID.String(),
+			BlobID:      p.BlobID.String(),
+			Name:        p.Name,
+			Repair:      p.Repair,
+			Repaired:    p.Repaired,
+		}
+		if p.Err != nil {
+			fp.Error = p.Err.Error()
+		}
+		problems = append(problems, fp)
+	}
+
+	b, _ := json.Marshal(problems)
+	return string(b[:])
+}
+
+type (
+	// PruneResult represents the result of the prune command.
+	PruneResult struct {
+		full   bool
+		dryRun bool
+		pruned []*dataplane.Pruned
+	}
+
+	// prunedSnapshot is a snapshot expired by a retention policy in JSON output
+	prunedSnapshot struct {
+		VolumeSetID string `json:"volumeset_id"`
+		SnapshotID  string `json:"snapshot_id"`
+		Name        string `json:"name,omitempty"`
+		Created     string `json:"created"`
+		Size        uint64 `json:"size"`
+		Pruned      bool   `json:"pruned"`
+		Deleted     bool   `json:"deleted"`
+		Kept        string `json:"kept,omitempty"`
+		Error       string `json:"error,omitempty"`
+	}
+)
+
+var _ Result = &PruneResult{}
+
+// status returns what happened to an expired snapshot
+func (r PruneResult) status(p *dataplane.Pruned) string {
+	switch {
+	case p.Kept != "":
+		return "kept, " + p.Kept
+	case p.Err != nil:
+		return fmt.Sprintf("failed: %v", p.Err)
+	case r.dryRun && p.Deleted:
+		return "would be pruned and deleted"
+	case r.dryRun:
+		return "would be pruned"
+	case p.Deleted:
+		return "pruned and deleted"
+	}
+	return "pruned"
+}
+
+func (r PruneResult) String() string {
+	if len(r.pruned) == 0 {
+		return "No snapshots to prune\n"
+	}
+
+	tab := [][]string{{"VOLUMESET ID", "SNAPSHOT ID", "CREATED", "SIZE", "NAME", "STATUS"}}
+	var (
+		count int
+		size  uint64
+	)
+	for _, p := range r.pruned {
+		vsid := p.Snapshot.VolSetID.String()
+		id := p.Snapshot.ID.String()
+		if !r.full {
+			vsid = uuid.ShrinkUUID(vsid)
+			id = uuid.ShrinkUUID(id)
+		}
+
+		if p.Kept == "" && p.Err == nil {
+			count++
+			size += p.Snapshot.Size
+		}
+
+		tab = append(tab, []string{
+			vsid,
+			id,
+			p.Snapshot.CreationTime.Format(time.Stamp),
+			readableSize(p.Snapshot.Size),
+			p.Snapshot.Name,
+			r.status(p),
+		})
+	}
+
+	summary := fmt.Sprintf("%d snapshots pruned, %s freed", count, readableSize(size))
+	if r.dryRun {
+		summary = fmt.Sprintf("%d snapshots would be pruned, %s would be freed", count, readableSize(size))
+	}
+
+	return CmdOutput{Op: []CmdResult{{Tab: tab}, {Str: summary}}}.String()
+}
+
+// JSON translates the snapshots expired by retention policies to JSON string.
+func (r PruneResult) JSON() string {
+	pruned := []prunedSnapshot{}
+	for _, p := range r.pruned {
+		ps := prunedSnapshot{
+			VolumeSetID: p.Snapshot.VolSetID.String(),
+			SnapshotID:  p.Snapshot.ID.String(),
+			Name:        p.Snapshot.Name,
+			Created:     p.Snapshot.CreationTime.Format(time.Stamp),
+			Size:        p.Snapshot.Size,
+			Pruned:      !r.dryRun && p.Kept == "" && p.Err == nil,
+			Deleted:     !r.dryRun && p.Deleted && p.Err == nil,
+			Kept:        p.Kept,
+		}
+		if p.Err != nil {
+			ps.Error = p.Err.Error()
+		}
+		pruned = append(pruned, ps)
+	}
+
+	b, _ := json.Marshal(pruned)
+	return string(b[:])
+}
+
+type (
+	// DiffResult represents the result of the diff command, either a summary or the raw records.
+	DiffResult struct {
+		summary *datalayer.DiffSummary
+		records []string
+	}
+)
+
+var _ Result = &DiffResult{}
+
+func (r DiffResult) String() string {
+	if r.summary == nil {
+		if len(r.records) == 0 {
+			return ""
+		}
+		return strings.Join(r.records, "\n") + "\n"
+	}
+
+	tab := [][]string{{"CHANGE", "PATH"}}
+	for _, p := range r.summary.Added {
+		tab = append(tab, []string{"added", p})
+	}
+	for _, p := range r.summary.Removed {
+		tab = append(tab, []string{"removed", p})
+	}
+	for _, p := range r.summary.Modified {
+		tab = append(tab, []string{"modified", p})
+	}
+	for _, rn := range r.summary.Renamed {
+		tab = append(tab, []string{"renamed", rn.From + " -> " + rn.To})
+	}
+	for _, p := range r.summary.AttrsChanged {
+		tab = append(tab, []string{"attributes", p})
+	}
+
+	if len(tab) == 1 {
+		return "No changes\n"
+	}
+
+	summary := fmt.Sprintf("%d added, %d removed, %d modified, %d renamed, %d attributes changed, %s written",
+		len(r.summary.Added), len(r.summary.Removed), len(r.summary.Modified), len(r.summary.Renamed),
+		len(r.summary.AttrsChanged), readableSize(r.summary.BytesChanged))
+
+	return CmdOutput{Op: []CmdResult{{Tab: tab}, {Str: summary}}}.String()
+}
+
+// JSON translates the diff summary or the records to JSON string.
+func (r DiffResult) JSON() string {
+	var v interface{} = r.summary
+	if r.summary == nil {
+		v = append([]string{}, r.records...)
+	}
+
+	b, _ := json.Marshal(v)
+	return string(b[:])
+}
+
+type (
+	// TransferEstimateResult represents the result of a push or pull dry run.
+	TransferEstimateResult struct {
+		full      bool
+		pull      bool
+		estimates []*sync.Estimate
+	}
+
+	transferEstimate struct {
+		VolumeSetID    string `json:"volumeset_id"`
+		SnapshotID     string `json:"snapshot_id"`
+		Name           string `json:"name"`
+		BaseSnapshotID string `json:"base_snapshot_id,omitempty"`
+		Bytes          uint64 `json:"bytes"`
+		Records        uint64 `json:"records,omitempty"`
+		Exact          bool   `json:"exact"`
+	}
+)
+
+var _ Result = &TransferEstimateResult{}
+
+func (r TransferEstimateResult) String() string {
+	verb := "pushed"
+	if r.pull {
+		verb = "pulled"
+	}
+
+	if len(r.estimates) == 0 {
+		return fmt.Sprintf("Nothing to be %s\n", verb)
+	}
+
+	tab := [][]string{{"SNAPSHOT ID", "NAME", "BASE", "RECORDS", "SIZE"}}
+	var total uint64
+	exact := true
+	for _, e := range r.estimates {
+		id := e.Snapshot.ID.String()
+		base := "-"
+		if e.BaseID != nil {
+			base = e.BaseID.String()
+		}
+		if !r.full {
+			id = uuid.ShrinkUUID(id)
+			if e.BaseID != nil {
+				base = uuid.ShrinkUUID(base)
+			}
+		}
+
+		records := "-"
+		size := "<= " + readableSize(e.Bytes)
+		if e.Exact {
+			records = strconv.FormatUint(e.Records, 10)
+			size = readableSize(e.Bytes)
+		} else {
+			exact = false
+		}
+
+		tab = append(tab, []string{id, e.Snapshot.Name, base, records, size})
+		total += e.Bytes
+	}
+
+	bound := ""
+	if !exact {
+		bound = "at most "
+	}
+	summary := fmt.Sprintf("%d snapshot(s) would be %s, %s%s", len(r.estimates), verb, bound, readableSize(total))
+
+	return CmdOutput{Op: []CmdResult{{Tab: tab}, {Str: summary}}}.String()
+}
+
+// JSON translates the transfer estimates to JSON string.
+func (r TransferEstimateResult) JSON() string {
+	estimates := []transferEstimate{}
+	for _, e := range r.estimates {
+		te := transferEstimate{
+			VolumeSetID: e.Snapshot.VolSetID.String(),
+			SnapshotID:  e.Snapshot.ID.String(),
+			Name:        e.Snapshot.Name,
+			Bytes:       e.Bytes,
+			Records:     e.Records,
+			Exact:       e.Exact,
+		}
+		if e.BaseID != nil {
+			te.BaseSnapshotID = e.BaseID.String()
+		}
+		estimates = append(estimates, te)
+	}
+
+	b, _ := json.Marshal(estimates)
+	return string(b[:])
+}
@@ -17,7 +17,9 @@
 package blobdiffer
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
@@ -29,9 +31,16 @@ import (
 	"github.com/ClusterHQ/fli/dl/filediffer/attrcmp"
 	dlhash "github.com/ClusterHQ/fli/dl/hash"
 	"github.com/ClusterHQ/fli/dl/record"
+	"github.com/ClusterHQ/fli/dl/sparse"
 	"github.com/ClusterHQ/fli/errors"
 )
 
+const (
+	// maxOrderedDiffers is the most file differs an ordered differ runs at the same time, each of them holds on to
+	// its records until the records of the files before it are sent
+	maxOrderedDiffers = 8
+)
+
 type (
 	// FileDiffer defines the file differ factory interface
 	FileDiffer interface {
@@ -43,7 +52,10 @@ type (
 		FileDiffer FileDiffer
 		// Limit is the max number of file differs can run at the same time
 		Limit int
-		hf    dlhash.Factory
+		// Digests sends a digest record after the content of each file, receivers verify the files with it.
+		Digests bool
+		hf      dlhash.Factory
+		ordered bool
 	}
 
 	// SafeFactory is a helper for creating a new xattrs-based blob differ factory
@@ -51,7 +63,10 @@ type (
 		FileDiffer FileDiffer
 		// Limit is the max number of file differs can run at the same time
 		Limit int
-		hf    dlhash.Factory
+		// Digests sends a digest record after the content of each file, receivers verify the files with it.
+		Digests bool
+		hf      dlhash.Factory
+		ordered bool
 	}
 
 	differ struct {
@@ -86,6 +101,27 @@ type (
 
 		// cancelCh is the channel for cancellation
 		cancelCh <-chan bool
+
+		// seq keeps records in the order the walk generates them if records have to be generated in the same
+		// order every time, it is nil if records of different files are interleaved
+		seq *sequencer
+
+		// digests means a digest record is sent after the content of each file
+		digests bool
+
+		// attrDiffer diffs the attributes of directories
+		attrDiffer attrDifferFn
+
+		// dirs are the directories whose attributes are diffed after the walk, newDirs indexes the ones made by
+		// the diff
+		dirs    []dirAttrs
+		newDirs map[string]int
+	}
+
+	// dirAttrs is a directory to diff the attributes of, origin is "" for a new directory
+	dirAttrs struct {
+		origin, target string
+		removed        bool
 	}
 
 	xattrDiffer struct {
@@ -95,22 +131,47 @@ type (
 	// FileInfo ...
 	FileInfo interface {
 		io.ReadCloser
+		io.Seeker
 		Size() int64
 		Path() string
+
+		// Holes returns the holes of the file in offset order, file differs skip them
+		Holes() []sparse.Extent
 	}
 
 	fileInfoImpl struct {
-		io.ReadCloser
+		*os.File
 		size  int64
 		fpath string
+		holes []sparse.Extent
+	}
+
+	// digestFile hashes the content of a file as a file differ reads it, the holes it seeks over are hashed as
+	// zeros. broken is set if the file is not read in order, its digest is then read from the file.
+	digestFile struct {
+		FileInfo
+		h      hash.Hash
+		off    int64
+		broken bool
+	}
+
+	// zeros reads zeros
+	zeros struct{}
+
+	// sequencer forwards the records of an ordered differ in the order the walk generates them, while file differs
+	// run at the same time. The walk and each file differ send records to segments of their own, segments are
+	// forwarded one after the other in the order they are made.
+	sequencer struct {
+		segments chan chan record.Record
 	}
 
 	attrDifferFn func(f1 string, f2 string, target string, records chan<- record.Record, hf dlhash.Factory) error
 )
 
 var (
-	_ datalayer.BlobDifferFactory = Factory{}
-	_ delta.DifferenceOperations  = &differ{}
+	_ datalayer.OrderedBlobDifferFactory = Factory{}
+	_ datalayer.OrderedBlobDifferFactory = SafeFactory{}
+	_ delta.DifferenceOperations         = &differ{}
 )
 
 // New creates a new BlobDiffer
@@ -121,7 +182,16 @@ func (f Factory) New(origin, target string, hf dlhash.Factory, exErrCh chan<- er
 		// TODO: Chose a default or make all caller configurable
 		f.Limit = 128
 	}
-	return newDiffer(origin, target, f.FileDiffer, f.Limit, hf, exErrCh, cancelCh, wg)
+	return newDiffer(origin, target, f.FileDiffer, f.Limit, f.ordered, f.Digests, hf, exErrCh, cancelCh, wg)
+}
+
+// Ordered implements datalayer.OrderedBlobDifferFactory
+func (f Factory) Ordered() datalayer.BlobDifferFactory {
+	if f.Limit == 0 || f.Limit > maxOrderedDiffers {
+		f.Limit = maxOrderedDiffers
+	}
+	f.ordered = true
+	return f
 }
 
 // New creates a new BlobDiffer
@@ -132,12 +202,21 @@ func (f SafeFactory) New(origin, target string, hf dlhash.Factory, exErrCh chan<
 		// TODO: Chose a default or make all caller configurable
 		f.Limit = 128
 	}
-	return newSafeDiffer(origin, target, f.FileDiffer, f.Limit, hf, exErrCh, cancelCh, wg)
+	return newSafeDiffer(origin, target, f.FileDiffer, f.Limit, f.ordered, f.Digests, hf, exErrCh, cancelCh, wg)
+}
+
+// Ordered implements datalayer.OrderedBlobDifferFactory
+func (f SafeFactory) Ordered() datalayer.BlobDifferFactory {
+	if f.Limit == 0 || f.Limit > maxOrderedDiffers {
+		f.Limit = maxOrderedDiffers
+	}
+	f.ordered = true
+	return f
 }
 
 // newDiffer starts the delta algorithm in a go routine.
 // records generated by differ are sent to the channel for others to consume
-func newDiffer(origin, target string, fileDiffer FileDiffer, fileDifferLimit int,
+func newDiffer(origin, target string, fileDiffer FileDiffer, fileDifferLimit int, ordered bool, digests bool,
 	hf dlhash.Factory, exErrCh chan<- error, cancelCh <-chan bool, wg *sync.WaitGroup) <-chan record.Record {
 	d := &differ{
 		origin:          origin,
@@ -148,18 +227,26 @@ func newDiffer(origin, target string, fileDiffer FileDiffer, fileDifferLimit int
 		hf:              hf,
 		records:         make(chan record.Record, datalayer.DifferChannelSize),
 		// Enough room for all file differs and the one sync executed differ request
-		errc:     make(chan error, fileDifferLimit+1),
-		exErrCh:  exErrCh,
-		cancelCh: cancelCh,
-		wgExt:    wg,
+		errc:       make(chan error, fileDifferLimit+1),
+		exErrCh:    exErrCh,
+		cancelCh:   cancelCh,
+		wgExt:      wg,
+		digests:    digests,
+		attrDiffer: diffAttrs,
+		newDirs:    make(map[string]int),
+	}
+	records := d.records
+	if ordered {
+		d.seq = newSequencer(records, fileDifferLimit)
+		d.records = d.seq.segment()
 	}
 	go d.run(origin, target)
-	return d.records
+	return records
 }
 
 // newDiffer starts the delta algorithm in a go routine.
 // records generated by differ are sent to the channel for others to consume
-func newSafeDiffer(origin, target string, fileDiffer FileDiffer, fileDifferLimit int,
+func newSafeDiffer(origin, target string, fileDiffer FileDiffer, fileDifferLimit int, ordered bool, digests bool,
 	hf dlhash.Factory, exErrCh chan<- error, cancelCh <-chan bool, wg *sync.WaitGroup) <-chan record.Record {
 	d := &xattrDiffer{differ{
 		origin:          origin,
@@ -173,15 +260,26 @@ func newSafeDiffer(origin, target string, fileDiffer FileDiffer, fileDifferLimit
 		exErrCh:         exErrCh,
 		cancelCh:        cancelCh,
 		wgExt:           wg,
+		digests:         digests,
+		attrDiffer:      diffXattrAttrs,
+		newDirs:         make(map[string]int),
 	}}
+	records := d.records
+	if ordered {
+		d.seq = newSequencer(records, fileDifferLimit)
+		d.records = d.seq.segment()
+	}
 	go d.run(origin, target)
-	return d.records
+	return records
 }
 
 // start starts the differ process.
 func (d *differ) run(origin, target string) {
 	defer d.wgExt.Done()
 	err := delta.Alloc(origin, target, d, false).DoParsing()
+	if err == nil && !d.Stop() {
+		err = d.diffDirs()
+	}
 
 	// Wait for all file differs to finish
 	d.wgInt.Wait()
@@ -191,6 +289,9 @@ func (d *differ) run(origin, target string) {
 
 	// All done, closing
 	close(d.records)
+	if d.seq != nil {
+		d.seq.close()
+	}
 
 	select {
 	case errDiffer := <-d.errc:
@@ -217,7 +318,7 @@ func (d differ) GetTargetPath() string {
 // setmtime record is generated at the end of all pwrites to reflect the correct file mtime on the receiving side.
 // origin and target are relative paths to differ's origin and target respectively
 // If origin is "", it implies that it is diffing against a blank file(generate pwrites for a new file)
-func (d differ) diffFile(origin, target string) {
+func (d *differ) diffFile(origin, target string) {
 	// If there are too many differs running already, wait; otherwise, start the back ground job
 	d.fileDifferQueue <- struct{}{}
 
@@ -228,8 +329,56 @@ func (d differ) diffFile(origin, target string) {
 	p2 := filepath.Join(d.target, target)
 
 	d.wgInt.Add(1)
-	go diffFile(p1, p2, target, d.records, d.wgInt, d.fileDiffer, diffAttrs, d.fileDifferQueue, d.errc, d.hf)
-	return
+	records := d.fileRecords()
+	go func() {
+		diffFile(p1, p2, target, records, d.wgInt, d.fileDiffer, d.attrDiffer, d.fileDifferQueue, d.errc, d.hf,
+			d.digests)
+		if d.seq != nil {
+			close(records)
+		}
+	}()
+}
+
+// fileRecords returns the channel a file differ sends its records to. If records are ordered, the file differ gets a
+// segment of its own and the walk continues with a new segment after it. Otherwise records of different files are
+// interleaved.
+func (d *differ) fileRecords() chan record.Record {
+	if d.seq == nil {
+		return d.records
+	}
+
+	walk := d.records
+	records := d.seq.segment()
+	d.records = d.seq.segment()
+	close(walk)
+	return records
+}
+
+// newSequencer starts forwarding segments to the records channel, it is closed after the last segment
+func newSequencer(records chan<- record.Record, limit int) *sequencer {
+	// A walk segment and a file segment for each running file differ and the walk's current segment
+	seq := &sequencer{segments: make(chan chan record.Record, 2*limit+1)}
+	go func() {
+		for seg := range seq.segments {
+			for r := range seg {
+				records <- r
+			}
+		}
+		close(records)
+	}()
+	return seq
+}
+
+// segment returns a new segment, its records are forwarded after the records of the segments made before it
+func (seq *sequencer) segment() chan record.Record {
+	seg := make(chan record.Record, datalayer.DifferChannelSize)
+	seq.segments <- seg
+	return seg
+}
+
+// close ends the sequence, the records channel is closed once all segments are forwarded
+func (seq *sequencer) close() {
+	close(seq.segments)
 }
 
 func diffAttrs(f1 string, f2 string, target string, reords chan<- record.Record, hf dlhash.Factory) error {
@@ -243,9 +392,10 @@ func diffAttrs(f1 string, f2 string, target string, reords chan<- record.Record,
 }
 
 // diffFile opens the base and target, generate diff between them, send over to remote.
+// If digests is true, the content is verified with a digest record, the digest is computed as the content is diffed.
 func diffFile(srcBaseFullPath string, srcTargetFullPath string, remoteTarget string, records chan<- record.Record,
 	wg *sync.WaitGroup, fileDiffer FileDiffer, attrDiffer attrDifferFn, fileDifferQueue chan struct{},
-	errc chan<- error, hf dlhash.Factory) error {
+	errc chan<- error, hf dlhash.Factory, digests bool) error {
 	defer wg.Done()
 	defer func() { <-fileDifferQueue }()
 
@@ -263,7 +413,7 @@ func diffFile(srcBaseFullPath string, srcTargetFullPath string, remoteTarget str
 		}
 		defer f1.Close()
 	} else {
-		f1 = fileInfoImpl{nil, 0, ""}
+		f1 = fileInfoImpl{}
 	}
 
 	f2, err = open(srcTargetFullPath)
@@ -273,19 +423,48 @@ func diffFile(srcBaseFullPath string, srcTargetFullPath string, remoteTarget str
 	}
 	defer f2.Close()
 
-	// Truncate if the new file is smaller the the old one
-	if f2.Size() < f1.Size() {
-		err = record.Send(record.NewTruncate(srcTargetFullPath, f2.Size()), records, hf)
+	// Files with the same content are diffed too, file differs send no data for them and the holes may differ
+	var df *digestFile
+	if digests {
+		df = &digestFile{FileInfo: f2, h: sha256.New()}
+		err = fileDiffer.DiffContents(f1, df, remoteTarget, records, hf)
+	} else {
+		err = fileDiffer.DiffContents(f1, f2, remoteTarget, records, hf)
+	}
+	if err != nil {
+		errc <- err
+		return err
+	}
+
+	// Holes are punched after the contents because file differs may copy data from them
+	err = punchHoles(f1, f2, remoteTarget, records, hf)
+	if err != nil {
+		errc <- err
+		return err
+	}
+
+	// Truncate if the new file is smaller the the old one, it is done after the contents because file differs may
+	// copy data from beyond the new size. A file which grows and ends in a hole is extended, no pwrite reaches its end.
+	holes := f2.Holes()
+	if f2.Size() < f1.Size() ||
+		(f2.Size() > f1.Size() && len(holes) > 0 && holes[len(holes)-1].End() == f2.Size()) {
+		err = record.Send(record.NewTruncate(remoteTarget, f2.Size()), records, hf)
 		if err != nil {
 			errc <- err
 			return err
 		}
 	}
 
-	err = fileDiffer.DiffContents(f1, f2, remoteTarget, records, hf)
-	if err != nil {
-		errc <- err
-		return err
+	if digests {
+		var sum []byte
+		sum, err = df.sum()
+		if err == nil {
+			err = record.Send(record.NewDigest(remoteTarget, sum), records, hf)
+		}
+		if err != nil {
+			errc <- err
+			return err
+		}
 	}
 
 	err = attrDiffer(f1.Path(), f2.Path(), remoteTarget, records, hf)
@@ -296,13 +475,13 @@ func diffFile(srcBaseFullPath string, srcTargetFullPath string, remoteTarget str
 	return nil
 }
 
-func (d differ) diffNewFile(target string) {
+func (d *differ) diffNewFile(target string) {
 	d.diffFile("", target)
 }
 
 // ResolveDiff implements DifferenceOperations
 func (d *differ) ResolveDiff(origin string, target string) error {
-	// Note: origin and target are always the same as of the current delta code
+	// Note: origin and target differ for renamed files
 	f1 := filepath.Join(d.origin, origin)
 	info, err := os.Lstat(f1)
 	if err != nil {
@@ -310,7 +489,7 @@ func (d *differ) ResolveDiff(origin string, target string) error {
 	}
 
 	if info.IsDir() {
-		// TODO: handle it, ignoring for now
+		d.addDir(origin, target)
 		return nil
 	}
 
@@ -351,12 +530,53 @@ func (d *differ) Unlink(path string) error {
 
 // Rmdir implements DifferenceOperations
 func (d *differ) Rmdir(path string) error {
+	// A directory made and removed by the diff, like the one renames are staged in, has no attributes to send
+	if i, ok := d.newDirs[path]; ok {
+		d.dirs[i].removed = true
+		delete(d.newDirs, path)
+	}
+
 	return record.Send(record.NewRemove(path), d.records, d.hf)
 }
 
 // Mkdir implements DifferenceOperations
 func (d *differ) Mkdir(path string) error {
-	return record.Send(record.NewMkdir(path, record.DefaultCreateMode), d.records, d.hf)
+	err := record.Send(record.NewMkdir(path, record.DefaultCreateMode), d.records, d.hf)
+	if err != nil {
+		return err
+	}
+
+	d.newDirs[path] = len(d.dirs)
+	d.addDir("", path)
+	return nil
+}
+
+// addDir queues a directory for attribute diffing, origin is "" for a new directory
+func (d *differ) addDir(origin, target string) {
+	d.dirs = append(d.dirs, dirAttrs{origin: origin, target: target})
+}
+
+// diffDirs diffs the attributes of the queued directories, children before parents. It runs after the walk so
+// directory mtimes are set after all of their entries are made, removed or renamed.
+func (d *differ) diffDirs() error {
+	for i := len(d.dirs) - 1; i >= 0; i-- {
+		dir := d.dirs[i]
+		if dir.removed {
+			continue
+		}
+
+		f1 := ""
+		if dir.origin != "" {
+			f1 = filepath.Join(d.origin, dir.origin)
+		}
+
+		err := d.attrDiffer(f1, filepath.Join(d.target, dir.target), dir.target, d.records, d.hf)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // Mknod implements DifferenceOperations
@@ -374,6 +594,11 @@ func (d *differ) Mknod(path string) error {
 	return record.Send(record.NewMknod(path, s.Mode, int(s.Rdev)), d.records, d.hf)
 }
 
+// Rename implements DifferenceOperations
+func (d *differ) Rename(src string, dst string) error {
+	return record.Send(record.NewRename(src, dst), d.records, d.hf)
+}
+
 // Stop implements DifferenceOperations
 func (d *differ) Stop() bool {
 	return len(d.errc) != 0 || len(d.cancelCh) != 0
@@ -389,7 +614,101 @@ func open(path string) (FileInfo, error) {
 	if err != nil {
 		return fileInfoImpl{}, fmt.Errorf("Failed to open %s", path)
 	}
-	return fileInfoImpl{ReadCloser: fd, size: info.Size(), fpath: path}, nil
+
+	holes, err := sparse.Holes(fd, info.Size())
+	if err == nil {
+		_, err = fd.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		fd.Close()
+		return fileInfoImpl{}, fmt.Errorf("Failed to find the holes of %s: %v", path, err)
+	}
+
+	return fileInfoImpl{File: fd, size: info.Size(), fpath: path, holes: holes}, nil
+}
+
+// punchHoles sends punch holes for the holes of the new file where the old file has data
+func punchHoles(f1, f2 FileInfo, target string, records chan<- record.Record, hf dlhash.Factory) error {
+	var holes []sparse.Extent
+	for _, h := range f2.Holes() {
+		if h.Offset >= f1.Size() {
+			break
+		}
+		if h.End() > f1.Size() {
+			h.Length = f1.Size() - h.Offset
+		}
+		holes = append(holes, h)
+	}
+
+	for _, h := range sparse.Subtract(holes, f1.Holes()) {
+		err := record.Send(record.NewPunchHole(target, uint64(h.Offset), uint64(h.Length)), records, hf)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// digest returns the digest of the file's content, the file is read from the start and the offset is reset
+func digest(f FileInfo) ([]byte, error) {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	sum, err := record.FileDigest(f)
+	if err != nil {
+		return nil, errors.Errorf("Failed to read %s: %v", f.Path(), err)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	return sum, err
+}
+
+// Read hashes the data read from the file
+func (f *digestFile) Read(p []byte) (int, error) {
+	n, err := f.FileInfo.Read(p)
+	if n > 0 && !f.broken {
+		f.h.Write(p[:n])
+		f.off += int64(n)
+	}
+	return n, err
+}
+
+// Seek hashes zeros for a hole sought over, the digest is broken by any other seek
+func (f *digestFile) Seek(offset int64, whence int) (int64, error) {
+	off, err := f.FileInfo.Seek(offset, whence)
+	if err != nil || f.broken || off == f.off {
+		return off, err
+	}
+
+	skipped := []sparse.Extent{{Offset: f.off, Length: off - f.off}}
+	if off < f.off || off > f.Size() || len(sparse.Subtract(skipped, f.Holes())) != 0 {
+		f.broken = true
+		return off, nil
+	}
+
+	_, err = io.CopyN(f.h, zeros{}, off-f.off)
+	f.off = off
+	return off, err
+}
+
+// sum returns the digest of the file's content, it is read from the file if the file differ didn't read all of it
+// in order
+func (f *digestFile) sum() ([]byte, error) {
+	if !f.broken && f.off == f.Size() {
+		return f.h.Sum(nil), nil
+	}
+	return digest(f.FileInfo)
+}
+
+// Read implements io.Reader
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
 }
 
 func (fi fileInfoImpl) Size() int64 {
@@ -400,6 +719,10 @@ func (fi fileInfoImpl) Path() string {
 	return fi.fpath
 }
 
+func (fi fileInfoImpl) Holes() []sparse.Extent {
+	return fi.holes
+}
+
 // Mknod implements DifferenceOperations
 func (d *xattrDiffer) Mknod(path string) error {
 	fullpath := filepath.Join(d.GetTargetPath(), path)
@@ -417,7 +740,7 @@ func (d *xattrDiffer) Mknod(path string) error {
 
 // ResolveDiff implements DifferenceOperations
 func (d *xattrDiffer) ResolveDiff(origin string, target string) error {
-	// Note: origin and target are always the same as of the current delta code
+	// Note: origin and target differ for renamed files
 	f1 := filepath.Join(d.origin, origin)
 	info, err := os.Lstat(f1)
 	if err != nil {
@@ -425,7 +748,7 @@ func (d *xattrDiffer) ResolveDiff(origin string, target string) error {
 	}
 
 	if info.IsDir() {
-		// TODO: handle it, ignoring for now
+		d.addDir(origin, target)
 		return nil
 	}
 
@@ -442,18 +765,8 @@ func (d *xattrDiffer) Create(path string) error {
 	return d.diffFile("", path)
 }
 
-func (d xattrDiffer) diffFile(origin, target string) error {
-	// If there are too many differs running already, wait; otherwise, start the back ground job
-	d.fileDifferQueue <- struct{}{}
-
-	p1 := ""
-	if origin != "" {
-		p1 = filepath.Join(d.origin, origin)
-	}
-	p2 := filepath.Join(d.target, target)
-
-	d.wgInt.Add(1)
-	go diffFile(p1, p2, target, d.records, d.wgInt, d.fileDiffer, diffXattrAttrs, d.fileDifferQueue, d.errc, d.hf)
+func (d *xattrDiffer) diffFile(origin, target string) error {
+	d.differ.diffFile(origin, target)
 	return nil
 }
 
@@ -0,0 +1,393 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package btrfs
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/meta/blob"
+	snapPkg "github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volume"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+	"github.com/ClusterHQ/fli/securefilepath"
+	uuidPkg "github.com/pborman/uuid"
+)
+
+// Btrfs storage implementation
+// The storage is a directory on a mounted btrfs file system, quotas are enabled on the file system to account space.
+//
+// Volume set is a directory:
+// root/uuid(of volume set)
+//
+// The empty blob of a volume set is an empty read-only subvolume, its subvolume ID names the level 1 qgroup all
+// subvolumes of the volume set are added to:
+// btrfs subvolume create root/uuid(of volume set)/empty
+// btrfs qgroup create 1/id(of empty) root
+//
+// Volume is a writable snapshot of a blob:
+// btrfs subvolume snapshot -i 1/id root/blob root/uuid_of_volume_set/volumes/uuid_of_volume
+//
+// Snapshot is a read-only snapshot of a volume, its blob id is the path relative to root:
+// btrfs subvolume snapshot -r -i 1/id root/uuid_of_volume_set/volumes/uuid_of_volume
+//     root/uuid_of_volume_set/snapshots/uuid_of_snapshot
+//
+// Btrfs has no equivalent of ZFS's written property, the space exclusive to a volume right before it is snapshotted
+// is what was written since its previous snapshot. It is kept next to the snapshots:
+// root/uuid_of_volume_set/written/uuid_of_snapshot
+
+const (
+	// emptySnapshot is the name of a volume set's empty blob
+	emptySnapshot = "empty"
+
+	snapshotsDir = "snapshots"
+	volumesDir   = "volumes"
+	writtenDir   = "written"
+)
+
+type (
+	// Btrfs is the btrfs implementation of the datalayer.Storage interface
+	Btrfs struct {
+		root       string
+		blobDiffer datalayer.BlobDifferFactory
+	}
+)
+
+var (
+	_ datalayer.Storage = Btrfs{}
+)
+
+// New returns a btrfs storage which keeps volume sets under the given directory of a mounted btrfs file system.
+// Quotas are enabled on the file system if they are not yet.
+func New(root string, blobDiffer datalayer.BlobDifferFactory) (Btrfs, error) {
+	b := Btrfs{root: filepath.Clean(root), blobDiffer: blobDiffer}
+	if err := b.Validate(); err != nil {
+		return b, err
+	}
+
+	if err := enableQuota(b.root); err != nil {
+		return b, err
+	}
+
+	return b, nil
+}
+
+// Version implements datalayer.Storage interface
+func (b Btrfs) Version() string {
+	return version()
+}
+
+// BlobDiffer implements datalayer.Storage interface
+func (b Btrfs) BlobDiffer() datalayer.BlobDifferFactory {
+	return b.blobDiffer
+}
+
+// EmptyBlobID implements datalayer.Storage interface
+func (b Btrfs) EmptyBlobID(vsid volumeset.ID) (blob.ID, error) {
+	base := filepath.Join(vsid.String(), emptySnapshot)
+	path := b.path(base)
+	if !exists(path) {
+		// Volume set's base has not been established, create it
+		for _, dir := range []string{snapshotsDir, volumesDir, writtenDir} {
+			err := os.MkdirAll(b.path(vsid.String(), dir), 0700)
+			if err != nil {
+				return blob.NilID(), errors.New(err)
+			}
+		}
+
+		err := createSubvolume(path)
+		if err != nil {
+			return blob.NilID(), err
+		}
+
+		id, err := rootID(path)
+		if err != nil {
+			return blob.NilID(), err
+		}
+
+		qgroup := "1/" + strconv.FormatUint(id, 10)
+		err = createQgroup(qgroup, b.root)
+		if err != nil {
+			return blob.NilID(), err
+		}
+
+		err = assignQgroup("0/"+strconv.FormatUint(id, 10), qgroup, b.root)
+		if err != nil {
+			return blob.NilID(), err
+		}
+
+		err = setReadOnly(path)
+		if err != nil {
+			return blob.NilID(), err
+		}
+
+		log.Printf("Empty base created for %v", path)
+	}
+
+	return blob.NewID(base), nil
+}
+
+// CreateVolume implements datalayer.Storage interface, volumes are always accessible so the mount type is ignored
+func (b Btrfs) CreateVolume(
+	vsid volumeset.ID,
+	bid blob.ID,
+	_ datalayer.MountType,
+) (volume.ID, securefilepath.SecureFilePath, error) {
+	qgroup, err := b.qgroup(vsid)
+	if err != nil {
+		return volume.NilID(), nil, err
+	}
+
+	vid := volume.NewID(uuidPkg.New())
+	path := b.volumePath(vsid, vid)
+	err = snapshot(b.path(bid.String()), path, false, qgroup)
+	if err != nil {
+		return volume.NilID(), nil, err
+	}
+
+	mntPath, err := securefilepath.New(path)
+	if err != nil {
+		return volume.NilID(), nil, errors.New(err)
+	}
+
+	return vid, mntPath, nil
+}
+
+// CreateSnapshot implements datalayer.Storage interface
+func (b Btrfs) CreateSnapshot(vsid volumeset.ID, ssid snapPkg.ID, vid volume.ID) (blob.ID, error) {
+	qgroup, err := b.qgroup(vsid)
+	if err != nil {
+		return blob.NilID(), err
+	}
+
+	volPath := b.volumePath(vsid, vid)
+	id, err := rootID(volPath)
+	if err != nil {
+		return blob.NilID(), err
+	}
+
+	err = syncFS(b.root)
+	if err != nil {
+		return blob.NilID(), err
+	}
+
+	_, written, err := qgroupUsage(b.root, "0/"+strconv.FormatUint(id, 10))
+	if err != nil {
+		return blob.NilID(), err
+	}
+
+	err = ioutil.WriteFile(b.path(vsid.String(), writtenDir, ssid.String()),
+		[]byte(strconv.FormatUint(written, 10)), 0600)
+	if err != nil {
+		return blob.NilID(), errors.New(err)
+	}
+
+	base := filepath.Join(vsid.String(), snapshotsDir, ssid.String())
+	err = snapshot(volPath, b.path(base), true, qgroup)
+	if err != nil {
+		return blob.NilID(), err
+	}
+
+	return blob.NewID(base), nil
+}
+
+// DestroyVolume implements datalayer.Storage interface
+func (b Btrfs) DestroyVolume(vsid volumeset.ID, vid volume.ID) error {
+	return deleteSubvolume(b.volumePath(vsid, vid))
+}
+
+// DestroySnapshot implements datalayer.Storage interface
+func (b Btrfs) DestroySnapshot(bid blob.ID) error {
+	err := deleteSubvolume(b.path(bid.String()))
+	if err != nil {
+		return err
+	}
+
+	os.Remove(b.writtenPath(bid))
+	return nil
+}
+
+// DestroyVolumeSet implements datalayer.Storage interface
+func (b Btrfs) DestroyVolumeSet(vsid volumeset.ID) error {
+	empty := b.path(vsid.String(), emptySnapshot)
+	if !exists(empty) {
+		return nil
+	}
+
+	qgroup, err := b.qgroup(vsid)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range []string{volumesDir, snapshotsDir} {
+		names, err := ioutil.ReadDir(b.path(vsid.String(), dir))
+		if err != nil {
+			return errors.New(err)
+		}
+
+		for _, n := range names {
+			err = deleteSubvolume(b.path(vsid.String(), dir, n.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = deleteSubvolume(empty)
+	if err != nil {
+		return err
+	}
+
+	// Qgroups of deleted subvolumes may still be members until the cleaner removes them, the volume set's qgroup
+	// is left behind then
+	err = destroyQgroup(qgroup, b.root)
+	if err != nil {
+		log.Printf("Failed to destroy qgroup %s of volume set %v: %v", qgroup, vsid, err)
+	}
+
+	err = os.RemoveAll(b.path(vsid.String()))
+	if err != nil {
+		return errors.New(err)
+	}
+
+	return nil
+}
+
+// SnapshotExists implements datalayer.Storage interface
+func (b Btrfs) SnapshotExists(bid blob.ID) (bool, error) {
+	return exists(b.path(bid.String())), nil
+}
+
+// MountBlob implements datalayer.Storage interface, snapshots are read-only subvolumes which are always accessible
+func (b Btrfs) MountBlob(bid blob.ID) (string, error) {
+	return b.path(bid.String()), nil
+}
+
+// Unmount implements datalayer.Storage interface
+func (b Btrfs) Unmount(path string) error {
+	return nil
+}
+
+// GetSnapshotSpace implements datalayer.Storage interface, the logical size is the space referenced by the
+// snapshot's qgroup.
+func (b Btrfs) GetSnapshotSpace(bid blob.ID) (datalayer.SnapshotSpace, error) {
+	path := b.path(bid.String())
+	id, err := rootID(path)
+	if err != nil {
+		return datalayer.SnapshotSpace{}, err
+	}
+
+	err = syncFS(b.root)
+	if err != nil {
+		return datalayer.SnapshotSpace{}, err
+	}
+
+	referenced, _, err := qgroupUsage(b.root, "0/"+strconv.FormatUint(id, 10))
+	if err != nil {
+		return datalayer.SnapshotSpace{}, err
+	}
+
+	// Empty blobs and snapshots without a record of what was written have no delta
+	var written uint64
+	data, err := ioutil.ReadFile(b.writtenPath(bid))
+	if err == nil {
+		written, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return datalayer.SnapshotSpace{}, errors.New(err)
+		}
+	}
+
+	return datalayer.SnapshotSpace{LogicalSize: referenced, DeltaFromPrevious: written}, nil
+}
+
+// GetTotalSpace implements datalayer.Storage interface
+func (b Btrfs) GetTotalSpace() (datalayer.DiskSpace, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(b.root, &st)
+	if err != nil {
+		return datalayer.DiskSpace{}, errors.New(err)
+	}
+
+	return datalayer.DiskSpace{
+		Used:      (st.Blocks - st.Bfree) * uint64(st.Bsize),
+		Available: st.Bavail * uint64(st.Bsize),
+	}, nil
+}
+
+// GetVolumesetSpace implements datalayer.Storage interface, the used space is the space referenced by the volume
+// set's qgroup.
+func (b Btrfs) GetVolumesetSpace(vsid volumeset.ID) (datalayer.DiskSpace, error) {
+	total, err := b.GetTotalSpace()
+	if err != nil {
+		return datalayer.DiskSpace{}, err
+	}
+
+	qgroup, err := b.qgroup(vsid)
+	if err != nil {
+		return datalayer.DiskSpace{}, err
+	}
+
+	err = syncFS(b.root)
+	if err != nil {
+		return datalayer.DiskSpace{}, err
+	}
+
+	used, _, err := qgroupUsage(b.root, qgroup)
+	if err != nil {
+		return datalayer.DiskSpace{}, err
+	}
+
+	return datalayer.DiskSpace{Used: used, Available: total.Available}, nil
+}
+
+// Validate checks the btrfs utilities are installed and the storage's root is on a btrfs file system
+func (b Btrfs) Validate() error {
+	return validate(b.root)
+}
+
+// path returns the absolute path of a path relative to the storage's root
+func (b Btrfs) path(elem ...string) string {
+	return filepath.Join(append([]string{b.root}, elem...)...)
+}
+
+// volumePath returns the path of a volume's subvolume
+func (b Btrfs) volumePath(vsid volumeset.ID, vid volume.ID) string {
+	return b.path(vsid.String(), volumesDir, vid.String())
+}
+
+// writtenPath returns the path of the file which keeps how much was written before the snapshot was taken
+func (b Btrfs) writtenPath(bid blob.ID) string {
+	vsid := strings.SplitN(bid.String(), "/", 2)[0]
+	return b.path(vsid, writtenDir, filepath.Base(bid.String()))
+}
+
+// qgroup returns the level 1 qgroup of a volume set, it is named after the subvolume ID of the empty blob
+func (b Btrfs) qgroup(vsid volumeset.ID) (string, error) {
+	id, err := rootID(b.path(vsid.String(), emptySnapshot))
+	if err != nil {
+		return "", err
+	}
+
+	return "1/" + strconv.FormatUint(id, 10), nil
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package btrfs
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ClusterHQ/fli/errors"
+)
+
+// Btrfs backend shell command interface implementation
+
+const (
+	// btrfsSuperMagic is the f_type statfs returns for btrfs file systems
+	btrfsSuperMagic = 0x9123683E
+)
+
+// run executes one btrfs call using the given arguments synchronously and returns the output of the exec call and
+// error if any
+func run(args ...string) (string, error) {
+	o, err := exec.Command("btrfs", args...).Output()
+	if err == nil {
+		return string(o), nil
+	}
+	if e, ok := err.(*exec.ExitError); ok {
+		return string(e.Stderr), err
+	}
+	return string(o), errors.New(err)
+}
+
+// runErr executes one btrfs call and returns an error with its output if it fails
+func runErr(args ...string) error {
+	o, err := run(args...)
+	if err != nil {
+		return errors.Errorf("btrfs %s failed: %s %v", strings.Join(args, " "), strings.TrimSpace(o), err)
+	}
+	return nil
+}
+
+func version() string {
+	o, err := run("--version")
+	if err != nil {
+		return ""
+	}
+
+	// btrfs-progs v4.4
+	return strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(o), "btrfs-progs"))
+}
+
+// exists returns true if the path exists
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func createSubvolume(path string) error {
+	return runErr("subvolume", "create", path)
+}
+
+func deleteSubvolume(path string) error {
+	return runErr("subvolume", "delete", path)
+}
+
+// snapshot creates a snapshot of the source subvolume which is added to the qgroup
+func snapshot(src, dst string, readOnly bool, qgroup string) error {
+	args := []string{"subvolume", "snapshot"}
+	if readOnly {
+		args = append(args, "-r")
+	}
+	args = append(args, "-i", qgroup, src, dst)
+	return runErr(args...)
+}
+
+func setReadOnly(path string) error {
+	return runErr("property", "set", "-ts", path, "ro", "true")
+}
+
+// rootID returns the subvolume ID of the subvolume at the path
+func rootID(path string) (uint64, error) {
+	o, err := run("inspect-internal", "rootid", path)
+	if err != nil {
+		return 0, errors.Errorf("%#v %#v", o, err)
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSpace(o), 10, 64)
+	if err != nil {
+		return 0, errors.New(err)
+	}
+
+	return id, nil
+}
+
+func enableQuota(root string) error {
+	return runErr("quota", "enable", root)
+}
+
+func createQgroup(qgroup, root string) error {
+	return runErr("qgroup", "create", qgroup, root)
+}
+
+func destroyQgroup(qgroup, root string) error {
+	return runErr("qgroup", "destroy", qgroup, root)
+}
+
+func assignQgroup(src, dst, root string) error {
+	return runErr("qgroup", "assign", src, dst, root)
+}
+
+// syncFS commits the file system's transaction so qgroups account for everything written
+func syncFS(root string) error {
+	return runErr("filesystem", "sync", root)
+}
+
+// qgroupUsage returns the referenced and exclusive bytes of the qgroup
+func qgroupUsage(root, qgroup string) (uint64, uint64, error) {
+	o, err := run("qgroup", "show", "--raw", root)
+	if err != nil {
+		return 0, 0, errors.Errorf("%#v %#v", o, err)
+	}
+
+	// qgroupid         rfer         excl
+	// --------         ----         ----
+	// 0/5             16384        16384
+	for _, line := range strings.Split(o, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != qgroup {
+			continue
+		}
+
+		var excl uint64
+		rfer, err := strconv.ParseUint(fields[1], 10, 64)
+		if err == nil {
+			excl, err = strconv.ParseUint(fields[2], 10, 64)
+		}
+		if err != nil {
+			return 0, 0, errors.New(err)
+		}
+
+		return rfer, excl, nil
+	}
+
+	return 0, 0, errors.Errorf("Qgroup %s not found", qgroup)
+}
+
+func validate(root string) error {
+	_, err := exec.LookPath("btrfs")
+	if err != nil {
+		return &ErrBtrfsUtilsNotFound{}
+	}
+
+	var st syscall.Statfs_t
+	err = syscall.Statfs(root, &st)
+	if err != nil || st.Type != btrfsSuperMagic {
+		return &ErrNotBtrfs{Path: root}
+	}
+
+	return nil
+}
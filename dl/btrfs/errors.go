@@ -0,0 +1,40 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package btrfs
+
+type (
+	// ErrBtrfsUtilsNotFound ...
+	ErrBtrfsUtilsNotFound struct{}
+
+	// ErrNotBtrfs ...
+	ErrNotBtrfs struct {
+		Path string
+	}
+)
+
+var (
+	_ error = &ErrBtrfsUtilsNotFound{}
+	_ error = &ErrNotBtrfs{}
+)
+
+func (e ErrBtrfsUtilsNotFound) Error() string {
+	return "Btrfs utils not found"
+}
+
+func (e ErrNotBtrfs) Error() string {
+	return e.Path + " is not a mounted btrfs file system"
+}
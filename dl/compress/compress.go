@@ -0,0 +1,191 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compress
+
+import (
+	"io"
+
+	"github.com/ClusterHQ/fli/dl/encdec"
+	"github.com/ClusterHQ/fli/dl/record"
+	"github.com/ClusterHQ/fli/errors"
+)
+
+type (
+	// Type defines the kind of compression
+	Type int
+
+	// Factory defines the stream compressor factory interface
+	Factory interface {
+		// NewWriter returns a writer which compresses to the target, the writer must be closed to flush the
+		// end of the compressed stream.
+		NewWriter(io.Writer) (io.WriteCloser, error)
+
+		// NewReader returns a reader which decompresses from the source
+		NewReader(io.Reader) (io.ReadCloser, error)
+
+		Type() Type
+	}
+
+	// Compressed is implemented by enc/dec factories which compress the encoded records
+	Compressed interface {
+		encdec.Factory
+		Compression() Type
+	}
+
+	factory struct {
+		ed encdec.Factory
+		c  Factory
+	}
+
+	encoder struct {
+		w   io.WriteCloser
+		e   encdec.Encoder
+		err error
+	}
+
+	decoder struct {
+		c   Factory
+		src io.Reader
+		ed  encdec.Factory
+		r   io.ReadCloser
+		d   encdec.Decoder
+	}
+)
+
+const (
+	// None type for no compression
+	None Type = iota
+
+	// Gzip type for gzip compression
+	Gzip
+
+	// Zstd type for Zstandard compression
+	Zstd
+
+	// S2 type for S2 compression, an extension of Snappy
+	S2
+)
+
+var (
+	_ Compressed     = &factory{}
+	_ encdec.Encoder = &encoder{}
+	_ encdec.Decoder = &decoder{}
+	_ io.Closer      = &encoder{}
+	_ io.Closer      = &decoder{}
+
+	names = map[Type]string{
+		None: "none",
+		Gzip: "gzip",
+		Zstd: "zstd",
+		S2:   "s2",
+	}
+)
+
+// String returns the compression's name
+func (t Type) String() string {
+	name, ok := names[t]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+// ParseType returns the compression type with the given name, an empty name is no compression.
+func ParseType(name string) (Type, error) {
+	if name == "" {
+		return None, nil
+	}
+
+	for t, n := range names {
+		if n == name {
+			return t, nil
+		}
+	}
+
+	return None, errors.Errorf("Unknown compression %s, supported compressions are none, gzip, zstd and s2", name)
+}
+
+// Wrap returns an enc/dec factory which compresses the records encoded by the given factory. Encoders and decoders
+// of the returned factory implement io.Closer, they must be closed once the last record is encoded or decoded.
+// No wrapping is done for no compression.
+func Wrap(ed encdec.Factory, c Factory) encdec.Factory {
+	if c.Type() == None {
+		return ed
+	}
+	return &factory{ed: ed, c: c}
+}
+
+// NewEncoder returns a new encoder
+func (f *factory) NewEncoder(target io.Writer) encdec.Encoder {
+	w, err := f.c.NewWriter(target)
+	if err != nil {
+		return &encoder{err: err}
+	}
+	return &encoder{w: w, e: f.ed.NewEncoder(w)}
+}
+
+// NewDecoder returns a new decoder, the compressed stream is opened by the first Decode()
+func (f *factory) NewDecoder(src io.Reader) encdec.Decoder {
+	return &decoder{c: f.c, src: src, ed: f.ed}
+}
+
+// Type returns the type of the wrapped encoder/decoder
+func (f *factory) Type() encdec.Type {
+	return f.ed.Type()
+}
+
+// Compression returns the compression type
+func (f *factory) Compression() Type {
+	return f.c.Type()
+}
+
+// Encode implements encoder
+func (e *encoder) Encode(recs []record.Record) error {
+	if e.err != nil {
+		return e.err
+	}
+	return e.e.Encode(recs)
+}
+
+// Close flushes the end of the compressed stream
+func (e *encoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Close()
+}
+
+// Decode implements decoder
+func (d *decoder) Decode() ([]record.Record, error) {
+	if d.d == nil {
+		r, err := d.c.NewReader(d.src)
+		if err != nil {
+			return nil, err
+		}
+		d.r = r
+		d.d = d.ed.NewDecoder(r)
+	}
+	return d.d.Decode()
+}
+
+// Close releases the decompressor
+func (d *decoder) Close() error {
+	if d.r == nil {
+		return nil
+	}
+	return d.r.Close()
+}
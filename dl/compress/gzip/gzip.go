@@ -0,0 +1,55 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gzip
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/ClusterHQ/fli/dl/compress"
+)
+
+type (
+	// Factory is a helper for creating gzip compressed streams
+	Factory struct {
+		// Level is the gzip compression level, gzip.DefaultCompression is used if it is 0
+		Level int
+	}
+)
+
+var (
+	_ compress.Factory = Factory{}
+)
+
+// NewWriter returns a gzip writer
+func (f Factory) NewWriter(target io.Writer) (io.WriteCloser, error) {
+	level := f.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(target, level)
+}
+
+// NewReader returns a gzip reader
+func (f Factory) NewReader(src io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(src)
+}
+
+// Type returns the compression's type
+func (f Factory) Type() compress.Type {
+	return compress.Gzip
+}
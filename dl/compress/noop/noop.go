@@ -0,0 +1,58 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package noop
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/ClusterHQ/fli/dl/compress"
+)
+
+type (
+	// Factory is a helper for creating streams which are not compressed
+	Factory struct {
+	}
+
+	nopWriteCloser struct {
+		io.Writer
+	}
+)
+
+var (
+	_ compress.Factory = Factory{}
+)
+
+// NewWriter returns the target as is
+func (f Factory) NewWriter(target io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{target}, nil
+}
+
+// NewReader returns the source as is
+func (f Factory) NewReader(src io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(src), nil
+}
+
+// Type returns the compression's type
+func (f Factory) Type() compress.Type {
+	return compress.None
+}
+
+// Close implements io.Closer
+func (w nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package s2
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/ClusterHQ/fli/dl/compress"
+	"github.com/klauspost/compress/s2"
+)
+
+type (
+	// Factory is a helper for creating S2 compressed streams, S2 trades compression ratio for speed
+	Factory struct {
+	}
+)
+
+var (
+	_ compress.Factory = Factory{}
+)
+
+// NewWriter returns a S2 writer
+func (f Factory) NewWriter(target io.Writer) (io.WriteCloser, error) {
+	return s2.NewWriter(target), nil
+}
+
+// NewReader returns a S2 reader
+func (f Factory) NewReader(src io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(s2.NewReader(src)), nil
+}
+
+// Type returns the compression's type
+func (f Factory) Type() compress.Type {
+	return compress.S2
+}
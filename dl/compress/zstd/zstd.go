@@ -0,0 +1,64 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package zstd
+
+import (
+	"io"
+
+	"github.com/ClusterHQ/fli/dl/compress"
+	"github.com/klauspost/compress/zstd"
+)
+
+type (
+	// Factory is a helper for creating Zstandard compressed streams
+	Factory struct {
+	}
+
+	// reader closes the decoder, it doesn't return an error on Close()
+	reader struct {
+		*zstd.Decoder
+	}
+)
+
+var (
+	_ compress.Factory = Factory{}
+)
+
+// NewWriter returns a Zstandard writer
+func (f Factory) NewWriter(target io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(target)
+}
+
+// NewReader returns a Zstandard reader
+func (f Factory) NewReader(src io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(src)
+	if err != nil {
+		return nil, err
+	}
+	return reader{d}, nil
+}
+
+// Type returns the compression's type
+func (f Factory) Type() compress.Type {
+	return compress.Zstd
+}
+
+// Close implements io.Closer
+func (r reader) Close() error {
+	r.Decoder.Close()
+	return nil
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datalayer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/volume"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+	"github.com/ClusterHQ/fli/securefilepath"
+)
+
+// Checkpoints of interrupted transfers. A receiver keeps the volume a transfer was applied to and how many records
+// were applied, a retry of the transfer continues from there instead of starting over.
+
+type (
+	// Progress is how far a transfer went
+	Progress struct {
+		// BaseBlobID and TargetBlobID are the sender's blobs of the stream
+		BaseBlobID   blob.ID
+		TargetBlobID blob.ID
+
+		// Applied is the number of records applied
+		Applied uint64
+	}
+
+	// Checkpoint is the state of an interrupted transfer on the receiving side
+	Checkpoint struct {
+		Progress
+
+		// VolSetID, VolumeID and MntPath are the volume the records are applied to
+		VolSetID volumeset.ID
+		VolumeID volume.ID
+		MntPath  string
+	}
+
+	// CheckpointStore keeps checkpoints of interrupted transfers
+	CheckpointStore interface {
+		// Get returns the checkpoint saved with the key, nil if there is none
+		Get(key string) (*Checkpoint, error)
+
+		// Put saves a checkpoint with the key, an existing checkpoint is replaced
+		Put(key string, cp *Checkpoint) error
+
+		// Delete removes the checkpoint saved with the key if there is one
+		Delete(key string) error
+	}
+
+	fileCheckpointStore struct {
+		dir string
+	}
+
+	memCheckpointStore struct {
+		lock        *sync.Mutex
+		checkpoints map[string]Checkpoint
+	}
+)
+
+var (
+	_ CheckpointStore = &fileCheckpointStore{}
+	_ CheckpointStore = &memCheckpointStore{}
+)
+
+// NewFileCheckpointStore returns a checkpoint store which keeps one file per checkpoint in the given directory, the
+// directory is created if it doesn't exist.
+func NewFileCheckpointStore(dir securefilepath.SecureFilePath) (CheckpointStore, error) {
+	err := os.MkdirAll(dir.Path(), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileCheckpointStore{dir: dir.Path()}, nil
+}
+
+// NewMemCheckpointStore returns a checkpoint store which keeps checkpoints in memory, checkpoints are lost when the
+// process exits.
+func NewMemCheckpointStore() CheckpointStore {
+	return &memCheckpointStore{
+		lock:        &sync.Mutex{},
+		checkpoints: make(map[string]Checkpoint),
+	}
+}
+
+func (fs *fileCheckpointStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(fs.dir, hex.EncodeToString(sum[:]))
+}
+
+// Get implements CheckpointStore interface
+func (fs *fileCheckpointStore) Get(key string) (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(fs.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cp Checkpoint
+	err = json.Unmarshal(data, &cp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cp, nil
+}
+
+// Put implements CheckpointStore interface
+func (fs *fileCheckpointStore) Put(key string, cp *Checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	// Write and rename so a crash never leaves a partially written checkpoint behind
+	p := fs.path(key)
+	err = ioutil.WriteFile(p+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(p+".tmp", p)
+}
+
+// Delete implements CheckpointStore interface
+func (fs *fileCheckpointStore) Delete(key string) error {
+	err := os.Remove(fs.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Get implements CheckpointStore interface
+func (ms *memCheckpointStore) Get(key string) (*Checkpoint, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	cp, ok := ms.checkpoints[key]
+	if !ok {
+		return nil, nil
+	}
+	return &cp, nil
+}
+
+// Put implements CheckpointStore interface
+func (ms *memCheckpointStore) Put(key string, cp *Checkpoint) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.checkpoints[key] = *cp
+	return nil
+}
+
+// Delete implements CheckpointStore interface
+func (ms *memCheckpointStore) Delete(key string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	delete(ms.checkpoints, key)
+	return nil
+}
+
+// OpenCheckpoint returns the checkpoint saved with the key if its volume is still there, otherwise a new volume is
+// created from the base blob and a new checkpoint is returned. A checkpoint whose volume is gone is removed.
+func OpenCheckpoint(s Storage, cps CheckpointStore, key string, vsid volumeset.ID,
+	base blob.ID) (*Checkpoint, error) {
+	cp, err := cps.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if cp != nil {
+		if _, err := os.Stat(cp.MntPath); err == nil {
+			return cp, nil
+		}
+
+		err = cps.Delete(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	vid, mntPath, err := s.CreateVolume(vsid, base, NoAutoMount)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Checkpoint{
+		VolSetID: vsid,
+		VolumeID: vid,
+		MntPath:  mntPath.Path(),
+	}, nil
+}
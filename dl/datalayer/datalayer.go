@@ -17,22 +17,39 @@
 package datalayer
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/ClusterHQ/fli/dl/compress"
+	"github.com/ClusterHQ/fli/dl/compress/gzip"
+	compressnoop "github.com/ClusterHQ/fli/dl/compress/noop"
+	"github.com/ClusterHQ/fli/dl/compress/s2"
+	"github.com/ClusterHQ/fli/dl/compress/zstd"
 	"github.com/ClusterHQ/fli/dl/encdec"
+	"github.com/ClusterHQ/fli/dl/encdec/aesgcm"
 	dlbin "github.com/ClusterHQ/fli/dl/encdec/binary"
 	dlgob "github.com/ClusterHQ/fli/dl/encdec/gob"
 	"github.com/ClusterHQ/fli/dl/executor"
 	dlhash "github.com/ClusterHQ/fli/dl/hash"
 	"github.com/ClusterHQ/fli/dl/hash/adler32"
+	"github.com/ClusterHQ/fli/dl/hash/blake2b"
+	"github.com/ClusterHQ/fli/dl/hash/blake3"
 	"github.com/ClusterHQ/fli/dl/hash/md5"
 	"github.com/ClusterHQ/fli/dl/hash/noop"
 	dlsha "github.com/ClusterHQ/fli/dl/hash/sha256"
+	"github.com/ClusterHQ/fli/dl/hash/xxh3"
+	"github.com/ClusterHQ/fli/dl/hash/xxhash64"
+	"github.com/ClusterHQ/fli/dl/progress"
 	"github.com/ClusterHQ/fli/dl/record"
 	"github.com/ClusterHQ/fli/errors"
 	"github.com/ClusterHQ/fli/meta/blob"
@@ -41,6 +58,7 @@ import (
 	"github.com/ClusterHQ/fli/meta/volumeset"
 	"github.com/ClusterHQ/fli/protocols"
 	"github.com/ClusterHQ/fli/protocols/transferhdr"
+	"github.com/ClusterHQ/fli/rest"
 	"github.com/ClusterHQ/fli/securefilepath"
 )
 
@@ -53,6 +71,37 @@ type (
 			cancel <-chan bool, wg *sync.WaitGroup) <-chan record.Record
 	}
 
+	// OrderedBlobDifferFactory is a blob differ factory which can generate records in the same order every time
+	// the same two blobs are diffed, which is required to resume an interrupted transfer.
+	OrderedBlobDifferFactory interface {
+		BlobDifferFactory
+
+		// Ordered returns a factory whose differs generate records in order
+		Ordered() BlobDifferFactory
+	}
+
+	// ErrInterrupted is returned when a transfer ends before the end of transfer record, all records received
+	// were applied and the transfer can be resumed from Progress.
+	ErrInterrupted struct {
+		Progress
+		Err error
+	}
+
+	// errHTTPStatus is returned when a transfer request is answered with an unexpected status, msg is the error
+	// the server answered with
+	errHTTPStatus struct {
+		op     string
+		status int
+		msg    string
+	}
+
+	// sourceReader keeps the error of the last read from a transfer's source, it tells a source which failed or
+	// ended from records which can't be decoded
+	sourceReader struct {
+		io.Reader
+		err error
+	}
+
 	// MountType defines mount mode when a new volume is created
 	MountType bool
 
@@ -143,9 +192,27 @@ const (
 
 	// DifferChannelSize ...
 	DifferChannelSize = 20
+
+	// MaxTransferRetries is how many times an interrupted upload or download is retried
+	MaxTransferRetries = 5
+
+	// maxHdrStringLen is the longest string, for example a blob id or a resume token, accepted in a transfer header
+	maxHdrStringLen = 4096
+
+	// maxErrorLen is the most read of the response to a failed transfer request
+	maxErrorLen = 64 * 1024
 )
 
-// UploadBlobDiff ...
+var (
+	// TransferRetryDelay is the delay before the first retry of an interrupted transfer, it grows with every retry
+	TransferRetryDelay = 2 * time.Second
+)
+
+// UploadBlobDiff sends the diff between the base and target blobs to a data server. An interrupted upload is
+// retried with the same token and resumes from the last record the data server applied.
+// Encrypted records are always the diff from the empty blob, the data server can't apply them so it keeps them as
+// they are and sends them back the same way.
+// The transfer is counted by the tracker, which can be nil.
 func UploadBlobDiff(
 	s Storage,
 	encdec encdec.Factory,
@@ -155,13 +222,14 @@ func UploadBlobDiff(
 	targetBlobID blob.ID,
 	token string,
 	dspuburl string,
+	tr *progress.Tracker,
 ) error {
 	var (
 		baseBlobID blob.ID
 		err        error
 	)
 
-	if base.IsNilID() {
+	if _, encrypted := encdec.(aesgcm.Factory); base.IsNilID() || encrypted {
 		baseBlobID, err = s.EmptyBlobID(vsid)
 		if err != nil {
 			return err
@@ -170,6 +238,71 @@ func UploadBlobDiff(
 		baseBlobID = base
 	}
 
+	for retry := 0; ; retry++ {
+		var cp *protocols.RespUploadCheckpoint
+		cp, err = uploadCheckpoint(dspuburl, token)
+		if err == nil {
+			// Encrypted records are never sent natively, the data server can't read them
+			if _, encrypted := encdec.(aesgcm.Factory); encrypted {
+				cp.Native = nil
+			}
+			err = uploadBlobDiff(s, encdec, hf, baseBlobID, targetBlobID, token, dspuburl, cp, tr)
+		}
+		if err == nil || !retryable(err) || retry == MaxTransferRetries {
+			return err
+		}
+
+		log.Printf("Upload of blob %v interrupted(%v), retry %d of %d", targetBlobID, err, retry+1,
+			MaxTransferRetries)
+		time.Sleep(time.Duration(retry+1) * TransferRetryDelay)
+	}
+}
+
+// uploadCheckpoint asks the data server how many records of an interrupted upload it has applied and which native
+// streams it can receive.
+func uploadCheckpoint(dspuburl string, token string) (*protocols.RespUploadCheckpoint, error) {
+	req, err := http.NewRequest("GET", makeURL(dspuburl, protocols.HTTPReqUploadCheckpoint, token), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	protocols.SetCorrelationID(req, protocols.GenerateCorrelationID())
+	resp, err := protocols.GetClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// A data server which doesn't support resume always starts from the beginning
+	if resp.StatusCode == http.StatusNotFound {
+		return &protocols.RespUploadCheckpoint{}, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, httpStatusError("upload checkpoint", resp)
+	}
+
+	var (
+		r  rest.Response
+		cp protocols.RespUploadCheckpoint
+	)
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.GetResult(&cp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cp, nil
+}
+
+// uploadBlobDiff sends the diff natively if the data server offers it, otherwise as records starting from the
+// checkpoint's record.
+func uploadBlobDiff(s Storage, encdec encdec.Factory, hf dlhash.Factory, baseBlobID blob.ID, targetBlobID blob.ID,
+	token string, dspuburl string, cp *protocols.RespUploadCheckpoint, tr *progress.Tracker) error {
 	reqBody, reqWriter := io.Pipe()
 
 	url := makeUploadURL(dspuburl, token)
@@ -188,6 +321,8 @@ func UploadBlobDiff(
 	// routine. The pipe is written to by differ.
 	go func(errc chan<- error, wg *sync.WaitGroup) {
 		defer wg.Done()
+		// Unblocks the differ if the request ends before the whole diff is sent
+		defer reqBody.Close()
 
 		req.Header.Set("Content-Length", "0")
 		client := protocols.GetClient()
@@ -199,7 +334,7 @@ func UploadBlobDiff(
 		defer resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
-			errc <- errors.Errorf("HTTP request for upload failed with status %d", resp.StatusCode)
+			errc <- httpStatusError("upload", resp)
 		}
 	}(errc, wg)
 
@@ -210,7 +345,11 @@ func UploadBlobDiff(
 	default:
 	}
 
-	err = SendDiff(s, baseBlobID, targetBlobID, encdec, hf, reqWriter)
+	w := tr.Writer(reqWriter)
+	native, err := SendNative(s, baseBlobID, targetBlobID, cp.Native, w)
+	if err == nil && !native {
+		err = SendDiffFrom(s, baseBlobID, targetBlobID, encdec, hf, w, cp.Offset, tr)
+	}
 	if err != nil {
 		reqWriter.CloseWithError(err)
 	} else {
@@ -219,14 +358,20 @@ func UploadBlobDiff(
 
 	wg.Wait()
 	select {
-	case err = <-errc:
-		return err
+	case errHTTP := <-errc:
+		return errHTTP
 	default:
-		return nil
+		return err
 	}
 }
 
-// DownloadBlobDiff receives records from an HTTP server, apply them to the local backing storage.
+// DownloadBlobDiff receives records from an HTTP server, apply them to the local backing storage. If the enc/dec
+// factory encrypts records, only records encrypted with one of its keys are accepted.
+// The server checksums the records with the hash factory.
+// An interrupted download is retried with the same token and resumes from the last record applied. If it still
+// can't complete, the partially applied volume is kept in the checkpoint store so a later download of the same
+// snapshot resumes from there. cps can be nil, in which case resume only happens within this call.
+// The transfer is counted by the tracker, which can be nil.
 func DownloadBlobDiff(
 	s Storage,
 	encdec encdec.Factory,
@@ -237,6 +382,8 @@ func DownloadBlobDiff(
 	e executor.Executor,
 	hf dlhash.Factory,
 	dspuburl string,
+	cps CheckpointStore,
+	tr *progress.Tracker,
 ) (blob.ID, uint64, uint64, error) {
 	var (
 		baseBlobID blob.ID
@@ -256,41 +403,78 @@ func DownloadBlobDiff(
 		return blob.NilID(), 0, 0, nil
 	}
 
-	var (
-		vid     volume.ID
-		mntPath securefilepath.SecureFilePath
-	)
-	vid, mntPath, err = s.CreateVolume(vsid, baseBlobID, NoAutoMount)
-	if err != nil {
-		return blob.NilID(), 0, 0, errors.New(err)
+	// Encrypted records are never sent natively, the data server can't read them
+	if keyring(encdec) == nil {
+		blobid, native, err := downloadNative(s, vsid, ssid, baseBlobID, token, dspuburl, tr)
+		if err != nil {
+			return blob.NilID(), 0, 0, err
+		}
+		if native {
+			return blobSpace(s, vsid, blobid)
+		}
 	}
 
-	dlURL := makeDownloadURL(dspuburl, token)
-	req, err := http.NewRequest("GET", dlURL, nil)
+	persistent := cps != nil
+	if !persistent {
+		cps = NewMemCheckpointStore()
+	}
+
+	// Note: The base given is used instead of the empty blob's ID, which may not be the same every time
+	key := "download/" + vsid.String() + "/" + ssid.String() + "/" + base.String()
+	cp, err := OpenCheckpoint(s, cps, key, vsid, baseBlobID)
 	if err != nil {
 		return blob.NilID(), 0, 0, errors.New(err)
 	}
 
-	correlationID := protocols.GenerateCorrelationID()
-	protocols.SetCorrelationID(req, correlationID)
-	client := protocols.GetClient()
-	resp, err := client.Do(req)
+	mntPath, err := securefilepath.New(cp.MntPath)
 	if err != nil {
 		return blob.NilID(), 0, 0, errors.New(err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return blob.NilID(), 0, 0, errors.Errorf("HTTP request for download failed with status %d", resp.StatusCode)
+	for retry := 0; ; retry++ {
+		if cp.Applied > 0 {
+			log.Printf("Resuming download of snapshot %v from record %d", ssid, cp.Applied)
+		}
+
+		err = downloadBlobDiff(cp, mntPath, token, encdec, hf, e, dspuburl, tr)
+		if err == nil {
+			break
+		}
+
+		if ei, ok := err.(*ErrInterrupted); ok {
+			cp.Progress = ei.Progress
+			errCp := cps.Put(key, cp)
+			if errCp != nil {
+				log.Printf("Failed to save checkpoint of snapshot %v download: %v", ssid, errCp)
+			}
+		} else if !retryable(err) {
+			// The volume can't be resumed, clean it up
+			cps.Delete(key)
+			destroyVolume(s, vsid, cp.VolumeID)
+			return blob.NilID(), 0, 0, err
+		}
+
+		if retry == MaxTransferRetries {
+			// Nothing to resume from later
+			if !persistent || cp.Applied == 0 {
+				cps.Delete(key)
+				destroyVolume(s, vsid, cp.VolumeID)
+			}
+			return blob.NilID(), 0, 0, err
+		}
+
+		log.Printf("Download of snapshot %v interrupted(%v), retry %d of %d", ssid, err, retry+1,
+			MaxTransferRetries)
+		time.Sleep(time.Duration(retry+1) * TransferRetryDelay)
 	}
 
-	err = ReceiveDiff(resp.Body, mntPath, e)
+	err = cps.Delete(key)
 	if err != nil {
-		return blob.NilID(), 0, 0, err
+		log.Printf("Failed to remove checkpoint of snapshot %v download: %v", ssid, err)
 	}
 
 	// Take a snapshot
-	blobid, err := s.CreateSnapshot(vsid, ssid, vid)
+	blobid, err := s.CreateSnapshot(vsid, ssid, cp.VolumeID)
 	if err != nil {
 		return blob.NilID(), 0, 0, err
 	}
@@ -298,11 +482,13 @@ func DownloadBlobDiff(
 	// Clean up when finished, destroy the volume created for the upload.
 	// Error is logged, no need to return to caller.
 	// Note: This still won't remove the volume set because how ZFS works. See zfs.go for details.
-	err = s.DestroyVolume(vsid, vid)
-	if err != nil {
-		log.Printf("Delete volume error %v after download volume set %v volume %v.", err, vsid, vid)
-	}
+	destroyVolume(s, vsid, cp.VolumeID)
 
+	return blobSpace(s, vsid, blobid)
+}
+
+// blobSpace returns the blob with its logical size and the space used by its volume set.
+func blobSpace(s Storage, vsid volumeset.ID, blobid blob.ID) (blob.ID, uint64, uint64, error) {
 	snapSize, err := s.GetSnapshotSpace(blobid)
 	if err != nil {
 		return blob.NilID(), 0, 0, err
@@ -316,6 +502,92 @@ func DownloadBlobDiff(
 	return blobid, snapSize.LogicalSize, vsSize.Used, nil
 }
 
+// downloadBlobDiff receives the diff starting from the record after the checkpoint's last applied record. The data
+// server is asked to compress the diff the same way as the enc/dec factory does and to checksum records with hf.
+func downloadBlobDiff(cp *Checkpoint, mntPath securefilepath.SecureFilePath, token string, encdec encdec.Factory,
+	hf dlhash.Factory, e executor.Executor, dspuburl string, tr *progress.Tracker) error {
+	dlURL := makeDownloadURL(dspuburl, token) + "&" + protocols.HTTPFieldOffset + "=" +
+		strconv.FormatUint(cp.Applied, 10)
+	if c := compression(encdec); c != compress.None {
+		dlURL += "&" + protocols.HTTPFieldCompression + "=" + c.String()
+	}
+	if hf != nil && hf.Type() != dlhash.Default {
+		dlURL += "&" + protocols.HTTPFieldHash + "=" + hf.Type().String()
+	}
+	req, err := http.NewRequest("GET", dlURL, nil)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	correlationID := protocols.GenerateCorrelationID()
+	protocols.SetCorrelationID(req, correlationID)
+	client := protocols.GetClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return httpStatusError("download", resp)
+	}
+
+	return ReceiveDiffFrom(tr.Reader(resp.Body), mntPath, e, cp.Progress, keyring(encdec), tr)
+}
+
+// destroyVolume destroys a volume used by a transfer, errors are only logged.
+func destroyVolume(s Storage, vsid volumeset.ID, vid volume.ID) {
+	err := s.DestroyVolume(vsid, vid)
+	if err != nil {
+		log.Printf("Delete volume error %v after download volume set %v volume %v.", err, vsid, vid)
+	}
+}
+
+// retryable returns true if a transfer which failed with the error can be retried. Only interrupted transfers and
+// network failures are retried, requests rejected by the server are not retried unless the server is busy with the
+// same transfer. Records which can't be applied or verified fail the same way every time.
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *ErrInterrupted:
+		return true
+	case *errHTTPStatus:
+		return e.status >= http.StatusInternalServerError || e.status == http.StatusConflict
+	case net.Error:
+		return true
+	default:
+		return false
+	}
+}
+
+// Read implements io.Reader
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// httpStatusError returns the error of a transfer request answered with an unexpected status, with the error message
+// of the server's response if it has one.
+func httpStatusError(op string, resp *http.Response) *errHTTPStatus {
+	var r rest.Response
+	json.NewDecoder(io.LimitReader(resp.Body, maxErrorLen)).Decode(&r)
+	return &errHTTPStatus{op: op, status: resp.StatusCode, msg: r.ErrorMessage}
+}
+
+func (e *errHTTPStatus) Error() string {
+	if e.msg != "" {
+		return fmt.Sprintf("HTTP request for %s failed with status %d: %s", e.op, e.status, e.msg)
+	}
+	return fmt.Sprintf("HTTP request for %s failed with status %d", e.op, e.status)
+}
+
+// Error implements error interface
+func (e *ErrInterrupted) Error() string {
+	return fmt.Sprintf("Transfer interrupted after %d records: %v", e.Applied, e.Err)
+}
+
 // ApplyDiff receives syscall records and apply to the given mount point.
 // In order to achieve max disk throughput, this function supports executing records in parallel.
 // Multiple worker threads are created, each thread works with a dedicated channel.
@@ -437,22 +709,55 @@ func (wrks *workers) recordCompleted(r record.Record) error {
 
 // ReceiveDiff reads records from the source, send them to the applier
 func ReceiveDiff(src io.Reader, mntPath securefilepath.SecureFilePath, e executor.Executor) error {
+	return ReceiveDiffFrom(src, mntPath, e, Progress{}, nil, nil)
+}
+
+// ReceiveDiffFrom reads records from the source and applies them on top of the records already applied in an earlier
+// attempt of the same transfer. If the source ends before the end of transfer record, all records read are applied
+// and *ErrInterrupted is returned with the progress to resume from. Records already applied are skipped if the source
+// starts before them.
+// Records which can't be decoded, applied or verified fail the transfer, it can't be resumed.
+// If keys is nil, encrypted records are refused. Otherwise only records encrypted with one of the keys are accepted.
+// Records received are counted by the tracker, which can be nil. Bytes are counted by the caller's source.
+func ReceiveDiffFrom(src io.Reader, mntPath securefilepath.SecureFilePath, e executor.Executor, p Progress,
+	keys aesgcm.Keyring, tr *progress.Tracker) error {
 	var (
-		err error
+		err    error
+		srcErr error
 		// Note: Define here, had trouble with err reflected outside for loop when using recs, err := ...
 		recs []record.Record
 	)
 
+	sr := &sourceReader{Reader: src}
+	src = sr
 	hdr, err := readTransferHdr(src)
 	if err != nil {
-		return err
+		if sr.err == nil {
+			return err
+		}
+		return &ErrInterrupted{Progress: p, Err: err}
 	}
 
-	if transferhdr.CurVer != hdr.Ver {
+	if hdr.Ver < transferhdr.MinVer || hdr.Ver > transferhdr.CurVer {
 		return errors.Errorf("Version %v is not supported, current version is %v.", hdr.Ver, transferhdr.CurVer)
 	}
 
-	encdec, err := EncDecFactory(hdr.EncDec)
+	if hdr.Stream != transferhdr.StreamRecords {
+		return errors.Errorf("Transfer is a %v stream, not records", hdr.Stream)
+	}
+
+	if hdr.Offset > p.Applied {
+		return errors.Errorf("Transfer starts from record %d, %d records were applied", hdr.Offset, p.Applied)
+	}
+
+	if p.Applied > 0 && (hdr.BaseBlobID != p.BaseBlobID || hdr.TargetBlobID != p.TargetBlobID) {
+		return errors.Errorf("Transfer of blob %v(base %v) can't resume transfer of blob %v(base %v)",
+			hdr.TargetBlobID, hdr.BaseBlobID, p.TargetBlobID, p.BaseBlobID)
+	}
+	p.BaseBlobID = hdr.BaseBlobID
+	p.TargetBlobID = hdr.TargetBlobID
+
+	encdec, err := receiveEncDec(hdr, keys)
 	if err != nil {
 		return err
 	}
@@ -466,6 +771,10 @@ func ReceiveDiff(src io.Reader, mntPath securefilepath.SecureFilePath, e executo
 	records := make(chan record.Record, 128)
 	errc := applyDiff(mntPath, e, hf, records, wg)
 	d := encdec.NewDecoder(src)
+	skip := p.Applied - hdr.Offset
+	if c, ok := d.(io.Closer); ok {
+		defer c.Close()
+	}
 
 receiveRecords:
 	for {
@@ -473,17 +782,24 @@ receiveRecords:
 		case err = <-errc:
 			break receiveRecords
 		default:
-			recs, err = d.Decode()
-			if err == io.EOF {
-				err = nil
+			recs, srcErr = d.Decode()
+			if srcErr == io.EOF {
+				srcErr = nil
 				break receiveRecords
 			}
-			if err != nil {
+			if srcErr != nil {
 				break receiveRecords
 			}
 
 			for _, r := range recs {
+				if skip > 0 {
+					// Applied in an earlier attempt
+					skip--
+					continue
+				}
 				records <- r
+				p.Applied++
+				tr.Record(r)
 			}
 		}
 	}
@@ -491,14 +807,28 @@ receiveRecords:
 	close(records)
 	wg.Wait()
 
+	// Records received before the source failed are all applied by now, unless applying one of them failed
+	if err == nil {
+		select {
+		case err = <-errc:
+		default:
+		}
+	}
 	if err != nil {
 		return err
 	}
 
-	if !e.EOT() {
-		return errors.New("Missing EOT")
+	if e.EOT() {
+		return nil
 	}
-	return nil
+
+	if srcErr == nil {
+		srcErr = errors.New("Missing EOT")
+	} else if sr.err == nil {
+		// The source is fine, what it sent is not. Records cut short by the end of the source are interrupted.
+		return srcErr
+	}
+	return &ErrInterrupted{Progress: p, Err: srcErr}
 }
 
 // applyDiff receives records from a channel and execute each record.
@@ -676,14 +1006,17 @@ func endInSlash(path string) string {
 	return path
 }
 
-func makeUploadURL(serverURL string, tok string) string {
+func makeURL(serverURL string, path string, tok string) string {
 	serverURL = endInSlash(serverURL)
-	return serverURL + protocols.HTTPReqUploadBlob + "?" + protocols.HTTPFieldToken + "=" + url.QueryEscape(tok)
+	return serverURL + path + "?" + protocols.HTTPFieldToken + "=" + url.QueryEscape(tok)
+}
+
+func makeUploadURL(serverURL string, tok string) string {
+	return makeURL(serverURL, protocols.HTTPReqUploadBlob, tok)
 }
 
 func makeDownloadURL(serverURL string, tok string) string {
-	serverURL = endInSlash(serverURL)
-	return serverURL + protocols.HTTPReqDownloadBlob + "?" + protocols.HTTPFieldToken + "=" + url.QueryEscape(tok)
+	return makeURL(serverURL, protocols.HTTPReqDownloadBlob, tok)
 }
 
 // Differ - sender work flow:
@@ -697,6 +1030,22 @@ func makeDownloadURL(serverURL string, tok string) string {
 // SendDiff sends records to a server, records are read from a channel
 func SendDiff(s Storage, baseBlobID blob.ID, targetBlobID blob.ID, encdec encdec.Factory, hf dlhash.Factory,
 	target io.Writer) error {
+	return SendDiffFrom(s, baseBlobID, targetBlobID, encdec, hf, target, 0, nil)
+}
+
+// SendDiffFrom sends records to a server starting from the record at offset, records before it were applied by the
+// receiver in an interrupted transfer. Records are generated in the same order every time if the storage's blob
+// differ supports it, so a transfer can be resumed.
+// Records sent are counted by the tracker, which can be nil. Bytes are counted by the caller's target.
+func SendDiffFrom(s Storage, baseBlobID blob.ID, targetBlobID blob.ID, encdec encdec.Factory, hf dlhash.Factory,
+	target io.Writer, offset uint64, tr *progress.Tracker) error {
+	differ := s.BlobDiffer()
+	if o, ok := differ.(OrderedBlobDifferFactory); ok {
+		differ = o.Ordered()
+	} else if offset > 0 {
+		return errors.New("Blob differ doesn't generate records in order, transfer can't be resumed")
+	}
+
 	exist, err := s.SnapshotExists(baseBlobID)
 	if exist == false || err != nil {
 		return errors.Errorf("Base blob %v not found", baseBlobID)
@@ -723,9 +1072,14 @@ func SendDiff(s Storage, baseBlobID blob.ID, targetBlobID blob.ID, encdec encdec
 	err = writeTransferHdr(
 		target,
 		&transferhdr.Hdr{
-			Ver:    transferhdr.CurVer,
-			Hash:   hf.Type(),
-			EncDec: encdec.Type(),
+			Ver:          transferhdr.CurVer,
+			Hash:         hf.Type(),
+			EncDec:       encdec.Type(),
+			Offset:       offset,
+			BaseBlobID:   baseBlobID,
+			TargetBlobID: targetBlobID,
+			Compression:  compression(encdec),
+			KeyID:        keyID(encdec),
 		})
 	if err != nil {
 		return err
@@ -736,8 +1090,8 @@ func SendDiff(s Storage, baseBlobID blob.ID, targetBlobID blob.ID, encdec encdec
 	cancelCh := make(chan bool, 1)
 
 	wg.Add(1)
-	records := s.BlobDiffer().New(basePath, targetPath, hf, errc, cancelCh, wg)
-	err = SendRecords(encdec, records, target, cancelCh)
+	records := differ.New(basePath, targetPath, hf, errc, cancelCh, wg)
+	err = sendRecords(encdec, records, target, cancelCh, offset, tr)
 	wg.Wait()
 
 	select {
@@ -751,7 +1105,16 @@ func SendDiff(s Storage, baseBlobID blob.ID, targetBlobID blob.ID, encdec encdec
 // SendRecords reads records from the channel, encode and send them to the target(for example an http link).
 // Stops only after received all records. In case of error, will notify differ to stop through the cancel channel.
 func SendRecords(encdec encdec.Factory, records <-chan record.Record, target io.Writer, cancelCh chan<- bool) error {
-	var err error
+	return sendRecords(encdec, records, target, cancelCh, 0, nil)
+}
+
+// sendRecords is SendRecords which skips the first records and counts the records sent.
+func sendRecords(encdec encdec.Factory, records <-chan record.Record, target io.Writer, cancelCh chan<- bool,
+	skip uint64, tr *progress.Tracker) error {
+	var (
+		err error
+		seq uint64
+	)
 
 	e := encdec.NewEncoder(target)
 	for {
@@ -765,11 +1128,27 @@ func SendRecords(encdec encdec.Factory, records <-chan record.Record, target io.
 			continue
 		}
 
+		seq++
+		if seq <= skip {
+			// Applied by the receiver already
+			continue
+		}
+
 		err = e.Encode([]record.Record{r})
 		if err != nil {
 			cancelCh <- true
 			continue
 		}
+		tr.Record(r)
+	}
+
+	if err == nil && seq < skip {
+		return errors.Errorf("Transfer has %d records, can't resume from record %d", seq, skip)
+	}
+
+	// Flushes the end of a compressed stream
+	if c, ok := e.(io.Closer); ok && err == nil {
+		err = c.Close()
 	}
 
 	return err
@@ -782,11 +1161,104 @@ func EncDecFactory(t encdec.Type) (encdec.Factory, error) {
 		return dlbin.Factory{}, nil
 	case encdec.Gob:
 		return dlgob.Factory{}, nil
+	case encdec.AESGCM:
+		return nil, errors.New("Encrypted encoder/decoder needs a key, use aesgcm.Factory")
 	default:
 		return nil, errors.Errorf("Invalid encoder/decoder type %v", t)
 	}
 }
 
+// CompressionFactory returns a compression factory instance based on the type given
+func CompressionFactory(t compress.Type) (compress.Factory, error) {
+	switch t {
+	case compress.None:
+		return compressnoop.Factory{}, nil
+	case compress.Gzip:
+		return gzip.Factory{}, nil
+	case compress.Zstd:
+		return zstd.Factory{}, nil
+	case compress.S2:
+		return s2.Factory{}, nil
+	default:
+		return nil, errors.Errorf("Invalid compression type %v", t)
+	}
+}
+
+// receiveEncDec returns the enc/dec factory of a transfer, keys are the keys of encrypted transfers.
+func receiveEncDec(hdr *transferhdr.Hdr, keys aesgcm.Keyring) (encdec.Factory, error) {
+	if hdr.EncDec != encdec.AESGCM {
+		if keys != nil {
+			return nil, errors.New("Records are not encrypted, refusing records which can't be authenticated")
+		}
+
+		ed, err := EncDecFactory(hdr.EncDec)
+		if err != nil {
+			return nil, err
+		}
+
+		cf, err := CompressionFactory(hdr.Compression)
+		if err != nil {
+			return nil, err
+		}
+
+		return compress.Wrap(ed, cf), nil
+	}
+
+	if keys == nil {
+		return nil, errors.Errorf("Records are encrypted with key %s, no key is given to authenticate them", hdr.KeyID)
+	}
+
+	if _, ok := keys[hdr.KeyID]; !ok {
+		return nil, &aesgcm.ErrUnknownKey{KeyID: hdr.KeyID}
+	}
+
+	return aesgcm.Factory{
+		KeyID: hdr.KeyID,
+		Keys:  keys,
+		Resolve: func(t encdec.Type, c compress.Type) (encdec.Factory, error) {
+			if t == encdec.AESGCM {
+				return nil, errors.New("Nested encryption is not supported")
+			}
+
+			ed, err := EncDecFactory(t)
+			if err != nil {
+				return nil, err
+			}
+
+			cf, err := CompressionFactory(c)
+			if err != nil {
+				return nil, err
+			}
+
+			return compress.Wrap(ed, cf), nil
+		},
+	}, nil
+}
+
+// keyID returns the ID of the key an enc/dec factory encrypts records with
+func keyID(encdec encdec.Factory) string {
+	if f, ok := encdec.(aesgcm.Factory); ok {
+		return f.KeyID
+	}
+	return ""
+}
+
+// keyring returns the keys of an enc/dec factory which encrypts records, nil if it doesn't encrypt records
+func keyring(encdec encdec.Factory) aesgcm.Keyring {
+	if f, ok := encdec.(aesgcm.Factory); ok {
+		return f.Keys
+	}
+	return nil
+}
+
+// compression returns the type of compression done by an enc/dec factory
+func compression(encdec encdec.Factory) compress.Type {
+	if c, ok := encdec.(compress.Compressed); ok {
+		return c.Compression()
+	}
+	return compress.None
+}
+
 // HashFactory returns a hash factory instance based on the type given
 func HashFactory(t dlhash.Type) (dlhash.Factory, error) {
 	switch t {
@@ -798,28 +1270,50 @@ func HashFactory(t dlhash.Type) (dlhash.Factory, error) {
 		return md5.Factory{}, nil
 	case dlhash.SHA256:
 		return dlsha.Factory{}, nil
+	case dlhash.XXHash64:
+		return xxhash64.Factory{}, nil
+	case dlhash.XXH3:
+		return xxh3.Factory{}, nil
+	case dlhash.BLAKE2b:
+		return blake2b.Factory{}, nil
+	case dlhash.BLAKE3:
+		return blake3.Factory{}, nil
 	default:
 		return nil, errors.Errorf("Invalid hash type %v", t)
 	}
 }
 
 func writeTransferHdr(target io.Writer, hdr *transferhdr.Hdr) error {
-	err := binary.Write(target, binary.LittleEndian, uint64(hdr.Ver))
+	for _, n := range []uint64{uint64(hdr.Ver), uint64(hdr.EncDec), uint64(hdr.Hash), hdr.Offset} {
+		err := binary.Write(target, binary.LittleEndian, n)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, id := range []blob.ID{hdr.BaseBlobID, hdr.TargetBlobID} {
+		err := writeHdrString(target, id.String())
+		if err != nil {
+			return err
+		}
+	}
+
+	err := binary.Write(target, binary.LittleEndian, uint64(hdr.Compression))
 	if err != nil {
 		return err
 	}
 
-	err = binary.Write(target, binary.LittleEndian, uint64(hdr.EncDec))
+	err = writeHdrString(target, hdr.KeyID)
 	if err != nil {
 		return err
 	}
 
-	err = binary.Write(target, binary.LittleEndian, uint64(hdr.Hash))
+	err = binary.Write(target, binary.LittleEndian, uint64(hdr.Stream))
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return writeHdrString(target, hdr.ResumeToken)
 }
 
 func readTransferHdr(src io.Reader) (*transferhdr.Hdr, error) {
@@ -846,5 +1340,98 @@ func readTransferHdr(src io.Reader) (*transferhdr.Hdr, error) {
 	}
 	hdr.Hash = dlhash.Type(n)
 
+	if hdr.Ver < 2 {
+		return &hdr, nil
+	}
+
+	err = binary.Read(src, binary.LittleEndian, &hdr.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range []*blob.ID{&hdr.BaseBlobID, &hdr.TargetBlobID} {
+		str, err := readHdrString(src)
+		if err != nil {
+			return nil, err
+		}
+		*id = blob.NewID(str)
+	}
+
+	if hdr.Ver < 3 {
+		return &hdr, nil
+	}
+
+	err = binary.Read(src, binary.LittleEndian, &n)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Compression = compress.Type(n)
+
+	if hdr.Ver < 4 {
+		return &hdr, nil
+	}
+
+	hdr.KeyID, err = readHdrString(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.Ver < 5 {
+		return &hdr, nil
+	}
+
+	err = binary.Read(src, binary.LittleEndian, &n)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Stream = transferhdr.Stream(n)
+
+	hdr.ResumeToken, err = readHdrString(src)
+	if err != nil {
+		return nil, err
+	}
+
 	return &hdr, nil
 }
+
+// PeekTransferHdr reads the transfer header from the source, the returned reader reads the whole transfer including
+// the header.
+func PeekTransferHdr(src io.Reader) (*transferhdr.Hdr, io.Reader, error) {
+	var buf bytes.Buffer
+	hdr, err := readTransferHdr(io.TeeReader(src, &buf))
+	if err != nil {
+		return nil, nil, err
+	}
+	return hdr, io.MultiReader(&buf, src), nil
+}
+
+// writeHdrString writes a length prefixed string of the transfer header
+func writeHdrString(target io.Writer, str string) error {
+	err := binary.Write(target, binary.LittleEndian, uint64(len(str)))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(target, str)
+	return err
+}
+
+// readHdrString reads a length prefixed string of the transfer header
+func readHdrString(src io.Reader) (string, error) {
+	var n uint64
+	err := binary.Read(src, binary.LittleEndian, &n)
+	if err != nil {
+		return "", err
+	}
+
+	if n > maxHdrStringLen {
+		return "", errors.Errorf("Invalid string length %d in transfer header", n)
+	}
+
+	buf := make([]byte, n)
+	_, err = io.ReadFull(src, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
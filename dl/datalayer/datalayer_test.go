@@ -18,24 +18,47 @@
 package datalayer_test
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/ClusterHQ/fli/dl/blobdiffer"
+	"github.com/ClusterHQ/fli/dl/btrfs"
+	"github.com/ClusterHQ/fli/dl/compress"
+	"github.com/ClusterHQ/fli/dl/compress/zstd"
 	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dl/encdec/aesgcm"
+	dlbin "github.com/ClusterHQ/fli/dl/encdec/binary"
+	"github.com/ClusterHQ/fli/dl/executor"
 	"github.com/ClusterHQ/fli/dl/filediffer/variableblk"
 	"github.com/ClusterHQ/fli/dl/fs"
+	dlhash "github.com/ClusterHQ/fli/dl/hash"
+	"github.com/ClusterHQ/fli/dl/hash/adler32"
+	"github.com/ClusterHQ/fli/dl/linkfs"
+	"github.com/ClusterHQ/fli/dl/overlay"
+	"github.com/ClusterHQ/fli/dl/record"
+	"github.com/ClusterHQ/fli/dl/sparse"
 	"github.com/ClusterHQ/fli/dl/testutils"
 	"github.com/ClusterHQ/fli/dl/zfs"
 	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/meta/blob"
 	"github.com/ClusterHQ/fli/meta/snapshot"
 	"github.com/ClusterHQ/fli/meta/volumeset"
+	"github.com/ClusterHQ/fli/protocols"
+	"github.com/ClusterHQ/fli/protocols/transferhdr"
 	"github.com/ClusterHQ/fli/securefilepath"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // basicTests tests volume creation, snapshot creation, volume deletion and snapshot deletion
@@ -339,6 +362,42 @@ func TestZFS(t *testing.T) {
 	zfs.Close()
 }
 
+// TestBtrfs runs the storage tests on a btrfs file system in a loop mounted file.
+func TestBtrfs(t *testing.T) {
+	if !testutils.RunningAsRoot() {
+		t.Skip("Not running as superuser, skip btrfs tests.")
+	}
+	if _, err := exec.LookPath("mkfs.btrfs"); err != nil {
+		t.Skip("mkfs.btrfs not found, skip btrfs tests.")
+	}
+
+	f, err := ioutil.TempFile("", "datalayer_test_btrfs-")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	require.NoError(t, f.Truncate(512*1024*1024))
+	require.NoError(t, f.Close())
+	out, err := exec.Command("mkfs.btrfs", "-f", f.Name()).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	mnt, err := ioutil.TempDir("", "datalayer_test_btrfs_mnt-")
+	require.NoError(t, err)
+	defer os.Remove(mnt)
+	out, err = exec.Command("mount", "-o", "loop", f.Name(), mnt).CombinedOutput()
+	require.NoError(t, err, string(out))
+	defer exec.Command("umount", mnt).Run()
+
+	s, err := btrfs.New(mnt, blobdiffer.Factory{FileDiffer: variableblk.Factory{}})
+	require.NoError(t, err)
+
+	for _, test := range []func(*testing.T, datalayer.Storage) error{basicTests, spaceTests, deleteVolumeSet} {
+		err = test(t, s)
+		if e, ok := err.(errors.Error); ok {
+			t.Fatal(e.Error(), e.GetStackTrace())
+		}
+		require.NoError(t, err)
+	}
+}
+
 func TestFS(t *testing.T) {
 	name, err := ioutil.TempDir("", "datalayer_test_fs-")
 	if err != nil {
@@ -363,3 +422,714 @@ func TestFS(t *testing.T) {
 		}
 	}
 }
+
+func TestLinkFS(t *testing.T) {
+	name, err := ioutil.TempDir("", "datalayer_test_linkfs-")
+	require.NoError(t, err)
+	defer os.RemoveAll(name)
+	path, err := securefilepath.New(name)
+	require.NoError(t, err)
+	s, err := linkfs.New(path, blobdiffer.Factory{FileDiffer: variableblk.Factory{}})
+	require.NoError(t, err)
+
+	for _, test := range []func(*testing.T, datalayer.Storage) error{basicTests, spaceTests, deleteVolumeSet} {
+		err = test(t, s)
+		if e, ok := err.(errors.Error); ok {
+			t.Fatal(e.Error(), e.GetStackTrace())
+		}
+		require.NoError(t, err)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	if !testutils.RunningAsRoot() {
+		t.Skip("Not running as superuser, skip overlay tests.")
+	}
+
+	name, err := ioutil.TempDir("", "datalayer_test_overlay-")
+	require.NoError(t, err)
+	defer os.RemoveAll(name)
+	path, err := securefilepath.New(name)
+	require.NoError(t, err)
+	s, err := overlay.New(path, overlay.DefaultMaxDepth, blobdiffer.Factory{FileDiffer: variableblk.Factory{}})
+	require.NoError(t, err)
+
+	for _, test := range []func(*testing.T, datalayer.Storage) error{basicTests, spaceTests, deleteVolumeSet} {
+		err = test(t, s)
+		if e, ok := err.(errors.Error); ok {
+			t.Fatal(e.Error(), e.GetStackTrace())
+		}
+		require.NoError(t, err)
+	}
+}
+
+// TestResumeDiff interrupts a transfer half way and resumes it from the last record applied.
+func TestResumeDiff(t *testing.T) {
+	name, err := ioutil.TempDir("", "datalayer_test_resume-")
+	require.NoError(t, err)
+	defer os.RemoveAll(name)
+	path, err := securefilepath.New(name)
+	require.NoError(t, err)
+	s, err := fs.New(path)
+	require.NoError(t, err)
+
+	vsid := volumeset.NewRandomID()
+	empty, err := s.EmptyBlobID(vsid)
+	require.NoError(t, err)
+
+	// Target blob with a few files
+	vid, mnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		err = writeRandomData(filepath.Join(mnt.Path(), fmt.Sprintf("file%d", i)), 256*1024)
+		require.NoError(t, err)
+	}
+	target, err := s.CreateSnapshot(vsid, snapshot.NewRandomID(), vid)
+	require.NoError(t, err)
+
+	var full bytes.Buffer
+	err = datalayer.SendDiff(s, empty, target, dlbin.Factory{}, adler32.Factory{}, &full)
+	require.NoError(t, err)
+
+	// Receive half of the stream
+	_, recvMnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+	require.NoError(t, err)
+	half := bytes.NewReader(full.Bytes()[:full.Len()/2])
+	err = datalayer.ReceiveDiffFrom(half, recvMnt, executor.NewCommonExecutor(), datalayer.Progress{}, nil, nil)
+	ei, ok := err.(*datalayer.ErrInterrupted)
+	require.True(t, ok, "unexpected error %v", err)
+	require.True(t, ei.Applied > 0)
+	require.Equal(t, target, ei.TargetBlobID)
+
+	// A stream which starts after the last record applied is rejected
+	var gap bytes.Buffer
+	err = datalayer.SendDiffFrom(s, empty, target, dlbin.Factory{}, adler32.Factory{}, &gap, ei.Applied+1, nil)
+	require.NoError(t, err)
+	err = datalayer.ReceiveDiffFrom(&gap, recvMnt, executor.NewCommonExecutor(), ei.Progress, nil, nil)
+	require.Error(t, err)
+	_, ok = err.(*datalayer.ErrInterrupted)
+	require.False(t, ok)
+
+	// Resume
+	var rest bytes.Buffer
+	err = datalayer.SendDiffFrom(s, empty, target, dlbin.Factory{}, adler32.Factory{}, &rest, ei.Applied, nil)
+	require.NoError(t, err)
+	require.True(t, rest.Len() < full.Len())
+	err = datalayer.ReceiveDiffFrom(&rest, recvMnt, executor.NewCommonExecutor(), ei.Progress, nil, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		f := fmt.Sprintf("file%d", i)
+		want, err := ioutil.ReadFile(filepath.Join(mnt.Path(), f))
+		require.NoError(t, err)
+		got, err := ioutil.ReadFile(filepath.Join(recvMnt.Path(), f))
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+}
+
+// TestOrderedDiff diffs files at the same time and sends their records in the same order every time.
+func TestOrderedDiff(t *testing.T) {
+	name, err := ioutil.TempDir("", "datalayer_test_ordered-")
+	require.NoError(t, err)
+	defer os.RemoveAll(name)
+	path, err := securefilepath.New(name)
+	require.NoError(t, err)
+	s, err := fs.New(path)
+	require.NoError(t, err)
+
+	vsid := volumeset.NewRandomID()
+	empty, err := s.EmptyBlobID(vsid)
+	require.NoError(t, err)
+
+	vid, mnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+	require.NoError(t, err)
+	// Files of different sizes, differs of small files finish before the ones of big files
+	for i := 0; i < 32; i++ {
+		size := int64(1024)
+		if i%4 == 0 {
+			size = 1024 * 1024
+		}
+		err = writeRandomData(filepath.Join(mnt.Path(), fmt.Sprintf("file%d", i)), size)
+		require.NoError(t, err)
+	}
+	target, err := s.CreateSnapshot(vsid, snapshot.NewRandomID(), vid)
+	require.NoError(t, err)
+
+	var first bytes.Buffer
+	err = datalayer.SendDiff(s, empty, target, dlbin.Factory{}, adler32.Factory{}, &first)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		var again bytes.Buffer
+		err = datalayer.SendDiff(s, empty, target, dlbin.Factory{}, adler32.Factory{}, &again)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(first.Bytes(), again.Bytes()))
+	}
+}
+
+// TestDirAttrs sends the mode and mtime of directories, mtimes are kept after the directories' entries are made.
+func TestDirAttrs(t *testing.T) {
+	name, err := ioutil.TempDir("", "datalayer_test_dirattrs-")
+	require.NoError(t, err)
+	defer os.RemoveAll(name)
+	path, err := securefilepath.New(name)
+	require.NoError(t, err)
+	s, err := fs.New(path)
+	require.NoError(t, err)
+
+	vsid := volumeset.NewRandomID()
+	empty, err := s.EmptyBlobID(vsid)
+	require.NoError(t, err)
+
+	vid, mnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+	require.NoError(t, err)
+	dir := filepath.Join(mnt.Path(), "data")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	require.NoError(t, writeRandomData(filepath.Join(dir, "file"), 1024))
+	require.NoError(t, os.Chmod(dir, 0700))
+	require.NoError(t, os.Chmod(mnt.Path(), 0750))
+	mtime := time.Unix(1000000000, 0)
+	require.NoError(t, os.Chtimes(dir, mtime, mtime))
+	base, err := s.CreateSnapshot(vsid, snapshot.NewRandomID(), vid)
+	require.NoError(t, err)
+
+	check := func(from, to blob.ID) {
+		var diff bytes.Buffer
+		err := datalayer.SendDiff(s, from, to, dlbin.Factory{}, adler32.Factory{}, &diff)
+		require.NoError(t, err)
+
+		_, recvMnt, err := s.CreateVolume(vsid, from, datalayer.NoAutoMount)
+		require.NoError(t, err)
+		err = datalayer.ReceiveDiff(&diff, recvMnt, executor.NewCommonExecutor())
+		require.NoError(t, err)
+
+		want, err := s.MountBlob(to)
+		require.NoError(t, err)
+		for _, p := range []string{"", "data"} {
+			w, err := os.Lstat(filepath.Join(want, p))
+			require.NoError(t, err)
+			g, err := os.Lstat(filepath.Join(recvMnt.Path(), p))
+			require.NoError(t, err)
+			assert.Equal(t, w.Mode(), g.Mode(), "mode of %q", p)
+			assert.Equal(t, w.ModTime(), g.ModTime(), "mtime of %q", p)
+		}
+	}
+
+	bp, err := s.MountBlob(base)
+	require.NoError(t, err)
+	fi, err := os.Lstat(filepath.Join(bp, "data"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+	check(empty, base)
+
+	// Incremental with a mode change and a new entry
+	require.NoError(t, os.Chmod(dir, 0750))
+	require.NoError(t, writeRandomData(filepath.Join(dir, "new"), 1024))
+	target, err := s.CreateSnapshot(vsid, snapshot.NewRandomID(), vid)
+	require.NoError(t, err)
+	check(base, target)
+}
+
+// TestSparseDiff sends a sparse file before and after a hole is punched into it, the receiver keeps the holes.
+func TestSparseDiff(t *testing.T) {
+	name, err := ioutil.TempDir("", "datalayer_test_sparse-")
+	require.NoError(t, err)
+	defer os.RemoveAll(name)
+	path, err := securefilepath.New(name)
+	require.NoError(t, err)
+	s, err := fs.New(path)
+	require.NoError(t, err)
+
+	vsid := volumeset.NewRandomID()
+	empty, err := s.EmptyBlobID(vsid)
+	require.NoError(t, err)
+
+	const mb = 1 << 20
+	vid, mnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+	require.NoError(t, err)
+	file := filepath.Join(mnt.Path(), "sparse")
+	f, err := os.Create(file)
+	require.NoError(t, err)
+	_, err = f.WriteAt(bytes.Repeat([]byte("data"), mb), 8*mb)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(16*mb))
+	holes, err := sparse.Holes(f, 16*mb)
+	require.NoError(t, err)
+	if len(holes) == 0 {
+		f.Close()
+		t.Skip("File system doesn't report holes")
+	}
+	base, err := s.CreateSnapshot(vsid, snapshot.NewRandomID(), vid)
+	require.NoError(t, err)
+
+	check := func(from, to blob.ID) {
+		var diff bytes.Buffer
+		err := datalayer.SendDiff(s, from, to, dlbin.Factory{}, adler32.Factory{}, &diff)
+		require.NoError(t, err)
+		// Holes are not sent
+		assert.True(t, diff.Len() < 8*mb, "diff of %d bytes", diff.Len())
+
+		_, recvMnt, err := s.CreateVolume(vsid, from, datalayer.NoAutoMount)
+		require.NoError(t, err)
+		err = datalayer.ReceiveDiff(&diff, recvMnt, executor.NewCommonExecutor())
+		require.NoError(t, err)
+
+		want, err := s.MountBlob(to)
+		require.NoError(t, err)
+		w, err := ioutil.ReadFile(filepath.Join(want, "sparse"))
+		require.NoError(t, err)
+		g, err := ioutil.ReadFile(filepath.Join(recvMnt.Path(), "sparse"))
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(w, g))
+
+		wh, err := sparse.PathHoles(filepath.Join(want, "sparse"), int64(len(w)))
+		require.NoError(t, err)
+		gh, err := sparse.PathHoles(filepath.Join(recvMnt.Path(), "sparse"), int64(len(g)))
+		require.NoError(t, err)
+		assert.Equal(t, wh, gh)
+	}
+
+	check(empty, base)
+
+	// Incremental with a hole punched into the data
+	require.NoError(t, sparse.Punch(f, 9*mb, 2*mb))
+	require.NoError(t, f.Close())
+	target, err := s.CreateSnapshot(vsid, snapshot.NewRandomID(), vid)
+	require.NoError(t, err)
+	check(base, target)
+}
+
+// dropWrites is an executor which throws away pwrite records
+type dropWrites struct {
+	executor.Executor
+}
+
+func (e dropWrites) Execute(path string, recs []record.Record) error {
+	var keep []record.Record
+	for _, r := range recs {
+		if r.Type() != record.TypePwrite {
+			keep = append(keep, r)
+		}
+	}
+	return e.Executor.Execute(path, keep)
+}
+
+// TestDigestDiff verifies the files of a received diff with digest records.
+func TestDigestDiff(t *testing.T) {
+	name, err := ioutil.TempDir("", "datalayer_test_digest-")
+	require.NoError(t, err)
+	defer os.RemoveAll(name)
+	path, err := securefilepath.New(name)
+	require.NoError(t, err)
+	s, err := linkfs.New(path, blobdiffer.Factory{FileDiffer: variableblk.Factory{}, Digests: true})
+	require.NoError(t, err)
+
+	vsid := volumeset.NewRandomID()
+	empty, err := s.EmptyBlobID(vsid)
+	require.NoError(t, err)
+
+	vid, mnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+	require.NoError(t, err)
+	require.NoError(t, writeRandomData(filepath.Join(mnt.Path(), "file"), 64*1024))
+	target, err := s.CreateSnapshot(vsid, snapshot.NewRandomID(), vid)
+	require.NoError(t, err)
+
+	digests := 0
+	err = datalayer.DiffBlobs(s, empty, target, adler32.Factory{}, func(r record.Record) error {
+		if r.Type() == record.TypeDigest {
+			digests++
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, digests)
+
+	receive := func(e executor.Executor) error {
+		var diff bytes.Buffer
+		err := datalayer.SendDiff(s, empty, target, dlbin.Factory{}, adler32.Factory{}, &diff)
+		require.NoError(t, err)
+
+		_, recvMnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+		require.NoError(t, err)
+		return datalayer.ReceiveDiff(&diff, recvMnt, e)
+	}
+	require.NoError(t, receive(executor.NewCommonExecutor()))
+
+	// The file is not written, its digest doesn't match
+	err = receive(dropWrites{executor.NewCommonExecutor()})
+	e, ok := err.(*record.ErrDigestMismatch)
+	require.True(t, ok, "%v", err)
+	assert.Equal(t, "file", e.Path)
+}
+
+// TestDownloadDigestMismatch fails a download whose file doesn't match its digest at once, it is not retried.
+func TestDownloadDigestMismatch(t *testing.T) {
+	name, err := ioutil.TempDir("", "datalayer_test_download-")
+	require.NoError(t, err)
+	defer os.RemoveAll(name)
+	path, err := securefilepath.New(name)
+	require.NoError(t, err)
+	s, err := linkfs.New(path, blobdiffer.Factory{FileDiffer: variableblk.Factory{}, Digests: true})
+	require.NoError(t, err)
+
+	vsid := volumeset.NewRandomID()
+	empty, err := s.EmptyBlobID(vsid)
+	require.NoError(t, err)
+
+	vid, mnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+	require.NoError(t, err)
+	require.NoError(t, writeRandomData(filepath.Join(mnt.Path(), "file"), 64*1024))
+	target, err := s.CreateSnapshot(vsid, snapshot.NewRandomID(), vid)
+	require.NoError(t, err)
+
+	var diff bytes.Buffer
+	err = datalayer.SendDiff(s, empty, target, dlbin.Factory{}, adler32.Factory{}, &diff)
+	require.NoError(t, err)
+
+	gets := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gets++
+		w.Write(diff.Bytes())
+	}))
+	defer srv.Close()
+
+	_, _, _, err = datalayer.DownloadBlobDiff(s, dlbin.Factory{}, vsid, snapshot.NewRandomID(), blob.NilID(),
+		"token", dropWrites{executor.NewCommonExecutor()}, adler32.Factory{}, srv.URL, nil, nil)
+	e, ok := err.(*record.ErrDigestMismatch)
+	require.True(t, ok, "%v", err)
+	assert.Equal(t, "file", e.Path)
+	assert.Equal(t, 1, gets)
+}
+
+// digestStorage is a storage whose blob differ sends digests
+type digestStorage struct {
+	datalayer.Storage
+}
+
+func (digestStorage) BlobDiffer() datalayer.BlobDifferFactory {
+	return blobdiffer.Factory{FileDiffer: variableblk.Factory{}, Digests: true}
+}
+
+// TestDigestHoles verifies a sparse file with a digest record, the holes the differ skips are in the digest.
+func TestDigestHoles(t *testing.T) {
+	name, err := ioutil.TempDir("", "datalayer_test_digest_holes-")
+	require.NoError(t, err)
+	defer os.RemoveAll(name)
+	path, err := securefilepath.New(name)
+	require.NoError(t, err)
+	fss, err := fs.New(path)
+	require.NoError(t, err)
+	s := digestStorage{fss}
+
+	vsid := volumeset.NewRandomID()
+	empty, err := s.EmptyBlobID(vsid)
+	require.NoError(t, err)
+
+	const mb = 1 << 20
+	vid, mnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+	require.NoError(t, err)
+	f, err := os.Create(filepath.Join(mnt.Path(), "sparse"))
+	require.NoError(t, err)
+	_, err = f.WriteAt(bytes.Repeat([]byte("data"), mb/4), 2*mb)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(4*mb))
+	holes, err := sparse.Holes(f, 4*mb)
+	require.NoError(t, f.Close())
+	require.NoError(t, err)
+	if len(holes) == 0 {
+		t.Skip("File system doesn't report holes")
+	}
+	target, err := s.CreateSnapshot(vsid, snapshot.NewRandomID(), vid)
+	require.NoError(t, err)
+
+	var diff bytes.Buffer
+	err = datalayer.SendDiff(s, empty, target, dlbin.Factory{}, adler32.Factory{}, &diff)
+	require.NoError(t, err)
+	// Holes are not sent
+	assert.True(t, diff.Len() < 2*mb, "diff of %d bytes", diff.Len())
+
+	_, recvMnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+	require.NoError(t, err)
+	require.NoError(t, datalayer.ReceiveDiff(&diff, recvMnt, executor.NewCommonExecutor()))
+}
+
+// TestCompressedDiff sends a diff with every compression and receives it.
+func TestCompressedDiff(t *testing.T) {
+	name, err := ioutil.TempDir("", "datalayer_test_compress-")
+	require.NoError(t, err)
+	defer os.RemoveAll(name)
+	path, err := securefilepath.New(name)
+	require.NoError(t, err)
+	s, err := fs.New(path)
+	require.NoError(t, err)
+
+	vsid := volumeset.NewRandomID()
+	empty, err := s.EmptyBlobID(vsid)
+	require.NoError(t, err)
+
+	vid, mnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+	require.NoError(t, err)
+	data := bytes.Repeat([]byte("compressible "), 64*1024)
+	err = ioutil.WriteFile(filepath.Join(mnt.Path(), "file"), data, 0600)
+	require.NoError(t, err)
+	target, err := s.CreateSnapshot(vsid, snapshot.NewRandomID(), vid)
+	require.NoError(t, err)
+
+	for _, ct := range []compress.Type{compress.None, compress.Gzip, compress.Zstd, compress.S2} {
+		cf, err := datalayer.CompressionFactory(ct)
+		require.NoError(t, err)
+
+		var diff bytes.Buffer
+		err = datalayer.SendDiff(s, empty, target, compress.Wrap(dlbin.Factory{}, cf), adler32.Factory{}, &diff)
+		require.NoError(t, err)
+		if ct != compress.None {
+			require.True(t, diff.Len() < len(data)/10, "%v compressed to %d bytes", ct, diff.Len())
+		}
+
+		_, recvMnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+		require.NoError(t, err)
+		err = datalayer.ReceiveDiff(&diff, recvMnt, executor.NewCommonExecutor())
+		require.NoError(t, err, "%v", ct)
+
+		got, err := ioutil.ReadFile(filepath.Join(recvMnt.Path(), "file"))
+		require.NoError(t, err)
+		require.Equal(t, data, got)
+	}
+}
+
+// TestHashDiff sends a diff with every record checksum hash and receives it.
+func TestHashDiff(t *testing.T) {
+	name, err := ioutil.TempDir("", "datalayer_test_hash-")
+	require.NoError(t, err)
+	defer os.RemoveAll(name)
+	path, err := securefilepath.New(name)
+	require.NoError(t, err)
+	s, err := fs.New(path)
+	require.NoError(t, err)
+
+	vsid := volumeset.NewRandomID()
+	empty, err := s.EmptyBlobID(vsid)
+	require.NoError(t, err)
+
+	vid, mnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+	require.NoError(t, err)
+	require.NoError(t, writeRandomData(filepath.Join(mnt.Path(), "file"), 256*1024))
+	target, err := s.CreateSnapshot(vsid, snapshot.NewRandomID(), vid)
+	require.NoError(t, err)
+
+	want, err := ioutil.ReadFile(filepath.Join(mnt.Path(), "file"))
+	require.NoError(t, err)
+
+	for _, ht := range []dlhash.Type{dlhash.NoOp, dlhash.Adler32, dlhash.XXHash64, dlhash.XXH3, dlhash.MD5,
+		dlhash.SHA256, dlhash.BLAKE2b, dlhash.BLAKE3} {
+		hf, err := datalayer.HashFactory(ht)
+		require.NoError(t, err)
+		require.Equal(t, ht, hf.Type())
+
+		var diff bytes.Buffer
+		err = datalayer.SendDiff(s, empty, target, dlbin.Factory{}, hf, &diff)
+		require.NoError(t, err)
+
+		_, recvMnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+		require.NoError(t, err)
+		err = datalayer.ReceiveDiff(&diff, recvMnt, executor.NewCommonExecutor())
+		require.NoError(t, err, "%v", ht)
+
+		got, err := ioutil.ReadFile(filepath.Join(recvMnt.Path(), "file"))
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+}
+
+// TestEncryptedDiff receives encrypted records, streams which can't be authenticated are refused.
+func TestEncryptedDiff(t *testing.T) {
+	name, err := ioutil.TempDir("", "datalayer_test_encrypt-")
+	require.NoError(t, err)
+	defer os.RemoveAll(name)
+	path, err := securefilepath.New(name)
+	require.NoError(t, err)
+	s, err := fs.New(path)
+	require.NoError(t, err)
+
+	vsid := volumeset.NewRandomID()
+	empty, err := s.EmptyBlobID(vsid)
+	require.NoError(t, err)
+
+	vid, mnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		err = writeRandomData(filepath.Join(mnt.Path(), fmt.Sprintf("file%d", i)), 256*1024)
+		require.NoError(t, err)
+	}
+	target, err := s.CreateSnapshot(vsid, snapshot.NewRandomID(), vid)
+	require.NoError(t, err)
+
+	key, err := aesgcm.NewKey()
+	require.NoError(t, err)
+	keys := aesgcm.Keyring{"k1": key}
+	ed := aesgcm.Factory{Inner: compress.Wrap(dlbin.Factory{}, zstd.Factory{}), KeyID: "k1", Keys: keys}
+
+	var encrypted, plain bytes.Buffer
+	err = datalayer.SendDiff(s, empty, target, ed, adler32.Factory{}, &encrypted)
+	require.NoError(t, err)
+	err = datalayer.SendDiff(s, empty, target, dlbin.Factory{}, adler32.Factory{}, &plain)
+	require.NoError(t, err)
+
+	_, recvMnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+	require.NoError(t, err)
+
+	// Encrypted records without a key and records which are not encrypted are refused
+	err = datalayer.ReceiveDiff(bytes.NewReader(encrypted.Bytes()), recvMnt, executor.NewCommonExecutor())
+	require.Error(t, err)
+	err = datalayer.ReceiveDiffFrom(bytes.NewReader(plain.Bytes()), recvMnt, executor.NewCommonExecutor(),
+		datalayer.Progress{}, keys, nil)
+	require.Error(t, err)
+
+	// Interrupted half way
+	half := bytes.NewReader(encrypted.Bytes()[:encrypted.Len()/2])
+	err = datalayer.ReceiveDiffFrom(half, recvMnt, executor.NewCommonExecutor(), datalayer.Progress{}, keys, nil)
+	ei, ok := err.(*datalayer.ErrInterrupted)
+	require.True(t, ok, "unexpected error %v", err)
+
+	// Resumed from the whole stream, records applied are skipped
+	err = datalayer.ReceiveDiffFrom(bytes.NewReader(encrypted.Bytes()), recvMnt, executor.NewCommonExecutor(),
+		ei.Progress, keys, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		f := fmt.Sprintf("file%d", i)
+		want, err := ioutil.ReadFile(filepath.Join(mnt.Path(), f))
+		require.NoError(t, err)
+		got, err := ioutil.ReadFile(filepath.Join(recvMnt.Path(), f))
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+}
+
+// filePool creates a zpool on a sparse file, the returned function destroys it.
+func filePool(t *testing.T, name string) (zfs.ZFS, func()) {
+	f, err := ioutil.TempFile("", "datalayer_test_"+name+"-")
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(256*1024*1024))
+	require.NoError(t, f.Close())
+
+	out, err := exec.Command("zpool", "create", "-f", name, f.Name()).CombinedOutput()
+	require.NoError(t, err, string(out))
+	destroy := func() {
+		exec.Command("zpool", "destroy", "-f", name).Run()
+		os.Remove(f.Name())
+	}
+
+	s, err := zfs.New(name, blobdiffer.Factory{FileDiffer: variableblk.Factory{}})
+	if err != nil {
+		destroy()
+		t.Fatal(err)
+	}
+	return s, destroy
+}
+
+// TestZFSNative sends full and incremental ZFS streams between two file backed zpools.
+func TestZFSNative(t *testing.T) {
+	if !testutils.RunningAsRoot() {
+		t.Skip("Not running as superuser, skip ZFS tests.")
+	}
+	if _, err := exec.LookPath("zpool"); err != nil {
+		t.Skip("zpool not found, skip ZFS tests.")
+	}
+
+	defer zfs.Close()
+	src, destroySrc := filePool(t, "flitest-src")
+	defer destroySrc()
+	dst, destroyDst := filePool(t, "flitest-dst")
+	defer destroyDst()
+
+	vsid := volumeset.NewRandomID()
+	srcEmpty, err := src.EmptyBlobID(vsid)
+	require.NoError(t, err)
+	dstEmpty, err := dst.EmptyBlobID(vsid)
+	require.NoError(t, err)
+
+	vid, mnt, err := src.CreateVolume(vsid, srcEmpty, datalayer.NoAutoMount)
+	require.NoError(t, err)
+	require.NoError(t, writeRandomData(filepath.Join(mnt.Path(), "file1"), 1024*1024))
+	ss1 := snapshot.NewRandomID()
+	b1, err := src.CreateSnapshot(vsid, ss1, vid)
+	require.NoError(t, err)
+	require.NoError(t, writeRandomData(filepath.Join(mnt.Path(), "file2"), 1024*1024))
+	ss2 := snapshot.NewRandomID()
+	b2, err := src.CreateSnapshot(vsid, ss2, vid)
+	require.NoError(t, err)
+
+	// Full stream
+	offer, err := datalayer.OfferNative(dst, vsid, ss1, dstEmpty)
+	require.NoError(t, err)
+	require.NotNil(t, offer)
+	var diff bytes.Buffer
+	native, err := datalayer.SendNative(src, srcEmpty, b1, offer, &diff)
+	require.NoError(t, err)
+	require.True(t, native)
+	dstB1, err := datalayer.ReceiveNative(dst, &diff, vsid, ss1, dstEmpty)
+	require.NoError(t, err)
+
+	// A base the receiver doesn't have is sent as records
+	diff.Reset()
+	native, err = datalayer.SendNative(src, b1, b2, offer, &diff)
+	require.NoError(t, err)
+	require.False(t, native)
+	require.Equal(t, 0, diff.Len())
+
+	// Incremental stream
+	offer, err = datalayer.OfferNative(dst, vsid, ss2, dstB1)
+	require.NoError(t, err)
+	native, err = datalayer.SendNative(src, b1, b2, offer, &diff)
+	require.NoError(t, err)
+	require.True(t, native)
+	dstB2, err := datalayer.ReceiveNative(dst, &diff, vsid, ss2, dstB1)
+	require.NoError(t, err)
+
+	srcMnt, err := src.MountBlob(b2)
+	require.NoError(t, err)
+	defer src.Unmount(srcMnt)
+	dstMnt, err := dst.MountBlob(dstB2)
+	require.NoError(t, err)
+	defer dst.Unmount(dstMnt)
+	for _, f := range []string{"file1", "file2"} {
+		want, err := ioutil.ReadFile(filepath.Join(srcMnt, f))
+		require.NoError(t, err)
+		got, err := ioutil.ReadFile(filepath.Join(dstMnt, f))
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+}
+
+// TestNativeFallback checks storages without a native stream format always use records.
+func TestNativeFallback(t *testing.T) {
+	name, err := ioutil.TempDir("", "datalayer_test_native-")
+	require.NoError(t, err)
+	defer os.RemoveAll(name)
+	path, err := securefilepath.New(name)
+	require.NoError(t, err)
+	s, err := fs.New(path)
+	require.NoError(t, err)
+
+	vsid := volumeset.NewRandomID()
+	empty, err := s.EmptyBlobID(vsid)
+	require.NoError(t, err)
+
+	offer, err := datalayer.OfferNative(s, vsid, snapshot.NewRandomID(), empty)
+	require.NoError(t, err)
+	require.Nil(t, offer)
+
+	var diff bytes.Buffer
+	native, err := datalayer.SendNative(s, empty, empty, &protocols.NativeOffer{Stream: "zfs"}, &diff)
+	require.NoError(t, err)
+	require.False(t, native)
+	require.Equal(t, 0, diff.Len())
+
+	// A record stream is reported as such by its header
+	err = datalayer.SendDiff(s, empty, empty, dlbin.Factory{}, adler32.Factory{}, &diff)
+	require.NoError(t, err)
+	hdr, _, err := datalayer.PeekTransferHdr(&diff)
+	require.NoError(t, err)
+	require.Equal(t, transferhdr.StreamRecords, hdr.Stream)
+}
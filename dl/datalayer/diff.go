@@ -0,0 +1,268 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datalayer
+
+import (
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/ClusterHQ/fli/dl/encdec"
+	"github.com/ClusterHQ/fli/dl/encdec/aesgcm"
+	dlhash "github.com/ClusterHQ/fli/dl/hash"
+	"github.com/ClusterHQ/fli/dl/record"
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+)
+
+type (
+	// Renamed is a path renamed between two blobs
+	Renamed struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+
+	// DiffSummary is what changed between two blobs
+	DiffSummary struct {
+		Added    []string  `json:"added"`
+		Removed  []string  `json:"removed"`
+		Modified []string  `json:"modified"`
+		Renamed  []Renamed `json:"renamed"`
+
+		// AttrsChanged are paths whose owner, mode, extended attributes or modification time changed but not their
+		// content
+		AttrsChanged []string `json:"attrs_changed"`
+
+		// BytesChanged is the number of bytes written to files
+		BytesChanged uint64 `json:"bytes_changed"`
+	}
+
+	// DiffSummarizer builds a diff summary from the records of a blob diff
+	DiffSummarizer struct {
+		changes map[string]change
+		renamed []Renamed
+		bytes   uint64
+	}
+
+	// countingWriter throws away what is written to it and counts the bytes
+	countingWriter struct {
+		n uint64
+	}
+
+	// change is what happened to a path, content and attribute changes never replace a higher change
+	change int
+)
+
+const (
+	changeAttrs change = iota + 1
+	changeModified
+	changeAdded
+	changeRemoved
+)
+
+// NewDiffSummarizer returns an empty summarizer
+func NewDiffSummarizer() *DiffSummarizer {
+	return &DiffSummarizer{changes: make(map[string]change)}
+}
+
+// Add adds a record to the summary
+func (s *DiffSummarizer) Add(rec record.Record) {
+	switch r := rec.(type) {
+	case *record.Create:
+		s.add(r.Path)
+	case *record.Mkdir:
+		s.add(r.Path)
+	case *record.Symlink:
+		s.add(r.NewName)
+	case *record.Hardlink:
+		s.add(r.NewName)
+	case *record.Mknod:
+		s.add(r.Path)
+	case *record.Remove:
+		if s.changes[r.Path] == changeAdded {
+			delete(s.changes, r.Path)
+		} else {
+			s.changes[r.Path] = changeRemoved
+		}
+	case *record.Rename:
+		s.rename(r.OldPath, r.NewPath)
+	case *record.Pwrite:
+		s.bytes += uint64(len(r.Data))
+		s.set(r.Path, changeModified)
+	case *record.CopyRange:
+		s.bytes += r.Length
+		s.set(r.Path, changeModified)
+	case *record.Truncate:
+		s.set(r.Path, changeModified)
+	case *record.PunchHole:
+		s.set(r.Path, changeModified)
+	case *record.Chmod:
+		s.set(r.Path, changeAttrs)
+	case *record.Chown:
+		s.set(r.Path, changeAttrs)
+	case *record.Setxattr:
+		s.set(r.Path, changeAttrs)
+	case *record.Rmxattr:
+		s.set(r.Path, changeAttrs)
+	case *record.Setmtime:
+		s.set(r.Path, changeAttrs)
+	}
+}
+
+// add records a created path, a path removed and created again is modified
+func (s *DiffSummarizer) add(path string) {
+	if s.changes[path] == changeRemoved {
+		s.changes[path] = changeModified
+		return
+	}
+	s.changes[path] = changeAdded
+}
+
+// rename records a renamed path, a rename of a path renamed before (staged through a temporary directory) extends it
+func (s *DiffSummarizer) rename(from, to string) {
+	for i := range s.renamed {
+		if s.renamed[i].To == from {
+			s.renamed[i].To = to
+			return
+		}
+	}
+	s.renamed = append(s.renamed, Renamed{From: from, To: to})
+}
+
+func (s *DiffSummarizer) set(path string, c change) {
+	if s.changes[path] < c {
+		s.changes[path] = c
+	}
+}
+
+// Summary returns the summary of the records added so far, paths are sorted
+func (s *DiffSummarizer) Summary() *DiffSummary {
+	sum := &DiffSummary{
+		Added:        []string{},
+		Removed:      []string{},
+		Modified:     []string{},
+		Renamed:      append([]Renamed{}, s.renamed...),
+		AttrsChanged: []string{},
+		BytesChanged: s.bytes,
+	}
+
+	for path, c := range s.changes {
+		switch c {
+		case changeAdded:
+			sum.Added = append(sum.Added, path)
+		case changeRemoved:
+			sum.Removed = append(sum.Removed, path)
+		case changeModified:
+			sum.Modified = append(sum.Modified, path)
+		case changeAttrs:
+			sum.AttrsChanged = append(sum.AttrsChanged, path)
+		}
+	}
+
+	sort.Strings(sum.Added)
+	sort.Strings(sum.Removed)
+	sort.Strings(sum.Modified)
+	sort.Strings(sum.AttrsChanged)
+	return sum
+}
+
+// DiffBlobs runs the storage's blob differ between the base and the target blobs and passes the records to fn in
+// the order they are generated. The diff is cancelled if fn returns an error.
+func DiffBlobs(s Storage, baseBlobID blob.ID, targetBlobID blob.ID, hf dlhash.Factory,
+	fn func(record.Record) error) error {
+	for _, id := range []blob.ID{baseBlobID, targetBlobID} {
+		exist, err := s.SnapshotExists(id)
+		if exist == false || err != nil {
+			return errors.Errorf("Blob %v not found", id)
+		}
+	}
+
+	basePath, err := s.MountBlob(baseBlobID)
+	if err != nil {
+		return err
+	}
+	defer s.Unmount(baseBlobID.String())
+
+	targetPath, err := s.MountBlob(targetBlobID)
+	if err != nil {
+		return err
+	}
+	defer s.Unmount(targetBlobID.String())
+
+	wg := &sync.WaitGroup{}
+	errc := make(chan error, 1)
+	cancelCh := make(chan bool, 1)
+
+	wg.Add(1)
+	records := s.BlobDiffer().New(basePath, targetPath, hf, errc, cancelCh, wg)
+
+	// The differ stops after a cancel request, records are drained until it closes the channel
+	for r := range records {
+		if err != nil {
+			continue
+		}
+
+		err = fn(r)
+		if err != nil {
+			cancelCh <- true
+		}
+	}
+	wg.Wait()
+
+	select {
+	case errDiffer := <-errc:
+		return errDiffer
+	default:
+		return err
+	}
+}
+
+// EstimateBlobDiff returns the number of bytes and records an upload of the diff between the base and the target
+// blobs sends. The records are encoded like an upload, but not sent anywhere.
+func EstimateBlobDiff(s Storage, encdec encdec.Factory, hf dlhash.Factory, vsid volumeset.ID, base blob.ID,
+	targetBlobID blob.ID) (uint64, uint64, error) {
+	baseBlobID := base
+	if _, encrypted := encdec.(aesgcm.Factory); base.IsNilID() || encrypted {
+		var err error
+		baseBlobID, err = s.EmptyBlobID(vsid)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	w := &countingWriter{}
+	e := encdec.NewEncoder(w)
+
+	var records uint64
+	err := DiffBlobs(s, baseBlobID, targetBlobID, hf, func(r record.Record) error {
+		records++
+		return e.Encode([]record.Record{r})
+	})
+
+	// Flushes the end of a compressed stream
+	if c, ok := e.(io.Closer); ok && err == nil {
+		err = c.Close()
+	}
+
+	return w.n, records, err
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += uint64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datalayer
+
+import (
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/volume"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+)
+
+// Inventory of a storage. A storage which can list what it holds lets a consistency check find objects the meta
+// data store doesn't know about, for example volumes left behind by failed downloads.
+
+type (
+	// StoredObject is a blob or a volume held by a storage
+	StoredObject struct {
+		// VolSetID is the volume set the object belongs to, nil if the storage doesn't keep track of it
+		VolSetID volumeset.ID
+
+		// BlobID is set for blobs, VolumeID for volumes
+		BlobID   blob.ID
+		VolumeID volume.ID
+
+		// Name is the object's name in the storage, for example a ZFS data set
+		Name string
+
+		// Blobs are the blobs which can't be destroyed after the volume, for example the snapshots of a ZFS file
+		// system
+		Blobs []blob.ID
+	}
+
+	// Inventory is a storage which can list the objects it holds
+	Inventory interface {
+		Storage
+
+		// Objects returns all blobs and volumes in the storage, empty blobs are not included
+		Objects() ([]StoredObject, error)
+
+		// DestroyObject destroys an object returned by Objects
+		DestroyObject(StoredObject) error
+
+		// Mounted returns true if the volume is mounted at the path
+		Mounted(vsid volumeset.ID, vid volume.ID, path string) (bool, error)
+
+		// Mount mounts an existing volume which is not mounted
+		Mount(vsid volumeset.ID, vid volume.ID) error
+	}
+)
+
+// IsBlob returns true if the object is a blob
+func (o StoredObject) IsBlob() bool {
+	return !o.BlobID.IsNilID()
+}
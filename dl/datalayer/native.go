@@ -0,0 +1,210 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datalayer
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ClusterHQ/fli/dl/progress"
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+	"github.com/ClusterHQ/fli/protocols"
+	"github.com/ClusterHQ/fli/protocols/transferhdr"
+)
+
+// Native streams. A storage which has its own diff format, for example ZFS send streams, transfers blobs that way
+// to a peer with the same storage. The receiver offers the native streams it can receive, the sender sends one if
+// its storage has the same stream format and the same base blob, otherwise records are sent.
+
+type (
+	// NativeStorage is a storage which can send and receive blob diffs in its own stream format
+	NativeStorage interface {
+		Storage
+
+		// Stream returns the native stream format of the storage
+		Stream() transferhdr.Stream
+
+		// BlobGUID returns an identity of the blob which is kept when the blob is transferred natively, a native
+		// diff can only be received on top of a blob with the same identity as the diff's base. Empty blobs return
+		// "", diffs from them are full streams.
+		BlobGUID(blob.ID) (string, error)
+
+		// SendStream writes the native diff between the blobs, it continues an interrupted diff if a resume token
+		// is given.
+		SendStream(base blob.ID, target blob.ID, resumeToken string, w io.Writer) error
+
+		// ReceiveStream receives a native diff of the snapshot on top of base and returns the new blob. What was
+		// received of an interrupted diff is kept unless the next diff is not resumed.
+		ReceiveStream(vsid volumeset.ID, ssid snapshot.ID, base blob.ID, resumed bool, src io.Reader) (blob.ID,
+			error)
+
+		// ResumeToken returns the token to continue an interrupted receive of the snapshot, "" if there is none
+		ResumeToken(vsid volumeset.ID, ssid snapshot.ID) (string, error)
+	}
+)
+
+// OfferNative returns the native streams the storage can receive for the snapshot on top of base, nil if the
+// storage has no native stream format.
+func OfferNative(s Storage, vsid volumeset.ID, ssid snapshot.ID, base blob.ID) (*protocols.NativeOffer, error) {
+	ns, ok := s.(NativeStorage)
+	if !ok {
+		return nil, nil
+	}
+
+	guid, err := ns.BlobGUID(base)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := ns.ResumeToken(vsid, ssid)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocols.NativeOffer{
+		Stream:      ns.Stream().String(),
+		BaseGUID:    guid,
+		ResumeToken: token,
+	}, nil
+}
+
+// SendNative sends the native diff between the blobs if the receiver's offer accepts it. False is returned without
+// sending anything if it doesn't, the diff has to be sent as records.
+func SendNative(s Storage, baseBlobID blob.ID, targetBlobID blob.ID, offer *protocols.NativeOffer,
+	target io.Writer) (bool, error) {
+	ns, ok := s.(NativeStorage)
+	if !ok || offer == nil || offer.Stream != ns.Stream().String() {
+		return false, nil
+	}
+
+	guid, err := ns.BlobGUID(baseBlobID)
+	if err != nil {
+		return false, err
+	}
+	if guid != offer.BaseGUID {
+		return false, nil
+	}
+
+	err = writeTransferHdr(
+		target,
+		&transferhdr.Hdr{
+			Ver:          transferhdr.CurVer,
+			BaseBlobID:   baseBlobID,
+			TargetBlobID: targetBlobID,
+			Stream:       ns.Stream(),
+			ResumeToken:  offer.ResumeToken,
+		})
+	if err != nil {
+		return true, err
+	}
+
+	return true, ns.SendStream(baseBlobID, targetBlobID, offer.ResumeToken, target)
+}
+
+// ReceiveNative receives a native diff of the snapshot on top of base and returns the new blob. *ErrInterrupted is
+// returned if the diff ends early and can be resumed.
+func ReceiveNative(s Storage, src io.Reader, vsid volumeset.ID, ssid snapshot.ID, base blob.ID) (blob.ID, error) {
+	hdr, err := readTransferHdr(src)
+	if err != nil {
+		return blob.NilID(), err
+	}
+
+	if hdr.Ver < transferhdr.MinVer || hdr.Ver > transferhdr.CurVer {
+		return blob.NilID(), errors.Errorf("Version %v is not supported, current version is %v.", hdr.Ver,
+			transferhdr.CurVer)
+	}
+
+	ns, ok := s.(NativeStorage)
+	if !ok || hdr.Stream != ns.Stream() {
+		return blob.NilID(), errors.Errorf("Storage can't receive %v streams", hdr.Stream)
+	}
+
+	blobid, err := ns.ReceiveStream(vsid, ssid, base, hdr.ResumeToken != "", src)
+	if err != nil {
+		if token, errToken := ns.ResumeToken(vsid, ssid); errToken == nil && token != "" {
+			return blob.NilID(), &ErrInterrupted{Err: err}
+		}
+		return blob.NilID(), err
+	}
+
+	return blobid, nil
+}
+
+// downloadNative asks the data server for a native diff and receives it. False is returned if the storage has no
+// native stream format or the data server sends records, the diff has to be downloaded as records then.
+func downloadNative(s Storage, vsid volumeset.ID, ssid snapshot.ID, baseBlobID blob.ID, token string,
+	dspuburl string, tr *progress.Tracker) (blob.ID, bool, error) {
+	for retry := 0; ; retry++ {
+		blobid, native, err := downloadNativeOnce(s, vsid, ssid, baseBlobID, token, dspuburl, tr)
+		if err == nil || !native || !retryable(err) || retry == MaxTransferRetries {
+			return blobid, native, err
+		}
+
+		log.Printf("Download of snapshot %v interrupted(%v), retry %d of %d", ssid, err, retry+1,
+			MaxTransferRetries)
+		time.Sleep(time.Duration(retry+1) * TransferRetryDelay)
+	}
+}
+
+func downloadNativeOnce(s Storage, vsid volumeset.ID, ssid snapshot.ID, baseBlobID blob.ID, token string,
+	dspuburl string, tr *progress.Tracker) (blob.ID, bool, error) {
+	offer, err := OfferNative(s, vsid, ssid, baseBlobID)
+	if err != nil || offer == nil {
+		return blob.NilID(), false, err
+	}
+
+	dlURL := makeDownloadURL(dspuburl, token) +
+		"&" + protocols.HTTPFieldStream + "=" + url.QueryEscape(offer.Stream) +
+		"&" + protocols.HTTPFieldBaseGUID + "=" + url.QueryEscape(offer.BaseGUID)
+	if offer.ResumeToken != "" {
+		log.Printf("Resuming download of snapshot %v", ssid)
+		dlURL += "&" + protocols.HTTPFieldResumeToken + "=" + url.QueryEscape(offer.ResumeToken)
+	}
+	req, err := http.NewRequest("GET", dlURL, nil)
+	if err != nil {
+		return blob.NilID(), true, errors.New(err)
+	}
+
+	protocols.SetCorrelationID(req, protocols.GenerateCorrelationID())
+	resp, err := protocols.GetClient().Do(req)
+	if err != nil {
+		return blob.NilID(), true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return blob.NilID(), true, httpStatusError("download", resp)
+	}
+
+	hdr, src, err := PeekTransferHdr(resp.Body)
+	if err != nil {
+		return blob.NilID(), true, &ErrInterrupted{Err: err}
+	}
+	if hdr.Stream == transferhdr.StreamRecords {
+		// The data server can't send a native diff
+		return blob.NilID(), false, nil
+	}
+
+	blobid, err := ReceiveNative(s, tr.Reader(src), vsid, ssid, baseBlobID)
+	return blobid, true, err
+}
@@ -39,9 +39,8 @@ import (
  * generate a sequence of instructions that allow reconstruction of the target
  * snapshot from the origin snapshot.
  *
- * It is analogous to a compiler in that it has a front end and a backend. At
- * present, there is only the first stage, but in the near future, we will have
- * 3 main stages:
+ * It is analogous to a compiler in that it has a front end and a backend. It
+ * has 3 main stages:
  *
  *	* Stage 1	Parsing - We traverse the snapshots to determine which
  *			files are different while populating data structures.
@@ -130,6 +129,27 @@ import (
  * easily while the directory case would require a constraint, although it is
  * going to be handled by the receiver (Serge's suggestion).
  *
+ * Stage 2 is done with a fixed ordering of the operations instead of the
+ * constraint heap described below. Stage 1 emits differences of common paths
+ * right away and collects the unlinks, links, mkdirs and rmdirs. Stage 2 then
+ * turns an inode that is a regular file unlinked in the origin and linked in
+ * the target, with no path common to both, into a rename. A rename onto a path
+ * that is still in use when renames are done (a directory removed later or the
+ * source of another rename) or from a path where a new directory is made is
+ * staged through a temporary directory. Stage 3 emits, in order:
+ *
+ *	* Unlinks of files that are gone
+ *	* Renames into the temporary directory
+ *	* Mkdirs (pre-order)
+ *	* Renames straight to the final location
+ *	* Rmdirs (post-order)
+ *	* Renames out of the temporary directory
+ *	* Links and creates of new files
+ *	* Rmdir of the temporary directory
+ *
+ * A renamed file is differenced against its origin path after the rename if
+ * it was modified.
+ *
  * There are 3 main data structures involved in the 3 stages:
  *
  *	* The inode dictionary
@@ -179,6 +199,9 @@ const sliceGrowthFactor int = 2
 /* XXX: Verify this is large enough to trigger zfetch */
 const getdentsBufSize int = 1048576
 
+/* Name of the directory renames are staged in, a suffix is added if it exists */
+const tmpDirName string = ".fli-delta-tmp"
+
 /* Linux-specific constants that the go runtime does not tell us. */
 const oDirectory int = 0200000
 const atFdcwd int = -100
@@ -224,16 +247,12 @@ type parseLocation int
  *	This is expected to handle block devices, character devices, fifos and
  *	unix domain sockets.
  *
- * MkTmpDir(path string) - Not implemented yet
- *	path to make directory with default permissions. It is to be empty at
- *	the end and also unlinked. The only valid operation involving this
- *	directory is Rename.
- *
- * Rename(src string, dst string) - Not implemented yet
+ * Rename(src string, dst string)
  *	Neither of these need correspond to things in the origin or target
  *	snapshots. It just needs to be sent to the other side to enable us to
- *	perform a POSIX conformant transofmration of the hierachy. This is used
- *	in conjunction with MkTmpDir.
+ *	perform a POSIX conformant transofmration of the hierachy. Renames
+ *	through the temporary directory use Mkdir and Rmdir on a path that is
+ *	in neither snapshot to make and remove it.
  *
  * Operational methods:
  * ErrorChannel() chan<- error
@@ -250,6 +269,7 @@ type DifferenceOperations interface {
 	Rmdir(string) error
 	Mkdir(string) error
 	Mknod(string) error
+	Rename(string, string) error
 
 	// Stop checks if the differ needs to stop because of cancellation or error had happened
 	Stop() bool
@@ -318,6 +338,17 @@ type State struct {
 	getdentsBuf   []byte     // Cached buffer
 	diffOps       DifferenceOperations
 	xattrMetadata bool
+	unlinks       []pathRef // Non-directories unique to the origin
+	links         []pathRef // Non-directories unique to the target
+	mkdirs        []string  // Directories unique to the target, pre-order
+	rmdirs        []string  // Directories unique to the origin, post-order
+}
+
+/* pathRef is a path collected by stage 1 and the inode it refers to */
+type pathRef struct {
+	path  string
+	index uint64 // Index into the inoderef slice
+	Type  uint8
 }
 
 // dirEntSortBySame is for sorting slices of dirent
@@ -703,15 +734,14 @@ func (g *State) addToInodeMap(d *dirEnt, l parseLocation) error {
 	iref.ino = d.ino
 	path := filepath.Join(d.DirName, d.BaseName)
 
-	/* We print here to show where we can do diff, link, unlink
-	 * operations if using only the parser. However, this does not
-	 * preserve hardlinks or handle rename properly.
+	/* Differences of common paths are emitted right away, everything else
+	 * is collected for link analysis.
 	 */
 	var err error
 	switch l {
 	case seenCommon:
 		diff, _ := g.isDiff(path, path)
-		if !exists && diff {
+		if len(iref.commonPath) == 0 && diff {
 			err = g.diffOps.ResolveDiff(path, path)
 			if err != nil {
 				break
@@ -724,75 +754,38 @@ func (g *State) addToInodeMap(d *dirEnt, l parseLocation) error {
 		break
 	case seenOrigin:
 		if d.Type == syscall.DT_DIR {
-			err = g.diffOps.Rmdir(path)
-			if err != nil {
-				break
-			}
+			g.rmdirs = append(g.rmdirs, path)
 		} else {
-			err = g.diffOps.Unlink(path)
-			if err != nil {
-				break
-			}
+			g.unlinks = append(g.unlinks, pathRef{path: path, index: index, Type: d.Type})
 		}
 		iref.originType = d.Type
 		iref.unlinkPath = stringSlice(iref.unlinkPath).add(path)
 		break
 	case seenTarget:
 		if d.Type == syscall.DT_DIR {
-			err = g.diffOps.Mkdir(path)
-			if err != nil {
-				break
-			}
+			g.mkdirs = append(g.mkdirs, path)
 		} else {
-			var link *string
-			if len(iref.commonPath) > 0 {
-				link = &iref.commonPath[0]
-			} else if len(iref.linkPath) > 0 {
-				link = &iref.linkPath[0]
-			}
-
-			if link != nil {
-				err = g.diffOps.Link(path, *link)
-				if err != nil {
-					break
-				}
-			} else {
-				if g.xattrMetadata && d.Type == syscall.DT_REG {
-					xattr, err := xattr.Getxattr(path, record.XattrPrefix+"devmode")
-					if err == nil {
-						devmode, err := strconv.ParseInt(string(xattr), 0, 32)
-						if err != nil {
-							log.Println("Error: failed to parse devmode ", string(xattr))
-							/*XXX: Add error handling */
-						} else {
-							if (devmode & syscall.S_IFBLK) != 0 {
-								d.Type = syscall.DT_BLK
-							} else if (devmode & syscall.S_IFCHR) != 0 {
-								d.Type = syscall.DT_CHR
-							} else if (devmode & syscall.S_IFIFO) != 0 {
-								d.Type = syscall.DT_FIFO
-							} else if (devmode & syscall.S_IFSOCK) != 0 {
-								d.Type = syscall.DT_SOCK
-							}
+			if g.xattrMetadata && d.Type == syscall.DT_REG {
+				xattr, err := xattr.Getxattr(path, record.XattrPrefix+"devmode")
+				if err == nil {
+					devmode, err := strconv.ParseInt(string(xattr), 0, 32)
+					if err != nil {
+						log.Println("Error: failed to parse devmode ", string(xattr))
+						/*XXX: Add error handling */
+					} else {
+						if (devmode & syscall.S_IFBLK) != 0 {
+							d.Type = syscall.DT_BLK
+						} else if (devmode & syscall.S_IFCHR) != 0 {
+							d.Type = syscall.DT_CHR
+						} else if (devmode & syscall.S_IFIFO) != 0 {
+							d.Type = syscall.DT_FIFO
+						} else if (devmode & syscall.S_IFSOCK) != 0 {
+							d.Type = syscall.DT_SOCK
 						}
 					}
 				}
-				switch d.Type {
-				case syscall.DT_LNK:
-					err = g.diffOps.Symlink(path)
-					break
-				case syscall.DT_REG:
-					err = g.diffOps.Create(path)
-					break
-				case syscall.DT_BLK, syscall.DT_CHR, syscall.DT_FIFO, syscall.DT_SOCK:
-					err = g.diffOps.Mknod(path)
-					break
-				default:
-					log.Println("Error: unknown type ", d.Type)
-					/*XXX: Add error handling */
-					break
-				}
 			}
+			g.links = append(g.links, pathRef{path: path, index: index, Type: d.Type})
 		}
 		iref.targetType = d.Type
 		iref.linkPath = stringSlice(iref.linkPath).add(path)
@@ -802,6 +795,190 @@ func (g *State) addToInodeMap(d *dirEnt, l parseLocation) error {
 	return err
 }
 
+/* renamed tells whether stage 2 turns the unlink and link of an inode into a
+ * rename. Only regular files are renamed, other types are cheap to recreate
+ * and directories are recreated with their contents moved into them. An inode
+ * with a path common to both snapshots is linked to that path instead.
+ */
+func (g *State) renamed(iref *inoderef) bool {
+	return len(iref.commonPath) == 0 && len(iref.unlinkPath) > 0 && len(iref.linkPath) > 0 &&
+		iref.originType == syscall.DT_REG && iref.targetType == syscall.DT_REG
+}
+
+/* tmpDir returns the name of the directory renames are staged in. The name is
+ * deterministic and in neither snapshot.
+ */
+func (g *State) tmpDir() (string, error) {
+	for i := 0; ; i++ {
+		name := tmpDirName
+		if i > 0 {
+			name += "." + strconv.Itoa(i)
+		}
+
+		_, errOrigin := os.Lstat(filepath.Join(g.originPrefix, name))
+		_, errTarget := os.Lstat(filepath.Join(g.targetPrefix, name))
+		if os.IsNotExist(errOrigin) && os.IsNotExist(errTarget) {
+			return name, nil
+		}
+
+		if errOrigin != nil && !os.IsNotExist(errOrigin) {
+			return "", errOrigin
+		}
+		if errTarget != nil && !os.IsNotExist(errTarget) {
+			return "", errTarget
+		}
+	}
+}
+
+/* rename moves a renamed file to dst and differences it against its origin
+ * path if it was modified.
+ */
+func (g *State) rename(origin string, src string, dst string) error {
+	err := g.diffOps.Rename(src, dst)
+	if err != nil {
+		return err
+	}
+
+	diff, _ := g.isDiff(origin, dst)
+	if diff {
+		return g.diffOps.ResolveDiff(origin, dst)
+	}
+	return nil
+}
+
+/* create recreates a non-directory unique to the target */
+func (g *State) create(l pathRef) error {
+	switch l.Type {
+	case syscall.DT_LNK:
+		return g.diffOps.Symlink(l.path)
+	case syscall.DT_REG:
+		return g.diffOps.Create(l.path)
+	case syscall.DT_BLK, syscall.DT_CHR, syscall.DT_FIFO, syscall.DT_SOCK:
+		return g.diffOps.Mknod(l.path)
+	default:
+		log.Println("Error: unknown type ", l.Type)
+		/*XXX: Add error handling */
+		return nil
+	}
+}
+
+/* generateDelta does link analysis on what stage 1 collected and emits the
+ * operations in the order described at the top of this file.
+ */
+func (g *State) generateDelta() error {
+	if g.diffOps.Stop() {
+		return nil
+	}
+
+	/* Origin paths that are still there when renames are done */
+	inUse := make(map[string]bool)
+	for _, path := range g.rmdirs {
+		inUse[path] = true
+	}
+
+	newDirs := make(map[string]bool)
+	for _, path := range g.mkdirs {
+		newDirs[path] = true
+	}
+
+	var renames []uint64
+	for _, u := range g.unlinks {
+		iref := &g.inodeSlice[u.index]
+		if g.renamed(iref) && u.path == iref.unlinkPath[0] {
+			renames = append(renames, u.index)
+			inUse[u.path] = true
+			continue
+		}
+
+		if err := g.diffOps.Unlink(u.path); err != nil {
+			return err
+		}
+	}
+
+	var (
+		direct, staged []uint64
+		tmp            string
+		err            error
+	)
+	for _, index := range renames {
+		iref := &g.inodeSlice[index]
+		src, dst := iref.unlinkPath[0], iref.linkPath[0]
+		if !inUse[dst] && !newDirs[src] {
+			direct = append(direct, index)
+			continue
+		}
+
+		if len(staged) == 0 {
+			if tmp, err = g.tmpDir(); err != nil {
+				return err
+			}
+			if err = g.diffOps.Mkdir(tmp); err != nil {
+				return err
+			}
+		}
+
+		err = g.diffOps.Rename(src, filepath.Join(tmp, strconv.FormatUint(iref.ino, 10)))
+		if err != nil {
+			return err
+		}
+		staged = append(staged, index)
+	}
+
+	for _, path := range g.mkdirs {
+		if err = g.diffOps.Mkdir(path); err != nil {
+			return err
+		}
+	}
+
+	for _, index := range direct {
+		iref := &g.inodeSlice[index]
+		err = g.rename(iref.unlinkPath[0], iref.unlinkPath[0], iref.linkPath[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, path := range g.rmdirs {
+		if err = g.diffOps.Rmdir(path); err != nil {
+			return err
+		}
+	}
+
+	for _, index := range staged {
+		iref := &g.inodeSlice[index]
+		err = g.rename(iref.unlinkPath[0], filepath.Join(tmp, strconv.FormatUint(iref.ino, 10)), iref.linkPath[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, l := range g.links {
+		if g.diffOps.Stop() {
+			return nil
+		}
+
+		iref := &g.inodeSlice[l.index]
+		switch {
+		case len(iref.commonPath) > 0:
+			err = g.diffOps.Link(l.path, iref.commonPath[0])
+		case l.path != iref.linkPath[0]:
+			err = g.diffOps.Link(l.path, iref.linkPath[0])
+		case g.renamed(iref):
+			/* Moved into place above */
+		default:
+			err = g.create(l)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(staged) > 0 {
+		return g.diffOps.Rmdir(tmp)
+	}
+	return nil
+}
+
 /* processUniqueSubtree is a helper function for processCommonSubtree. It handles
  * subtrees that exist on only the origin or the target snapshot. It
  * recursively traverses the subtree and adds entries to the inode map. See the
@@ -1006,40 +1183,6 @@ func (g *State) processCommonSubtree(fd []int, path string) error {
 				}
 				i++
 			} else {
-				/*
-				 * If origin.Ents and target.Ents have a name
-				 * collision between different inodes, we must
-				 * avoid the situation where they are processed
-				 * in the wrong order by processing the one in
-				 * origin.Ents first. This would happen if the
-				 * origin inode number is greater than the
-				 * target inode number. When this happens, we
-				 * would emit create and then unlink without
-				 * this kludge. With this kludge, we find the
-				 * collision, swap the entry with the next one
-				 * in origin.Ents and process it first to avoid
-				 * this condition.
-				 *
-				 * XXX: We should optimize this by identifying
-				 * collisions in advance and processing them
-				 * once, rather than checking each time a
-				 * collision might be possible. This is not a
-				 * commonly executed codepath and this code
-				 * will likely change once hardlinks are
-				 * handled properly, so this is left as an
-				 * exercise for then.
-				 */
-				for index, entry := range origin.Ents[i:] {
-					if strings.Compare(entry.BaseName, e.BaseName) == 0 {
-						origin.Ents[i], origin.Ents[index] = origin.Ents[index], origin.Ents[i]
-						err = g.addToInodeMap(&entry, seenOrigin)
-						if err != nil {
-							return err
-						}
-						i++
-						break
-					}
-				}
 				err = g.addToInodeMap(e, seenTarget)
 				if err != nil {
 					return err
@@ -1103,7 +1246,8 @@ func (g *State) processCommonSubtree(fd []int, path string) error {
 }
 
 // DoParsing does a depth first search traversal of the filesystem using the
-// openat and getdents system calls to generate a parse graph. Each directory
+// openat and getdents system calls to generate a parse graph, then does link
+// analysis and generates the rest of the delta. Each directory
 // has 1 open() operation and 1 or more getdents operations on each snapshot.
 // The number of getdents operations can be reduced on snapshots with large
 // directories by increasing getdentsBufSize. Absolute paths are used for the
@@ -1126,10 +1270,22 @@ func (g *State) DoParsing() error {
 		}
 	}
 
+	/* The root is common to both snapshots, but it is not a directory entry */
+	if err == nil {
+		diff, _ := g.isDiff(".", ".")
+		if diff {
+			err = g.diffOps.ResolveDiff(".", ".")
+		}
+	}
+
 	if err == nil {
 		err = g.processCommonSubtree(fd, "")
 	}
 
+	if err == nil {
+		err = g.generateDelta()
+	}
+
 	for i--; i >= 0; i-- {
 		/*
 		 * Failing here should imply a bug in the code closed a file
@@ -0,0 +1,258 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package delta_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ClusterHQ/fli/dl/delta"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	// applier applies the operations to a copy of the origin and records them
+	applier struct {
+		target string
+		work   string
+		calls  []string
+	}
+
+	// tree lists the files of a snapshot, files with the same inode name map to hard links of one file
+	tree map[string]string
+)
+
+var _ delta.DifferenceOperations = &applier{}
+
+func (a *applier) record(op string, args ...string) {
+	a.calls = append(a.calls, op+" "+strings.Join(args, " "))
+}
+
+func (a *applier) copyFile(path string) error {
+	data, err := ioutil.ReadFile(filepath.Join(a.target, path))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(a.work, path), data, 0644)
+}
+
+func (a *applier) ResolveDiff(origin string, target string) error {
+	fi, err := os.Lstat(filepath.Join(a.target, target))
+	if err != nil || fi.IsDir() {
+		return err
+	}
+	a.record("ResolveDiff", origin, target)
+	return a.copyFile(target)
+}
+
+func (a *applier) Create(path string) error {
+	a.record("Create", path)
+	return a.copyFile(path)
+}
+
+func (a *applier) Link(path string, dst string) error {
+	a.record("Link", path, dst)
+	return os.Link(filepath.Join(a.work, dst), filepath.Join(a.work, path))
+}
+
+func (a *applier) Symlink(path string) error {
+	a.record("Symlink", path)
+	oldname, err := os.Readlink(filepath.Join(a.target, path))
+	if err != nil {
+		return err
+	}
+	return os.Symlink(oldname, filepath.Join(a.work, path))
+}
+
+func (a *applier) Unlink(path string) error {
+	a.record("Unlink", path)
+	return os.Remove(filepath.Join(a.work, path))
+}
+
+func (a *applier) Rmdir(path string) error {
+	a.record("Rmdir", path)
+	return os.Remove(filepath.Join(a.work, path))
+}
+
+func (a *applier) Mkdir(path string) error {
+	a.record("Mkdir", path)
+	return os.Mkdir(filepath.Join(a.work, path), 0755)
+}
+
+func (a *applier) Mknod(path string) error {
+	return fmt.Errorf("unexpected mknod %s", path)
+}
+
+func (a *applier) Rename(src string, dst string) error {
+	a.record("Rename", src, dst)
+	return os.Rename(filepath.Join(a.work, src), filepath.Join(a.work, dst))
+}
+
+func (a *applier) Stop() bool {
+	return false
+}
+
+// build makes the files of the tree under dir, a file is hard linked to the inode's file in inodes so the same inode
+// name in the origin and target is the same inode
+func build(t *testing.T, dir string, files tree, inodes string) {
+	for path, ino := range files {
+		p := filepath.Join(dir, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+
+		src := filepath.Join(inodes, ino)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			require.NoError(t, ioutil.WriteFile(src, []byte("data of "+ino), 0644))
+		}
+		require.NoError(t, os.Link(src, p))
+	}
+}
+
+// copyTree copies the directories and file contents of src to dst
+func copyTree(t *testing.T, src string, dst string) {
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dst, rel), data, 0644)
+	})
+	require.NoError(t, err)
+}
+
+// contents returns the files of a tree and their data, directories have no data
+func contents(t *testing.T, dir string) map[string]string {
+	m := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			m[rel+"/"] = ""
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		m[rel] = string(data)
+		return err
+	})
+	require.NoError(t, err)
+	return m
+}
+
+func TestRename(t *testing.T) {
+	tests := []struct {
+		name    string
+		origin  tree
+		target  tree
+		renames int
+		creates int
+	}{
+		{
+			name:    "move",
+			origin:  tree{"a": "1", "b": "2"},
+			target:  tree{"c": "1", "b": "2"},
+			renames: 1,
+		},
+		{
+			name:    "into new directory",
+			origin:  tree{"dir/a": "1"},
+			target:  tree{"new/a": "1"},
+			renames: 1,
+		},
+		{
+			name:    "file replaces its directory",
+			origin:  tree{"foo/bar": "1"},
+			target:  tree{"foo": "1"},
+			renames: 2,
+		},
+		{
+			name:    "directory replaces its file",
+			origin:  tree{"foo": "1"},
+			target:  tree{"foo/bar": "1"},
+			renames: 2,
+		},
+		{
+			name:    "swap",
+			origin:  tree{"a": "1", "b": "2"},
+			target:  tree{"a": "2", "b": "1"},
+			renames: 4,
+		},
+		{
+			name:    "hard links",
+			origin:  tree{"a": "1", "b": "1"},
+			target:  tree{"c": "1", "d": "1", "e": "3"},
+			renames: 1,
+			creates: 1,
+		},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "delta_test-")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		origin := filepath.Join(dir, "origin")
+		target := filepath.Join(dir, "target")
+		inodes := filepath.Join(dir, "inodes")
+		for _, d := range []string{origin, target, inodes} {
+			require.NoError(t, os.Mkdir(d, 0755))
+		}
+		build(t, origin, test.origin, inodes)
+		build(t, target, test.target, inodes)
+
+		a := &applier{target: target, work: filepath.Join(dir, "work")}
+		copyTree(t, origin, a.work)
+
+		err = delta.Alloc(origin, target, a, false).DoParsing()
+		require.NoError(t, err, test.name)
+		require.Equal(t, contents(t, target), contents(t, a.work), "%s: %v", test.name, a.calls)
+
+		var renames, creates int
+		for _, c := range a.calls {
+			switch {
+			case strings.HasPrefix(c, "Rename "):
+				renames++
+			case strings.HasPrefix(c, "Create "):
+				creates++
+			case strings.HasPrefix(c, "ResolveDiff "):
+				t.Errorf("%s: unmodified file differenced: %v", test.name, a.calls)
+			}
+		}
+		require.Equal(t, test.renames, renames, "%s: %v", test.name, a.calls)
+		require.Equal(t, test.creates, creates, "%s: %v", test.name, a.calls)
+
+		_, err = os.Lstat(filepath.Join(a.work, ".fli-delta-tmp"))
+		require.True(t, os.IsNotExist(err), test.name)
+	}
+}
@@ -0,0 +1,295 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package aesgcm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/ClusterHQ/fli/dl/compress"
+	"github.com/ClusterHQ/fli/dl/encdec"
+	"github.com/ClusterHQ/fli/dl/record"
+	"github.com/ClusterHQ/fli/errors"
+)
+
+// A stream starts with a preamble in clear text, the inner enc/dec type and compression of the batches and a random
+// salt, followed by one sealed frame per batch of records:
+//
+//	preamble: inner type(uint64) | compression(uint64) | salt(32 bytes)
+//	frame:    length(uint32) | AES-256-GCM ciphertext and tag
+//
+// Each stream is encrypted with its own key, HMAC-SHA256(key, salt), the nonce of a frame is its sequence number in
+// the stream so frames can't be dropped, reordered or taken from another stream. The key ID and the preamble are the
+// additional data of every frame.
+
+type (
+	// Keyring holds 256 bit keys by key ID
+	Keyring map[string][]byte
+
+	// Factory is a helper for creating encoders/decoders which encrypt batches of records encoded by an inner
+	// encoder/decoder with AES-256-GCM
+	Factory struct {
+		// Inner encodes a batch of records before it is encrypted, its encoders and decoders are closed after
+		// each batch if they implement io.Closer
+		Inner encdec.Factory
+
+		// KeyID is the ID of the key in Keys records are encrypted or decrypted with
+		KeyID string
+
+		// Keys are the keys known to the factory
+		Keys Keyring
+
+		// Resolve returns the inner encoder/decoder a stream being decoded was encoded with, Inner is used if it is
+		// nil
+		Resolve func(encdec.Type, compress.Type) (encdec.Factory, error)
+	}
+
+	// ErrUnknownKey is returned if a stream is encrypted with a key which is not in the key ring
+	ErrUnknownKey struct {
+		KeyID string
+	}
+
+	// ErrNotAuthenticated is returned if a frame of a stream fails authentication
+	ErrNotAuthenticated struct{}
+
+	encoder struct {
+		f      Factory
+		target io.Writer
+		aead   cipher.AEAD
+		ad     []byte
+		seq    uint64
+		err    error
+	}
+
+	decoder struct {
+		f     Factory
+		src   io.Reader
+		inner encdec.Factory
+		aead  cipher.AEAD
+		ad    []byte
+		seq   uint64
+	}
+)
+
+const (
+	// KeySize is the size of keys in bytes
+	KeySize = 32
+
+	saltSize = 32
+
+	// maxFrameSize limits the memory a corrupted frame length can make the decoder allocate
+	maxFrameSize = 1 << 30
+)
+
+var (
+	_ encdec.Factory = Factory{}
+	_ encdec.Encoder = &encoder{}
+	_ encdec.Decoder = &decoder{}
+)
+
+// NewKey returns a new random key
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// NewEncoder returns a new encoder, the preamble is written by the first Encode()
+func (f Factory) NewEncoder(target io.Writer) encdec.Encoder {
+	return &encoder{f: f, target: target}
+}
+
+// NewDecoder returns a new decoder, the preamble is read by the first Decode()
+func (f Factory) NewDecoder(src io.Reader) encdec.Decoder {
+	return &decoder{f: f, src: src}
+}
+
+// Type returns the encoder/decoder's type
+func (f Factory) Type() encdec.Type {
+	return encdec.AESGCM
+}
+
+// newAEAD returns the cipher of a stream and the additional data of its frames.
+func (f Factory) newAEAD(preamble []byte) (cipher.AEAD, []byte, error) {
+	key, ok := f.Keys[f.KeyID]
+	if !ok {
+		return nil, nil, &ErrUnknownKey{KeyID: f.KeyID}
+	}
+	if len(key) != KeySize {
+		return nil, nil, errors.Errorf("Key %s is %d bytes, expected %d", f.KeyID, len(key), KeySize)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(preamble[len(preamble)-saltSize:])
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ad := append([]byte(f.KeyID), preamble...)
+	return aead, ad, nil
+}
+
+// nonce returns the nonce of a frame
+func nonce(aead cipher.AEAD, seq uint64) []byte {
+	n := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-8:], seq)
+	return n
+}
+
+// start writes the preamble and sets up the cipher
+func (e *encoder) start() error {
+	var compression compress.Type
+	if c, ok := e.f.Inner.(compress.Compressed); ok {
+		compression = c.Compression()
+	}
+
+	preamble := make([]byte, 16+saltSize)
+	binary.LittleEndian.PutUint64(preamble, uint64(e.f.Inner.Type()))
+	binary.LittleEndian.PutUint64(preamble[8:], uint64(compression))
+	_, err := rand.Read(preamble[16:])
+	if err != nil {
+		return err
+	}
+
+	e.aead, e.ad, err = e.f.newAEAD(preamble)
+	if err != nil {
+		return err
+	}
+
+	_, err = e.target.Write(preamble)
+	return err
+}
+
+// Encode implements encoder
+func (e *encoder) Encode(recs []record.Record) error {
+	if e.err != nil {
+		return e.err
+	}
+
+	if e.aead == nil {
+		e.err = e.start()
+		if e.err != nil {
+			return e.err
+		}
+	}
+
+	var buf bytes.Buffer
+	inner := e.f.Inner.NewEncoder(&buf)
+	err := inner.Encode(recs)
+	if err != nil {
+		return err
+	}
+	if c, ok := inner.(io.Closer); ok {
+		err = c.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	frame := e.aead.Seal(nil, nonce(e.aead, e.seq), buf.Bytes(), e.ad)
+	e.seq++
+
+	err = binary.Write(e.target, binary.LittleEndian, uint32(len(frame)))
+	if err != nil {
+		return err
+	}
+
+	_, err = e.target.Write(frame)
+	return err
+}
+
+// start reads the preamble and sets up the cipher
+func (d *decoder) start() error {
+	preamble := make([]byte, 16+saltSize)
+	_, err := io.ReadFull(d.src, preamble)
+	if err != nil {
+		return err
+	}
+
+	d.inner = d.f.Inner
+	if d.f.Resolve != nil {
+		d.inner, err = d.f.Resolve(encdec.Type(binary.LittleEndian.Uint64(preamble)),
+			compress.Type(binary.LittleEndian.Uint64(preamble[8:])))
+		if err != nil {
+			return err
+		}
+	}
+
+	d.aead, d.ad, err = d.f.newAEAD(preamble)
+	return err
+}
+
+// Decode implements decoder
+func (d *decoder) Decode() ([]record.Record, error) {
+	if d.aead == nil {
+		err := d.start()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var n uint32
+	err := binary.Read(d.src, binary.LittleEndian, &n)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > maxFrameSize {
+		return nil, &ErrNotAuthenticated{}
+	}
+
+	frame := make([]byte, n)
+	_, err = io.ReadFull(d.src, frame)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := d.aead.Open(frame[:0], nonce(d.aead, d.seq), frame, d.ad)
+	if err != nil {
+		return nil, &ErrNotAuthenticated{}
+	}
+	d.seq++
+
+	inner := d.inner.NewDecoder(bytes.NewReader(plain))
+	if c, ok := inner.(io.Closer); ok {
+		defer c.Close()
+	}
+	return inner.Decode()
+}
+
+func (e *ErrUnknownKey) Error() string {
+	return "Encryption key " + e.KeyID + " not found"
+}
+
+func (e *ErrNotAuthenticated) Error() string {
+	return "Records failed authentication, they are corrupted or were not encrypted with the key given"
+}
@@ -132,6 +132,12 @@ func (d *decoder) Decode() ([]record.Record, error) {
 			r = record.NewSetMtime("", time.Time{})
 		case record.TypeEOT:
 			r = record.NewEOT()
+		case record.TypeCopyRange:
+			r = record.NewCopyRange("", 0, 0, 0)
+		case record.TypePunchHole:
+			r = record.NewPunchHole("", 0, 0)
+		case record.TypeDigest:
+			r = record.NewDigest("", nil)
 		}
 
 		if r == nil {
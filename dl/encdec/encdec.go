@@ -52,4 +52,7 @@ const (
 
 	// Gob type for Gob encoder/decoder
 	Gob
+
+	// AESGCM type for encoder/decoder which encrypts the records of another encoder/decoder
+	AESGCM
 )
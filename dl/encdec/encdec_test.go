@@ -25,6 +25,7 @@ import (
 	"time"
 
 	"github.com/ClusterHQ/fli/dl/encdec"
+	"github.com/ClusterHQ/fli/dl/encdec/aesgcm"
 	dlbin "github.com/ClusterHQ/fli/dl/encdec/binary"
 	dlgob "github.com/ClusterHQ/fli/dl/encdec/gob"
 	dlhash "github.com/ClusterHQ/fli/dl/hash"
@@ -89,6 +90,9 @@ func test(t *testing.T, ed encdec.Factory, hf dlhash.Factory) {
 	rmxattr := record.NewRmXattr(path, attr)
 	setxattr := record.NewSetXattr(path, attr, []byte(val))
 	rmStrangeFile := record.NewRemove(strangepath)
+	copyRange := record.NewCopyRange(filename, offset, uint64(size), uint64(len(data)))
+	punchHole := record.NewPunchHole(filename, offset, uint64(len(data)))
+	digest := record.NewDigest(filename, data)
 	eot := record.NewEOT()
 
 	allrecords := []record.Record{
@@ -107,6 +111,9 @@ func test(t *testing.T, ed encdec.Factory, hf dlhash.Factory) {
 		rmxattr,
 		setxattr,
 		rmStrangeFile,
+		copyRange,
+		punchHole,
+		digest,
 		eot,
 	}
 	for _, r := range allrecords {
@@ -133,6 +140,9 @@ func test(t *testing.T, ed encdec.Factory, hf dlhash.Factory) {
 			chmod,
 			mtime,
 			rmStrangeFile,
+			copyRange,
+			punchHole,
+			digest,
 			eot,
 		},
 		ed,
@@ -179,3 +189,34 @@ func TestEncDec(t *testing.T) {
 	test(t, dlbin.Factory{}, noop.Factory{})
 	test(t, dlgob.Factory{}, noop.Factory{})
 }
+
+// TestAESGCM tests records encrypted with AES-GCM can only be decoded with the same key and fail authentication
+// if they are modified.
+func TestAESGCM(t *testing.T) {
+	key, err := aesgcm.NewKey()
+	require.NoError(t, err)
+	ed := aesgcm.Factory{Inner: dlbin.Factory{}, KeyID: "k1", Keys: aesgcm.Keyring{"k1": key}}
+	test(t, ed, dlsha.Factory{})
+
+	var bbuf bytes.Buffer
+	err = ed.NewEncoder(&bbuf).Encode([]record.Record{record.NewMkdir("dir", record.DefaultCreateMode)})
+	require.NoError(t, err)
+
+	// Another key with the same ID
+	otherKey, err := aesgcm.NewKey()
+	require.NoError(t, err)
+	other := aesgcm.Factory{Inner: dlbin.Factory{}, KeyID: "k1", Keys: aesgcm.Keyring{"k1": otherKey}}
+	_, err = other.NewDecoder(bytes.NewReader(bbuf.Bytes())).Decode()
+	require.IsType(t, &aesgcm.ErrNotAuthenticated{}, err)
+
+	// Unknown key
+	other = aesgcm.Factory{Inner: dlbin.Factory{}, KeyID: "k2", Keys: aesgcm.Keyring{"k1": key}}
+	_, err = other.NewDecoder(bytes.NewReader(bbuf.Bytes())).Decode()
+	require.IsType(t, &aesgcm.ErrUnknownKey{}, err)
+
+	// Modified records
+	modified := append([]byte{}, bbuf.Bytes()...)
+	modified[len(modified)-1] ^= 1
+	_, err = ed.NewDecoder(bytes.NewReader(modified)).Decode()
+	require.IsType(t, &aesgcm.ErrNotAuthenticated{}, err)
+}
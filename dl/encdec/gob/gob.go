@@ -67,6 +67,9 @@ func init() {
 	gob.Register(&record.Chmod{})
 	gob.Register(&record.Setmtime{})
 	gob.Register(&record.EOT{})
+	gob.Register(&record.CopyRange{})
+	gob.Register(&record.PunchHole{})
+	gob.Register(&record.Digest{})
 }
 
 // NewEncoder returns a new encoder
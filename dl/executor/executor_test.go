@@ -44,6 +44,8 @@ func createRecs(prefix string) []record.Record {
 		record.NewCreate(filename, record.DefaultCreateMode),
 		record.NewChmod(filename, 0750),
 		record.NewPwrite(filename, data, offset),
+		record.NewCopyRange(filename, offset, offset*2, uint64(len(data))),
+		record.NewPunchHole(filename, offset, uint64(len(data))),
 		record.NewHardlink(filename, hardlink),
 		record.NewSymlink(filename, symlink),
 		record.NewTruncate(filename, newsize),
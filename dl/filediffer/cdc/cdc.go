@@ -0,0 +1,390 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package cdc provides a file diff method based on content-defined chunking:
+// Both files are cut into chunks where a rolling hash of the last bytes read hits a pattern, so chunk boundaries move
+// with the data when bytes are inserted or deleted. Chunks of the new file which are found in the old file are sent
+// as copies within the file, all other chunks are sent as pwrites except where the new file has holes.
+package cdc
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/ClusterHQ/fli/dl/blobdiffer"
+	"github.com/ClusterHQ/fli/dl/filediffer/variableblk"
+	dlhash "github.com/ClusterHQ/fli/dl/hash"
+	"github.com/ClusterHQ/fli/dl/record"
+	"github.com/ClusterHQ/fli/dl/sparse"
+)
+
+type (
+	// Factory is a helper for creating a new file differ factory
+	Factory struct {
+	}
+
+	// chunk is where a chunk is in the old file
+	chunk struct {
+		off  int64
+		size int64
+	}
+
+	// copyRange is a range of the new file copied from the old file
+	copyRange struct {
+		src, dst, size int64
+	}
+
+	// span is a range of the new file sent as pwrites
+	span struct {
+		off, size int64
+	}
+
+	// spansByOff sorts spans by offset
+	spansByOff []span
+
+	// copiesBySrc sorts indexes of copies by their source offset
+	copiesBySrc struct {
+		idx    []int
+		copies []copyRange
+	}
+
+	// chunker cuts a stream into content-defined chunks
+	chunker struct {
+		r          io.Reader
+		buf        []byte
+		start, end int
+		eof        bool
+	}
+)
+
+var (
+	_ blobdiffer.FileDiffer = Factory{}
+
+	// gear maps a byte to a random number which is rolled into the hash
+	gear [256]uint64
+)
+
+const (
+	// Number of bytes per read
+	bytesPerRead int = (1 << 20)
+
+	// Max number of bytes per pwrite record
+	maxBlockSize int64 = (1 << 17)
+
+	// Chunk sizes, a chunk is cut where the low bits of the rolling hash are zero which makes the average chunk
+	// size chunkMask + 1
+	minChunkSize int    = (1 << 11)
+	maxChunkSize int    = (1 << 16)
+	chunkMask    uint64 = (1 << 13) - 1
+)
+
+// init fills the gear table from a fixed seed, both sides of a diff must cut chunks the same way
+func init() {
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range gear {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// DiffContents chunks the old file and indexes the chunks, then chunks the new file and generates a copy for every
+// chunk found in the old file at a different offset and pwrites for the chunks not found.
+// Copies are sent before pwrites because pwrites may overwrite the data copies read. The new file is read again by
+// its path for the data of pwrites.
+// Caller is expected to close the records channel.
+func (factory Factory) DiffContents(f1, f2 blobdiffer.FileInfo, target string, records chan<- record.Record,
+	hf dlhash.Factory) error {
+	// Nothing to copy from, all data is new
+	if f1.Size() == 0 {
+		return variableblk.Factory{}.DiffContents(f1, f2, target, records, hf)
+	}
+
+	index := make(map[[sha256.Size]byte]chunk)
+	var off int64
+	c := newChunker(f1)
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		if _, ok := index[sum]; !ok {
+			index[sum] = chunk{off: off, size: int64(len(data))}
+		}
+		off += int64(len(data))
+	}
+
+	var (
+		copies   []copyRange
+		literals []span
+	)
+	off = 0
+	c = newChunker(f2)
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		size := int64(len(data))
+		ch, ok := index[sha256.Sum256(data)]
+		switch {
+		case ok && ch.off == off:
+			// Unchanged
+		case ok:
+			if n := len(copies); n > 0 && copies[n-1].src+copies[n-1].size == ch.off &&
+				copies[n-1].dst+copies[n-1].size == off {
+				copies[n-1].size += size
+			} else {
+				copies = append(copies, copyRange{src: ch.off, dst: off, size: size})
+			}
+		default:
+			literals = appendSpan(literals, span{off: off, size: size})
+		}
+		off += size
+	}
+
+	copies, broken := orderCopies(skipHoles(copies, f2.Holes()))
+	for _, cp := range copies {
+		r := record.NewCopyRange(target, uint64(cp.src), uint64(cp.dst), uint64(cp.size))
+		err := record.Send(r, records, hf)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, cp := range broken {
+		literals = append(literals, span{off: cp.dst, size: cp.size})
+	}
+	if len(literals) == 0 {
+		return nil
+	}
+
+	return sendLiterals(f2.Path(), literals, f2.Holes(), target, records, hf)
+}
+
+// sendLiterals reads the spans from the file and sends them as pwrites, the parts in holes of the file are left
+// to the blob differ which punches them
+func sendLiterals(path string, literals []span, holes []sparse.Extent, target string, records chan<- record.Record,
+	hf dlhash.Factory) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	sort.Sort(spansByOff(literals))
+	extents := make([]sparse.Extent, 0, len(literals))
+	for _, s := range literals {
+		extents = append(extents, sparse.Extent{Offset: s.off, Length: s.size})
+	}
+
+	for _, e := range sparse.Subtract(extents, holes) {
+		for off := e.Offset; off < e.End(); {
+			cnt := e.End() - off
+			if cnt > maxBlockSize {
+				cnt = maxBlockSize
+			}
+
+			// A new buffer for every pwrite because the record holds on to it
+			buf := make([]byte, cnt)
+			_, err = fp.ReadAt(buf, off)
+			if err != nil {
+				return err
+			}
+
+			err = record.Send(record.NewPwrite(target, buf, uint64(off)), records, hf)
+			if err != nil {
+				return err
+			}
+			off += cnt
+		}
+	}
+
+	return nil
+}
+
+// skipHoles drops the parts of copies which land in holes of the new file, the blob differ punches them
+func skipHoles(copies []copyRange, holes []sparse.Extent) []copyRange {
+	if len(holes) == 0 {
+		return copies
+	}
+
+	var result []copyRange
+	for _, cp := range copies {
+		dst := []sparse.Extent{{Offset: cp.dst, Length: cp.size}}
+		for _, e := range sparse.Subtract(dst, holes) {
+			result = append(result, copyRange{src: cp.src + e.Offset - cp.dst, dst: e.Offset, size: e.Length})
+		}
+	}
+	return result
+}
+
+// appendSpan appends a span, merging it with the last span if they are adjacent
+func appendSpan(spans []span, s span) []span {
+	if n := len(spans); n > 0 && spans[n-1].off+spans[n-1].size == s.off {
+		spans[n-1].size += s.size
+		return spans
+	}
+	return append(spans, s)
+}
+
+// orderCopies orders copies so no copy overwrites data another copy has yet to read. Copies which depend on each
+// other in a cycle can't be ordered, some of them are returned as broken and have to be sent as pwrites instead.
+func orderCopies(copies []copyRange) ([]copyRange, []copyRange) {
+	n := len(copies)
+
+	// Sort copies by source, maxEnd[i] is the max end of the sources of the first i+1 copies
+	bySrc := make([]int, n)
+	for i := range bySrc {
+		bySrc[i] = i
+	}
+	sort.Sort(copiesBySrc{idx: bySrc, copies: copies})
+	maxEnd := make([]int64, n)
+	for i, idx := range bySrc {
+		maxEnd[i] = copies[idx].src + copies[idx].size
+		if i > 0 && maxEnd[i-1] > maxEnd[i] {
+			maxEnd[i] = maxEnd[i-1]
+		}
+	}
+
+	// Copy b has to wait for copy a if b's destination overlaps a's source
+	waitFor := make([]int, n)
+	next := make([][]int, n)
+	for b, cp := range copies {
+		dstEnd := cp.dst + cp.size
+		i := sort.Search(n, func(i int) bool { return copies[bySrc[i]].src >= dstEnd }) - 1
+		for ; i >= 0 && maxEnd[i] > cp.dst; i-- {
+			a := bySrc[i]
+			if a != b && copies[a].src+copies[a].size > cp.dst {
+				next[a] = append(next[a], b)
+				waitFor[b]++
+			}
+		}
+	}
+
+	var (
+		ordered []copyRange
+		broken  []copyRange
+		ready   []int
+		done    = make([]bool, n)
+	)
+	for i := range copies {
+		if waitFor[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	release := func(a int) {
+		done[a] = true
+		for _, b := range next[a] {
+			waitFor[b]--
+			if waitFor[b] == 0 && !done[b] {
+				ready = append(ready, b)
+			}
+		}
+	}
+
+	for remaining, candidate := n, 0; remaining > 0; remaining-- {
+		if len(ready) == 0 {
+			// Every copy left waits for another one, break the cycle by sending one as pwrites
+			for done[candidate] {
+				candidate++
+			}
+			broken = append(broken, copies[candidate])
+			release(candidate)
+			continue
+		}
+
+		a := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, copies[a])
+		release(a)
+	}
+
+	return ordered, broken
+}
+
+func (s spansByOff) Len() int           { return len(s) }
+func (s spansByOff) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s spansByOff) Less(i, j int) bool { return s[i].off < s[j].off }
+
+func (s copiesBySrc) Len() int           { return len(s.idx) }
+func (s copiesBySrc) Swap(i, j int)      { s.idx[i], s.idx[j] = s.idx[j], s.idx[i] }
+func (s copiesBySrc) Less(i, j int) bool { return s.copies[s.idx[i]].src < s.copies[s.idx[j]].src }
+
+// newChunker returns a chunker which reads from the reader
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, bytesPerRead)}
+}
+
+// next returns the next chunk or io.EOF if there is no more data, the chunk is only valid until the next call
+func (c *chunker) next() ([]byte, error) {
+	if c.end-c.start < maxChunkSize && !c.eof {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := cut(c.buf[c.start:c.end])
+	data := c.buf[c.start : c.start+n]
+	c.start += n
+	return data, nil
+}
+
+// cut returns the size of the chunk at the start of data
+func cut(data []byte) int {
+	if len(data) <= minChunkSize {
+		return len(data)
+	}
+	if len(data) > maxChunkSize {
+		data = data[:maxChunkSize]
+	}
+
+	var h uint64
+	for i := minChunkSize; i < len(data); i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
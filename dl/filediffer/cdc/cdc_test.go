@@ -0,0 +1,145 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cdc_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ClusterHQ/fli/dl/executor"
+	"github.com/ClusterHQ/fli/dl/filediffer/cdc"
+	"github.com/ClusterHQ/fli/dl/hash/adler32"
+	"github.com/ClusterHQ/fli/dl/record"
+	"github.com/ClusterHQ/fli/dl/sparse"
+	"github.com/stretchr/testify/require"
+)
+
+type fileInfo struct {
+	*os.File
+	size int64
+}
+
+func (fi fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi fileInfo) Path() string {
+	return fi.Name()
+}
+
+func (fi fileInfo) Holes() []sparse.Extent {
+	return nil
+}
+
+func open(t *testing.T, path string) fileInfo {
+	fp, err := os.Open(path)
+	require.NoError(t, err)
+	info, err := fp.Stat()
+	require.NoError(t, err)
+	return fileInfo{File: fp, size: info.Size()}
+}
+
+// diff generates the records which turn the old data into the new data and applies them to the old data
+func diff(t *testing.T, old, new []byte) ([]record.Record, []byte) {
+	dir, err := ioutil.TempDir("", "cdc_test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "old"), old, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "new"), new, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), old, 0600))
+
+	f1 := open(t, filepath.Join(dir, "old"))
+	defer f1.Close()
+	f2 := open(t, filepath.Join(dir, "new"))
+	defer f2.Close()
+
+	records := make(chan record.Record)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- cdc.Factory{}.DiffContents(f1, f2, "file", records, adler32.Factory{})
+		close(records)
+	}()
+
+	var recs []record.Record
+	for r := range records {
+		recs = append(recs, r)
+	}
+	require.NoError(t, <-errc)
+
+	// Truncate is sent by the blob differ after the contents
+	all := recs
+	if len(new) < len(old) {
+		all = append(all, record.NewTruncate("file", int64(len(new))))
+	}
+	err = executor.NewCommonExecutor().Execute(dir, all)
+	require.NoError(t, err)
+	applied, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+
+	return recs, applied
+}
+
+// written returns the number of bytes sent in pwrites and the number of copies
+func written(recs []record.Record) (int, int) {
+	var n, copies int
+	for _, r := range recs {
+		switch r.Type() {
+		case record.TypePwrite:
+			n += len(r.(*record.Pwrite).Data)
+		case record.TypeCopyRange:
+			copies++
+		}
+	}
+	return n, copies
+}
+
+// TestShiftedData makes sure data moved by an insert or a delete is copied instead of sent again.
+func TestShiftedData(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	old := make([]byte, 1<<20)
+	rnd.Read(old)
+	inserted := make([]byte, 100)
+	rnd.Read(inserted)
+
+	tests := []struct {
+		name string
+		new  []byte
+		max  int
+	}{
+		{"insert", append(append([]byte{}, inserted...), old...), 1 << 17},
+		{"delete", append(append([]byte{}, old[:1000]...), old[5000:]...), 1 << 17},
+		{"swap", append(append([]byte{}, old[len(old)/2:]...), old[:len(old)/2]...), len(old)},
+		{"repeat", bytes.Repeat(old[:1<<18], 4), len(old) / 2},
+		{"new", inserted, len(inserted)},
+	}
+
+	for _, test := range tests {
+		recs, applied := diff(t, old, test.new)
+		require.Equal(t, test.new, applied, test.name)
+
+		n, copies := written(recs)
+		require.True(t, n <= test.max, "%s: %d bytes written", test.name, n)
+		if test.name != "new" {
+			require.True(t, copies > 0, test.name)
+		}
+	}
+}
@@ -18,6 +18,7 @@
 // Scan the files and compare byte by byte. For a byte stream that is the same, it is skipped if it reaches certain
 // length; the bytes are included in the pwrite even though they are the same, this is to avoid sending smaller pwrites.
 // For bytes stream that is not the same, generates a pwrite as large as possible(pre-defined length).
+// Holes of the new file are skipped without reading them.
 package variableblk
 
 import (
@@ -63,17 +64,42 @@ func (factory Factory) DiffContents(f1, f2 blobdiffer.FileInfo, target string, r
 		n1, n2 int   // total number of bytes in the current read buffer of file1 and file2
 	)
 
+	holes := f2.Holes()
+
 	// Loop through file 2 chunk by chunk
 	for ; off < f2.Size(); off += int64(n2) {
-		// Read a chunk from file 2
-		n2, err = f2.Read(buf2)
+		// Skip a hole of file 2, the data file 1 has there is punched out by the blob differ
+		if len(holes) > 0 && holes[0].Offset == off {
+			off = holes[0].End()
+			holes = holes[1:]
+			n2 = 0
+
+			_, err = f2.Seek(off, io.SeekStart)
+			if err != nil {
+				return err
+			}
+			if off < f1.Size() {
+				_, err = f1.Seek(off, io.SeekStart)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		// Read a chunk from file 2, up to the next hole
+		cnt := len(buf2)
+		if len(holes) > 0 && holes[0].Offset-off < int64(cnt) {
+			cnt = int(holes[0].Offset - off)
+		}
+		n2, err = f2.Read(buf2[:cnt])
 		if err != nil && err != io.EOF {
 			return err
 		}
 
 		// Read from file 1 if there are enough bytes left
 		if off < f1.Size() {
-			n1, err = f1.Read(buf1)
+			n1, err = f1.Read(buf1[:cnt])
 			if err != nil && err != io.EOF {
 				return err
 			}
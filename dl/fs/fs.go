@@ -19,7 +19,7 @@ package fs
 import (
 	"errors"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -27,6 +27,7 @@ import (
 	"github.com/ClusterHQ/fli/dl/blobdiffer"
 	"github.com/ClusterHQ/fli/dl/datalayer"
 	"github.com/ClusterHQ/fli/dl/filediffer/variableblk"
+	"github.com/ClusterHQ/fli/dl/sparse"
 	"github.com/ClusterHQ/fli/meta/blob"
 	"github.com/ClusterHQ/fli/meta/snapshot"
 	"github.com/ClusterHQ/fli/meta/volume"
@@ -47,7 +48,8 @@ var (
 	// Even though this is called emptyID, the content of this is not empty.
 	emptyID = blob.NewID(uuid.New())
 
-	_ datalayer.Storage = &fsStorage{}
+	_ datalayer.Storage   = &fsStorage{}
+	_ datalayer.Inventory = &fsStorage{}
 )
 
 func newRandomID() string {
@@ -248,7 +250,7 @@ func copyTree(source, destination securefilepath.SecureFilePath) error {
 		}
 		defer output.Close()
 
-		_, err = io.Copy(output, input)
+		err = sparse.Copy(output, input)
 		if err == nil {
 			log.Printf("Copied from %s to %s", path, outputPath.Path())
 		} else {
@@ -275,3 +277,57 @@ func (s *fsStorage) GetVolumesetSpace(vsid volumeset.ID) (datalayer.DiskSpace, e
 	// TODO implement me...
 	return datalayer.DiskSpace{}, nil
 }
+
+// Objects ...
+func (s *fsStorage) Objects() ([]datalayer.StoredObject, error) {
+	var objs []datalayer.StoredObject
+
+	blobs, err := ioutil.ReadDir(s.blobs.Path())
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range blobs {
+		if fi.Name() == emptyID.String() {
+			continue
+		}
+		objs = append(objs, datalayer.StoredObject{BlobID: blob.NewID(fi.Name()), Name: fi.Name()})
+	}
+
+	vols, err := ioutil.ReadDir(s.volumes.Path())
+	if os.IsNotExist(err) {
+		return objs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range vols {
+		objs = append(objs, datalayer.StoredObject{VolumeID: volume.NewID(fi.Name()), Name: fi.Name()})
+	}
+
+	return objs, nil
+}
+
+// DestroyObject ...
+func (s *fsStorage) DestroyObject(obj datalayer.StoredObject) error {
+	if obj.IsBlob() {
+		return s.DestroySnapshot(obj.BlobID)
+	}
+	return s.DestroyVolume(obj.VolSetID, obj.VolumeID)
+}
+
+// Mounted returns true if the volume's directory exists, volumes are not mounted
+func (s *fsStorage) Mounted(_ volumeset.ID, _ volume.ID, path string) (bool, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return fi.IsDir(), nil
+}
+
+// Mount ...
+func (s *fsStorage) Mount(_ volumeset.ID, id volume.ID) error {
+	return fmt.Errorf("Volume %v has no working copy", id)
+}
@@ -16,7 +16,11 @@
 
 package hash
 
-import "hash"
+import (
+	"hash"
+
+	"github.com/ClusterHQ/fli/errors"
+)
 
 type (
 	// Type defines the kind of hash
@@ -41,4 +45,57 @@ const (
 
 	// Adler32 type for adler32 CRC
 	Adler32
+
+	// XXHash64 type for 64 bit xxHash
+	XXHash64
+
+	// XXH3 type for 64 bit XXH3, the newer xxHash
+	XXH3
+
+	// BLAKE2b type for 256 bit BLAKE2b hashing
+	BLAKE2b
+
+	// BLAKE3 type for 256 bit BLAKE3 hashing
+	BLAKE3
+
+	// Default is the hash used when none is given
+	Default = Adler32
 )
+
+var (
+	names = map[Type]string{
+		NoOp:     "none",
+		SHA256:   "sha256",
+		MD5:      "md5",
+		Adler32:  "adler32",
+		XXHash64: "xxhash64",
+		XXH3:     "xxh3",
+		BLAKE2b:  "blake2b",
+		BLAKE3:   "blake3",
+	}
+)
+
+// String returns the hash's name
+func (t Type) String() string {
+	name, ok := names[t]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+// ParseType returns the hash type with the given name, an empty name is the default hash.
+func ParseType(name string) (Type, error) {
+	if name == "" {
+		return Default, nil
+	}
+
+	for t, n := range names {
+		if n == name {
+			return t, nil
+		}
+	}
+
+	return Default, errors.Errorf("Unknown hash %s, supported hashes are none, adler32, xxhash64, xxh3, md5, "+
+		"sha256, blake2b and blake3", name)
+}
@@ -0,0 +1,500 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package linkfs is a storage which keeps volumes and snapshots as directory trees on any file system. Files of
+// snapshots share their data with the volume they were taken from using reflinks where the file system supports them,
+// otherwise they are hard links to content addressed objects shared by all snapshots.
+package linkfs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volume"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+	"github.com/ClusterHQ/fli/securefilepath"
+	"github.com/pborman/uuid"
+)
+
+// Layout of the storage's root directory:
+// blobs/uuid(of volume set)/empty                        empty blob of the volume set
+// blobs/uuid(of volume set)/uuid(of snapshot)            snapshot, its blob id is uuid_of_volume_set/uuid_of_snapshot
+// blobs/uuid(of volume set)/uuid(of snapshot).json       space used by the snapshot and the objects its files link to
+// volumes/uuid(of volume set)/uuid(of volume)            volume
+// volumes/uuid(of volume set)/uuid(of volume).base       blob the volume was created from or last snapshotted to
+// objects/xx/key                                         content addressed file, hard link mode only
+//
+// Objects are named after the sha256 of their content and the attributes shared by all hard links, a file is only
+// hashed if it changed since the volume's base blob. An object is removed when the last snapshot linking to it is.
+
+const (
+	emptyBlob  = "empty"
+	blobsDir   = "blobs"
+	volumesDir = "volumes"
+	objectsDir = "objects"
+	tmpSuffix  = ".tmp"
+	infoSuffix = ".json"
+	baseSuffix = ".base"
+)
+
+type (
+	// Mode is how snapshot files share data with volume files
+	Mode int
+
+	// Storage is the reflink/hard link implementation of the datalayer.Storage interface
+	Storage struct {
+		root       string
+		mode       Mode
+		blobDiffer datalayer.BlobDifferFactory
+	}
+
+	// blobInfo is kept next to each snapshot
+	blobInfo struct {
+		Space datalayer.SnapshotSpace
+
+		// Objects maps paths of files to the objects they link to, hard link mode only
+		Objects map[string]string `json:",omitempty"`
+	}
+)
+
+const (
+	// Reflink clones files, they share data until either is written
+	Reflink Mode = iota
+
+	// Hardlink links files of snapshots to objects, volumes are full copies
+	Hardlink
+)
+
+var (
+	_ datalayer.Storage = &Storage{}
+)
+
+func (m Mode) String() string {
+	switch m {
+	case Reflink:
+		return "reflink"
+	case Hardlink:
+		return "hardlink"
+	}
+	return "unknown"
+}
+
+// New returns a storage which keeps its trees under the given directory, reflinks are used if the directory's file
+// system supports them.
+func New(root securefilepath.SecureFilePath, blobDiffer datalayer.BlobDifferFactory) (*Storage, error) {
+	s := &Storage{root: root.Path(), mode: Hardlink, blobDiffer: blobDiffer}
+	for _, dir := range []string{blobsDir, volumesDir, objectsDir} {
+		err := os.MkdirAll(s.path(dir), 0700)
+		if err != nil {
+			return nil, errors.New(err)
+		}
+	}
+
+	ok, err := ReflinkSupported(s.path(objectsDir))
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		s.mode = Reflink
+	}
+
+	return s, nil
+}
+
+// Mode returns how snapshot files share data with volume files
+func (s *Storage) Mode() Mode {
+	return s.mode
+}
+
+// Version implements datalayer.Storage interface
+func (s *Storage) Version() string {
+	return "linkfs " + s.mode.String()
+}
+
+// BlobDiffer implements datalayer.Storage interface
+func (s *Storage) BlobDiffer() datalayer.BlobDifferFactory {
+	return s.blobDiffer
+}
+
+// EmptyBlobID implements datalayer.Storage interface
+func (s *Storage) EmptyBlobID(vsid volumeset.ID) (blob.ID, error) {
+	b := blob.NewID(filepath.Join(vsid.String(), emptyBlob))
+	err := os.MkdirAll(s.blobPath(b), 0755)
+	if err != nil {
+		return blob.NilID(), errors.New(err)
+	}
+
+	return b, nil
+}
+
+// CreateVolume implements datalayer.Storage interface, volumes are directories so the mount type is ignored
+func (s *Storage) CreateVolume(
+	vsid volumeset.ID,
+	b blob.ID,
+	_ datalayer.MountType,
+) (volume.ID, securefilepath.SecureFilePath, error) {
+	exists, err := s.SnapshotExists(b)
+	if err != nil {
+		return volume.NilID(), nil, err
+	}
+	if !exists {
+		return volume.NilID(), nil, errors.Errorf("Blob %v not found", b)
+	}
+
+	vid := volume.NewID(uuid.New())
+	path := s.volumePath(vsid, vid)
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return volume.NilID(), nil, errors.New(err)
+	}
+
+	err = CopyTree(s.blobPath(b), path, s.mode == Reflink)
+	if err != nil {
+		os.RemoveAll(path)
+		return volume.NilID(), nil, err
+	}
+
+	err = ioutil.WriteFile(path+baseSuffix, []byte(b.String()), 0600)
+	if err != nil {
+		os.RemoveAll(path)
+		return volume.NilID(), nil, errors.New(err)
+	}
+
+	mntPath, err := securefilepath.New(path)
+	if err != nil {
+		return volume.NilID(), nil, errors.New(err)
+	}
+
+	return vid, mntPath, nil
+}
+
+// CreateSnapshot implements datalayer.Storage interface
+func (s *Storage) CreateSnapshot(vsid volumeset.ID, ssid snapshot.ID, vid volume.ID) (blob.ID, error) {
+	volPath := s.volumePath(vsid, vid)
+	base, err := s.volumeBase(volPath)
+	if err != nil {
+		return blob.NilID(), err
+	}
+
+	baseInfo, err := s.blobInfo(base)
+	if err != nil {
+		return blob.NilID(), err
+	}
+
+	b := blob.NewID(filepath.Join(vsid.String(), ssid.String()))
+	path := s.blobPath(b)
+
+	// The tree is built aside and renamed, a snapshot is either complete or not there
+	os.RemoveAll(path + tmpSuffix)
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return blob.NilID(), errors.New(err)
+	}
+	snap := &snapshotter{
+		mode:     s.mode,
+		objects:  s.path(objectsDir),
+		base:     s.blobPath(base),
+		baseInfo: baseInfo,
+		info:     &blobInfo{},
+	}
+	err = snap.snapshotTree(volPath, path+tmpSuffix)
+	if err != nil {
+		os.RemoveAll(path + tmpSuffix)
+		return blob.NilID(), err
+	}
+
+	err = writeJSON(path+infoSuffix, snap.info)
+	if err != nil {
+		return blob.NilID(), err
+	}
+
+	err = os.Rename(path+tmpSuffix, path)
+	if err != nil {
+		return blob.NilID(), errors.New(err)
+	}
+
+	// Data written to the volume from now on is new compared to this snapshot
+	err = ioutil.WriteFile(volPath+baseSuffix, []byte(b.String()), 0600)
+	if err != nil {
+		return blob.NilID(), errors.New(err)
+	}
+
+	return b, nil
+}
+
+// DestroyVolume implements datalayer.Storage interface
+func (s *Storage) DestroyVolume(vsid volumeset.ID, vid volume.ID) error {
+	path := s.volumePath(vsid, vid)
+	err := os.RemoveAll(path)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	os.Remove(path + baseSuffix)
+	return nil
+}
+
+// DestroySnapshot implements datalayer.Storage interface, objects no other snapshot links to are removed
+func (s *Storage) DestroySnapshot(b blob.ID) error {
+	info, err := s.blobInfo(b)
+	if err != nil {
+		return err
+	}
+
+	path := s.blobPath(b)
+	err = os.RemoveAll(path)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	os.Remove(path + infoSuffix)
+
+	for _, key := range info.Objects {
+		err = s.releaseObject(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DestroyVolumeSet implements datalayer.Storage interface
+func (s *Storage) DestroyVolumeSet(vsid volumeset.ID) error {
+	err := os.RemoveAll(s.path(volumesDir, vsid.String()))
+	if err != nil {
+		return errors.New(err)
+	}
+
+	blobs := s.path(blobsDir, vsid.String())
+	names, err := ioutil.ReadDir(blobs)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New(err)
+	}
+
+	for _, n := range names {
+		if !strings.HasSuffix(n.Name(), infoSuffix) {
+			continue
+		}
+
+		b := blob.NewID(filepath.Join(vsid.String(), strings.TrimSuffix(n.Name(), infoSuffix)))
+		err = s.DestroySnapshot(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.RemoveAll(blobs)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	return nil
+}
+
+// SnapshotExists implements datalayer.Storage interface
+func (s *Storage) SnapshotExists(b blob.ID) (bool, error) {
+	_, err := os.Stat(s.blobPath(b))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.New(err)
+	}
+
+	return true, nil
+}
+
+// MountBlob implements datalayer.Storage interface, blobs are directories which are always accessible
+func (s *Storage) MountBlob(b blob.ID) (string, error) {
+	return s.blobPath(b), nil
+}
+
+// Unmount implements datalayer.Storage interface
+func (s *Storage) Unmount(path string) error {
+	return nil
+}
+
+// GetSnapshotSpace implements datalayer.Storage interface, the space is accounted when the snapshot is created
+func (s *Storage) GetSnapshotSpace(b blob.ID) (datalayer.SnapshotSpace, error) {
+	info, err := s.blobInfo(b)
+	if err != nil {
+		return datalayer.SnapshotSpace{}, err
+	}
+
+	return info.Space, nil
+}
+
+// GetTotalSpace implements datalayer.Storage interface
+func (s *Storage) GetTotalSpace() (datalayer.DiskSpace, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(s.root, &st)
+	if err != nil {
+		return datalayer.DiskSpace{}, errors.New(err)
+	}
+
+	return datalayer.DiskSpace{
+		Used:      (st.Blocks - st.Bfree) * uint64(st.Bsize),
+		Available: st.Bavail * uint64(st.Bsize),
+	}, nil
+}
+
+// GetVolumesetSpace implements datalayer.Storage interface, the used space is what each snapshot added plus what
+// each volume doesn't share with its base blob.
+func (s *Storage) GetVolumesetSpace(vsid volumeset.ID) (datalayer.DiskSpace, error) {
+	total, err := s.GetTotalSpace()
+	if err != nil {
+		return datalayer.DiskSpace{}, err
+	}
+
+	var used uint64
+	names, err := ioutil.ReadDir(s.path(blobsDir, vsid.String()))
+	if err != nil && !os.IsNotExist(err) {
+		return datalayer.DiskSpace{}, errors.New(err)
+	}
+	for _, n := range names {
+		if !strings.HasSuffix(n.Name(), infoSuffix) {
+			continue
+		}
+
+		info, err := s.blobInfo(blob.NewID(filepath.Join(vsid.String(), strings.TrimSuffix(n.Name(), infoSuffix))))
+		if err != nil {
+			return datalayer.DiskSpace{}, err
+		}
+		used += info.Space.DeltaFromPrevious
+	}
+
+	names, err = ioutil.ReadDir(s.path(volumesDir, vsid.String()))
+	if err != nil && !os.IsNotExist(err) {
+		return datalayer.DiskSpace{}, errors.New(err)
+	}
+	for _, n := range names {
+		if !n.IsDir() {
+			continue
+		}
+
+		volPath := s.path(volumesDir, vsid.String(), n.Name())
+		base, err := s.volumeBase(volPath)
+		if err != nil {
+			return datalayer.DiskSpace{}, err
+		}
+
+		// Volumes are full copies in hard link mode
+		var baseTree string
+		if s.mode == Reflink {
+			baseTree = s.blobPath(base)
+		}
+		size, err := changedSize(volPath, baseTree)
+		if err != nil {
+			return datalayer.DiskSpace{}, err
+		}
+		used += size
+	}
+
+	return datalayer.DiskSpace{Used: used, Available: total.Available}, nil
+}
+
+// path returns the absolute path of a path relative to the storage's root
+func (s *Storage) path(elem ...string) string {
+	return filepath.Join(append([]string{s.root}, elem...)...)
+}
+
+func (s *Storage) blobPath(b blob.ID) string {
+	return s.path(blobsDir, b.String())
+}
+
+func (s *Storage) volumePath(vsid volumeset.ID, vid volume.ID) string {
+	return s.path(volumesDir, vsid.String(), vid.String())
+}
+
+// volumeBase returns the blob the volume was created from or last snapshotted to
+func (s *Storage) volumeBase(volPath string) (blob.ID, error) {
+	data, err := ioutil.ReadFile(volPath + baseSuffix)
+	if err != nil {
+		return blob.NilID(), errors.New(err)
+	}
+
+	return blob.NewID(string(data)), nil
+}
+
+// blobInfo returns the info kept next to the snapshot, empty blobs have none
+func (s *Storage) blobInfo(b blob.ID) (*blobInfo, error) {
+	var info blobInfo
+	data, err := ioutil.ReadFile(s.blobPath(b) + infoSuffix)
+	if os.IsNotExist(err) {
+		return &info, nil
+	}
+	if err != nil {
+		return nil, errors.New(err)
+	}
+
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		return nil, errors.New(err)
+	}
+
+	return &info, nil
+}
+
+// releaseObject removes the object if no snapshot links to it anymore
+func (s *Storage) releaseObject(key string) error {
+	path := objectPath(s.path(objectsDir), key)
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.New(err)
+	}
+
+	if fi.Sys().(*syscall.Stat_t).Nlink > 1 {
+		return nil
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	return nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	err = ioutil.WriteFile(path+tmpSuffix, data, 0600)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	err = os.Rename(path+tmpSuffix, path)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	return nil
+}
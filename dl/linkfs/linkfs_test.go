@@ -0,0 +1,128 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package linkfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ClusterHQ/fli/dl/blobdiffer"
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dl/filediffer/variableblk"
+	"github.com/ClusterHQ/fli/dl/linkfs"
+	"github.com/ClusterHQ/fli/dl/testutils"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+	"github.com/ClusterHQ/fli/securefilepath"
+	"github.com/stretchr/testify/require"
+)
+
+func countObjects(t *testing.T, root string) int {
+	n := 0
+	err := filepath.Walk(filepath.Join(root, "objects"), func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			n++
+		}
+		return err
+	})
+	require.NoError(t, err)
+	return n
+}
+
+// TestSnapshots takes snapshots of a volume and checks they share unchanged files and account new data only.
+func TestSnapshots(t *testing.T) {
+	root, err := ioutil.TempDir("", "linkfs_test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	path, err := securefilepath.New(root)
+	require.NoError(t, err)
+	s, err := linkfs.New(path, blobdiffer.Factory{FileDiffer: variableblk.Factory{}})
+	require.NoError(t, err)
+
+	vsid := volumeset.NewRandomID()
+	empty, err := s.EmptyBlobID(vsid)
+	require.NoError(t, err)
+	vid, mnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+	require.NoError(t, err)
+
+	a := filepath.Join(mnt.Path(), "a")
+	b := filepath.Join(mnt.Path(), "dir", "b")
+	require.NoError(t, ioutil.WriteFile(a, make([]byte, 64*1024), 0644))
+	require.NoError(t, os.Mkdir(filepath.Dir(b), 0755))
+	require.NoError(t, ioutil.WriteFile(b, []byte("unchanged"), 0600))
+	require.NoError(t, os.Symlink("dir/b", filepath.Join(mnt.Path(), "link")))
+
+	b1, err := s.CreateSnapshot(vsid, snapshot.NewRandomID(), vid)
+	require.NoError(t, err)
+	p1, err := s.MountBlob(b1)
+	require.NoError(t, err)
+	require.NoError(t, testutils.CompareTree(mnt.Path(), p1))
+	space1, err := s.GetSnapshotSpace(b1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(64*1024+9), space1.LogicalSize)
+	require.Equal(t, uint64(64*1024+9), space1.DeltaFromPrevious)
+
+	// Modify a, make sure its modification time differs from the snapshot's
+	require.NoError(t, ioutil.WriteFile(a, make([]byte, 32*1024), 0644))
+	require.NoError(t, os.Chtimes(a, time.Now(), time.Now().Add(time.Hour)))
+	b2, err := s.CreateSnapshot(vsid, snapshot.NewRandomID(), vid)
+	require.NoError(t, err)
+	p2, err := s.MountBlob(b2)
+	require.NoError(t, err)
+	require.NoError(t, testutils.CompareTree(mnt.Path(), p2))
+	space2, err := s.GetSnapshotSpace(b2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(32*1024+9), space2.LogicalSize)
+	require.Equal(t, uint64(32*1024), space2.DeltaFromPrevious)
+
+	vsSpace, err := s.GetVolumesetSpace(vsid)
+	require.NoError(t, err)
+	require.True(t, vsSpace.Used >= space1.DeltaFromPrevious+space2.DeltaFromPrevious)
+
+	if s.Mode() == linkfs.Hardlink {
+		fi1, err := os.Stat(filepath.Join(p1, "dir", "b"))
+		require.NoError(t, err)
+		fi2, err := os.Stat(filepath.Join(p2, "dir", "b"))
+		require.NoError(t, err)
+		require.True(t, os.SameFile(fi1, fi2))
+		require.Equal(t, 3, countObjects(t, root))
+	}
+
+	// A volume from a snapshot doesn't change the snapshot when written
+	_, mnt2, err := s.CreateVolume(vsid, b1, datalayer.NoAutoMount)
+	require.NoError(t, err)
+	require.NoError(t, testutils.CompareTree(p1, mnt2.Path()))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mnt2.Path(), "dir", "b"), []byte("changed"), 0600))
+	data, err := ioutil.ReadFile(filepath.Join(p2, "dir", "b"))
+	require.NoError(t, err)
+	require.Equal(t, "unchanged", string(data))
+
+	// Objects only the destroyed snapshot links to are removed
+	require.NoError(t, s.DestroySnapshot(b1))
+	exists, err := s.SnapshotExists(b1)
+	require.NoError(t, err)
+	require.False(t, exists)
+	if s.Mode() == linkfs.Hardlink {
+		require.Equal(t, 2, countObjects(t, root))
+	}
+
+	require.NoError(t, s.DestroyVolumeSet(vsid))
+	require.Equal(t, 0, countObjects(t, root))
+}
@@ -0,0 +1,433 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package linkfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/ClusterHQ/fli/dl/sparse"
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/pkg/xattr"
+)
+
+const (
+	// ficlone is the FICLONE ioctl which makes the destination file share the source file's data
+	ficlone = 0x40049409
+)
+
+type (
+	// snapshotter builds a snapshot's tree from a volume, files which didn't change since the base blob reuse its
+	// objects
+	snapshotter struct {
+		mode     Mode
+		objects  string
+		base     string
+		baseInfo *blobInfo
+		info     *blobInfo
+	}
+
+	// dirAttrs are applied to directories after their content is created, creating entries changes the
+	// directory's modification time
+	dirAttrs struct {
+		path string
+		fi   os.FileInfo
+	}
+)
+
+// ReflinkSupported returns true if files in the directory can be cloned
+func ReflinkSupported(dir string) (bool, error) {
+	src, err := ioutil.TempFile(dir, "reflink-")
+	if err != nil {
+		return false, errors.New(err)
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+
+	_, err = src.Write([]byte{0})
+	if err != nil {
+		return false, errors.New(err)
+	}
+
+	dst, err := ioutil.TempFile(dir, "reflink-")
+	if err != nil {
+		return false, errors.New(err)
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	return ioctlClone(dst, src) == nil, nil
+}
+
+func ioctlClone(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// cloneFile creates dst sharing src's data, the data is copied if the file system can't clone it
+func cloneFile(src, dst string, reflink bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.New(err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.New(err)
+	}
+	defer out.Close()
+
+	if reflink && ioctlClone(out, in) == nil {
+		return nil
+	}
+
+	err = sparse.Copy(out, in)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	return nil
+}
+
+// CopyTree copies the tree at src to dst, which must not exist, with the attributes of all entries. Files are cloned
+// if reflink is true.
+func CopyTree(src, dst string, reflink bool) error {
+	var dirs []dirAttrs
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, path[len(src):])
+		switch {
+		case fi.IsDir():
+			dirs = append(dirs, dirAttrs{path: target, fi: fi})
+			return mkdir(target)
+		case fi.Mode().IsRegular():
+			err = cloneFile(path, target, reflink)
+		default:
+			err = copySpecial(path, target, fi)
+		}
+		if err != nil {
+			return err
+		}
+
+		return setAttrs(path, target, fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	return setDirAttrs(src, dst, dirs)
+}
+
+// snapshotTree builds the snapshot of the tree at src in dst and accounts its space
+func (s *snapshotter) snapshotTree(src, dst string) error {
+	if s.mode == Hardlink {
+		s.info.Objects = make(map[string]string)
+	}
+
+	var dirs []dirAttrs
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel := path[len(src):]
+		target := filepath.Join(dst, rel)
+		switch {
+		case fi.IsDir():
+			dirs = append(dirs, dirAttrs{path: target, fi: fi})
+			return mkdir(target)
+		case fi.Mode().IsRegular():
+			return s.snapshotFile(path, rel, target, fi)
+		default:
+			err = copySpecial(path, target, fi)
+			if err != nil {
+				return err
+			}
+			return setAttrs(path, target, fi)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return setDirAttrs(src, dst, dirs)
+}
+
+func (s *snapshotter) snapshotFile(path, rel, target string, fi os.FileInfo) error {
+	size := uint64(fi.Size())
+	s.info.Space.LogicalSize += size
+	unchanged := sameFile(path, fi, filepath.Join(s.base, rel))
+
+	if s.mode == Reflink {
+		if !unchanged {
+			s.info.Space.DeltaFromPrevious += size
+		}
+
+		err := cloneFile(path, target, true)
+		if err != nil {
+			return err
+		}
+		return setAttrs(path, target, fi)
+	}
+
+	key, ok := s.baseInfo.Objects[rel]
+	if !unchanged || !ok {
+		var created bool
+		var err error
+		key, created, err = storeObject(s.objects, path, fi)
+		if err != nil {
+			return err
+		}
+		if created {
+			s.info.Space.DeltaFromPrevious += size
+		}
+	}
+
+	err := os.Link(objectPath(s.objects, key), target)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	s.info.Objects[rel] = key
+	return nil
+}
+
+// storeObject adds the file to the objects directory and returns its key, created is false if there already was an
+// object with the same content and attributes.
+func storeObject(objects string, path string, fi os.FileInfo) (string, bool, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", false, errors.New(err)
+	}
+	defer in.Close()
+
+	tmp, err := ioutil.TempFile(objects, "tmp-")
+	if err != nil {
+		return "", false, errors.New(err)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), in)
+	tmp.Close()
+	if err != nil {
+		return "", false, errors.New(err)
+	}
+
+	// All links of an object share its attributes, they are part of the key
+	err = hashXattrs(h, path)
+	if err != nil {
+		return "", false, err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	key := fmt.Sprintf("%x-%o-%d-%d-%d", h.Sum(nil), st.Mode&07777, st.Uid, st.Gid, fi.ModTime().UnixNano())
+
+	obj := objectPath(objects, key)
+	if _, err := os.Lstat(obj); err == nil {
+		return key, false, nil
+	}
+
+	err = setAttrs(path, tmp.Name(), fi)
+	if err != nil {
+		return "", false, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(obj), 0700)
+	if err != nil {
+		return "", false, errors.New(err)
+	}
+
+	err = os.Rename(tmp.Name(), obj)
+	if err != nil {
+		return "", false, errors.New(err)
+	}
+
+	return key, true, nil
+}
+
+// objectPath returns the path of an object
+func objectPath(objects string, key string) string {
+	return filepath.Join(objects, key[:2], key)
+}
+
+// changedSize returns the size of regular files in the tree which are not the same in the base tree, all files are
+// counted if base is empty.
+func changedSize(tree, base string) (uint64, error) {
+	var size uint64
+	err := filepath.Walk(tree, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode().IsRegular() && (base == "" || !sameFile(path, fi, filepath.Join(base, path[len(tree):]))) {
+			size += uint64(fi.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.New(err)
+	}
+
+	return size, nil
+}
+
+// sameFile returns true if the regular file at basePath has the same size, modification time and attributes as fi
+func sameFile(path string, fi os.FileInfo, basePath string) bool {
+	bfi, err := os.Lstat(basePath)
+	if err != nil || !bfi.Mode().IsRegular() {
+		return false
+	}
+
+	st := fi.Sys().(*syscall.Stat_t)
+	bst := bfi.Sys().(*syscall.Stat_t)
+	if fi.Size() != bfi.Size() || !fi.ModTime().Equal(bfi.ModTime()) || st.Mode != bst.Mode ||
+		st.Uid != bst.Uid || st.Gid != bst.Gid {
+		return false
+	}
+
+	// Setting extended attributes doesn't change the modification time
+	h1, h2 := sha256.New(), sha256.New()
+	if hashXattrs(h1, path) != nil || hashXattrs(h2, basePath) != nil {
+		return false
+	}
+	return bytes.Equal(h1.Sum(nil), h2.Sum(nil))
+}
+
+// hashXattrs adds the extended attributes of the file to the hash in name order
+func hashXattrs(h hash.Hash, path string) error {
+	names, err := xattr.Listxattr(path)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		val, err := xattr.Getxattr(path, name)
+		if err != nil {
+			return errors.New(err)
+		}
+
+		fmt.Fprintf(h, "%d:%s%d:", len(name), name, len(val))
+		h.Write(val)
+	}
+
+	return nil
+}
+
+func mkdir(path string) error {
+	err := os.Mkdir(path, 0700)
+	if err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// copySpecial creates a symbolic link, device, fifo or socket like the one at src
+func copySpecial(src, dst string, fi os.FileInfo) error {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(src)
+		if err != nil {
+			return errors.New(err)
+		}
+
+		err = os.Symlink(link, dst)
+		if err != nil {
+			return errors.New(err)
+		}
+		return nil
+	}
+
+	st := fi.Sys().(*syscall.Stat_t)
+	err := syscall.Mknod(dst, st.Mode, int(st.Rdev))
+	if err != nil {
+		return errors.New(err)
+	}
+
+	return nil
+}
+
+// setAttrs gives dst the owner, mode, extended attributes and times of src
+func setAttrs(src, dst string, fi os.FileInfo) error {
+	st := fi.Sys().(*syscall.Stat_t)
+	err := os.Lchown(dst, int(st.Uid), int(st.Gid))
+	if err != nil && !os.IsPermission(err) {
+		return errors.New(err)
+	}
+
+	// Symbolic links have no mode, extended attributes or times of their own which can be set portably
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	err = os.Chmod(dst, fi.Mode())
+	if err != nil {
+		return errors.New(err)
+	}
+
+	names, err := xattr.Listxattr(src)
+	if err != nil {
+		return errors.New(err)
+	}
+	for _, name := range names {
+		val, err := xattr.Getxattr(src, name)
+		if err != nil {
+			return errors.New(err)
+		}
+
+		err = xattr.Setxattr(dst, name, val)
+		if err != nil {
+			return errors.New(err)
+		}
+	}
+
+	atime := time.Unix(st.Atim.Unix())
+	err = os.Chtimes(dst, atime, fi.ModTime())
+	if err != nil {
+		return errors.New(err)
+	}
+
+	return nil
+}
+
+// setDirAttrs sets the attributes of directories deepest first
+func setDirAttrs(src, dst string, dirs []dirAttrs) error {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		err := setAttrs(filepath.Join(src, d.path[len(dst):]), d.path, d.fi)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,782 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package overlay is a storage built on overlayfs. Snapshots are chains of immutable layers, volumes are upper
+// directories mounted on top of their base snapshot's chain.
+package overlay
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dl/linkfs"
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volume"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+	"github.com/ClusterHQ/fli/securefilepath"
+	"github.com/pborman/uuid"
+)
+
+// Layout of the storage's root directory:
+// layers/empty                                      empty layer every chain ends with
+// layers/uuid(of layer)                             layer, an overlayfs upper directory with whiteouts
+// layers/uuid(of layer).json                        size of the layer
+// blobs/uuid(of volume set)/uuid(of snapshot).json  layers of the snapshot top first and its space, the blob id is
+//                                                   uuid_of_volume_set/uuid_of_snapshot
+// volumes/uuid(of volume set)/uuid(of volume)       upper, work and merged directories of the volume
+// volumes/uuid(of volume set)/uuid(of volume).json  base blob and layers the volume is mounted on
+// mnt/uuid                                          blobs mounted read-only
+//
+// A snapshot moves the volume's upper directory to a new layer and remounts the volume on top of it. If the volume
+// is busy and can't be unmounted, its upper directory is copied instead. Chains deeper than the storage's maximum
+// depth are squashed into a single layer. Layers no snapshot or volume uses are removed.
+
+const (
+	// DefaultMaxDepth is the number of layers a chain is squashed at by default
+	DefaultMaxDepth = 16
+
+	emptyLayer = "empty"
+	emptyBlob  = "empty"
+	layersDir  = "layers"
+	blobsDir   = "blobs"
+	volumesDir = "volumes"
+	mntDir     = "mnt"
+	upperDir   = "upper"
+	workDir    = "work"
+	mergedDir  = "merged"
+	tmpSuffix  = ".tmp"
+	infoSuffix = ".json"
+)
+
+type (
+	// Storage is the overlayfs implementation of the datalayer.Storage interface
+	Storage struct {
+		root       string
+		maxDepth   int
+		reflink    bool
+		blobDiffer datalayer.BlobDifferFactory
+	}
+
+	// blobInfo is kept for each snapshot
+	blobInfo struct {
+		Layers []string
+		Space  datalayer.SnapshotSpace
+	}
+
+	// volumeInfo is kept for each volume
+	volumeInfo struct {
+		Base   blob.ID
+		Layers []string
+	}
+
+	// layerInfo is kept for each layer
+	layerInfo struct {
+		Size uint64
+	}
+)
+
+var (
+	_ datalayer.Storage = &Storage{}
+)
+
+// New returns a storage which keeps its layers and volumes under the given directory, chains deeper than maxDepth
+// are squashed. Volumes which are not mounted, for example after a reboot, are mounted again.
+func New(root securefilepath.SecureFilePath, maxDepth int, blobDiffer datalayer.BlobDifferFactory) (*Storage,
+	error) {
+	if maxDepth < 1 {
+		return nil, errors.Errorf("Invalid maximum depth %d", maxDepth)
+	}
+
+	s := &Storage{root: root.Path(), maxDepth: maxDepth, blobDiffer: blobDiffer}
+	for _, dir := range []string{filepath.Join(layersDir, emptyLayer), blobsDir, volumesDir, mntDir} {
+		err := os.MkdirAll(s.path(dir), 0700)
+		if err != nil {
+			return nil, errors.New(err)
+		}
+	}
+
+	reflink, err := linkfs.ReflinkSupported(s.path(layersDir))
+	if err != nil {
+		return nil, err
+	}
+	s.reflink = reflink
+
+	err = s.mountVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Version implements datalayer.Storage interface
+func (s *Storage) Version() string {
+	return "overlay"
+}
+
+// BlobDiffer implements datalayer.Storage interface
+func (s *Storage) BlobDiffer() datalayer.BlobDifferFactory {
+	return s.blobDiffer
+}
+
+// EmptyBlobID implements datalayer.Storage interface
+func (s *Storage) EmptyBlobID(vsid volumeset.ID) (blob.ID, error) {
+	b := blob.NewID(filepath.Join(vsid.String(), emptyBlob))
+	path := s.blobInfoPath(b)
+	if _, err := os.Stat(path); err == nil {
+		return b, nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return blob.NilID(), errors.New(err)
+	}
+
+	err = writeJSON(path, &blobInfo{Layers: []string{emptyLayer}})
+	if err != nil {
+		return blob.NilID(), err
+	}
+
+	return b, nil
+}
+
+// CreateVolume implements datalayer.Storage interface, volumes are always mounted so the mount type is ignored
+func (s *Storage) CreateVolume(
+	vsid volumeset.ID,
+	b blob.ID,
+	_ datalayer.MountType,
+) (volume.ID, securefilepath.SecureFilePath, error) {
+	bi, err := s.blobInfo(b)
+	if err != nil {
+		return volume.NilID(), nil, err
+	}
+
+	vid := volume.NewID(uuid.New())
+	path := s.volumePath(vsid, vid)
+	for _, dir := range []string{upperDir, workDir, mergedDir} {
+		err = os.MkdirAll(filepath.Join(path, dir), 0755)
+		if err != nil {
+			return volume.NilID(), nil, errors.New(err)
+		}
+	}
+
+	vi := &volumeInfo{Base: b, Layers: bi.Layers}
+	err = writeJSON(path+infoSuffix, vi)
+	if err != nil {
+		os.RemoveAll(path)
+		return volume.NilID(), nil, err
+	}
+
+	err = s.mountVolume(path, vi)
+	if err != nil {
+		os.RemoveAll(path)
+		os.Remove(path + infoSuffix)
+		return volume.NilID(), nil, err
+	}
+
+	mntPath, err := securefilepath.New(filepath.Join(path, mergedDir))
+	if err != nil {
+		return volume.NilID(), nil, errors.New(err)
+	}
+
+	return vid, mntPath, nil
+}
+
+// CreateSnapshot implements datalayer.Storage interface
+func (s *Storage) CreateSnapshot(vsid volumeset.ID, ssid snapshot.ID, vid volume.ID) (blob.ID, error) {
+	path := s.volumePath(vsid, vid)
+	var vi volumeInfo
+	err := readJSON(path+infoSuffix, &vi)
+	if err != nil {
+		return blob.NilID(), err
+	}
+
+	layer := uuid.New()
+	layerPath := s.path(layersDir, layer)
+	upper := filepath.Join(path, upperDir)
+	merged := filepath.Join(path, mergedDir)
+
+	// Moving the upper directory needs the volume unmounted, a busy volume's upper directory is copied
+	rotated := syscall.Unmount(merged, 0) == nil
+	if rotated {
+		err = s.rotate(path, layerPath)
+	} else {
+		log.Printf("Volume %v is busy, copying its changes to a new layer", vid)
+		syscall.Sync()
+		err = linkfs.CopyTree(upper, layerPath+tmpSuffix, s.reflink)
+		if err == nil {
+			err = os.Rename(layerPath+tmpSuffix, layerPath)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(layerPath + tmpSuffix)
+		if rotated {
+			s.mountVolume(path, &vi)
+		}
+		return blob.NilID(), err
+	}
+
+	delta, err := s.writeLayerInfo(layer)
+	if err != nil {
+		return blob.NilID(), err
+	}
+
+	layers := append([]string{layer}, vi.Layers...)
+	if len(layers) > s.maxDepth {
+		layers, err = s.squash(layers)
+		if err != nil {
+			return blob.NilID(), err
+		}
+	}
+
+	b := blob.NewID(filepath.Join(vsid.String(), ssid.String()))
+	if rotated {
+		// The volume continues on top of the snapshot
+		vi = volumeInfo{Base: b, Layers: layers}
+		err = writeJSON(path+infoSuffix, &vi)
+		if err != nil {
+			return blob.NilID(), err
+		}
+
+		err = s.mountVolume(path, &vi)
+		if err != nil {
+			return blob.NilID(), err
+		}
+	}
+
+	logical, err := s.snapshotSize(layers)
+	if err != nil {
+		return blob.NilID(), err
+	}
+
+	err = writeJSON(s.blobInfoPath(b), &blobInfo{
+		Layers: layers,
+		Space:  datalayer.SnapshotSpace{LogicalSize: logical, DeltaFromPrevious: delta},
+	})
+	if err != nil {
+		return blob.NilID(), err
+	}
+
+	return b, nil
+}
+
+// rotate moves the unmounted volume's upper directory to the layer and gives the volume empty upper and work
+// directories
+func (s *Storage) rotate(path, layerPath string) error {
+	err := os.Rename(filepath.Join(path, upperDir), layerPath)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	err = os.RemoveAll(filepath.Join(path, workDir))
+	if err != nil {
+		return errors.New(err)
+	}
+
+	for _, dir := range []string{upperDir, workDir} {
+		err = os.Mkdir(filepath.Join(path, dir), 0755)
+		if err != nil {
+			return errors.New(err)
+		}
+	}
+
+	// The root of the volume keeps the attributes it had
+	fi, err := os.Lstat(layerPath)
+	if err != nil {
+		return errors.New(err)
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	err = os.Chmod(filepath.Join(path, upperDir), fi.Mode())
+	if err == nil {
+		err = os.Chown(filepath.Join(path, upperDir), int(st.Uid), int(st.Gid))
+	}
+	if err != nil {
+		return errors.New(err)
+	}
+
+	return nil
+}
+
+// squash merges the layers into a new one and returns the new chain
+func (s *Storage) squash(layers []string) ([]string, error) {
+	mnt, err := s.mountLayers(layers)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Unmount(mnt)
+
+	layer := uuid.New()
+	layerPath := s.path(layersDir, layer)
+	err = linkfs.CopyTree(mnt, layerPath+tmpSuffix, s.reflink)
+	if err == nil {
+		err = os.Rename(layerPath+tmpSuffix, layerPath)
+	}
+	if err != nil {
+		os.RemoveAll(layerPath + tmpSuffix)
+		return nil, err
+	}
+
+	_, err = s.writeLayerInfo(layer)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Squashed %d layers into %s", len(layers), layer)
+	return []string{layer}, nil
+}
+
+// snapshotSize returns the size of the files the chain of layers shows
+func (s *Storage) snapshotSize(layers []string) (uint64, error) {
+	mnt, err := s.mountLayers(layers)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Unmount(mnt)
+
+	return treeSize(mnt)
+}
+
+// DestroyVolume implements datalayer.Storage interface
+func (s *Storage) DestroyVolume(vsid volumeset.ID, vid volume.ID) error {
+	err := s.destroyVolume(s.volumePath(vsid, vid))
+	if err != nil {
+		return err
+	}
+
+	return s.removeUnusedLayers()
+}
+
+func (s *Storage) destroyVolume(path string) error {
+	err := syscall.Unmount(filepath.Join(path, mergedDir), 0)
+	if err != nil && err != syscall.EINVAL && err != syscall.ENOENT {
+		return errors.New(err)
+	}
+
+	err = os.RemoveAll(path)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	os.Remove(path + infoSuffix)
+	return nil
+}
+
+// DestroySnapshot implements datalayer.Storage interface
+func (s *Storage) DestroySnapshot(b blob.ID) error {
+	err := os.Remove(s.blobInfoPath(b))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New(err)
+	}
+
+	return s.removeUnusedLayers()
+}
+
+// DestroyVolumeSet implements datalayer.Storage interface
+func (s *Storage) DestroyVolumeSet(vsid volumeset.ID) error {
+	vols := s.path(volumesDir, vsid.String())
+	names, err := ioutil.ReadDir(vols)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New(err)
+	}
+	for _, n := range names {
+		if n.IsDir() {
+			err = s.destroyVolume(filepath.Join(vols, n.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, dir := range []string{vols, s.path(blobsDir, vsid.String())} {
+		err = os.RemoveAll(dir)
+		if err != nil {
+			return errors.New(err)
+		}
+	}
+
+	return s.removeUnusedLayers()
+}
+
+// SnapshotExists implements datalayer.Storage interface
+func (s *Storage) SnapshotExists(b blob.ID) (bool, error) {
+	_, err := os.Stat(s.blobInfoPath(b))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.New(err)
+	}
+
+	return true, nil
+}
+
+// MountBlob implements datalayer.Storage interface, the blob's layers are mounted read-only
+func (s *Storage) MountBlob(b blob.ID) (string, error) {
+	bi, err := s.blobInfo(b)
+	if err != nil {
+		return "", err
+	}
+
+	return s.mountLayers(bi.Layers)
+}
+
+// Unmount implements datalayer.Storage interface
+func (s *Storage) Unmount(path string) error {
+	if !strings.HasPrefix(path, s.path(mntDir)+string(filepath.Separator)) {
+		return nil
+	}
+
+	err := syscall.Unmount(path, 0)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	return nil
+}
+
+// GetSnapshotSpace implements datalayer.Storage interface, the space is accounted when the snapshot is created and
+// the new data is the size of the snapshot's top layer
+func (s *Storage) GetSnapshotSpace(b blob.ID) (datalayer.SnapshotSpace, error) {
+	bi, err := s.blobInfo(b)
+	if err != nil {
+		return datalayer.SnapshotSpace{}, err
+	}
+
+	return bi.Space, nil
+}
+
+// GetTotalSpace implements datalayer.Storage interface
+func (s *Storage) GetTotalSpace() (datalayer.DiskSpace, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(s.root, &st)
+	if err != nil {
+		return datalayer.DiskSpace{}, errors.New(err)
+	}
+
+	return datalayer.DiskSpace{
+		Used:      (st.Blocks - st.Bfree) * uint64(st.Bsize),
+		Available: st.Bavail * uint64(st.Bsize),
+	}, nil
+}
+
+// GetVolumesetSpace implements datalayer.Storage interface, the used space is the size of the layers the volume
+// set's snapshots and volumes use and of its volumes' upper directories.
+func (s *Storage) GetVolumesetSpace(vsid volumeset.ID) (datalayer.DiskSpace, error) {
+	total, err := s.GetTotalSpace()
+	if err != nil {
+		return datalayer.DiskSpace{}, err
+	}
+
+	layers := make(map[string]bool)
+	var used uint64
+	err = s.walkInfos(s.path(blobsDir, vsid.String()), func(path string) error {
+		var bi blobInfo
+		err := readJSON(path, &bi)
+		for _, l := range bi.Layers {
+			layers[l] = true
+		}
+		return err
+	})
+	if err != nil {
+		return datalayer.DiskSpace{}, err
+	}
+
+	err = s.walkInfos(s.path(volumesDir, vsid.String()), func(path string) error {
+		var vi volumeInfo
+		err := readJSON(path, &vi)
+		if err != nil {
+			return err
+		}
+		for _, l := range vi.Layers {
+			layers[l] = true
+		}
+
+		size, err := treeSize(filepath.Join(strings.TrimSuffix(path, infoSuffix), upperDir))
+		used += size
+		return err
+	})
+	if err != nil {
+		return datalayer.DiskSpace{}, err
+	}
+
+	for l := range layers {
+		if l == emptyLayer {
+			continue
+		}
+
+		var li layerInfo
+		err = readJSON(s.path(layersDir, l)+infoSuffix, &li)
+		if err != nil {
+			return datalayer.DiskSpace{}, err
+		}
+		used += li.Size
+	}
+
+	return datalayer.DiskSpace{Used: used, Available: total.Available}, nil
+}
+
+// path returns the absolute path of a path relative to the storage's root
+func (s *Storage) path(elem ...string) string {
+	return filepath.Join(append([]string{s.root}, elem...)...)
+}
+
+func (s *Storage) blobInfoPath(b blob.ID) string {
+	return s.path(blobsDir, b.String()) + infoSuffix
+}
+
+func (s *Storage) volumePath(vsid volumeset.ID, vid volume.ID) string {
+	return s.path(volumesDir, vsid.String(), vid.String())
+}
+
+func (s *Storage) blobInfo(b blob.ID) (*blobInfo, error) {
+	var bi blobInfo
+	err := readJSON(s.blobInfoPath(b), &bi)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bi, nil
+}
+
+// writeLayerInfo accounts the size of the layer and returns it
+func (s *Storage) writeLayerInfo(layer string) (uint64, error) {
+	size, err := treeSize(s.path(layersDir, layer))
+	if err != nil {
+		return 0, err
+	}
+
+	return size, writeJSON(s.path(layersDir, layer)+infoSuffix, &layerInfo{Size: size})
+}
+
+// mountLayers mounts the chain of layers read-only and returns the mount point, a single layer is its own mount
+// point since overlayfs needs two lower directories without an upper one.
+func (s *Storage) mountLayers(layers []string) (string, error) {
+	if len(layers) == 1 {
+		return s.path(layersDir, layers[0]), nil
+	}
+
+	mnt := s.path(mntDir, uuid.New())
+	err := os.Mkdir(mnt, 0700)
+	if err != nil {
+		return "", errors.New(err)
+	}
+
+	err = syscall.Mount("overlay", mnt, "overlay", syscall.MS_RDONLY, "lowerdir="+s.lowerDirs(layers))
+	if err != nil {
+		os.Remove(mnt)
+		return "", errors.Errorf("Failed to mount layers %v: %v", layers, err)
+	}
+
+	return mnt, nil
+}
+
+// mountVolume mounts the volume's upper directory on top of its layers
+func (s *Storage) mountVolume(path string, vi *volumeInfo) error {
+	opts := "lowerdir=" + s.lowerDirs(vi.Layers) +
+		",upperdir=" + filepath.Join(path, upperDir) +
+		",workdir=" + filepath.Join(path, workDir)
+	err := syscall.Mount("overlay", filepath.Join(path, mergedDir), "overlay", 0, opts)
+	if err != nil {
+		return errors.Errorf("Failed to mount volume %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// mountVolumes mounts the volumes which are not mounted
+func (s *Storage) mountVolumes() error {
+	sets, err := ioutil.ReadDir(s.path(volumesDir))
+	if err != nil {
+		return errors.New(err)
+	}
+
+	for _, vs := range sets {
+		err = s.walkInfos(s.path(volumesDir, vs.Name()), func(path string) error {
+			path = strings.TrimSuffix(path, infoSuffix)
+			mounted, err := isMountPoint(filepath.Join(path, mergedDir))
+			if err != nil || mounted {
+				return err
+			}
+
+			var vi volumeInfo
+			err = readJSON(path+infoSuffix, &vi)
+			if err != nil {
+				return err
+			}
+
+			return s.mountVolume(path, &vi)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) lowerDirs(layers []string) string {
+	dirs := make([]string, len(layers))
+	for i, l := range layers {
+		dirs[i] = s.path(layersDir, l)
+	}
+	return strings.Join(dirs, ":")
+}
+
+// removeUnusedLayers removes layers no snapshot or volume uses
+func (s *Storage) removeUnusedLayers() error {
+	used := map[string]bool{emptyLayer: true}
+	for _, dir := range []string{blobsDir, volumesDir} {
+		sets, err := ioutil.ReadDir(s.path(dir))
+		if err != nil {
+			return errors.New(err)
+		}
+
+		for _, vs := range sets {
+			err = s.walkInfos(s.path(dir, vs.Name()), func(path string) error {
+				// Infos of blobs and volumes both list their layers
+				var info blobInfo
+				err := readJSON(path, &info)
+				for _, l := range info.Layers {
+					used[l] = true
+				}
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	names, err := ioutil.ReadDir(s.path(layersDir))
+	if err != nil {
+		return errors.New(err)
+	}
+	for _, n := range names {
+		// Layers being created are left alone
+		if !n.IsDir() || used[n.Name()] || strings.HasSuffix(n.Name(), tmpSuffix) {
+			continue
+		}
+
+		path := s.path(layersDir, n.Name())
+		err = os.RemoveAll(path)
+		if err != nil {
+			return errors.New(err)
+		}
+		os.Remove(path + infoSuffix)
+	}
+
+	return nil
+}
+
+// walkInfos calls fn with the path of each info file in the directory
+func (s *Storage) walkInfos(dir string, fn func(path string) error) error {
+	names, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.New(err)
+	}
+
+	for _, n := range names {
+		if n.IsDir() || !strings.HasSuffix(n.Name(), infoSuffix) {
+			continue
+		}
+
+		err = fn(filepath.Join(dir, n.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isMountPoint returns true if a file system is mounted at the directory
+func isMountPoint(path string) (bool, error) {
+	var st, parent syscall.Stat_t
+	err := syscall.Stat(path, &st)
+	if err == nil {
+		err = syscall.Stat(filepath.Dir(path), &parent)
+	}
+	if err != nil {
+		return false, errors.New(err)
+	}
+
+	return st.Dev != parent.Dev, nil
+}
+
+// treeSize returns the size of the regular files in the tree
+func treeSize(root string) (uint64, error) {
+	var size uint64
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			size += uint64(fi.Size())
+		}
+		return err
+	})
+	if err != nil {
+		return 0, errors.New(err)
+	}
+
+	return size, nil
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	return nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	err = ioutil.WriteFile(path+tmpSuffix, data, 0600)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	err = os.Rename(path+tmpSuffix, path)
+	if err != nil {
+		return errors.New(err)
+	}
+
+	return nil
+}
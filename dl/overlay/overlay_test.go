@@ -0,0 +1,180 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package overlay_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/ClusterHQ/fli/dl/blobdiffer"
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dl/filediffer/variableblk"
+	"github.com/ClusterHQ/fli/dl/overlay"
+	"github.com/ClusterHQ/fli/dl/testutils"
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+	"github.com/ClusterHQ/fli/securefilepath"
+	"github.com/stretchr/testify/require"
+)
+
+func newStorage(t *testing.T, maxDepth int) (*overlay.Storage, string) {
+	if !testutils.RunningAsRoot() {
+		t.Skip("Not running as superuser, skip overlay tests.")
+	}
+
+	root, err := ioutil.TempDir("", "overlay_test-")
+	require.NoError(t, err)
+	path, err := securefilepath.New(root)
+	require.NoError(t, err)
+	s, err := overlay.New(path, maxDepth, blobdiffer.Factory{FileDiffer: variableblk.Factory{}})
+	require.NoError(t, err)
+
+	return s, root
+}
+
+// requireContent checks the blob has exactly the files given
+func requireContent(t *testing.T, s *overlay.Storage, b blob.ID, files map[string]string) {
+	mnt, err := s.MountBlob(b)
+	require.NoError(t, err)
+	defer s.Unmount(mnt)
+
+	got := make(map[string]string)
+	err = filepath.Walk(mnt, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		got[path[len(mnt)+1:]] = string(data)
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, files, got)
+}
+
+// TestLayers snapshots a volume on each change, snapshots keep what the volume had when they were taken while their
+// chains are squashed.
+func TestLayers(t *testing.T) {
+	s, root := newStorage(t, 3)
+	defer os.RemoveAll(root)
+
+	vsid := volumeset.NewRandomID()
+	empty, err := s.EmptyBlobID(vsid)
+	require.NoError(t, err)
+	vid, mnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+	require.NoError(t, err)
+
+	files := map[string]string{}
+	var blobs []blob.ID
+	var contents []map[string]string
+	snap := func() {
+		b, err := s.CreateSnapshot(vsid, snapshot.NewRandomID(), vid)
+		require.NoError(t, err)
+		c := make(map[string]string)
+		for k, v := range files {
+			c[k] = v
+		}
+		blobs = append(blobs, b)
+		contents = append(contents, c)
+	}
+	write := func(name, data string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(mnt.Path(), name)), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(mnt.Path(), name), []byte(data), 0644))
+		files[name] = data
+	}
+	remove := func(name string) {
+		require.NoError(t, os.RemoveAll(filepath.Join(mnt.Path(), name)))
+		delete(files, name)
+	}
+
+	write("a", "a1")
+	write("dir/b", "b1")
+	snap()
+	write("a", "a2")
+	remove("dir/b")
+	snap()
+	write("dir/c", "c1")
+	snap()
+
+	// A busy volume's changes are copied
+	f, err := os.Open(filepath.Join(mnt.Path(), "a"))
+	require.NoError(t, err)
+	write("d", "d1")
+	snap()
+	f.Close()
+
+	remove("a")
+	snap()
+	write("a", "a3")
+	snap()
+
+	for i, b := range blobs {
+		requireContent(t, s, b, contents[i])
+	}
+
+	space, err := s.GetSnapshotSpace(blobs[0])
+	require.NoError(t, err)
+	require.Equal(t, datalayer.SnapshotSpace{LogicalSize: 4, DeltaFromPrevious: 4}, space)
+
+	// A volume from a snapshot in the middle
+	_, mnt2, err := s.CreateVolume(vsid, blobs[1], datalayer.NoAutoMount)
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(mnt2.Path(), "a"))
+	require.NoError(t, err)
+	require.Equal(t, "a2", string(data))
+	_, err = os.Stat(filepath.Join(mnt2.Path(), "dir", "b"))
+	require.True(t, os.IsNotExist(err))
+
+	for _, b := range blobs {
+		require.NoError(t, s.DestroySnapshot(b))
+	}
+	require.NoError(t, s.DestroyVolumeSet(vsid))
+
+	// Only the empty layer is left
+	layers, err := ioutil.ReadDir(filepath.Join(root, "layers"))
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+}
+
+// TestRemount mounts volumes again when the storage is opened after they were unmounted.
+func TestRemount(t *testing.T) {
+	s, root := newStorage(t, overlay.DefaultMaxDepth)
+	defer os.RemoveAll(root)
+
+	vsid := volumeset.NewRandomID()
+	empty, err := s.EmptyBlobID(vsid)
+	require.NoError(t, err)
+	_, mnt, err := s.CreateVolume(vsid, empty, datalayer.NoAutoMount)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mnt.Path(), "a"), []byte("a"), 0644))
+	defer s.DestroyVolumeSet(vsid)
+
+	require.NoError(t, syscall.Unmount(mnt.Path(), 0))
+	_, err = os.Stat(filepath.Join(mnt.Path(), "a"))
+	require.True(t, os.IsNotExist(err))
+
+	path, err := securefilepath.New(root)
+	require.NoError(t, err)
+	_, err = overlay.New(path, overlay.DefaultMaxDepth, blobdiffer.Factory{FileDiffer: variableblk.Factory{}})
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(mnt.Path(), "a"))
+	require.NoError(t, err)
+	require.Equal(t, "a", string(data))
+}
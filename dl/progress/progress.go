@@ -0,0 +1,373 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ClusterHQ/fli/dl/record"
+)
+
+// Progress of blob transfers. A tracker counts the records, bytes and files of one snapshot's transfer and hands
+// the counters to a reporter every tick while the transfer runs, and once more when it is finished.
+
+type (
+	// Stats are the counters of a transfer at one point in time
+	Stats struct {
+		Name    string `json:"name"`
+		Records uint64 `json:"records"`
+		Bytes   uint64 `json:"bytes"`
+
+		// Files is the number of files touched, consecutive records of the same file count once
+		Files uint64 `json:"files"`
+
+		// Total is the number of bytes expected, 0 if it is not known
+		Total uint64 `json:"total,omitempty"`
+
+		Elapsed time.Duration `json:"elapsed"`
+		Done    bool          `json:"done"`
+	}
+
+	// Reporter shows or forwards the stats of a transfer
+	Reporter interface {
+		Report(Stats)
+	}
+
+	// ReporterFunc adapts a function to a Reporter
+	ReporterFunc func(Stats)
+
+	// Tracker counts the records, bytes and files of a transfer. All methods can be called on a nil tracker, they
+	// do nothing, so a transfer which isn't tracked passes nil.
+	Tracker struct {
+		// Note: Updated atomically, keep them first for 64 bit alignment
+		records uint64
+		bytes   uint64
+		files   uint64
+
+		name     string
+		total    uint64
+		start    time.Time
+		reporter Reporter
+
+		lock    *sync.Mutex
+		lastKey string
+
+		stop chan struct{}
+		wg   *sync.WaitGroup
+	}
+
+	throttle struct {
+		r        Reporter
+		interval time.Duration
+		lock     *sync.Mutex
+		last     time.Time
+	}
+
+	bar struct {
+		w     io.Writer
+		width int
+	}
+
+	jsonLines struct {
+		w io.Writer
+	}
+
+	countingWriter struct {
+		w io.Writer
+		t *Tracker
+	}
+
+	countingReader struct {
+		r io.Reader
+		t *Tracker
+	}
+)
+
+const (
+	// Tick is how often a tracker reports while a transfer runs
+	Tick = 500 * time.Millisecond
+
+	// JSONInterval is how often the JSON lines reporter writes a line
+	JSONInterval = 10 * time.Second
+
+	barWidth = 30
+)
+
+var (
+	_ Reporter = ReporterFunc(nil)
+	_ Reporter = &throttle{}
+	_ Reporter = &bar{}
+	_ Reporter = &jsonLines{}
+)
+
+// Report implements Reporter interface
+func (f ReporterFunc) Report(s Stats) {
+	f(s)
+}
+
+// Start starts tracking a transfer, r is told the stats every tick until Finish is called. r can be nil in which
+// case the counters are only kept.
+func Start(name string, total uint64, r Reporter) *Tracker {
+	t := &Tracker{
+		name:     name,
+		total:    total,
+		start:    time.Now(),
+		reporter: r,
+		lock:     &sync.Mutex{},
+		stop:     make(chan struct{}),
+		wg:       &sync.WaitGroup{},
+	}
+
+	if r != nil {
+		t.wg.Add(1)
+		go t.tick()
+	}
+
+	return t
+}
+
+func (t *Tracker) tick() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(Tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			t.reporter.Report(t.Stats())
+		}
+	}
+}
+
+// Record counts a record sent or received.
+func (t *Tracker) Record(r record.Record) {
+	if t == nil {
+		return
+	}
+
+	atomic.AddUint64(&t.records, 1)
+
+	key := r.Key()
+	t.lock.Lock()
+	if key != t.lastKey {
+		t.lastKey = key
+		atomic.AddUint64(&t.files, 1)
+	}
+	t.lock.Unlock()
+}
+
+// Add counts bytes sent or received.
+func (t *Tracker) Add(n int) {
+	if t == nil || n <= 0 {
+		return
+	}
+	atomic.AddUint64(&t.bytes, uint64(n))
+}
+
+// Writer returns a writer which counts the bytes written to w.
+func (t *Tracker) Writer(w io.Writer) io.Writer {
+	if t == nil {
+		return w
+	}
+	return &countingWriter{w: w, t: t}
+}
+
+// Reader returns a reader which counts the bytes read from r.
+func (t *Tracker) Reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &countingReader{r: r, t: t}
+}
+
+// Stats returns the current counters.
+func (t *Tracker) Stats() Stats {
+	if t == nil {
+		return Stats{}
+	}
+
+	return Stats{
+		Name:    t.name,
+		Records: atomic.LoadUint64(&t.records),
+		Bytes:   atomic.LoadUint64(&t.bytes),
+		Files:   atomic.LoadUint64(&t.files),
+		Total:   t.total,
+		Elapsed: time.Since(t.start),
+	}
+}
+
+// Finish stops the ticks and reports the final stats, it returns them as well.
+func (t *Tracker) Finish() Stats {
+	if t == nil {
+		return Stats{}
+	}
+
+	close(t.stop)
+	t.wg.Wait()
+
+	s := t.Stats()
+	s.Done = true
+	if t.reporter != nil {
+		t.reporter.Report(s)
+	}
+	return s
+}
+
+// Rate returns the average number of bytes transferred per second.
+func (s Stats) Rate() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Elapsed.Seconds()
+}
+
+// ETA returns how long the transfer is expected to take still, false if it can't tell because the total is not
+// known or nothing was transferred yet.
+func (s Stats) ETA() (time.Duration, bool) {
+	rate := s.Rate()
+	if s.Total == 0 || rate == 0 {
+		return 0, false
+	}
+	if s.Bytes >= s.Total {
+		return 0, true
+	}
+	return time.Duration(float64(s.Total-s.Bytes)/rate) * time.Second, true
+}
+
+// Throttle returns a reporter which passes stats on to r at most once per interval, the final stats are always
+// passed on.
+func Throttle(r Reporter, interval time.Duration) Reporter {
+	return &throttle{r: r, interval: interval, lock: &sync.Mutex{}}
+}
+
+// Report implements Reporter interface
+func (t *throttle) Report(s Stats) {
+	t.lock.Lock()
+	now := time.Now()
+	skip := !s.Done && now.Sub(t.last) < t.interval
+	if !skip {
+		t.last = now
+	}
+	t.lock.Unlock()
+
+	if !skip {
+		t.r.Report(s)
+	}
+}
+
+// NewBar returns a reporter which draws a progress bar on a terminal.
+func NewBar(w io.Writer) Reporter {
+	return &bar{w: w, width: barWidth}
+}
+
+// Report implements Reporter interface
+func (b *bar) Report(s Stats) {
+	rate := humanSize(uint64(s.Rate())) + "/s"
+
+	var line string
+	if s.Total > 0 {
+		frac := float64(s.Bytes) / float64(s.Total)
+		if frac > 1 {
+			frac = 1
+		}
+		n := int(frac * float64(b.width))
+		eta := "--"
+		if d, ok := s.ETA(); ok {
+			eta = d.String()
+		}
+		line = fmt.Sprintf("%s [%s%s] %3.0f%% %s %s ETA %s", s.Name, strings.Repeat("=", n),
+			strings.Repeat(" ", b.width-n), frac*100, humanSize(s.Bytes), rate, eta)
+	} else {
+		line = fmt.Sprintf("%s %d records %d files %s %s", s.Name, s.Records, s.Files, humanSize(s.Bytes), rate)
+	}
+
+	end := ""
+	if s.Done {
+		end = "\n"
+	}
+
+	// Clears what is left of a longer previous line
+	fmt.Fprintf(b.w, "\r%-79s%s", line, end)
+}
+
+// NewJSONLines returns a reporter which writes the stats as one JSON object per line, every JSONInterval.
+func NewJSONLines(w io.Writer) Reporter {
+	return Throttle(&jsonLines{w: w}, JSONInterval)
+}
+
+// Report implements Reporter interface
+func (j *jsonLines) Report(s Stats) {
+	line := struct {
+		Stats
+		Rate uint64 `json:"rate"`
+		ETA  string `json:"eta,omitempty"`
+	}{Stats: s, Rate: uint64(s.Rate())}
+	if d, ok := s.ETA(); ok && !s.Done {
+		line.ETA = d.String()
+	}
+
+	b, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	j.w.Write(append(b, '\n'))
+}
+
+// New returns a progress bar reporter if f is a terminal, otherwise a JSON lines reporter.
+func New(f *os.File) Reporter {
+	fi, err := f.Stat()
+	if err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		return NewBar(f)
+	}
+	return NewJSONLines(f)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.t.Add(n)
+	return n, err
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.t.Add(n)
+	return n, err
+}
+
+func humanSize(sz uint64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	f := float64(sz)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", sz)
+	}
+	return fmt.Sprintf("%.1f%s", f, units[i])
+}
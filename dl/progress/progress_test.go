@@ -0,0 +1,117 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package progress_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ClusterHQ/fli/dl/progress"
+	"github.com/ClusterHQ/fli/dl/record"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracker(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		reports []progress.Stats
+	)
+	tr := progress.Start("snap", 100, progress.ReporterFunc(func(s progress.Stats) {
+		lock.Lock()
+		reports = append(reports, s)
+		lock.Unlock()
+	}))
+
+	w := tr.Writer(ioutil.Discard)
+	_, err := w.Write(make([]byte, 30))
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(tr.Reader(bytes.NewReader(make([]byte, 20))))
+	require.NoError(t, err)
+
+	// Consecutive records of the same file count as one file
+	tr.Record(record.NewMkdir("a", 0755))
+	tr.Record(record.NewCreate("a/f", 0644))
+	tr.Record(record.NewTruncate("a/f", 10))
+	tr.Record(record.NewCreate("a/g", 0644))
+
+	time.Sleep(progress.Tick + progress.Tick/2)
+	st := tr.Finish()
+	assert.Equal(t, "snap", st.Name)
+	assert.Equal(t, uint64(4), st.Records)
+	assert.Equal(t, uint64(3), st.Files)
+	assert.Equal(t, uint64(50), st.Bytes)
+	assert.True(t, st.Done)
+
+	eta, ok := st.ETA()
+	assert.True(t, ok)
+	assert.True(t, eta >= 0)
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.True(t, len(reports) >= 2)
+	assert.False(t, reports[0].Done)
+	assert.Equal(t, st, reports[len(reports)-1])
+}
+
+func TestNilTracker(t *testing.T) {
+	var tr *progress.Tracker
+	tr.Record(record.NewMkdir("a", 0755))
+	tr.Add(10)
+
+	var buf bytes.Buffer
+	assert.Equal(t, &buf, tr.Writer(&buf))
+	assert.Equal(t, progress.Stats{}, tr.Finish())
+
+	_, ok := tr.Stats().ETA()
+	assert.False(t, ok)
+}
+
+func TestReporters(t *testing.T) {
+	st := progress.Stats{Name: "snap", Records: 3, Bytes: 2048, Files: 1, Total: 4096, Elapsed: time.Second}
+
+	var bar bytes.Buffer
+	progress.NewBar(&bar).Report(st)
+	assert.Contains(t, bar.String(), "snap [")
+	assert.Contains(t, bar.String(), " 50% ")
+	assert.False(t, strings.HasSuffix(bar.String(), "\n"))
+
+	st.Done = true
+	progress.NewBar(&bar).Report(st)
+	assert.True(t, strings.HasSuffix(bar.String(), "\n"))
+
+	// Only the first report and the final one are written within an interval
+	var lines bytes.Buffer
+	r := progress.NewJSONLines(&lines)
+	st.Done = false
+	r.Report(st)
+	r.Report(st)
+	st.Done = true
+	r.Report(st)
+
+	out := strings.Split(strings.TrimSpace(lines.String()), "\n")
+	require.Len(t, out, 2)
+
+	var got progress.Stats
+	require.NoError(t, json.Unmarshal([]byte(out[1]), &got))
+	assert.Equal(t, st, got)
+}
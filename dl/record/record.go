@@ -20,6 +20,8 @@
 package record
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -35,6 +37,7 @@ import (
 	"time"
 
 	dlhash "github.com/ClusterHQ/fli/dl/hash"
+	"github.com/ClusterHQ/fli/dl/sparse"
 	"github.com/pkg/xattr"
 )
 
@@ -54,6 +57,9 @@ const (
 	fallbackUser   string = "nobody"
 	fallbackGroup1 string = "nogroup"
 	fallbackGroup2 string = "nobody"
+
+	// Number of bytes copied at a time by a copy range record
+	copyRangeBufSize int = (1 << 20)
 )
 
 type (
@@ -167,6 +173,38 @@ type (
 		MTime int64
 	}
 
+	// CopyRange represents a record for copying a range of a file to another offset of the same file
+	CopyRange struct {
+		Hdr
+		Path      string
+		SrcOffset uint64
+		DstOffset uint64
+		Length    uint64
+	}
+
+	// PunchHole represents a record for deallocating a range of a file, the range reads as zeros after
+	PunchHole struct {
+		Hdr
+		Path   string
+		Offset uint64
+		Length uint64
+	}
+
+	// Digest represents a record which verifies the SHA-256 digest of a file's content, it is sent after the records
+	// which change the content of the file
+	Digest struct {
+		Hdr
+		Path string
+		Sum  []byte
+	}
+
+	// ErrDigestMismatch is returned by a digest record when the file's content differs from the sender's
+	ErrDigestMismatch struct {
+		Path string
+		Want []byte
+		Got  []byte
+	}
+
 	// EOT represents a special record which does nothing to the file system but indicates the end of a transfer
 	EOT struct {
 		Hdr
@@ -219,6 +257,15 @@ const (
 
 	// TypeEOT defines the type ID
 	TypeEOT
+
+	// TypeCopyRange defines the type ID
+	TypeCopyRange
+
+	// TypePunchHole defines the type ID
+	TypePunchHole
+
+	// TypeDigest defines the type ID
+	TypeDigest
 )
 
 // Record defines the function signature for all the common methods implemented for each record type
@@ -279,6 +326,9 @@ var (
 	_ SafeRecord = &Chmod{}
 	_ Record     = &Setmtime{}
 	_ Record     = &EOT{}
+	_ Record     = &CopyRange{}
+	_ Record     = &PunchHole{}
+	_ Record     = &Digest{}
 )
 
 // SetChksum sets the record's checksum
@@ -1832,7 +1882,6 @@ func NewRename(oldpath string, newpath string) Record {
 }
 
 // Exec is implementation of Record interface
-// TODO: currently not used
 func (rec *Rename) Exec(root string) error {
 	return os.Rename(path.Join(root, rec.OldPath), path.Join(root, rec.NewPath))
 }
@@ -1994,6 +2043,430 @@ func (rec *EOT) Chksum(hf dlhash.Factory) ([]byte, error) {
 	return h.Sum(nil), nil
 }
 
+// COPYRANGE-SPECIFIC INTERFACE IMPLEMENTATION//////////////////////////////////////
+// The functions below describe copying data within a file, it is used to move data shifted by an insert or a
+// delete without sending it again.
+
+// NewCopyRange returns an record object of type copy range from the parameters
+func NewCopyRange(path string, srcOffset uint64, dstOffset uint64, length uint64) Record {
+	return &CopyRange{
+		Path:      path,
+		SrcOffset: srcOffset,
+		DstOffset: dstOffset,
+		Length:    length,
+	}
+}
+
+// Exec is implementation of Record interface
+// The source and destination may overlap, the range is copied as if through an intermediate buffer.
+func (rec *CopyRange) Exec(root string) error {
+	fp, err := os.OpenFile(path.Join(root, rec.Path), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	bufSize := uint64(copyRangeBufSize)
+	if rec.Length < bufSize {
+		bufSize = rec.Length
+	}
+	buf := make([]byte, bufSize)
+
+	// Copy backwards if the destination is after the source, so no data is overwritten before it is read
+	backwards := rec.DstOffset > rec.SrcOffset
+	for done := uint64(0); done < rec.Length; {
+		n := rec.Length - done
+		if n > bufSize {
+			n = bufSize
+		}
+
+		pos := done
+		if backwards {
+			pos = rec.Length - done - n
+		}
+
+		_, err = fp.ReadAt(buf[:n], int64(rec.SrcOffset+pos))
+		if err != nil {
+			return err
+		}
+
+		_, err = fp.WriteAt(buf[:n], int64(rec.DstOffset+pos))
+		if err != nil {
+			return err
+		}
+
+		done += n
+	}
+
+	return nil
+}
+
+func (rec *CopyRange) String() string {
+	return fmt.Sprintf("%T: file = %s, src = %d, dst = %d, len = %d",
+		rec, rec.Path, rec.SrcOffset, rec.DstOffset, rec.Length)
+}
+
+// Key is implementation of Record interface
+func (rec *CopyRange) Key() string {
+	return rec.Path
+}
+
+// ExecType is implementation of Record interface
+// Note: Copies read data which may be overwritten by pwrites of the same file, they are executed synchronously so
+// they are done before any pwrite sent after them.
+func (rec *CopyRange) ExecType() ExecType {
+	return SyncExec
+}
+
+// Type is implementation of Record interface
+func (rec *CopyRange) Type() Type {
+	return TypeCopyRange
+}
+
+// ToBinary is implementation of Record interface
+func (rec *CopyRange) ToBinary(target io.Writer) error {
+	err := writeUint64(target, uint64(rec.Type()))
+	if err != nil {
+		return err
+	}
+
+	err = writeBytes(target, rec.Hdr.Chksum)
+	if err != nil {
+		return err
+	}
+
+	err = writeString(target, rec.Path)
+	if err != nil {
+		return err
+	}
+
+	err = writeUint64(target, rec.SrcOffset)
+	if err != nil {
+		return err
+	}
+
+	err = writeUint64(target, rec.DstOffset)
+	if err != nil {
+		return err
+	}
+
+	err = writeUint64(target, rec.Length)
+	return err
+}
+
+// FromBinary is implementation of Record interface
+func (rec *CopyRange) FromBinary(src io.Reader) error {
+	chksum, err := readBytes(src)
+	if err != nil {
+		return err
+	}
+	rec.Hdr.Chksum = chksum
+
+	path, err := readString(src)
+	if err != nil {
+		return err
+	}
+	rec.Path = path
+
+	n, err := readUint64(src)
+	if err != nil {
+		return err
+	}
+	rec.SrcOffset = n
+
+	n, err = readUint64(src)
+	if err != nil {
+		return err
+	}
+	rec.DstOffset = n
+
+	n, err = readUint64(src)
+	if err != nil {
+		return err
+	}
+	rec.Length = n
+
+	return nil
+}
+
+// Chksum is implementation of Record interface
+func (rec *CopyRange) Chksum(hf dlhash.Factory) ([]byte, error) {
+	h := hf.New()
+
+	err := hashString(h, rec.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = hashUint64(h, rec.SrcOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	err = hashUint64(h, rec.DstOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	err = hashUint64(h, rec.Length)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// PUNCHHOLE-SPECIFIC INTERFACE IMPLEMENTATION//////////////////////////////////////
+// The functions below describe deallocating a range of a file, it is used to keep the holes of sparse files instead
+// of writing zeros.
+
+// NewPunchHole returns an record object of type punch hole from the parameters
+func NewPunchHole(path string, offset uint64, length uint64) Record {
+	return &PunchHole{
+		Path:   path,
+		Offset: offset,
+		Length: length,
+	}
+}
+
+// Exec is implementation of Record interface
+// Zeros are written if the file system can't punch holes.
+func (rec *PunchHole) Exec(root string) error {
+	fp, err := os.OpenFile(path.Join(root, rec.Path), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	return sparse.Punch(fp, int64(rec.Offset), int64(rec.Length))
+}
+
+func (rec *PunchHole) String() string {
+	return fmt.Sprintf("%T: file = %s, offset = %d, len = %d", rec, rec.Path, rec.Offset, rec.Length)
+}
+
+// Key is implementation of Record interface
+func (rec *PunchHole) Key() string {
+	return rec.Path
+}
+
+// ExecType is implementation of Record interface
+// Note: Holes are punched after the copies of the same file, they are executed synchronously to keep that order.
+func (rec *PunchHole) ExecType() ExecType {
+	return SyncExec
+}
+
+// Type is implementation of Record interface
+func (rec *PunchHole) Type() Type {
+	return TypePunchHole
+}
+
+// ToBinary is implementation of Record interface
+func (rec *PunchHole) ToBinary(target io.Writer) error {
+	err := writeUint64(target, uint64(rec.Type()))
+	if err != nil {
+		return err
+	}
+
+	err = writeBytes(target, rec.Hdr.Chksum)
+	if err != nil {
+		return err
+	}
+
+	err = writeString(target, rec.Path)
+	if err != nil {
+		return err
+	}
+
+	err = writeUint64(target, rec.Offset)
+	if err != nil {
+		return err
+	}
+
+	err = writeUint64(target, rec.Length)
+	return err
+}
+
+// FromBinary is implementation of Record interface
+func (rec *PunchHole) FromBinary(src io.Reader) error {
+	chksum, err := readBytes(src)
+	if err != nil {
+		return err
+	}
+	rec.Hdr.Chksum = chksum
+
+	path, err := readString(src)
+	if err != nil {
+		return err
+	}
+	rec.Path = path
+
+	n, err := readUint64(src)
+	if err != nil {
+		return err
+	}
+	rec.Offset = n
+
+	n, err = readUint64(src)
+	if err != nil {
+		return err
+	}
+	rec.Length = n
+
+	return nil
+}
+
+// Chksum is implementation of Record interface
+func (rec *PunchHole) Chksum(hf dlhash.Factory) ([]byte, error) {
+	h := hf.New()
+
+	err := hashString(h, rec.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = hashUint64(h, rec.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	err = hashUint64(h, rec.Length)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// DIGEST-SPECIFIC INTERFACE IMPLEMENTATION/////////////////////////////////////////
+// The functions below describe verifying the content of a file after a transfer.
+
+// NewDigest returns an record object of type digest from the parameters, sum is the SHA-256 digest of the file's
+// content, see FileDigest.
+func NewDigest(path string, sum []byte) Record {
+	return &Digest{
+		Path: path,
+		Sum:  sum,
+	}
+}
+
+// FileDigest returns the SHA-256 digest of the content read from src
+func FileDigest(src io.Reader) ([]byte, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, src)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Exec is implementation of Record interface
+// *ErrDigestMismatch is returned if the file's content differs from the sender's.
+func (rec *Digest) Exec(root string) error {
+	fp, err := os.Open(path.Join(root, rec.Path))
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	sum, err := FileDigest(fp)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(sum, rec.Sum) {
+		return &ErrDigestMismatch{Path: rec.Path, Want: rec.Sum, Got: sum}
+	}
+
+	return nil
+}
+
+func (rec *Digest) String() string {
+	return fmt.Sprintf("%T: file = %s, sum = %x", rec, rec.Path, rec.Sum)
+}
+
+// Key is implementation of Record interface
+func (rec *Digest) Key() string {
+	return rec.Path
+}
+
+// ExecType is implementation of Record interface
+// Note: The digest is verified after all writes of the same file are executed.
+func (rec *Digest) ExecType() ExecType {
+	return DelayExec
+}
+
+// Type is implementation of Record interface
+func (rec *Digest) Type() Type {
+	return TypeDigest
+}
+
+// ToBinary is implementation of Record interface
+func (rec *Digest) ToBinary(target io.Writer) error {
+	err := writeUint64(target, uint64(rec.Type()))
+	if err != nil {
+		return err
+	}
+
+	err = writeBytes(target, rec.Hdr.Chksum)
+	if err != nil {
+		return err
+	}
+
+	err = writeString(target, rec.Path)
+	if err != nil {
+		return err
+	}
+
+	err = writeBytes(target, rec.Sum)
+	return err
+}
+
+// FromBinary is implementation of Record interface
+func (rec *Digest) FromBinary(src io.Reader) error {
+	chksum, err := readBytes(src)
+	if err != nil {
+		return err
+	}
+	rec.Hdr.Chksum = chksum
+
+	path, err := readString(src)
+	if err != nil {
+		return err
+	}
+	rec.Path = path
+
+	sum, err := readBytes(src)
+	if err != nil {
+		return err
+	}
+	rec.Sum = sum
+
+	return nil
+}
+
+// Chksum is implementation of Record interface
+func (rec *Digest) Chksum(hf dlhash.Factory) ([]byte, error) {
+	h := hf.New()
+
+	err := hashString(h, rec.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = hashBytes(h, rec.Sum)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+func (e *ErrDigestMismatch) Error() string {
+	return fmt.Sprintf("Content of %s doesn't match the sender's, SHA-256 digest is %x instead of %x", e.Path, e.Got,
+		e.Want)
+}
+
 // Binary encode/decode utility functions
 func writeUint64(target io.Writer, v uint64) error {
 	err := binary.Write(target, binary.LittleEndian, v)
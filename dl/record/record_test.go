@@ -17,13 +17,21 @@
 package record_test
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	dlhash "github.com/ClusterHQ/fli/dl/hash"
 	"github.com/ClusterHQ/fli/dl/hash/adler32"
+	"github.com/ClusterHQ/fli/dl/hash/blake2b"
+	"github.com/ClusterHQ/fli/dl/hash/blake3"
 	"github.com/ClusterHQ/fli/dl/hash/md5"
 	dlsha "github.com/ClusterHQ/fli/dl/hash/sha256"
+	"github.com/ClusterHQ/fli/dl/hash/xxh3"
+	"github.com/ClusterHQ/fli/dl/hash/xxhash64"
 	"github.com/ClusterHQ/fli/dl/record"
 	"github.com/stretchr/testify/require"
 )
@@ -49,6 +57,9 @@ func TestType(t *testing.T) {
 		{record.NewChmod("", 0), record.TypeChmod},
 		{record.NewSetMtime("", time.Now()), record.TypeSetmtime},
 		{record.NewEOT(), record.TypeEOT},
+		{record.NewCopyRange("", 0, 0, 0), record.TypeCopyRange},
+		{record.NewPunchHole("", 0, 0), record.TypePunchHole},
+		{record.NewDigest("", nil), record.TypeDigest},
 	}
 
 	alltypes := make(map[int]int)
@@ -76,6 +87,9 @@ func testChecksum(t *testing.T, hf dlhash.Factory) {
 		record.NewMknod("test", 0, 0),
 		record.NewChmod("test", 0),
 		record.NewSetMtime("test", time.Now()),
+		record.NewCopyRange("test", 0, 0, 0),
+		record.NewPunchHole("test", 0, 0),
+		record.NewDigest("test", nil),
 		record.NewEOT(),
 	}
 
@@ -108,6 +122,9 @@ func testChecksum(t *testing.T, hf dlhash.Factory) {
 		record.NewMknod("test1", 0, 0),
 		record.NewChmod("test1", 0),
 		record.NewSetMtime("test1", time.Now()),
+		record.NewCopyRange("test1", 0, 0, 0),
+		record.NewPunchHole("test1", 0, 0),
+		record.NewDigest("test1", nil),
 	}
 	for idx, r := range recs {
 		actual, err := r.Chksum(hf)
@@ -134,6 +151,9 @@ func testChecksum(t *testing.T, hf dlhash.Factory) {
 		record.NewChmod("test", 2),
 		// Note: No need to modify, time will change
 		record.NewSetMtime("test", time.Now()),
+		record.NewCopyRange("test", 2, 0, 0),
+		record.NewPunchHole("test", 2, 0),
+		record.NewDigest("test", []byte{2}),
 	}
 	for idx, r := range recs {
 		actual, err := r.Chksum(hf)
@@ -160,6 +180,9 @@ func testChecksum(t *testing.T, hf dlhash.Factory) {
 		record.NewChmod("test3", 3),
 		// Note: No need to modify, time will change
 		record.NewSetMtime("test", time.Now()),
+		record.NewCopyRange("test", 0, 3, 3),
+		record.NewPunchHole("test", 0, 3),
+		record.NewDigest("test3", []byte{3}),
 	}
 	for idx, r := range recs {
 		actual, err := r.Chksum(hf)
@@ -173,4 +196,31 @@ func TestChecksum(t *testing.T) {
 	testChecksum(t, dlsha.Factory{})
 	testChecksum(t, md5.Factory{})
 	testChecksum(t, adler32.Factory{})
+	testChecksum(t, xxhash64.Factory{})
+	testChecksum(t, xxh3.Factory{})
+	testChecksum(t, blake2b.Factory{})
+	testChecksum(t, blake3.Factory{})
+}
+
+// TestDigest verifies a file's content with a digest record
+func TestDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record_test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := []byte("digest record test")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), data, 0600))
+	sum, err := record.FileDigest(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	rec := record.NewDigest("file", sum)
+	require.NoError(t, rec.Exec(dir))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), data[1:], 0600))
+	err = rec.Exec(dir)
+	require.Error(t, err)
+	e, ok := err.(*record.ErrDigestMismatch)
+	require.True(t, ok)
+	require.Equal(t, "file", e.Path)
+	require.Equal(t, sum, e.Want)
 }
@@ -0,0 +1,200 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sparse finds the holes of sparse files, punches holes and copies files without filling their holes.
+package sparse
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+type (
+	// Extent is a range of a file
+	Extent struct {
+		Offset int64
+		Length int64
+	}
+)
+
+const (
+	// Linux-specific whence values of lseek, the go runtime does not define them
+	seekData int = 3
+	seekHole int = 4
+
+	// Linux-specific fallocate modes
+	fallocKeepSize  uint32 = 0x01
+	fallocPunchHole uint32 = 0x02
+
+	// Number of bytes of zeros written at a time where holes can't be punched
+	zeroBufSize int64 = (1 << 20)
+)
+
+// End returns the offset after the extent
+func (e Extent) End() int64 {
+	return e.Offset + e.Length
+}
+
+// Holes returns the holes in the first size bytes of the file in offset order, they are found with SEEK_DATA and
+// SEEK_HOLE. A file system which doesn't report holes has none. The file offset is changed.
+func Holes(f *os.File, size int64) ([]Extent, error) {
+	var holes []Extent
+	fd := int(f.Fd())
+	for off := int64(0); off < size; {
+		data, err := syscall.Seek(fd, off, seekData)
+		switch err {
+		case nil:
+		case syscall.ENXIO:
+			// No data after off
+			data = size
+		case syscall.EINVAL:
+			// SEEK_DATA is not supported
+			return nil, nil
+		default:
+			return nil, err
+		}
+
+		if data > size {
+			data = size
+		}
+		if data > off {
+			holes = append(holes, Extent{Offset: off, Length: data - off})
+		}
+		if data == size {
+			break
+		}
+
+		off, err = syscall.Seek(fd, data, seekHole)
+		if err == syscall.ENXIO {
+			// The file was truncated
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return holes, nil
+}
+
+// PathHoles returns the holes in the first size bytes of the file at the path
+func PathHoles(path string, size int64) ([]Extent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Holes(f, size)
+}
+
+// Subtract returns the parts of the extents which are not in any of the others, both are in offset order and
+// don't overlap.
+func Subtract(extents []Extent, others []Extent) []Extent {
+	var result []Extent
+	for _, e := range extents {
+		for _, o := range others {
+			if o.End() <= e.Offset {
+				continue
+			}
+			if o.Offset >= e.End() {
+				break
+			}
+
+			if o.Offset > e.Offset {
+				result = append(result, Extent{Offset: e.Offset, Length: o.Offset - e.Offset})
+			}
+			if o.End() >= e.End() {
+				e.Length = 0
+				break
+			}
+			e = Extent{Offset: o.End(), Length: e.End() - o.End()}
+		}
+
+		if e.Length > 0 {
+			result = append(result, e)
+		}
+	}
+
+	return result
+}
+
+// Punch deallocates the range of the file keeping its size, the range reads as zeros. Zeros are written if the
+// file system can't punch holes.
+func Punch(f *os.File, offset, length int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, offset, length)
+	if err != syscall.EOPNOTSUPP && err != syscall.ENOSYS {
+		return err
+	}
+
+	bufSize := zeroBufSize
+	if length < bufSize {
+		bufSize = length
+	}
+	buf := make([]byte, bufSize)
+	for done := int64(0); done < length; {
+		n := length - done
+		if n > bufSize {
+			n = bufSize
+		}
+
+		_, err = f.WriteAt(buf[:n], offset+done)
+		if err != nil {
+			return err
+		}
+		done += n
+	}
+
+	return nil
+}
+
+// Copy copies the data of src to dst without writing the holes of src, dst ends up with src's size. Both file
+// offsets are changed.
+func Copy(dst, src *os.File) error {
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	holes, err := Holes(src, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	var off int64
+	for _, h := range append(holes, Extent{Offset: fi.Size()}) {
+		if h.Offset > off {
+			_, err = src.Seek(off, io.SeekStart)
+			if err != nil {
+				return err
+			}
+
+			_, err = dst.Seek(off, io.SeekStart)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.CopyN(dst, src, h.Offset-off)
+			if err != nil {
+				return err
+			}
+		}
+		off = h.End()
+	}
+
+	return dst.Truncate(fi.Size())
+}
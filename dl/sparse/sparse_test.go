@@ -0,0 +1,102 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sparse_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/ClusterHQ/fli/dl/sparse"
+	"github.com/stretchr/testify/require"
+)
+
+const mb = 1 << 20
+
+// sparseFile makes a file of 4MB with data in its second and last MB, nil is returned if the file system doesn't
+// report holes
+func sparseFile(t *testing.T, dir string) *os.File {
+	f, err := os.Create(filepath.Join(dir, "sparse"))
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte{0xab}, mb)
+	_, err = f.WriteAt(data, mb)
+	require.NoError(t, err)
+	_, err = f.WriteAt(data, 3*mb)
+	require.NoError(t, err)
+
+	holes, err := sparse.Holes(f, 4*mb)
+	require.NoError(t, err)
+	if len(holes) == 0 {
+		f.Close()
+		return nil
+	}
+	require.Equal(t, []sparse.Extent{{Offset: 0, Length: mb}, {Offset: 2 * mb, Length: mb}}, holes)
+	return f
+}
+
+func blocks(t *testing.T, f *os.File) int64 {
+	var st syscall.Stat_t
+	require.NoError(t, syscall.Fstat(int(f.Fd()), &st))
+	return st.Blocks
+}
+
+func TestSubtract(t *testing.T) {
+	extents := []sparse.Extent{{Offset: 0, Length: 10}, {Offset: 20, Length: 10}}
+	others := []sparse.Extent{{Offset: 5, Length: 2}, {Offset: 8, Length: 14}, {Offset: 28, Length: 10}}
+	require.Equal(t,
+		[]sparse.Extent{{Offset: 0, Length: 5}, {Offset: 7, Length: 1}, {Offset: 22, Length: 6}},
+		sparse.Subtract(extents, others))
+	require.Equal(t, extents, sparse.Subtract(extents, nil))
+	require.Nil(t, sparse.Subtract(nil, others))
+}
+
+func TestCopyAndPunch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sparse_test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := sparseFile(t, dir)
+	if src == nil {
+		t.Skip("File system doesn't report holes")
+	}
+	defer src.Close()
+
+	dst, err := os.Create(filepath.Join(dir, "copy"))
+	require.NoError(t, err)
+	defer dst.Close()
+
+	require.NoError(t, sparse.Copy(dst, src))
+	want, err := ioutil.ReadFile(src.Name())
+	require.NoError(t, err)
+	got, err := ioutil.ReadFile(dst.Name())
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	require.Equal(t, blocks(t, src), blocks(t, dst))
+
+	require.NoError(t, sparse.Punch(dst, mb, mb))
+	holes, err := sparse.Holes(dst, 4*mb)
+	require.NoError(t, err)
+	require.Equal(t, []sparse.Extent{{Offset: 0, Length: 3 * mb}}, holes)
+	got, err = ioutil.ReadFile(dst.Name())
+	require.NoError(t, err)
+	require.Equal(t, 4*mb, len(got))
+	require.Equal(t, make([]byte, 3*mb), got[:3*mb])
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package token
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// signed is the payload of a key, only one of the tokens is set based on the type
+	signed struct {
+		Type     Type
+		Upload   UploadToken
+		Download DownloadToken
+	}
+
+	// ErrInvalidToken is returned when a key is malformed, has a bad signature or is of the wrong type
+	ErrInvalidToken struct{}
+
+	// ErrTokenExpired is returned when a key is valid but its token has expired
+	ErrTokenExpired struct{}
+)
+
+var (
+	_ error = &ErrInvalidToken{}
+	_ error = &ErrTokenExpired{}
+
+	encoding = base64.RawURLEncoding
+)
+
+// RequestExpiration is how long a signed request stays valid
+const RequestExpiration = 5 * time.Minute
+
+func (e *ErrInvalidToken) Error() string {
+	return "Invalid token"
+}
+
+func (e *ErrTokenExpired) Error() string {
+	return "Token expired"
+}
+
+// SignUpload returns a key of the upload token signed with the given secret
+func SignUpload(secret []byte, t UploadToken) (Key, error) {
+	return sign(secret, signed{Type: Upload, Upload: t})
+}
+
+// SignDownload returns a key of the download token signed with the given secret
+func SignDownload(secret []byte, t DownloadToken) (Key, error) {
+	return sign(secret, signed{Type: Download, Download: t})
+}
+
+// VerifyUpload checks the key's signature and expiration time, returns the upload token in the key
+func VerifyUpload(secret []byte, k Key) (*UploadToken, error) {
+	s, err := verify(secret, k, Upload)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(s.Upload.ExpirationTime) {
+		return nil, &ErrTokenExpired{}
+	}
+
+	return &s.Upload, nil
+}
+
+// VerifyDownload checks the key's signature and expiration time, returns the download token in the key
+func VerifyDownload(secret []byte, k Key) (*DownloadToken, error) {
+	s, err := verify(secret, k, Download)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(s.Download.ExpirationTime) {
+		return nil, &ErrTokenExpired{}
+	}
+
+	return &s.Download, nil
+}
+
+// SignRequest returns the signature of a request between a data plane and a data server sent at the given time, it
+// covers the request's method, end point path and body
+func SignRequest(secret []byte, method, path string, body []byte, now time.Time) string {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	return ts + "." + encoding.EncodeToString(mac(secret, requestPayload(method, path, ts, body)))
+}
+
+// VerifyRequest checks the signature of a request, signatures older than RequestExpiration are rejected. No request
+// is valid without a secret.
+func VerifyRequest(secret []byte, sig, method, path string, body []byte) error {
+	if len(secret) == 0 {
+		return &ErrInvalidToken{}
+	}
+
+	parts := strings.Split(sig, ".")
+	if len(parts) != 2 {
+		return &ErrInvalidToken{}
+	}
+
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return &ErrInvalidToken{}
+	}
+
+	m, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return &ErrInvalidToken{}
+	}
+
+	if !hmac.Equal(m, mac(secret, requestPayload(method, path, parts[0], body))) {
+		return &ErrInvalidToken{}
+	}
+
+	d := time.Now().Sub(time.Unix(sec, 0))
+	if d > RequestExpiration || d < -RequestExpiration {
+		return &ErrTokenExpired{}
+	}
+
+	return nil
+}
+
+func requestPayload(method, path, ts string, body []byte) []byte {
+	return append([]byte(method+"\n"+path+"\n"+ts+"\n"), body...)
+}
+
+// sign encodes the payload and appends its HMAC, both parts are URL safe base64 encoded and separated by a '.'
+func sign(secret []byte, s signed) (Key, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(s)
+	if err != nil {
+		return "", err
+	}
+
+	payload := buf.Bytes()
+	return Key(encoding.EncodeToString(payload) + "." + encoding.EncodeToString(mac(secret, payload))), nil
+}
+
+func verify(secret []byte, k Key, t Type) (*signed, error) {
+	parts := strings.Split(k.String(), ".")
+	if len(parts) != 2 {
+		return nil, &ErrInvalidToken{}
+	}
+
+	payload, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, &ErrInvalidToken{}
+	}
+
+	sig, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, &ErrInvalidToken{}
+	}
+
+	if !hmac.Equal(sig, mac(secret, payload)) {
+		return nil, &ErrInvalidToken{}
+	}
+
+	var s signed
+	err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&s)
+	if err != nil || s.Type != t {
+		return nil, &ErrInvalidToken{}
+	}
+
+	return &s, nil
+}
+
+func mac(secret []byte, payload []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(payload)
+	return h.Sum(nil)
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package zfs
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/volume"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+	uuidPkg "github.com/pborman/uuid"
+)
+
+// Inventory of the zpool
+// Volumes are the file systems zpool/uuid_of_volume_set/uuid_of_volume, blobs are their snapshots. File systems
+// snapshots are natively received into (zpool/uuid_of_volume_set/recv-snap_uuid) are listed as volumes without a
+// volume id. Data sets and snapshots not named by fli, for example snapshots taken by hand, are left out.
+
+const (
+	// mountsFile lists the mounted file systems
+	mountsFile = "/proc/self/mounts"
+)
+
+var (
+	_ datalayer.Inventory = ZFS{}
+)
+
+// Objects implements datalayer.Inventory interface
+func (z ZFS) Objects() ([]datalayer.StoredObject, error) {
+	names, err := list(z.zpool)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		objs  []datalayer.StoredObject
+		snaps = make(map[string][]blob.ID)
+	)
+	for _, name := range names {
+		segments := strings.Split(strings.TrimPrefix(name, z.zpool+"/"), "/")
+		if name == z.zpool || len(segments) != 2 {
+			// The zpool, a volume set's file system or its empty snapshot
+			continue
+		}
+
+		vsid := volumeset.NewID(segments[0])
+		fs := segments[1]
+		if !isUUID(segments[0]) {
+			continue
+		}
+
+		if strings.Contains(fs, "@") {
+			parts := strings.SplitN(fs, "@", 2)
+			if !isFileSystem(parts[0]) || !isUUID(parts[1]) {
+				continue
+			}
+
+			b := blob.NewID(name)
+			parent := name[:strings.Index(name, "@")]
+			snaps[parent] = append(snaps[parent], b)
+			objs = append(objs, datalayer.StoredObject{VolSetID: vsid, BlobID: b, Name: name})
+			continue
+		}
+
+		if !isFileSystem(fs) {
+			continue
+		}
+
+		obj := datalayer.StoredObject{VolSetID: vsid, Name: name}
+		if !strings.HasPrefix(fs, receivePrefix) {
+			obj.VolumeID = volume.NewID(fs)
+		}
+		objs = append(objs, obj)
+	}
+
+	for i := range objs {
+		if !objs[i].IsBlob() {
+			objs[i].Blobs = snaps[objs[i].Name]
+		}
+	}
+
+	return objs, nil
+}
+
+// isUUID returns true if s is a UUID, fli names volume sets, volumes and snapshots by their UUIDs
+func isUUID(s string) bool {
+	return uuidPkg.Parse(s) != nil
+}
+
+// isFileSystem returns true if fs is the name of a volume's file system or of a file system snapshots are received
+// into
+func isFileSystem(fs string) bool {
+	return isUUID(strings.TrimPrefix(fs, receivePrefix))
+}
+
+// DestroyObject implements datalayer.Inventory interface
+func (z ZFS) DestroyObject(obj datalayer.StoredObject) error {
+	if obj.IsBlob() {
+		return destroySnapshot([]string{obj.Name}, false)
+	}
+
+	m, err := mounted("/" + obj.Name)
+	if err != nil {
+		return err
+	}
+	if m {
+		err = unmount(obj.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return destroy(obj.Name)
+}
+
+// Mounted implements datalayer.Inventory interface
+func (z ZFS) Mounted(vsid volumeset.ID, vid volume.ID, path string) (bool, error) {
+	return mounted(path)
+}
+
+// Mount implements datalayer.Inventory interface
+func (z ZFS) Mount(vsid volumeset.ID, vid volume.ID) error {
+	_, err := mount(z.volumePath(vsid, vid))
+	return err
+}
+
+// mounted returns true if a file system is mounted at the path
+func mounted(path string) (bool, error) {
+	f, err := os.Open(mountsFile)
+	if err != nil {
+		return false, errors.New(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[1] == path {
+			return true, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return false, errors.New(err)
+	}
+	return false, nil
+}
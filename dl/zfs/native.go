@@ -0,0 +1,181 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package zfs
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/meta/blob"
+	snapPkg "github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+	"github.com/ClusterHQ/fli/protocols/transferhdr"
+)
+
+// Native ZFS streams
+// A blob diff between two ZFS storages is sent with 'zfs send' and received with 'zfs receive'. Snapshots have the
+// same guid on both sides after that, which is what an incremental stream needs to be received.
+//
+// A diff from the empty blob is a full stream:
+// zfs send zpool/uuid_of_volume_set/uuid_of_volume@snap_uuid
+// zfs receive -s -u zpool/uuid_of_volume_set/recv-snap_uuid
+//
+// Any other diff is an incremental stream received as a clone of the base:
+// zfs send -i base target
+// zfs receive -s -u -o origin=base zpool/uuid_of_volume_set/recv-snap_uuid
+//
+// An interrupted receive is resumed with the file system's receive_resume_token:
+// zfs send -t token
+
+const (
+	// receivePrefix is the prefix of file systems snapshots are received into
+	receivePrefix = "recv-"
+)
+
+var (
+	_ datalayer.NativeStorage = ZFS{}
+)
+
+// Stream implements datalayer.NativeStorage interface
+func (z ZFS) Stream() transferhdr.Stream {
+	return transferhdr.StreamZFS
+}
+
+// BlobGUID implements datalayer.NativeStorage interface
+func (z ZFS) BlobGUID(b blob.ID) (string, error) {
+	if strings.HasSuffix(b.String(), "@"+emptySnapshot) {
+		return "", nil
+	}
+
+	return zfsOutput("get", "-H", "-p", "-o", "value", "guid", b.String())
+}
+
+// SendStream implements datalayer.NativeStorage interface
+func (z ZFS) SendStream(base blob.ID, target blob.ID, resumeToken string, w io.Writer) error {
+	guid, err := z.BlobGUID(base)
+	if err != nil {
+		return err
+	}
+
+	var args []string
+	switch {
+	case resumeToken != "":
+		args = []string{"send", "-t", resumeToken}
+	case guid == "":
+		args = []string{"send", target.String()}
+	default:
+		args = []string{"send", "-i", base.String(), target.String()}
+	}
+
+	return zfsStream(nil, w, args...)
+}
+
+// ReceiveStream implements datalayer.NativeStorage interface
+func (z ZFS) ReceiveStream(vsid volumeset.ID, ssid snapPkg.ID, base blob.ID, resumed bool,
+	src io.Reader) (blob.ID, error) {
+	// Makes sure the volume set's file system exists
+	_, err := z.EmptyBlobID(vsid)
+	if err != nil {
+		return blob.NilID(), err
+	}
+
+	fs := z.receivePath(vsid, ssid)
+	if !resumed && exists(fs) {
+		// What is left of an earlier receive can't be continued by a stream from the beginning
+		_, err = zfsOutput("receive", "-A", fs)
+		if err != nil {
+			return blob.NilID(), err
+		}
+	}
+
+	guid, err := z.BlobGUID(base)
+	if err != nil {
+		return blob.NilID(), err
+	}
+
+	args := []string{"receive", "-s", "-u"}
+	if guid != "" && !resumed {
+		args = append(args, "-o", "origin="+base.String())
+	}
+	args = append(args, fs)
+
+	err = zfsStream(src, nil, args...)
+	if err != nil {
+		return blob.NilID(), err
+	}
+
+	// The received snapshot is the most recent one of the file system
+	o, err := zfsOutput("list", "-H", "-t", "snapshot", "-o", "name", "-s", "createtxg", "-d", "1", fs)
+	if err != nil {
+		return blob.NilID(), err
+	}
+	snaps := strings.Split(o, "\n")
+
+	return blob.NewID(snaps[len(snaps)-1]), nil
+}
+
+// ResumeToken implements datalayer.NativeStorage interface
+func (z ZFS) ResumeToken(vsid volumeset.ID, ssid snapPkg.ID) (string, error) {
+	fs := z.receivePath(vsid, ssid)
+	if !exists(fs) {
+		return "", nil
+	}
+
+	token, err := zfsOutput("get", "-H", "-o", "value", "receive_resume_token", fs)
+	if err != nil || token == "-" {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// receivePath forms a zfs filesystem path a snapshot is received into
+func (z ZFS) receivePath(vsid volumeset.ID, ssid snapPkg.ID) string {
+	return strings.Join([]string{z.zpool, vsid.String(), receivePrefix + ssid.String()}, "/")
+}
+
+// zfsOutput runs a ZFS command and returns its output without the trailing new line
+func zfsOutput(args ...string) (string, error) {
+	var out bytes.Buffer
+	err := zfsStream(nil, &out, args...)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(out.String(), "\n"), nil
+}
+
+// zfsStream runs a ZFS command which reads its input from stdin and writes its output to stdout
+func zfsStream(stdin io.Reader, stdout io.Writer, args ...string) error {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("zfs", args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return errors.Errorf("zfs %s failed: %v %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
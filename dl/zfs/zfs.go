@@ -60,6 +60,9 @@ import (
 const (
 	snapshotRoot = ".zfs"
 	snapshotDir  = "snapshot"
+
+	// emptySnapshot is the name of the snapshot of a volume set's file system new volumes are created from
+	emptySnapshot = "empty"
 )
 
 var (
@@ -103,7 +106,7 @@ func (z ZFS) BlobDiffer() datalayer.BlobDifferFactory {
 func (z ZFS) EmptyBlobID(vsid volumeset.ID) (blob.ID, error) {
 	// Check if volume set base exists
 	fs := z.volumesetPath(vsid)
-	base := fs + "@empty"
+	base := fs + "@" + emptySnapshot
 	if !exists(base) {
 		// Volume set's base has not been established, created it
 		err := createFileSystem(fs)
@@ -43,10 +43,10 @@ func run(args ...string) (string, error) {
 	return string(o), errors.New(err)
 }
 
-// list returns a slice of strings giving the names of all filesystems beneath
-// the given pool.
+// list returns a slice of strings giving the names of all filesystems and
+// snapshots beneath the given pool.
 func list(root string) ([]string, error) {
-	o, err := run("list", "-H", "-o", "name", "-r", root)
+	o, err := run("list", "-H", "-o", "name", "-t", "filesystem,snapshot", "-r", root)
 	if err != nil {
 		return nil, errors.Errorf("%#v %#v", o, err)
 	}
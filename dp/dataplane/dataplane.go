@@ -33,10 +33,11 @@ import (
 
 type (
 	// BlobUploader sends a local blob identified by delta of the blob id and the base blob id. The receiver of the blob
-	// is identified by the token.
+	// is identified by the token. ssid is the snapshot of the blob.
 	BlobUploader interface {
 		UploadBlobDiff(
 			vsid volumeset.ID,
+			ssid snapshot.ID,
 			base blob.ID,
 			blob blob.ID,
 			token string,
@@ -121,15 +122,31 @@ func Snapshot(
 	}
 
 	ssid := snapshot.NewRandomID()
-	// TODO: Make sure this is the right sequence in term of MDS consistence(transaction)
-	blobid, err := s.CreateSnapshot(vol.VolSetID, ssid, volid)
+
+	// The snapshot is rolled back if a crash happens before it is added to the branch, forward after
+	intent := &metastore.Intent{Op: metastore.IntentSnapshot, VolSetID: vol.VolSetID, SnapshotID: ssid, Volume: vol}
+	err = mds.AddIntent(intent)
 	if err != nil {
 		return nil, err
 	}
 
+	blobid, err := s.CreateSnapshot(vol.VolSetID, ssid, volid)
+	if err != nil {
+		return nil, abort(mds, intent, err)
+	}
+
+	// The blob is destroyed if the snapshot fails before it is added to the branch
+	intent.BlobIDs = []blob.ID{blobid}
+	err = mds.UpdateIntent(intent)
+	if err != nil {
+		destroyBlobs(s, intent.BlobIDs)
+		return nil, abort(mds, intent, err)
+	}
+
 	space, err := s.GetSnapshotSpace(blobid)
 	if err != nil {
-		return nil, err
+		destroyBlobs(s, intent.BlobIDs)
+		return nil, abort(mds, intent, err)
 	}
 
 	vsid := vol.VolSetID
@@ -137,7 +154,8 @@ func Snapshot(
 	var sn *snapshot.Snapshot
 	fork, err := forking(mds, branchName, syncMode, vol.BaseID)
 	if err != nil {
-		return nil, err
+		destroyBlobs(s, intent.BlobIDs)
+		return nil, abort(mds, intent, err)
 	}
 
 	if fork {
@@ -166,7 +184,8 @@ func Snapshot(
 		)
 	}
 	if err != nil {
-		return nil, err
+		destroyBlobs(s, intent.BlobIDs)
+		return nil, abort(mds, intent, err)
 	}
 
 	// TODO: This can be avoided if all datalayer supports ZFS like snapshot(fs mount continues after snapshot)
@@ -184,17 +203,31 @@ func Snapshot(
 		return nil, err
 	}
 
+	err = mds.RemoveIntent(intent.ID)
+	if err != nil {
+		return nil, err
+	}
+
 	err = updateStorageUsage(mds, s, vsid)
 	return sn, err
 }
 
 // createVolume creates a volume based on the given blob id
 func createVolume(mds metastore.Client, s datalayer.Storage, vsid volumeset.ID, sid *snapshot.ID, blobid blob.ID, name string) (*volume.Volume, error) {
-	vid, mntPath, err := s.CreateVolume(vsid, blobid, datalayer.AutoMount)
+	intent := &metastore.Intent{Op: metastore.IntentClone, VolSetID: vsid, BlobIDs: []blob.ID{blobid}}
+	if sid != nil {
+		intent.SnapshotID = *sid
+	}
+	err := mds.AddIntent(intent)
 	if err != nil {
 		return nil, err
 	}
 
+	vid, mntPath, err := s.CreateVolume(vsid, blobid, datalayer.AutoMount)
+	if err != nil {
+		return nil, abort(mds, intent, err)
+	}
+
 	// Updates meta data
 	vol := &volume.Volume{
 		ID:           vid,
@@ -205,12 +238,22 @@ func createVolume(mds metastore.Client, s datalayer.Storage, vsid volumeset.ID,
 		CreationTime: time.Now(),
 		Name:         name,
 	}
+
+	// The volume is imported if a crash happens before it is
+	intent.Volume = vol
+	err = mds.UpdateIntent(intent)
+	if err != nil {
+		destroyVolume(s, vol)
+		return nil, abort(mds, intent, err)
+	}
+
 	err = mds.ImportVolume(vol)
 	if err != nil {
-		return nil, err
+		destroyVolume(s, vol)
+		return nil, abort(mds, intent, err)
 	}
 
-	return vol, nil
+	return vol, mds.RemoveIntent(intent.ID)
 }
 
 // CreateEmptyVolume ...
@@ -255,10 +298,16 @@ func DeleteVolume(mds metastore.Client, s datalayer.Storage, vid volume.ID) erro
 		return err
 	}
 
+	intent := &metastore.Intent{Op: metastore.IntentDeleteVolume, VolSetID: vs.VolSetID, Volume: vs}
+	err = mds.AddIntent(intent)
+	if err != nil {
+		return err
+	}
+
 	// Remove from MDS first
 	err = mds.DeleteVolume(vid)
 	if err != nil {
-		return err
+		return abort(mds, intent, err)
 	}
 
 	// Remove from storage
@@ -268,6 +317,11 @@ func DeleteVolume(mds metastore.Client, s datalayer.Storage, vid volume.ID) erro
 		return err
 	}
 
+	err = mds.RemoveIntent(intent.ID)
+	if err != nil {
+		return err
+	}
+
 	return updateStorageUsage(mds, s, vs.VolSetID)
 }
 
@@ -284,32 +338,57 @@ func DeleteBlob(mds metastore.Client, s datalayer.Storage, snapid snapshot.ID) e
 	}
 
 	blobid := snap.BlobID
+	intent := &metastore.Intent{
+		Op:         metastore.IntentDeleteBlob,
+		VolSetID:   snap.VolSetID,
+		SnapshotID: snapid,
+		BlobIDs:    []blob.ID{blobid},
+	}
+	err = mds.AddIntent(intent)
+	if err != nil {
+		return err
+	}
+
 	snap.BlobID = blob.NilID()
 	snap.Size = 0
 	_, err = mds.UpdateSnapshot(snap, nil)
 	if err != nil {
-		return err
+		return abort(mds, intent, err)
 	}
 
-	// TODO: Needs a transaction log in case a crash happens here
 	err = s.DestroySnapshot(blobid)
 	if err != nil {
 		return err
 	}
 
+	err = mds.RemoveIntent(intent.ID)
+	if err != nil {
+		return err
+	}
+
 	return updateStorageUsage(mds, s, snap.VolSetID)
 }
 
 // DeleteVolumeSet ...
 func DeleteVolumeSet(mds metastore.Client, s datalayer.Storage, vsid volumeset.ID) error {
+	intent := &metastore.Intent{Op: metastore.IntentDeleteVolumeSet, VolSetID: vsid}
+	err := mds.AddIntent(intent)
+	if err != nil {
+		return err
+	}
+
 	// Remove meta data
-	err := mds.DeleteVolumeSet(vsid)
+	err = mds.DeleteVolumeSet(vsid)
+	if err != nil {
+		return abort(mds, intent, err)
+	}
+
+	err = s.DestroyVolumeSet(vsid)
 	if err != nil {
 		return err
 	}
 
-	// TODO: Needs a transaction log in case a crash happens here
-	return s.DestroyVolumeSet(vsid)
+	return mds.RemoveIntent(intent.ID)
 }
 
 // UploadBlobDiff ...
@@ -337,7 +416,7 @@ func UploadBlobDiff(
 		return err
 	}
 
-	return sender.UploadBlobDiff(vsid, baseBlobID, targetBlobID, token, dspuburl)
+	return sender.UploadBlobDiff(vsid, target, baseBlobID, targetBlobID, token, dspuburl)
 }
 
 // DownloadBlobDiff is the orchestrator of blob download. It finds the base blob is, download the diff and updates
@@ -443,16 +522,31 @@ func DeleteBranch(mds metastore.Client, s datalayer.Storage, vsid volumeset.ID,
 		}
 	}
 
-	err = mds.DeleteSnapshots(tobeDeleted, snap)
+	// Blobs are deleted if a crash happens after the snapshots are
+	intent := &metastore.Intent{Op: metastore.IntentDeleteBranch, VolSetID: vsid, SnapshotID: tip.Tip.ID}
+	for _, snap := range tobeDeleted {
+		if !snap.BlobID.Equals(blob.NilID()) {
+			intent.BlobIDs = append(intent.BlobIDs, snap.BlobID)
+		}
+	}
+	err = mds.AddIntent(intent)
 	if err != nil {
 		return err
 	}
 
+	err = mds.DeleteSnapshots(tobeDeleted, snap)
+	if err != nil {
+		return abort(mds, intent, err)
+	}
+
 	// Delete blobs
-	for _, snap := range tobeDeleted {
-		if !snap.BlobID.Equals(blob.NilID()) {
-			s.DestroySnapshot(snap.BlobID)
-		}
+	for _, blobid := range intent.BlobIDs {
+		s.DestroySnapshot(blobid)
+	}
+
+	err = mds.RemoveIntent(intent.ID)
+	if err != nil {
+		return err
 	}
 
 	return updateStorageUsage(mds, s, vsid)
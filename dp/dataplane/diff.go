@@ -0,0 +1,48 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dataplane
+
+import (
+	"fmt"
+
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	dlhash "github.com/ClusterHQ/fli/dl/hash"
+	"github.com/ClusterHQ/fli/dl/record"
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+)
+
+// Diff diffs the blobs of two snapshots and passes the records which turn the base into the target to fn. Both
+// snapshots must have their blobs in the storage.
+func Diff(mds metastore.Client, s datalayer.Storage, base snapshot.ID, target snapshot.ID, hf dlhash.Factory,
+	fn func(record.Record) error) error {
+	var snaps []*snapshot.Snapshot
+	for _, id := range []snapshot.ID{base, target} {
+		snap, err := metastore.GetSnapshot(mds, id)
+		if err != nil {
+			return err
+		}
+
+		if snap.BlobID.IsNilID() {
+			return fmt.Errorf("Snapshot %v has no data, pull it first", id)
+		}
+
+		snaps = append(snaps, snap)
+	}
+
+	return datalayer.DiffBlobs(s, snaps[0].BlobID, snaps[1].BlobID, hf, fn)
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dataplane_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dl/fs"
+	"github.com/ClusterHQ/fli/dl/hash/adler32"
+	"github.com/ClusterHQ/fli/dl/record"
+	"github.com/ClusterHQ/fli/dp/dataplane"
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/dp/metastore/testutil"
+	"github.com/ClusterHQ/fli/mdsimpls/sqlite3storage"
+	"github.com/ClusterHQ/fli/meta/attrs"
+	"github.com/ClusterHQ/fli/securefilepath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mdsPath, err := securefilepath.New(filepath.Join(dir, "mds"))
+	require.NoError(t, err)
+	mds, err := sqlite3storage.Create(mdsPath)
+	require.NoError(t, err)
+	storePath, err := securefilepath.New(filepath.Join(dir, "store"))
+	require.NoError(t, err)
+	s, err := fs.New(storePath)
+	require.NoError(t, err)
+
+	vs, err := testutil.VolumeSetTest(mds, "vs", "", attrs.Attrs{}, "")
+	require.NoError(t, err)
+	vol, err := dataplane.CreateEmptyVolume(mds, s, vs.ID, "vol")
+	require.NoError(t, err)
+
+	write := func(name, data string) {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(vol.MntPath.Path(), name), []byte(data), 0644))
+	}
+
+	write("kept", "same")
+	write("changed", "before")
+	write("removed", "gone soon")
+	a, err := dataplane.Snapshot(mds, s, vol.ID, "master", metastore.AutoSync, "a", attrs.Attrs{}, "")
+	require.NoError(t, err)
+
+	write("changed", "after!")
+	write("added", "new")
+	require.NoError(t, os.Remove(filepath.Join(vol.MntPath.Path(), "removed")))
+	b, err := dataplane.Snapshot(mds, s, vol.ID, "master", metastore.AutoSync, "b", attrs.Attrs{}, "")
+	require.NoError(t, err)
+
+	sum := datalayer.NewDiffSummarizer()
+	err = dataplane.Diff(mds, s, a.ID, b.ID, adler32.Factory{}, func(r record.Record) error {
+		sum.Add(r)
+		return nil
+	})
+	require.NoError(t, err)
+
+	summary := sum.Summary()
+	assert.Equal(t, []string{"added"}, summary.Added)
+	assert.Equal(t, []string{"removed"}, summary.Removed)
+	// The directory storage's differ may recreate files which didn't change
+	assert.Contains(t, summary.Modified, "changed")
+	assert.NotZero(t, summary.BytesChanged)
+}
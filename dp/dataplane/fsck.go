@@ -0,0 +1,274 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dataplane
+
+import (
+	"os"
+
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volume"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+)
+
+// Consistency check between the meta data store and the storage.
+// Every snapshot's blob must exist and every volume must be mounted at its mount path. Storages which implement
+// datalayer.Inventory are also checked for volumes which are gone and for blobs and volumes the meta data store
+// doesn't know about.
+
+type (
+	// ProblemKind is a kind of inconsistency found by Fsck
+	ProblemKind string
+
+	// Problem is an inconsistency between the meta data store and the storage
+	Problem struct {
+		Kind       ProblemKind
+		VolSetID   volumeset.ID
+		SnapshotID snapshot.ID
+		VolumeID   volume.ID
+		BlobID     blob.ID
+
+		// Name is the volume's mount path or the storage object's name
+		Name string
+
+		// Repair is how the problem is repaired, empty if it can't be
+		Repair string
+
+		// Repaired is true if the repair was done, Err is set if it failed
+		Repaired bool
+		Err      error
+	}
+)
+
+const (
+	// MissingBlob is a snapshot whose blob is not in the storage, it is marked missing by clearing its blob id
+	MissingBlob ProblemKind = "missing-blob"
+
+	// MissingVolume is a volume which is not in the storage, it is removed from the meta data store
+	MissingVolume ProblemKind = "missing-volume"
+
+	// UnmountedVolume is a volume which is not mounted at its mount path, it is mounted again
+	UnmountedVolume ProblemKind = "unmounted-volume"
+
+	// OrphanBlob is a blob no snapshot refers to, it is destroyed
+	OrphanBlob ProblemKind = "orphan-blob"
+
+	// OrphanVolume is a volume the meta data store doesn't know about, it is destroyed
+	OrphanVolume ProblemKind = "orphan-volume"
+)
+
+// Fsck checks the meta data store against the storage and returns the problems found, they are repaired if repair
+// is true. Objects of interrupted operations which are not recovered yet are not reported as orphans, neither are
+// objects of volume sets the meta data store doesn't know about.
+func Fsck(mds metastore.Client, s datalayer.Storage, repair bool) ([]*Problem, error) {
+	var (
+		problems []*Problem
+		objs     []datalayer.StoredObject
+		err      error
+
+		// blobs and vols are known to the meta data store, stored are the volumes in the storage
+		blobs  = make(map[blob.ID]bool)
+		vols   = make(map[volume.ID]bool)
+		stored = make(map[volume.ID]bool)
+	)
+
+	inv, _ := s.(datalayer.Inventory)
+	if inv != nil {
+		objs, err = inv.Objects()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range objs {
+			if !obj.IsBlob() && !obj.VolumeID.IsNilID() {
+				stored[obj.VolumeID] = true
+			}
+		}
+	}
+
+	intents, err := mds.GetIntents()
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range intents {
+		for _, b := range i.BlobIDs {
+			blobs[b] = true
+		}
+		if i.Volume != nil {
+			vols[i.Volume.ID] = true
+		}
+	}
+
+	vss, err := mds.GetVolumeSets(volumeset.Query{})
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[volumeset.ID]bool)
+	for _, vs := range vss {
+		known[vs.ID] = true
+	}
+
+	for _, vs := range vss {
+		snaps, err := mds.GetSnapshots(snapshot.Query{VolSetID: vs.ID})
+		if err != nil {
+			return nil, err
+		}
+
+		changed := false
+		for _, snap := range snaps {
+			if snap.BlobID.IsNilID() {
+				continue
+			}
+			blobs[snap.BlobID] = true
+
+			found, err := s.SnapshotExists(snap.BlobID)
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				continue
+			}
+
+			p := &Problem{
+				Kind:       MissingBlob,
+				VolSetID:   vs.ID,
+				SnapshotID: snap.ID,
+				BlobID:     snap.BlobID,
+				Repair:     "mark missing",
+			}
+			problems = append(problems, p)
+			if repair {
+				p.Err = mds.SetBlobIDAndSize(snap.ID, blob.NilID(), 0)
+				p.Repaired = p.Err == nil
+				changed = changed || p.Repaired
+			}
+		}
+
+		volumes, err := mds.GetVolumes(vs.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, vol := range volumes {
+			vols[vol.ID] = true
+			p, err := checkVolume(mds, s, inv, stored, vol, repair)
+			if err != nil {
+				return nil, err
+			}
+			if p != nil {
+				problems = append(problems, p)
+				changed = changed || (p.Repaired && p.Kind == MissingVolume)
+			}
+		}
+
+		if changed {
+			err = updateStorageUsage(mds, s, vs.ID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Blobs are destroyed before volumes, a ZFS file system can't be destroyed while it has snapshots
+	var volObjs []datalayer.StoredObject
+	for _, obj := range objs {
+		if !obj.VolSetID.IsNilID() && !known[obj.VolSetID] {
+			continue
+		}
+
+		if !obj.IsBlob() {
+			volObjs = append(volObjs, obj)
+			continue
+		}
+
+		if !blobs[obj.BlobID] {
+			p := &Problem{Kind: OrphanBlob, VolSetID: obj.VolSetID, BlobID: obj.BlobID, Name: obj.Name}
+			destroyObject(inv, obj, p, repair)
+			problems = append(problems, p)
+		}
+	}
+
+	for _, obj := range volObjs {
+		if !obj.VolumeID.IsNilID() && vols[obj.VolumeID] {
+			continue
+		}
+
+		// A volume whose snapshots are used is kept, on ZFS they depend on its file system
+		used := false
+		for _, b := range obj.Blobs {
+			used = used || blobs[b]
+		}
+		if used {
+			continue
+		}
+
+		p := &Problem{Kind: OrphanVolume, VolSetID: obj.VolSetID, VolumeID: obj.VolumeID, Name: obj.Name}
+		destroyObject(inv, obj, p, repair)
+		problems = append(problems, p)
+	}
+
+	return problems, nil
+}
+
+// checkVolume returns the problem of a volume, nil if it has none
+func checkVolume(mds metastore.Client, s datalayer.Storage, inv datalayer.Inventory, stored map[volume.ID]bool,
+	vol *volume.Volume, repair bool) (*Problem, error) {
+	p := &Problem{VolSetID: vol.VolSetID, VolumeID: vol.ID, Name: vol.MntPath.Path()}
+
+	if inv == nil {
+		// Without an inventory the mount path is all that can be checked
+		if _, err := os.Stat(vol.MntPath.Path()); os.IsNotExist(err) {
+			p.Kind = UnmountedVolume
+			return p, nil
+		}
+		return nil, nil
+	}
+
+	if !stored[vol.ID] {
+		p.Kind = MissingVolume
+		p.Repair = "remove"
+		if repair {
+			p.Err = mds.DeleteVolume(vol.ID)
+			p.Repaired = p.Err == nil
+		}
+		return p, nil
+	}
+
+	mounted, err := inv.Mounted(vol.VolSetID, vol.ID, vol.MntPath.Path())
+	if err != nil || mounted {
+		return nil, err
+	}
+
+	p.Kind = UnmountedVolume
+	p.Repair = "reattach"
+	if repair {
+		p.Err = inv.Mount(vol.VolSetID, vol.ID)
+		p.Repaired = p.Err == nil
+	}
+	return p, nil
+}
+
+func destroyObject(inv datalayer.Inventory, obj datalayer.StoredObject, p *Problem, repair bool) {
+	p.Repair = "destroy"
+	if repair {
+		p.Err = inv.DestroyObject(obj)
+		p.Repaired = p.Err == nil
+	}
+}
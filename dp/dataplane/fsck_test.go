@@ -0,0 +1,174 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dataplane_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dl/fs"
+	"github.com/ClusterHQ/fli/dp/dataplane"
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/dp/metastore/testutil"
+	"github.com/ClusterHQ/fli/mdsimpls/sqlite3storage"
+	"github.com/ClusterHQ/fli/meta/attrs"
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+	"github.com/ClusterHQ/fli/securefilepath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// foreignInventory lists an object fli didn't create besides the storage's objects
+type foreignInventory struct {
+	datalayer.Inventory
+	foreign   datalayer.StoredObject
+	destroyed bool
+}
+
+func (i *foreignInventory) Objects() ([]datalayer.StoredObject, error) {
+	objs, err := i.Inventory.Objects()
+	return append(objs, i.foreign), err
+}
+
+func (i *foreignInventory) DestroyObject(obj datalayer.StoredObject) error {
+	if obj.Name == i.foreign.Name {
+		i.destroyed = true
+		return nil
+	}
+	return i.Inventory.DestroyObject(obj)
+}
+
+func TestFsck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsck")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mdsPath, err := securefilepath.New(filepath.Join(dir, "mds"))
+	require.NoError(t, err)
+	mds, err := sqlite3storage.Create(mdsPath)
+	require.NoError(t, err)
+	storePath, err := securefilepath.New(filepath.Join(dir, "store"))
+	require.NoError(t, err)
+	s, err := fs.New(storePath)
+	require.NoError(t, err)
+
+	vs, err := testutil.VolumeSetTest(mds, "vs", "", attrs.Attrs{}, "")
+	require.NoError(t, err)
+	vol, err := dataplane.CreateEmptyVolume(mds, s, vs.ID, "vol")
+	require.NoError(t, err)
+
+	problems, err := dataplane.Fsck(mds, s, false)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	// A snapshot whose blob is gone
+	ssid := snapshot.NewRandomID()
+	blobid, err := s.CreateSnapshot(vs.ID, ssid, vol.ID)
+	require.NoError(t, err)
+	_, err = metastore.SnapshotFork(mds, vs.ID, ssid, "", nil, blobid, attrs.Attrs{}, "", 0, "")
+	require.NoError(t, err)
+	require.NoError(t, s.DestroySnapshot(blobid))
+
+	// A volume which is gone
+	vol2, err := dataplane.CreateEmptyVolume(mds, s, vs.ID, "vol2")
+	require.NoError(t, err)
+	require.NoError(t, s.DestroyVolume(vs.ID, vol2.ID))
+
+	// A blob and a volume left behind by a failed download
+	orphanBlob, err := s.CreateSnapshot(vs.ID, snapshot.NewRandomID(), vol.ID)
+	require.NoError(t, err)
+	emptyBlob, err := s.EmptyBlobID(vs.ID)
+	require.NoError(t, err)
+	orphanVol, _, err := s.CreateVolume(vs.ID, emptyBlob, datalayer.NoAutoMount)
+	require.NoError(t, err)
+
+	kinds := func(problems []*dataplane.Problem) map[dataplane.ProblemKind]*dataplane.Problem {
+		m := make(map[dataplane.ProblemKind]*dataplane.Problem)
+		for _, p := range problems {
+			m[p.Kind] = p
+		}
+		return m
+	}
+
+	problems, err = dataplane.Fsck(mds, s, false)
+	require.NoError(t, err)
+	require.Len(t, problems, 4)
+	found := kinds(problems)
+	assert.Equal(t, ssid, found[dataplane.MissingBlob].SnapshotID)
+	assert.Equal(t, vol2.ID, found[dataplane.MissingVolume].VolumeID)
+	assert.Equal(t, orphanBlob, found[dataplane.OrphanBlob].BlobID)
+	assert.Equal(t, orphanVol, found[dataplane.OrphanVolume].VolumeID)
+	for _, p := range problems {
+		assert.False(t, p.Repaired)
+	}
+
+	problems, err = dataplane.Fsck(mds, s, true)
+	require.NoError(t, err)
+	require.Len(t, problems, 4)
+	for _, p := range problems {
+		assert.NoError(t, p.Err)
+		assert.True(t, p.Repaired, "%s not repaired", p.Kind)
+	}
+
+	problems, err = dataplane.Fsck(mds, s, false)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	snap, err := metastore.GetSnapshot(mds, ssid)
+	require.NoError(t, err)
+	assert.True(t, snap.BlobID.IsNilID())
+	_, err = mds.GetVolume(vol2.ID)
+	assert.Error(t, err)
+}
+
+func TestFsckForeign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsck")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mdsPath, err := securefilepath.New(filepath.Join(dir, "mds"))
+	require.NoError(t, err)
+	mds, err := sqlite3storage.Create(mdsPath)
+	require.NoError(t, err)
+	storePath, err := securefilepath.New(filepath.Join(dir, "store"))
+	require.NoError(t, err)
+	s, err := fs.New(storePath)
+	require.NoError(t, err)
+
+	vs, err := testutil.VolumeSetTest(mds, "vs", "", attrs.Attrs{}, "")
+	require.NoError(t, err)
+	_, err = dataplane.CreateEmptyVolume(mds, s, vs.ID, "vol")
+	require.NoError(t, err)
+
+	// A snapshot of a volume set fli doesn't know about is left alone
+	other := volumeset.NewRandomID()
+	name := "pool/" + other.String() + "/data@backup"
+	inv := &foreignInventory{
+		Inventory: s.(datalayer.Inventory),
+		foreign:   datalayer.StoredObject{VolSetID: other, BlobID: blob.NewID(name), Name: name},
+	}
+
+	problems, err := dataplane.Fsck(mds, inv, true)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+	assert.False(t, inv.destroyed)
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dataplane
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dp/hooks"
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/meta/attrs"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volume"
+)
+
+// SnapshotWithHooks takes a snapshot like Snapshot with the hooks of the volume's volume set run around it. The
+// results of the pre hooks are recorded in the snapshot's attributes, the results of the post hooks are added after
+// they ran. Post hooks run even if a pre hook or the snapshot failed so they can undo what the pre hooks did. If a
+// post hook fails the snapshot is returned together with the error. Hooks only run if they are approved, no
+// snapshot is taken otherwise.
+func SnapshotWithHooks(
+	mds metastore.Client,
+	s datalayer.Storage,
+	approved hooks.Approvals,
+	volid volume.ID,
+	branchName string,
+	syncMode metastore.SyncMode,
+	name string,
+	attr attrs.Attrs,
+	desc string,
+) (*snapshot.Snapshot, error) {
+	vol, err := mds.GetVolume(volid)
+	if err != nil {
+		return nil, err
+	}
+
+	vs, err := metastore.GetVolumeSet(mds, vol.VolSetID)
+	if err != nil {
+		return nil, err
+	}
+
+	if vs.Hooks == "" {
+		return Snapshot(mds, s, volid, branchName, syncMode, name, attr, desc)
+	}
+
+	// Hooks may have been changed by a sync
+	if !approved.Approved(vs.ID.String(), vs.Hooks) {
+		return nil, &hooks.ErrNotApproved{VolSetID: vs.ID.String()}
+	}
+
+	h, err := hooks.Parse(vs.Hooks)
+	if err != nil {
+		return nil, err
+	}
+
+	env := hooks.Env{
+		VolSetID:     vol.VolSetID.String(),
+		VolumeID:     volid.String(),
+		VolumePath:   vol.MntPath.Path(),
+		SnapshotName: name,
+	}
+
+	var snap *snapshot.Snapshot
+	pre, err := hooks.Run(h.Pre, hooks.Pre, env)
+	if err == nil {
+		a := attr.Copy()
+		for k, v := range hooks.Attrs(pre) {
+			a[k] = v
+		}
+
+		snap, err = Snapshot(mds, s, volid, branchName, syncMode, name, a, desc)
+		if err == nil {
+			env.SnapshotID = snap.ID.String()
+		}
+	}
+
+	post, postErr := hooks.Run(h.Post, hooks.Post, env)
+	if err != nil {
+		if postErr != nil {
+			log.Printf("Snapshot of volume %v failed, %v", volid, postErr)
+		}
+		return nil, err
+	}
+
+	if len(post) != 0 {
+		if snap.Attrs == nil {
+			snap.Attrs = attrs.Attrs{}
+		}
+		for k, v := range hooks.Attrs(post) {
+			snap.Attrs[k] = v
+		}
+
+		err = metastore.UpdateSnapshot(mds, snap)
+		if err != nil {
+			return snap, err
+		}
+	}
+
+	if postErr != nil {
+		return snap, fmt.Errorf("Snapshot %v was taken, but %v", snap.ID, postErr)
+	}
+
+	return snap, nil
+}
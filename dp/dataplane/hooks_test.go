@@ -0,0 +1,147 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dataplane_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ClusterHQ/fli/dl/fs"
+	"github.com/ClusterHQ/fli/dp/dataplane"
+	"github.com/ClusterHQ/fli/dp/hooks"
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/dp/metastore/testutil"
+	"github.com/ClusterHQ/fli/dp/sync"
+	"github.com/ClusterHQ/fli/mdsimpls/sqlite3storage"
+	"github.com/ClusterHQ/fli/meta/attrs"
+	"github.com/ClusterHQ/fli/securefilepath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotWithHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mdsPath, err := securefilepath.New(filepath.Join(dir, "mds"))
+	require.NoError(t, err)
+	mds, err := sqlite3storage.Create(mdsPath)
+	require.NoError(t, err)
+	storePath, err := securefilepath.New(filepath.Join(dir, "store"))
+	require.NoError(t, err)
+	s, err := fs.New(storePath)
+	require.NoError(t, err)
+
+	vs, err := testutil.VolumeSetTest(mds, "vs", "", attrs.Attrs{}, "")
+	require.NoError(t, err)
+	vol, err := dataplane.CreateEmptyVolume(mds, s, vs.ID, "vol")
+	require.NoError(t, err)
+
+	marker := filepath.Join(dir, "post")
+	vs.Hooks = `{"pre": [{"name": "flush", "command": "echo flushed $FLI_SNAPSHOT_NAME"}],
+		"post": [{"command": "echo $FLI_SNAPSHOT_ID > ` + marker + `"}]}`
+	require.NoError(t, metastore.UpdateVolumeSet(mds, vs))
+	approved := hooks.Approvals{vs.ID.String(): hooks.Digest(vs.Hooks)}
+
+	snap, err := dataplane.SnapshotWithHooks(mds, s, approved, vol.ID, "master", metastore.AutoSync, "a",
+		attrs.Attrs{"k": "v"}, "")
+	require.NoError(t, err)
+
+	got, err := metastore.GetSnapshot(mds, snap.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "v", got.Attrs["k"])
+	assert.Equal(t, "ok", got.Attrs["hook.flush"])
+	assert.Equal(t, "flushed a", got.Attrs["hook.flush.output"])
+	assert.Equal(t, "ok", got.Attrs["hook.post-1"])
+
+	out, err := ioutil.ReadFile(marker)
+	require.NoError(t, err)
+	assert.Equal(t, snap.ID.String()+"\n", string(out))
+
+	// A failed pre hook aborts the snapshot, the post hooks still run
+	require.NoError(t, os.Remove(marker))
+	vs, err = metastore.GetVolumeSet(mds, vs.ID)
+	require.NoError(t, err)
+	vs.Hooks = `{"pre": [{"command": "exit 1"}], "post": [{"command": "touch ` + marker + `"}]}`
+	require.NoError(t, metastore.UpdateVolumeSet(mds, vs))
+	approved[vs.ID.String()] = hooks.Digest(vs.Hooks)
+
+	_, err = dataplane.SnapshotWithHooks(mds, s, approved, vol.ID, "master", metastore.AutoSync, "b", attrs.Attrs{},
+		"")
+	assert.Error(t, err)
+	_, err = os.Stat(marker)
+	assert.NoError(t, err)
+}
+
+func TestSnapshotWithPulledHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var stores []*sqlite3storage.Sqlite3Storage
+	for _, name := range []string{"mds", "hub", "init"} {
+		p, err := securefilepath.New(filepath.Join(dir, name))
+		require.NoError(t, err)
+		mds, err := sqlite3storage.Create(p)
+		require.NoError(t, err)
+		stores = append(stores, mds)
+	}
+	mds, hub, init := stores[0], stores[1], stores[2]
+
+	storePath, err := securefilepath.New(filepath.Join(dir, "store"))
+	require.NoError(t, err)
+	s, err := fs.New(storePath)
+	require.NoError(t, err)
+
+	vs, err := testutil.VolumeSetTest(mds, "vs", "", attrs.Attrs{}, "")
+	require.NoError(t, err)
+	vol, err := dataplane.CreateEmptyVolume(mds, s, vs.ID, "vol")
+	require.NoError(t, err)
+	require.NoError(t, sync.NewObjects(mds, hub, vs.ID))
+	require.NoError(t, sync.NewObjects(mds, init, vs.ID))
+
+	// Hooks are set on the hub and pulled
+	marker := filepath.Join(dir, "pre")
+	hubVs, err := metastore.GetVolumeSet(hub, vs.ID)
+	require.NoError(t, err)
+	hubVs.Hooks = `{"pre": [{"command": "touch ` + marker + `"}]}`
+	require.NoError(t, metastore.UpdateVolumeSet(hub, hubVs))
+	_, err = sync.Do(hub, mds, init, vs.ID, true, sync.Resolver{Strategy: sync.KeepRemote})
+	require.NoError(t, err)
+
+	vs, err = metastore.GetVolumeSet(mds, vs.ID)
+	require.NoError(t, err)
+	require.Equal(t, hubVs.Hooks, vs.Hooks)
+
+	// The pulled hooks don't run until they are approved
+	approved := hooks.Approvals{}
+	_, err = dataplane.SnapshotWithHooks(mds, s, approved, vol.ID, "master", metastore.AutoSync, "a", attrs.Attrs{},
+		"")
+	assert.IsType(t, &hooks.ErrNotApproved{}, err)
+	_, err = os.Stat(marker)
+	assert.True(t, os.IsNotExist(err))
+
+	approved[vs.ID.String()] = hooks.Digest(vs.Hooks)
+	_, err = dataplane.SnapshotWithHooks(mds, s, approved, vol.ID, "master", metastore.AutoSync, "a", attrs.Attrs{},
+		"")
+	require.NoError(t, err)
+	_, err = os.Stat(marker)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,256 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dataplane
+
+import (
+	"log"
+
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/volume"
+)
+
+// Recover rolls forward or back the operations whose intents were left behind by a crash, see metastore.Intent.
+// Storage objects which can't be destroyed are logged and left behind. Intents which fail to recover are logged and
+// kept for the next recovery, the other intents are still recovered.
+func Recover(mds metastore.Client, s datalayer.Storage) error {
+	intents, err := mds.GetIntents()
+	if err != nil {
+		return err
+	}
+
+	for _, i := range intents {
+		log.Printf("Recovering incomplete %s of volume set %v started at %v", i.Op, i.VolSetID, i.CreationTime)
+
+		err = recoverIntent(mds, s, i)
+		if err == nil {
+			err = mds.RemoveIntent(i.ID)
+		}
+		if err != nil {
+			log.Printf("Failed to recover %s %v of volume set %v: %v", i.Op, i.ID, i.VolSetID, err)
+		}
+	}
+
+	return nil
+}
+
+// abort removes the intent of an operation which failed before any step that can't be undone, the operation's error
+// is returned. The intent is left to Recover if it can't be removed.
+func abort(mds metastore.Client, i *metastore.Intent, err error) error {
+	rerr := mds.RemoveIntent(i.ID)
+	if rerr != nil {
+		log.Printf("Failed to remove %s %v of volume set %v: %v", i.Op, i.ID, i.VolSetID, rerr)
+	}
+	return err
+}
+
+func recoverIntent(mds metastore.Client, s datalayer.Storage, i *metastore.Intent) error {
+	switch i.Op {
+	case metastore.IntentSnapshot:
+		return recoverSnapshot(mds, s, i)
+	case metastore.IntentClone:
+		return recoverClone(mds, s, i)
+	case metastore.IntentDeleteVolume:
+		return recoverDeleteVolume(mds, s, i)
+	case metastore.IntentDeleteBlob:
+		return recoverDeleteBlob(mds, s, i)
+	case metastore.IntentDeleteBranch:
+		return recoverDeleteBranch(mds, s, i)
+	case metastore.IntentDeleteVolumeSet:
+		return recoverDeleteVolumeSet(mds, s, i)
+	}
+
+	log.Printf("Unknown intent %s, ignored", i.Op)
+	return nil
+}
+
+// exists returns false if err is a not found error of the meta data store, other errors are returned
+func exists(err error) (bool, error) {
+	switch err.(type) {
+	case nil:
+		return true, nil
+	case *metastore.ErrSnapshotNotFound, *metastore.ErrVolumeNotFound, *metastore.ErrVolumeSetNotFound:
+		return false, nil
+	}
+	return false, err
+}
+
+func destroyBlobs(s datalayer.Storage, blobids []blob.ID) {
+	for _, blobid := range blobids {
+		err := s.DestroySnapshot(blobid)
+		if err != nil {
+			log.Printf("Failed to destroy blob %v: %v", blobid, err)
+		}
+	}
+}
+
+// recoverSnapshot rolls a snapshot forward if it was added to its branch, the volume is rebased on it. Otherwise
+// its blob is destroyed.
+func recoverSnapshot(mds metastore.Client, s datalayer.Storage, i *metastore.Intent) error {
+	_, err := metastore.GetSnapshot(mds, i.SnapshotID)
+	found, err := exists(err)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		destroyBlobs(s, i.BlobIDs)
+		return nil
+	}
+
+	vol, err := mds.GetVolume(i.Volume.ID)
+	found, err = exists(err)
+	if err != nil {
+		return err
+	}
+
+	if found {
+		if vol.BaseID != nil && *vol.BaseID == i.SnapshotID {
+			return nil
+		}
+
+		err = mds.DeleteVolume(vol.ID)
+		if err != nil {
+			return err
+		}
+	} else {
+		vol = i.Volume
+	}
+
+	newVol := vol.Copy()
+	newVol.BaseID = &i.SnapshotID
+	err = mds.ImportVolume(newVol)
+	if err != nil {
+		return err
+	}
+
+	return updateStorageUsage(mds, s, i.VolSetID)
+}
+
+// recoverClone imports a created volume, it is destroyed instead if the snapshot it was created from is gone
+func recoverClone(mds metastore.Client, s datalayer.Storage, i *metastore.Intent) error {
+	if i.Volume == nil {
+		// Crashed before the volume was created or before its ID was journaled
+		return nil
+	}
+
+	_, err := mds.GetVolume(i.Volume.ID)
+	found, err := exists(err)
+	if err != nil || found {
+		return err
+	}
+
+	if !i.SnapshotID.IsNilID() {
+		_, err = metastore.GetSnapshot(mds, i.SnapshotID)
+		found, err = exists(err)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			destroyVolume(s, i.Volume)
+			return nil
+		}
+	}
+
+	return mds.ImportVolume(i.Volume)
+}
+
+func destroyVolume(s datalayer.Storage, vol *volume.Volume) {
+	err := s.DestroyVolume(vol.VolSetID, vol.ID)
+	if err != nil {
+		log.Printf("Failed to destroy volume %v: %v", vol.ID, err)
+	}
+}
+
+// recoverDeleteVolume rolls a volume deletion forward
+func recoverDeleteVolume(mds metastore.Client, s datalayer.Storage, i *metastore.Intent) error {
+	_, err := mds.GetVolume(i.Volume.ID)
+	found, err := exists(err)
+	if err != nil {
+		return err
+	}
+
+	if found {
+		err = mds.DeleteVolume(i.Volume.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	destroyVolume(s, i.Volume)
+	return updateStorageUsage(mds, s, i.VolSetID)
+}
+
+// recoverDeleteBlob rolls a blob deletion forward
+func recoverDeleteBlob(mds metastore.Client, s datalayer.Storage, i *metastore.Intent) error {
+	snap, err := metastore.GetSnapshot(mds, i.SnapshotID)
+	found, err := exists(err)
+	if err != nil {
+		return err
+	}
+
+	if found && snap.BlobID.Equals(i.BlobIDs[0]) {
+		snap.BlobID = blob.NilID()
+		snap.Size = 0
+		_, err = mds.UpdateSnapshot(snap, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	destroyBlobs(s, i.BlobIDs)
+	if !found {
+		return nil
+	}
+	return updateStorageUsage(mds, s, i.VolSetID)
+}
+
+// recoverDeleteBranch destroys the blobs of a deleted branch, nothing was deleted if the tip is still there
+func recoverDeleteBranch(mds metastore.Client, s datalayer.Storage, i *metastore.Intent) error {
+	_, err := metastore.GetSnapshot(mds, i.SnapshotID)
+	found, err := exists(err)
+	if err != nil || found {
+		return err
+	}
+
+	destroyBlobs(s, i.BlobIDs)
+	return updateStorageUsage(mds, s, i.VolSetID)
+}
+
+// recoverDeleteVolumeSet rolls a volume set deletion forward
+func recoverDeleteVolumeSet(mds metastore.Client, s datalayer.Storage, i *metastore.Intent) error {
+	_, err := metastore.GetVolumeSet(mds, i.VolSetID)
+	found, err := exists(err)
+	if err != nil {
+		return err
+	}
+
+	if found {
+		err = mds.DeleteVolumeSet(i.VolSetID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.DestroyVolumeSet(i.VolSetID)
+	if err != nil {
+		log.Printf("Failed to destroy volume set %v: %v", i.VolSetID, err)
+	}
+	return nil
+}
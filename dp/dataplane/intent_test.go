@@ -0,0 +1,189 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dataplane_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dl/fs"
+	"github.com/ClusterHQ/fli/dp/dataplane"
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/dp/metastore/testutil"
+	"github.com/ClusterHQ/fli/mdsimpls/sqlite3storage"
+	"github.com/ClusterHQ/fli/meta/attrs"
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volume"
+	"github.com/ClusterHQ/fli/securefilepath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// brokenVolumeMds fails to look up one volume
+type brokenVolumeMds struct {
+	metastore.Client
+	broken volume.ID
+}
+
+func (m brokenVolumeMds) GetVolume(vid volume.ID) (*volume.Volume, error) {
+	if vid == m.broken {
+		return nil, errors.New("broken")
+	}
+	return m.Client.GetVolume(vid)
+}
+
+func TestRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recover")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mdsPath, err := securefilepath.New(filepath.Join(dir, "mds"))
+	require.NoError(t, err)
+	mds, err := sqlite3storage.Create(mdsPath)
+	require.NoError(t, err)
+	storePath, err := securefilepath.New(filepath.Join(dir, "store"))
+	require.NoError(t, err)
+	s, err := fs.New(storePath)
+	require.NoError(t, err)
+
+	vs, err := testutil.VolumeSetTest(mds, "vs", "", attrs.Attrs{}, "")
+	require.NoError(t, err)
+	vol, err := dataplane.CreateEmptyVolume(mds, s, vs.ID, "vol")
+	require.NoError(t, err)
+
+	// Crash after the blob of a snapshot is created, the blob is destroyed
+	ssid := snapshot.NewRandomID()
+	blobid, err := s.CreateSnapshot(vs.ID, ssid, vol.ID)
+	require.NoError(t, err)
+	err = mds.AddIntent(&metastore.Intent{
+		Op:         metastore.IntentSnapshot,
+		VolSetID:   vs.ID,
+		SnapshotID: ssid,
+		Volume:     vol,
+		BlobIDs:    []blob.ID{blobid},
+	})
+	require.NoError(t, err)
+
+	// Crash after a snapshot is added to its branch, the volume is rebased on it
+	ssid2 := snapshot.NewRandomID()
+	blobid2, err := s.CreateSnapshot(vs.ID, ssid2, vol.ID)
+	require.NoError(t, err)
+	_, err = metastore.SnapshotFork(mds, vs.ID, ssid2, "", nil, blobid2, attrs.Attrs{}, "", 0, "")
+	require.NoError(t, err)
+	err = mds.AddIntent(&metastore.Intent{
+		Op:         metastore.IntentSnapshot,
+		VolSetID:   vs.ID,
+		SnapshotID: ssid2,
+		Volume:     vol,
+		BlobIDs:    []blob.ID{blobid2},
+	})
+	require.NoError(t, err)
+
+	// Crash after a volume is created, it is imported
+	vid, mntPath, err := s.CreateVolume(vs.ID, blobid2, datalayer.AutoMount)
+	require.NoError(t, err)
+	clone := *vol
+	clone.ID = vid
+	clone.MntPath = mntPath
+	clone.BaseID = &ssid2
+	err = mds.AddIntent(&metastore.Intent{
+		Op:         metastore.IntentClone,
+		VolSetID:   vs.ID,
+		SnapshotID: ssid2,
+		Volume:     &clone,
+		BlobIDs:    []blob.ID{blobid2},
+	})
+	require.NoError(t, err)
+
+	intents, err := mds.GetIntents()
+	require.NoError(t, err)
+	require.Len(t, intents, 3)
+	assert.Equal(t, mntPath.Path(), intents[2].Volume.MntPath.Path())
+
+	err = dataplane.Recover(mds, s)
+	require.NoError(t, err)
+
+	intents, err = mds.GetIntents()
+	require.NoError(t, err)
+	assert.Empty(t, intents)
+
+	exists, err := s.SnapshotExists(blobid)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	got, err := mds.GetVolume(vol.ID)
+	require.NoError(t, err)
+	require.NotNil(t, got.BaseID)
+	assert.Equal(t, ssid2, *got.BaseID)
+
+	got, err = mds.GetVolume(vid)
+	require.NoError(t, err)
+	assert.Equal(t, mntPath.Path(), got.MntPath.Path())
+}
+
+func TestRecoverFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recover")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mdsPath, err := securefilepath.New(filepath.Join(dir, "mds"))
+	require.NoError(t, err)
+	mds, err := sqlite3storage.Create(mdsPath)
+	require.NoError(t, err)
+	storePath, err := securefilepath.New(filepath.Join(dir, "store"))
+	require.NoError(t, err)
+	s, err := fs.New(storePath)
+	require.NoError(t, err)
+
+	vs, err := testutil.VolumeSetTest(mds, "vs", "", attrs.Attrs{}, "")
+	require.NoError(t, err)
+	vol, err := dataplane.CreateEmptyVolume(mds, s, vs.ID, "vol")
+	require.NoError(t, err)
+	vol2, err := dataplane.CreateEmptyVolume(mds, s, vs.ID, "vol2")
+	require.NoError(t, err)
+
+	// A snapshot which fails before it is added to its branch leaves no intent behind
+	err = os.RemoveAll(vol.MntPath.Path())
+	require.NoError(t, err)
+	_, err = dataplane.Snapshot(mds, s, vol.ID, "", metastore.AutoSync, "", attrs.Attrs{}, "")
+	require.Error(t, err)
+	intents, err := mds.GetIntents()
+	require.NoError(t, err)
+	assert.Empty(t, intents)
+
+	// An intent which fails to recover is kept, the next one is still recovered
+	for _, v := range []*volume.Volume{vol, vol2} {
+		err = mds.AddIntent(&metastore.Intent{Op: metastore.IntentDeleteVolume, VolSetID: vs.ID, Volume: v})
+		require.NoError(t, err)
+	}
+
+	err = dataplane.Recover(brokenVolumeMds{Client: mds, broken: vol.ID}, s)
+	require.NoError(t, err)
+
+	intents, err = mds.GetIntents()
+	require.NoError(t, err)
+	require.Len(t, intents, 1)
+	assert.Equal(t, vol.ID, intents[0].Volume.ID)
+
+	_, err = mds.GetVolume(vol2.ID)
+	assert.IsType(t, &metastore.ErrVolumeNotFound{}, err)
+}
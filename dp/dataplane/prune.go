@@ -0,0 +1,129 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dataplane
+
+import (
+	"time"
+
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/dp/retention"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+)
+
+type (
+	// Pruned is a snapshot expired by its volume set's retention policy
+	Pruned struct {
+		Snapshot *snapshot.Snapshot
+
+		// Kept is why the snapshot's blob is kept although it expired, empty if the blob is deleted
+		Kept string
+
+		// Deleted is true if the snapshot is deleted from the meta data store along with its blob
+		Deleted bool
+
+		// Err is set if deleting the blob failed
+		Err error
+	}
+)
+
+// Prune deletes the blobs of the snapshots expired by the volume set's retention policy, see retention.Policy.
+// Nothing is deleted if dryRun is true. Expired snapshots without children are deleted from the meta data store too,
+// the others keep their meta data so the history of the volume set stays intact and their blobs can be pulled again.
+// Branch tips and snapshots which volumes are created from are never deleted.
+func Prune(mds metastore.Client, s datalayer.Storage, vsid volumeset.ID, now time.Time,
+	dryRun bool) ([]*Pruned, error) {
+	vs, err := metastore.GetVolumeSet(mds, vsid)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := retention.Parse(vs.Retention)
+	if err != nil {
+		return nil, err
+	}
+
+	if policy.Empty() {
+		return nil, nil
+	}
+
+	all, err := mds.GetSnapshots(snapshot.Query{VolSetID: vsid})
+	if err != nil {
+		return nil, err
+	}
+
+	// Only snapshots with blobs take space
+	var snaps []*snapshot.Snapshot
+	for _, snap := range all {
+		if !snap.BlobID.IsNilID() {
+			snaps = append(snaps, snap)
+		}
+	}
+
+	// Snapshots are expired from the most recent, gone counts the children a dry run would have deleted so far of
+	// each snapshot. The meta data store doesn't count the children which are really deleted.
+	var pruned []*Pruned
+	gone := make(map[snapshot.ID]int)
+	for _, snap := range policy.Expired(snaps, now) {
+		p := &Pruned{Snapshot: snap}
+		pruned = append(pruned, p)
+
+		if snap.IsTip {
+			p.Kept = "branch tip"
+			continue
+		}
+
+		numVolumes, err := mds.NumVolumes(snap.ID)
+		if err != nil {
+			return nil, err
+		}
+		if numVolumes > 0 {
+			p.Kept = "has volumes"
+			continue
+		}
+
+		if !dryRun {
+			p.Err = DeleteBlob(mds, s, snap.ID)
+			if p.Err != nil {
+				continue
+			}
+		}
+
+		numChildren, err := mds.NumChildren(snap.ID)
+		if err != nil {
+			return nil, err
+		}
+		if numChildren > gone[snap.ID] {
+			continue
+		}
+
+		if !dryRun {
+			p.Err = mds.DeleteSnapshots([]*snapshot.Snapshot{snap}, nil)
+			if p.Err != nil {
+				continue
+			}
+		}
+
+		p.Deleted = true
+		if dryRun && snap.ParentID != nil {
+			gone[*snap.ParentID]++
+		}
+	}
+
+	return pruned, nil
+}
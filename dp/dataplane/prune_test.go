@@ -0,0 +1,220 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dataplane_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ClusterHQ/fli/dl/fs"
+	"github.com/ClusterHQ/fli/dp/dataplane"
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/dp/metastore/testutil"
+	"github.com/ClusterHQ/fli/mdsimpls/sqlite3storage"
+	"github.com/ClusterHQ/fli/meta/attrs"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/securefilepath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prune")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mdsPath, err := securefilepath.New(filepath.Join(dir, "mds"))
+	require.NoError(t, err)
+	mds, err := sqlite3storage.Create(mdsPath)
+	require.NoError(t, err)
+	storePath, err := securefilepath.New(filepath.Join(dir, "store"))
+	require.NoError(t, err)
+	s, err := fs.New(storePath)
+	require.NoError(t, err)
+
+	vs, err := testutil.VolumeSetTest(mds, "vs", "", attrs.Attrs{}, "")
+	require.NoError(t, err)
+	vol, err := dataplane.CreateEmptyVolume(mds, s, vs.ID, "vol")
+	require.NoError(t, err)
+
+	var snaps []*snapshot.Snapshot
+	for _, name := range []string{"a", "b", "c", "d"} {
+		snap, err := dataplane.Snapshot(mds, s, vol.ID, "master", metastore.AutoSync, name, attrs.Attrs{}, "")
+		require.NoError(t, err)
+		snaps = append(snaps, snap)
+	}
+	_, err = dataplane.CreateVolumeFromSnapshot(mds, s, snaps[1].ID, "vol2")
+	require.NoError(t, err)
+
+	// Nothing is pruned without a policy
+	pruned, err := dataplane.Prune(mds, s, vs.ID, time.Now(), false)
+	require.NoError(t, err)
+	assert.Empty(t, pruned)
+
+	vs.Retention = "last=1"
+	require.NoError(t, metastore.UpdateVolumeSet(mds, vs))
+
+	check := func(dryRun bool) {
+		pruned, err := dataplane.Prune(mds, s, vs.ID, time.Now(), dryRun)
+		require.NoError(t, err)
+		require.Len(t, pruned, 3)
+		for _, p := range pruned {
+			require.NoError(t, p.Err)
+		}
+		assert.Equal(t, snaps[2].ID, pruned[0].Snapshot.ID)
+		assert.Empty(t, pruned[0].Kept)
+		assert.Equal(t, snaps[1].ID, pruned[1].Snapshot.ID)
+		assert.NotEmpty(t, pruned[1].Kept)
+		assert.Equal(t, snaps[0].ID, pruned[2].Snapshot.ID)
+		assert.Empty(t, pruned[2].Kept)
+
+		for i, snap := range snaps {
+			got, err := metastore.GetSnapshot(mds, snap.ID)
+			require.NoError(t, err)
+			found, err := s.SnapshotExists(snap.BlobID)
+			require.NoError(t, err)
+
+			deleted := !dryRun && (i == 0 || i == 2)
+			assert.Equal(t, deleted, got.BlobID.IsNilID(), snap.Name)
+			assert.Equal(t, deleted, !found, snap.Name)
+		}
+	}
+
+	check(true)
+	check(false)
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prune")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mdsPath, err := securefilepath.New(filepath.Join(dir, "mds"))
+	require.NoError(t, err)
+	mds, err := sqlite3storage.Create(mdsPath)
+	require.NoError(t, err)
+	storePath, err := securefilepath.New(filepath.Join(dir, "store"))
+	require.NoError(t, err)
+	s, err := fs.New(storePath)
+	require.NoError(t, err)
+
+	vs, err := testutil.VolumeSetTest(mds, "vs", "", attrs.Attrs{}, "")
+	require.NoError(t, err)
+	vol, err := dataplane.CreateEmptyVolume(mds, s, vs.ID, "vol")
+	require.NoError(t, err)
+
+	var snaps []*snapshot.Snapshot
+	for _, name := range []string{"a", "b", "c", "d"} {
+		snap, err := dataplane.Snapshot(mds, s, vol.ID, "master", metastore.AutoSync, name, attrs.Attrs{}, "")
+		require.NoError(t, err)
+		snaps = append(snaps, snap)
+	}
+	require.NoError(t, dataplane.DeleteVolume(mds, s, vol.ID))
+
+	// Without the tip, c is the end of a chain no branch points to
+	require.NoError(t, mds.DeleteSnapshots(snaps[3:], nil))
+	require.NoError(t, s.DestroySnapshot(snaps[3].BlobID))
+
+	vs.Retention = "attr=keep"
+	require.NoError(t, metastore.UpdateVolumeSet(mds, vs))
+
+	for _, dryRun := range []bool{true, false} {
+		pruned, err := dataplane.Prune(mds, s, vs.ID, time.Now(), dryRun)
+		require.NoError(t, err)
+		require.Len(t, pruned, 3)
+		for _, p := range pruned {
+			require.NoError(t, p.Err)
+			assert.Empty(t, p.Kept)
+			assert.True(t, p.Deleted, p.Snapshot.Name)
+		}
+
+		for _, snap := range snaps[:3] {
+			_, err := metastore.GetSnapshot(mds, snap.ID)
+			if dryRun {
+				assert.NoError(t, err)
+			} else {
+				assert.IsType(t, &metastore.ErrSnapshotNotFound{}, err)
+			}
+		}
+	}
+}
+
+// TestPruneParent keeps a parent whose other child survives, only its childless child is deleted.
+func TestPruneParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prune")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mdsPath, err := securefilepath.New(filepath.Join(dir, "mds"))
+	require.NoError(t, err)
+	mds, err := sqlite3storage.Create(mdsPath)
+	require.NoError(t, err)
+	storePath, err := securefilepath.New(filepath.Join(dir, "store"))
+	require.NoError(t, err)
+	s, err := fs.New(storePath)
+	require.NoError(t, err)
+
+	vs, err := testutil.VolumeSetTest(mds, "vs", "", attrs.Attrs{}, "")
+	require.NoError(t, err)
+	vol, err := dataplane.CreateEmptyVolume(mds, s, vs.ID, "vol")
+	require.NoError(t, err)
+
+	// a -> b -> x on master, without the tip x b has no children
+	var snaps []*snapshot.Snapshot
+	for _, name := range []string{"a", "b", "x"} {
+		snap, err := dataplane.Snapshot(mds, s, vol.ID, "master", metastore.AutoSync, name, attrs.Attrs{}, "")
+		require.NoError(t, err)
+		snaps = append(snaps, snap)
+	}
+	require.NoError(t, dataplane.DeleteVolume(mds, s, vol.ID))
+	require.NoError(t, mds.DeleteSnapshots(snaps[2:], nil))
+	require.NoError(t, s.DestroySnapshot(snaps[2].BlobID))
+	a, b := snaps[0], snaps[1]
+
+	// a -> c, the tip of br
+	vol, err = dataplane.CreateVolumeFromSnapshot(mds, s, a.ID, "vol")
+	require.NoError(t, err)
+	c, err := dataplane.Snapshot(mds, s, vol.ID, "br", metastore.AutoSync, "c", attrs.Attrs{}, "")
+	require.NoError(t, err)
+	require.NoError(t, dataplane.DeleteVolume(mds, s, vol.ID))
+
+	vs.Retention = "attr=keep"
+	require.NoError(t, metastore.UpdateVolumeSet(mds, vs))
+
+	for _, dryRun := range []bool{true, false} {
+		pruned, err := dataplane.Prune(mds, s, vs.ID, time.Now(), dryRun)
+		require.NoError(t, err)
+		require.Len(t, pruned, 3)
+		deleted := make(map[snapshot.ID]bool)
+		for _, p := range pruned {
+			require.NoError(t, p.Err)
+			deleted[p.Snapshot.ID] = p.Deleted
+		}
+		assert.False(t, deleted[a.ID], "dry run %v", dryRun)
+		assert.True(t, deleted[b.ID], "dry run %v", dryRun)
+		assert.False(t, deleted[c.ID], "dry run %v", dryRun)
+
+		_, err = metastore.GetSnapshot(mds, a.ID)
+		require.NoError(t, err)
+		got, err := metastore.GetSnapshot(mds, c.ID)
+		require.NoError(t, err)
+		assert.Equal(t, a.ID, *got.ParentID)
+	}
+}
@@ -0,0 +1,309 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hooks
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/meta/attrs"
+)
+
+type (
+	// Phase is when a hook runs
+	Phase string
+
+	// Policy is what happens when a hook fails or times out
+	Policy string
+
+	// Hook is a command run with sh -c or a URL the snapshot's environment is POSTed to as JSON
+	Hook struct {
+		// Name identifies the hook in the snapshot attributes, <phase>-<N> if it is empty
+		Name    string `json:"name,omitempty"`
+		Command string `json:"command,omitempty"`
+		URL     string `json:"url,omitempty"`
+
+		// Timeout in seconds, DefaultTimeout if it is 0
+		Timeout int `json:"timeout,omitempty"`
+
+		// OnFailure is Abort if it is empty
+		OnFailure Policy `json:"on-failure,omitempty"`
+	}
+
+	// Hooks are run before and after a snapshot of a volume of a volume set
+	Hooks struct {
+		Pre  []Hook `json:"pre,omitempty"`
+		Post []Hook `json:"post,omitempty"`
+	}
+
+	// Env is the snapshot hooks are run for, commands get it as FLI_* environment variables
+	Env struct {
+		Phase        Phase  `json:"phase"`
+		VolSetID     string `json:"volumeset_id"`
+		VolumeID     string `json:"volume_id"`
+		VolumePath   string `json:"volume_path"`
+		SnapshotName string `json:"snapshot_name,omitempty"`
+
+		// SnapshotID is only known to post hooks of a successful snapshot
+		SnapshotID string `json:"snapshot_id,omitempty"`
+	}
+
+	// Result is the outcome of a hook
+	Result struct {
+		Name   string
+		Output string
+		Err    error
+	}
+
+	// Approvals are the digests of the hooks approved to run on this host by volume set ID. Hooks are synced with
+	// their volume set, hooks changed on another host don't run until they are approved here.
+	Approvals map[string]string
+
+	// ErrNotApproved is returned when the hooks of a volume set are not approved to run
+	ErrNotApproved struct {
+		VolSetID string
+	}
+)
+
+var (
+	_ error = &ErrNotApproved{}
+)
+
+const (
+	// Pre hooks run before the snapshot, e.g. to flush and lock a database
+	Pre Phase = "pre"
+
+	// Post hooks run after the snapshot, even if it failed
+	Post Phase = "post"
+
+	// Abort fails the snapshot if a pre hook fails, the snapshot is kept if a post hook fails but the error is
+	// returned
+	Abort Policy = "abort"
+
+	// Ignore records the failure in the snapshot's attributes and goes on
+	Ignore Policy = "ignore"
+
+	// DefaultTimeout is the timeout of hooks which have none
+	DefaultTimeout = 60 * time.Second
+
+	// maxOutput is how much of a hook's output is kept in the snapshot's attributes
+	maxOutput = 1024
+
+	// attrPrefix is the prefix of the attributes hook results are recorded in
+	attrPrefix = "hook."
+)
+
+func (e *ErrNotApproved) Error() string {
+	return fmt.Sprintf("Hooks of volumeset %s are not approved to run on this host, review them with 'fli show' "+
+		"and approve them with 'fli update --approve-hooks'", e.VolSetID)
+}
+
+// Digest returns the digest hooks are approved by, hooks are given in their JSON form.
+func Digest(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// Approved returns true if the hooks given in their JSON form are approved for the volume set.
+func (a Approvals) Approved(vsid string, s string) bool {
+	d, ok := a[vsid]
+	return ok && d == Digest(s)
+}
+
+// Parse parses hooks from their JSON form.
+func Parse(s string) (*Hooks, error) {
+	var h Hooks
+	if err := json.Unmarshal([]byte(s), &h); err != nil {
+		return nil, errors.Errorf("Invalid hooks: %v", err)
+	}
+
+	names := make(map[string]bool)
+	for _, hook := range append(h.Pre, h.Post...) {
+		if (hook.Command == "") == (hook.URL == "") {
+			return nil, errors.New("Invalid hooks: a hook has either a command or a URL")
+		}
+
+		if hook.Timeout < 0 {
+			return nil, errors.Errorf("Invalid hooks: negative timeout %d", hook.Timeout)
+		}
+
+		switch hook.OnFailure {
+		case "", Abort, Ignore:
+		default:
+			return nil, errors.Errorf("Invalid hooks: unknown failure policy '%s', expected %s or %s",
+				hook.OnFailure, Abort, Ignore)
+		}
+
+		if hook.Name != "" {
+			if names[hook.Name] {
+				return nil, errors.Errorf("Invalid hooks: duplicate name '%s'", hook.Name)
+			}
+			names[hook.Name] = true
+		}
+	}
+
+	return &h, nil
+}
+
+// String returns the JSON form of the hooks.
+func (h *Hooks) String() string {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// Empty returns true if there are no hooks.
+func (h *Hooks) Empty() bool {
+	return len(h.Pre) == 0 && len(h.Post) == 0
+}
+
+// Run runs the hooks of a phase in order. It stops at the first hook which fails with the Abort policy and returns
+// its error, the results of the hooks run so far are returned as well.
+func Run(hooks []Hook, phase Phase, env Env) ([]*Result, error) {
+	env.Phase = phase
+
+	var results []*Result
+	for i, hook := range hooks {
+		res := &Result{Name: hook.Name}
+		if res.Name == "" {
+			res.Name = fmt.Sprintf("%s-%d", phase, i+1)
+		}
+
+		timeout := DefaultTimeout
+		if hook.Timeout != 0 {
+			timeout = time.Duration(hook.Timeout) * time.Second
+		}
+
+		var output string
+		if hook.Command != "" {
+			output, res.Err = runCommand(hook.Command, timeout, env)
+		} else {
+			output, res.Err = post(hook.URL, timeout, env)
+		}
+
+		res.Output = strings.TrimSpace(output)
+		if len(res.Output) > maxOutput {
+			res.Output = res.Output[:maxOutput]
+		}
+		results = append(results, res)
+
+		if res.Err != nil && hook.OnFailure != Ignore {
+			return results, errors.Errorf("%s hook %s failed: %v", phase, res.Name, res.Err)
+		}
+	}
+
+	return results, nil
+}
+
+// Attrs returns the snapshot attributes the results are recorded in, hook.<name> is ok or the error and
+// hook.<name>.output is the hook's output if it has any.
+func Attrs(results []*Result) attrs.Attrs {
+	a := attrs.Attrs{}
+	for _, res := range results {
+		key := attrPrefix + res.Name
+		if res.Err != nil {
+			a[key] = "failed: " + res.Err.Error()
+		} else {
+			a[key] = "ok"
+		}
+
+		if res.Output != "" {
+			a[key+".output"] = res.Output
+		}
+	}
+	return a
+}
+
+// runCommand runs the command with sh -c, the command and all processes it started are killed when the timeout
+// expires.
+func runCommand(command string, timeout time.Duration, env Env) (string, error) {
+	var out bytes.Buffer
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = append(os.Environ(),
+		"FLI_HOOK_PHASE="+string(env.Phase),
+		"FLI_VOLUMESET_ID="+env.VolSetID,
+		"FLI_VOLUME_ID="+env.VolumeID,
+		"FLI_VOLUME_PATH="+env.VolumePath,
+		"FLI_SNAPSHOT_NAME="+env.SnapshotName,
+		"FLI_SNAPSHOT_ID="+env.SnapshotID,
+	)
+
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return out.String(), err
+	case <-timer.C:
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return out.String(), errors.Errorf("timed out after %v", timeout)
+	}
+}
+
+// post sends the environment to the URL, statuses other than 2xx are errors. The response body is the output.
+func post(url string, timeout time.Duration, env Env) (string, error) {
+	body, err := json.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	output, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxOutput))
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return string(output), errors.Errorf("status %d", resp.StatusCode)
+	}
+
+	return string(output), nil
+}
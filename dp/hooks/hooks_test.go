@@ -0,0 +1,84 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hooks_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ClusterHQ/fli/dp/hooks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	h, err := hooks.Parse(`{"pre": [{"command": "sync", "timeout": 5}], "post": [{"url": "http://localhost/"}]}`)
+	require.NoError(t, err)
+	assert.Len(t, h.Pre, 1)
+	assert.Len(t, h.Post, 1)
+
+	again, err := hooks.Parse(h.String())
+	require.NoError(t, err)
+	assert.Equal(t, h, again)
+
+	for _, s := range []string{
+		`[]`,
+		`{"pre": [{}]}`,
+		`{"pre": [{"command": "true", "url": "http://localhost/"}]}`,
+		`{"pre": [{"command": "true", "timeout": -1}]}`,
+		`{"pre": [{"command": "true", "on-failure": "retry"}]}`,
+		`{"pre": [{"name": "a", "command": "true"}], "post": [{"name": "a", "command": "true"}]}`,
+	} {
+		_, err := hooks.Parse(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestRun(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "locked")
+	}))
+	defer srv.Close()
+
+	env := hooks.Env{VolumeID: "vol"}
+	res, err := hooks.Run([]hooks.Hook{
+		{Command: "echo $FLI_HOOK_PHASE $FLI_VOLUME_ID"},
+		{Name: "db", URL: srv.URL},
+		{Command: "exit 1", OnFailure: hooks.Ignore},
+	}, hooks.Pre, env)
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+	assert.Equal(t, "pre vol", res[0].Output)
+
+	a := hooks.Attrs(res)
+	assert.Equal(t, "ok", a["hook.pre-1"])
+	assert.Equal(t, "pre vol", a["hook.pre-1.output"])
+	assert.Equal(t, "ok", a["hook.db"])
+	assert.Equal(t, "locked", a["hook.db.output"])
+	assert.Contains(t, a["hook.pre-3"], "failed")
+
+	// The first failed hook stops the phase
+	res, err = hooks.Run([]hooks.Hook{
+		{Command: "sleep 10", Timeout: 1},
+		{Command: "true"},
+	}, hooks.Post, env)
+	assert.Error(t, err)
+	require.Len(t, res, 1)
+	assert.Contains(t, res[0].Err.Error(), "timed out")
+}
@@ -26,11 +26,18 @@ type (
 	// ResolveStatus ..
 	ResolveStatus int
 
+	// BranchConflict is a change made to a branch on both sides of a sync
+	BranchConflict string
+
 	// VSMetaConflict - array of these is used for reporting conflicts in volumeset metadata
 	VSMetaConflict struct {
 		Tgt  *volumeset.VolumeSet `json:"target"`
 		Cur  *volumeset.VolumeSet `json:"current"`
 		Init *volumeset.VolumeSet `json:"init"`
+
+		// Resolved is the version kept by a sync, Resolution the strategy it was chosen by
+		Resolved   *volumeset.VolumeSet `json:"resolved,omitempty"`
+		Resolution string               `json:"resolution,omitempty"`
 	}
 
 	// SnapMetaConflict - array of these is used for reporting conflicts in snap metadata
@@ -38,11 +45,19 @@ type (
 		Tgt  *snapshot.Snapshot `json:"target"`
 		Cur  *snapshot.Snapshot `json:"current"`
 		Init *snapshot.Snapshot `json:"init"`
+
+		// Resolved is the version kept by a sync, Resolution the strategy it was chosen by
+		Resolved   *snapshot.Snapshot `json:"resolved,omitempty"`
+		Resolution string             `json:"resolution,omitempty"`
 	}
 
 	// BranchMetaConflict - array of these is used for reporting conflicts in branch metadata
 	BranchMetaConflict struct {
-		Tgt, Cur, Init *branch.Branch
+		Tgt  *branch.Branch `json:"target"`
+		Cur  *branch.Branch `json:"current"`
+		Init *branch.Branch `json:"init"`
+
+		Conflicts []BranchConflict `json:"conflicts"`
 	}
 
 	// MdsTriplet holds 3 stores for
@@ -69,6 +84,15 @@ const (
 	UseTgtConflict
 )
 
+const (
+	// BranchRenamed = branch renamed to different names on both sides
+	BranchRenamed BranchConflict = "renamed"
+	// BranchTipMoved = branch extended with different snapshots on both sides
+	BranchTipMoved BranchConflict = "tip-moved"
+	// BranchDeleted = branch deleted on one side and extended on the other
+	BranchDeleted BranchConflict = "deleted"
+)
+
 // IsEmpty ...
 func (v VSMetaConflict) IsEmpty() bool {
 	return v.Tgt == nil && v.Cur == nil && v.Init == nil
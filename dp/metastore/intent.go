@@ -0,0 +1,91 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metastore
+
+import (
+	"time"
+
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volume"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+)
+
+// Intents journal operations which change both the storage and the meta data store. An intent is added before the
+// operation's first change and removed after its last one, intents left behind by a crash are rolled forward or
+// back on the next start up.
+
+type (
+	// IntentID identifies an intent
+	IntentID string
+
+	// IntentOp is the operation of an intent
+	IntentOp string
+
+	// Intent is an operation in progress
+	Intent struct {
+		ID           IntentID
+		Op           IntentOp
+		CreationTime time.Time
+
+		VolSetID volumeset.ID
+
+		// SnapshotID is the snapshot taken, cloned, or the tip of the branch deleted
+		SnapshotID snapshot.ID
+
+		// Volume is the volume snapshotted, cloned or deleted
+		Volume *volume.Volume
+
+		// BlobIDs are the blobs created or deleted
+		BlobIDs []blob.ID
+	}
+
+	// Journal keeps intents
+	Journal interface {
+		// AddIntent journals a new intent, a new ID is assigned to it
+		AddIntent(i *Intent) error
+
+		// UpdateIntent records the progress of an intent
+		UpdateIntent(i *Intent) error
+
+		// RemoveIntent removes the intent of a completed operation
+		RemoveIntent(id IntentID) error
+
+		// GetIntents returns the intents of incomplete operations, oldest first
+		GetIntents() ([]*Intent, error)
+	}
+)
+
+const (
+	// IntentSnapshot = snapshot of a volume
+	IntentSnapshot IntentOp = "snapshot"
+	// IntentClone = volume created from a snapshot or the empty blob
+	IntentClone IntentOp = "clone"
+	// IntentDeleteVolume = volume deleted
+	IntentDeleteVolume IntentOp = "delete-volume"
+	// IntentDeleteBlob = blob of a snapshot deleted
+	IntentDeleteBlob IntentOp = "delete-blob"
+	// IntentDeleteBranch = branch and its blobs deleted
+	IntentDeleteBranch IntentOp = "delete-branch"
+	// IntentDeleteVolumeSet = volume set deleted
+	IntentDeleteVolumeSet IntentOp = "delete-volumeset"
+)
+
+// String ...
+func (id IntentID) String() string {
+	return string(id)
+}
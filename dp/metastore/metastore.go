@@ -142,6 +142,7 @@ type (
 	// Client supports volume, and it can be used a client like dpcli.
 	Client interface {
 		Store
+		Journal
 
 		// ImportVolume ...
 		ImportVolume(v *volume.Volume) error
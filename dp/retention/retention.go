@@ -0,0 +1,208 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package retention
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+)
+
+// Retention policies decide which snapshots of a volume set are kept. A policy is stored on the volume set as a
+// comma separated list of rules, a snapshot is kept if any rule keeps it:
+//
+// last=N     keeps the N most recent snapshots
+// hourly=N   keeps the most recent snapshot of each of the last N hours
+// daily=N    keeps the most recent snapshot of each of the last N days
+// weekly=N   keeps the most recent snapshot of each of the last N weeks
+// attr=K     keeps snapshots with the attribute K, attr=K:V keeps snapshots whose attribute K is V
+//
+// Periods are calendar hours, days and weeks in UTC. An empty policy keeps everything.
+
+type (
+	// Policy is a retention policy
+	Policy struct {
+		Last   int
+		Hourly int
+		Daily  int
+		Weekly int
+
+		// Attrs are the attributes which keep a snapshot, an empty value matches any value
+		Attrs []Attr
+	}
+
+	// Attr is an attribute which keeps a snapshot
+	Attr struct {
+		Key   string
+		Value string
+	}
+
+	// byNewest sorts snapshots from the most recent to the oldest
+	byNewest []*snapshot.Snapshot
+)
+
+const (
+	week = 7 * 24 * time.Hour
+)
+
+func (s byNewest) Len() int           { return len(s) }
+func (s byNewest) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byNewest) Less(i, j int) bool { return s[i].CreationTime.After(s[j].CreationTime) }
+
+// Parse parses a policy from its string form
+func Parse(str string) (*Policy, error) {
+	p := &Policy{}
+	if strings.TrimSpace(str) == "" {
+		return p, nil
+	}
+
+	for _, rule := range strings.Split(str, ",") {
+		kv := strings.SplitN(strings.TrimSpace(rule), "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, errors.Errorf("Invalid retention rule '%s'", rule)
+		}
+
+		if kv[0] == "attr" {
+			a := strings.SplitN(kv[1], ":", 2)
+			attr := Attr{Key: a[0]}
+			if len(a) == 2 {
+				attr.Value = a[1]
+			}
+			p.Attrs = append(p.Attrs, attr)
+			continue
+		}
+
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("Invalid count in retention rule '%s'", rule)
+		}
+
+		switch kv[0] {
+		case "last":
+			p.Last = n
+		case "hourly":
+			p.Hourly = n
+		case "daily":
+			p.Daily = n
+		case "weekly":
+			p.Weekly = n
+		default:
+			return nil, errors.Errorf("Unknown retention rule '%s'", rule)
+		}
+	}
+
+	return p, nil
+}
+
+// String returns the policy in the form Parse accepts
+func (p *Policy) String() string {
+	var rules []string
+	for _, r := range []struct {
+		name string
+		n    int
+	}{
+		{"last", p.Last},
+		{"hourly", p.Hourly},
+		{"daily", p.Daily},
+		{"weekly", p.Weekly},
+	} {
+		if r.n > 0 {
+			rules = append(rules, r.name+"="+strconv.Itoa(r.n))
+		}
+	}
+
+	for _, a := range p.Attrs {
+		if a.Value == "" {
+			rules = append(rules, "attr="+a.Key)
+		} else {
+			rules = append(rules, "attr="+a.Key+":"+a.Value)
+		}
+	}
+
+	return strings.Join(rules, ",")
+}
+
+// Empty returns true if the policy has no rules, an empty policy keeps everything
+func (p *Policy) Empty() bool {
+	return p.Last == 0 && p.Hourly == 0 && p.Daily == 0 && p.Weekly == 0 && len(p.Attrs) == 0
+}
+
+// Expired returns the snapshots the policy doesn't keep, most recent first
+func (p *Policy) Expired(snaps []*snapshot.Snapshot, now time.Time) []*snapshot.Snapshot {
+	if p.Empty() {
+		return nil
+	}
+
+	sorted := append([]*snapshot.Snapshot{}, snaps...)
+	sort.Sort(byNewest(sorted))
+
+	keep := make(map[snapshot.ID]bool)
+	for i, snap := range sorted {
+		if i < p.Last || p.keepAttrs(snap) {
+			keep[snap.ID] = true
+		}
+	}
+
+	p.keepPeriods(sorted, now, time.Hour, p.Hourly, keep)
+	p.keepPeriods(sorted, now, 24*time.Hour, p.Daily, keep)
+	p.keepPeriods(sorted, now, week, p.Weekly, keep)
+
+	var expired []*snapshot.Snapshot
+	for _, snap := range sorted {
+		if !keep[snap.ID] {
+			expired = append(expired, snap)
+		}
+	}
+
+	return expired
+}
+
+func (p *Policy) keepAttrs(snap *snapshot.Snapshot) bool {
+	for _, a := range p.Attrs {
+		v, ok := snap.Attrs[a.Key]
+		if ok && (a.Value == "" || a.Value == v) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepPeriods keeps the most recent snapshot of each of the last n periods, sorted is from the most recent
+func (p *Policy) keepPeriods(sorted []*snapshot.Snapshot, now time.Time, period time.Duration, n int,
+	keep map[snapshot.ID]bool) {
+	if n == 0 {
+		return
+	}
+
+	oldest := now.UTC().Truncate(period).Add(-time.Duration(n-1) * period)
+	seen := make(map[time.Time]bool)
+	for _, snap := range sorted {
+		start := snap.CreationTime.UTC().Truncate(period)
+		if start.Before(oldest) {
+			return
+		}
+
+		if !seen[start] {
+			seen[start] = true
+			keep[snap.ID] = true
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package retention_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ClusterHQ/fli/dp/retention"
+	"github.com/ClusterHQ/fli/meta/attrs"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	p, err := retention.Parse("daily=7, last=3,attr=release,attr=keep:true")
+	require.NoError(t, err)
+	assert.Equal(t, 3, p.Last)
+	assert.Equal(t, 7, p.Daily)
+	assert.Equal(t, []retention.Attr{{Key: "release"}, {Key: "keep", Value: "true"}}, p.Attrs)
+	assert.Equal(t, "last=3,daily=7,attr=release,attr=keep:true", p.String())
+
+	p, err = retention.Parse("")
+	require.NoError(t, err)
+	assert.True(t, p.Empty())
+
+	for _, str := range []string{"last", "last=-1", "monthly=2", "hourly=x", "attr="} {
+		_, err = retention.Parse(str)
+		assert.Error(t, err, str)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Date(2016, 12, 14, 12, 30, 0, 0, time.UTC)
+
+	// One snapshot every 6 hours over the last 4 days, the most recent first
+	var snaps []*snapshot.Snapshot
+	for i := 0; i < 16; i++ {
+		snaps = append(snaps, &snapshot.Snapshot{
+			ID:           snapshot.NewRandomID(),
+			CreationTime: now.Add(-time.Duration(i*6) * time.Hour),
+			Attrs:        attrs.Attrs{},
+		})
+	}
+	snaps[15].Attrs["release"] = "1.0"
+
+	// expired returns the indexes of the snapshots expired by the policy
+	expired := func(policy string) []int {
+		p, err := retention.Parse(policy)
+		require.NoError(t, err)
+
+		var indexes []int
+		for _, snap := range p.Expired(snaps, now) {
+			for i := range snaps {
+				if snaps[i] == snap {
+					indexes = append(indexes, i)
+				}
+			}
+		}
+		return indexes
+	}
+	between := func(from, to int) []int {
+		var indexes []int
+		for i := from; i < to; i++ {
+			indexes = append(indexes, i)
+		}
+		return indexes
+	}
+
+	assert.Empty(t, expired(""))
+	assert.Equal(t, between(3, 16), expired("last=3"))
+
+	// The snapshots of 12:00 and 06:00 today
+	assert.Equal(t, between(2, 16), expired("hourly=7"))
+
+	// The most recent snapshot of today and of the 2 days before
+	assert.Equal(t, append([]int{1, 2, 4, 5, 6}, between(8, 16)...), expired("daily=3"))
+
+	assert.Equal(t, between(3, 15), expired("last=3,attr=release"))
+	assert.Equal(t, between(3, 15), expired("last=3,attr=release:1.0"))
+	assert.Equal(t, between(3, 16), expired("last=3,attr=release:2.0"))
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+)
+
+type (
+	// Estimate is the size of the blob diff a push or pull of a snapshot transfers
+	Estimate struct {
+		Snapshot *snapshot.Snapshot
+
+		// BaseID is the snapshot the diff is based on, nil if the whole snapshot is transferred
+		BaseID *snapshot.ID
+
+		Bytes   uint64
+		Records uint64
+
+		// Exact is false if Bytes is the size of the whole snapshot and the number of records is unknown, the diff
+		// of a pull is only known to the peer
+		Exact bool
+	}
+
+	// BlobSizer computes the size of a blob diff without sending it
+	BlobSizer interface {
+		// EstimateBlobDiff returns the number of bytes and records of the diff between the base and target blobs
+		EstimateBlobDiff(vsid volumeset.ID, base blob.ID, target blob.ID) (uint64, uint64, error)
+	}
+)
+
+// EstimatePushForAllSnapshots negotiates the blobs target is willing to take like PushDataForAllSnapshots, but only
+// computes the size of each blob diff instead of uploading it.
+func EstimatePushForAllSnapshots(mds metastore.Store, vsid volumeset.ID, sizer BlobSizer,
+	target BlobAccepter) ([]*Estimate, error) {
+	snapshots, err := NewSnapshotIterator(mds, vsid)
+	if err != nil {
+		return nil, err
+	}
+	return estimatePush(mds, sizer, target, snapshots)
+}
+
+// EstimatePushForCertainSnapshots is PushDataForCertainSnapshots without uploading, see EstimatePushForAllSnapshots.
+func EstimatePushForCertainSnapshots(mds metastore.Store, sizer BlobSizer, target BlobAccepter,
+	pushSnapshots []snapshot.ID) ([]*Estimate, error) {
+	if len(pushSnapshots) == 0 {
+		return nil, nil
+	}
+
+	snapshots, err := newCertainSnapshotIterator(mds, pushSnapshots)
+	if err != nil {
+		return nil, err
+	}
+	return estimatePush(mds, sizer, target, snapshots)
+}
+
+// EstimatePullForAllSnapshots negotiates the blobs source is willing to provide like PullDataForAllSnapshots without
+// downloading them. The diffs are on the source, so the estimates are the sizes of the snapshots.
+func EstimatePullForAllSnapshots(source BlobSpewer, mds metastore.Client, vsid volumeset.ID) ([]*Estimate, error) {
+	snapshots, err := NewSnapshotIterator(mds, vsid)
+	if err != nil {
+		return nil, err
+	}
+	return estimatePull(source, mds, snapshots)
+}
+
+// EstimatePullForCertainSnapshots is PullDataForCertainSnapshots without downloading, see
+// EstimatePullForAllSnapshots.
+func EstimatePullForCertainSnapshots(source BlobSpewer, mds metastore.Client,
+	pullSnapshots []snapshot.ID) ([]*Estimate, error) {
+	if len(pullSnapshots) == 0 {
+		return nil, nil
+	}
+
+	snapshots, err := newCertainSnapshotIterator(mds, pullSnapshots)
+	if err != nil {
+		return nil, err
+	}
+	return estimatePull(source, mds, snapshots)
+}
+
+func estimatePush(mds metastore.Store, sizer BlobSizer, target BlobAccepter,
+	snapshots SnapshotIterator) ([]*Estimate, error) {
+	var estimates []*Estimate
+	for {
+		n, err := nextOffer(mds, target, snapshots)
+		if err != nil {
+			return nil, err
+		}
+		if n == nil {
+			return estimates, nil
+		}
+
+		base := blob.NilID()
+		if n.baseID != nil {
+			base, err = metastore.GetBlobID(mds, *n.baseID)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		target, err := metastore.GetBlobID(mds, n.sn.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		bytes, records, err := sizer.EstimateBlobDiff(n.sn.VolSetID, base, target)
+		if err != nil {
+			return nil, errors.Errorf("Estimate of snapshot %s failed: %v", n.sn.ID, err)
+		}
+
+		estimates = append(estimates, &Estimate{
+			Snapshot: n.sn,
+			BaseID:   n.baseID,
+			Bytes:    bytes,
+			Records:  records,
+			Exact:    true,
+		})
+	}
+}
+
+func estimatePull(source BlobSpewer, mds metastore.Client, snapshots SnapshotIterator) ([]*Estimate, error) {
+	var estimates []*Estimate
+	for {
+		n, err := nextRequest(source, mds, snapshots)
+		if err != nil {
+			return nil, err
+		}
+		if n == nil {
+			return estimates, nil
+		}
+
+		estimates = append(estimates, &Estimate{Snapshot: n.sn, BaseID: n.baseID, Bytes: n.sn.Size})
+	}
+}
@@ -49,18 +49,11 @@ func PullDataForCertainSnapshots(source BlobSpewer, mds metastore.Client, receiv
 	if len(pullSnapshots) == 0 {
 		return nil
 	}
-	// Figure out which volumeset this snapshot belongs to
-	vsid, err := metastore.GetVolumeSetBySnapID(mds, pullSnapshots[0])
+	snapshots, err := newCertainSnapshotIterator(mds, pullSnapshots)
 	if err != nil {
 		return err
 	}
-
-	// Reverse the snapshot slice so LazySnapshotLoader can use it like a stack.
-	snapshotStack := make([]snapshot.ID, 0, len(pullSnapshots))
-	for i := len(pullSnapshots) - 1; i > -1; i-- {
-		snapshotStack = append(snapshotStack, pullSnapshots[i])
-	}
-	return pullData(source, mds, receiver, NewLazyLoadSnapshotIterator(mds, vsid, snapshotStack))
+	return pullData(source, mds, receiver, snapshots)
 }
 
 // PullDataForQualifyingSnapshots downloads all blobs associated with snapshots
@@ -83,19 +76,49 @@ func PullDataForQualifyingSnapshots(source BlobSpewer, mds metastore.Client, vsi
 // will have their blobs considered for pull.
 func pullData(source BlobSpewer, mds metastore.Client, receiver dataplane.BlobDownloader,
 	snapshots SnapshotIterator) error {
+	for {
+		n, err := nextRequest(source, mds, snapshots)
+		if err != nil {
+			return err
+		}
+		if n == nil {
+			// All done
+			break
+		}
+
+		err = dataplane.DownloadBlobDiff(
+			mds,
+			receiver,
+			n.sn.VolSetID,
+			n.baseID,
+			n.sn.ID,
+			n.token,
+			n.dspuburl,
+		)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Downloaded snapshot %s\n", n.sn.ID.String())
+	}
+	return nil
+}
+
+// nextRequest requests the blob of the next snapshot in the iterator which has no blob locally from the source.
+// Snapshots the source rejects are skipped, nil is returned after the last snapshot.
+func nextRequest(source BlobSpewer, mds metastore.Client, snapshots SnapshotIterator) (*negotiated, error) {
 	for {
 		sn, err := snapshots.Next()
 		if err != nil {
 			if IsStopIteration(err) {
-				// All done
-				break
+				return nil, nil
 			}
-			return err
+			return nil, err
 		}
 
 		blobID, err := metastore.GetBlobID(mds, sn.ID)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		if !blobID.IsNilID() {
@@ -105,7 +128,7 @@ func pullData(source BlobSpewer, mds metastore.Client, receiver dataplane.BlobDo
 
 		blobs, err := blobsAlreadyHave(mds, sn)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		baseID, token, dspuburl, err := source.RequestBlobDiff(sn.VolSetID, sn.ID, blobs)
@@ -114,20 +137,6 @@ func pullData(source BlobSpewer, mds metastore.Client, receiver dataplane.BlobDo
 			continue
 		}
 
-		err = dataplane.DownloadBlobDiff(
-			mds,
-			receiver,
-			sn.VolSetID,
-			baseID,
-			sn.ID,
-			token,
-			dspuburl,
-		)
-		if err != nil {
-			return err
-		}
-
-		log.Printf("Downloaded snapshot %s\n", sn.ID.String())
+		return &negotiated{sn: sn, baseID: baseID, token: token, dspuburl: dspuburl}, nil
 	}
-	return nil
 }
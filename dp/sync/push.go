@@ -218,8 +218,9 @@ func pushBranch(mdsSrc metastore.Syncable, mdsTarget metastore.Syncable, vsid vo
 	}
 }
 
-// Push all branches in a volumeset one by one.
-func pushVolumeSet(mdsSrc metastore.Syncable, mdsTarget metastore.Syncable, vsid volumeset.ID) error {
+// Push all branches in a volumeset one by one, branches in skip are left as they are.
+func pushVolumeSet(mdsSrc metastore.Syncable, mdsTarget metastore.Syncable, vsid volumeset.ID,
+	skip map[branch.ID]bool) error {
 	srcBranches, err := metastore.GetBranches(mdsSrc, branch.Query{VolSetID: vsid})
 	if err != nil {
 		return err
@@ -237,6 +238,10 @@ func pushVolumeSet(mdsSrc metastore.Syncable, mdsTarget metastore.Syncable, vsid
 
 	sort.Sort(branch.SortableBranchesByTipDepth(srcBranches))
 	for _, b := range srcBranches {
+		if skip[b.ID] {
+			continue
+		}
+
 		for {
 			err = pushBranch(mdsSrc, mdsTarget, vsid, b, tgtBranchMap)
 			if err == nil {
@@ -279,6 +284,12 @@ func pushVolumeSet(mdsSrc metastore.Syncable, mdsTarget metastore.Syncable, vsid
 // new one.  Should we be smarter about that?  Should there be a method to remove a branch?
 // TODO: This is exported for test only, not export may be?
 func NewObjects(source metastore.Syncable, target metastore.Syncable, vsid volumeset.ID) error {
+	return newObjects(source, target, vsid, nil)
+}
+
+// newObjects is NewObjects which leaves the branches in skip as they are
+func newObjects(source metastore.Syncable, target metastore.Syncable, vsid volumeset.ID,
+	skip map[branch.ID]bool) error {
 	_, err := metastore.GetVolumeSet(target, vsid)
 	if err != nil {
 		if _, ok := err.(*metastore.ErrVolumeSetNotFound); !ok {
@@ -299,7 +310,7 @@ func NewObjects(source metastore.Syncable, target metastore.Syncable, vsid volum
 		}
 	}
 
-	return pushVolumeSet(source, target, vsid)
+	return pushVolumeSet(source, target, vsid, skip)
 }
 
 // Do syncs the volumeset between the metadata stores.
@@ -313,12 +324,17 @@ func NewObjects(source metastore.Syncable, target metastore.Syncable, vsid volum
 // In one way sync mode:
 // 1. Pull new snapshots from target to current
 // 2. Pull new snapshots from current to initial(including locally newly created and pulled from target)
-// 3. Sync meta data (new and old) from target to current and initial. Local changes will be overwritten
-//    with data from target when there are conflicts.
+// 3. Sync meta data (new and old) from target to current and initial.
+// Meta data changed on both current and target is resolved by the resolver's strategy, by default local changes
+// are overwritten with data from target. In one way sync mode the target is never updated.
+// Branches changed on both sides are detected before new objects are synced, see CheckBranchConflict(). Branches
+// whose tip moved on both sides or which are deleted on one side and extended on the other are reported and left
+// as they are in all three stores.
 func Do(
 	storeTgt, storeCur, storeInit metastore.Syncable,
 	vsid volumeset.ID,
 	pullOnly bool,
+	r Resolver,
 ) (MetaConflicts, error) {
 	log.Println("Syncing meta data of new objects ...")
 	var (
@@ -346,9 +362,33 @@ func Do(
 		return MetaConflicts{}, errors.Errorf("VolumeSet (%s) not found anywhere.", vsid.String())
 	}
 
+	s := metastore.MdsTriplet{
+		Tgt:  storeTgt,
+		Cur:  storeCur,
+		Init: storeInit,
+	}
+
+	branchMetaConflicts := []metastore.BranchMetaConflict{}
+	skip := make(map[branch.ID]bool)
+	if errTgt == nil && errCur == nil {
+		var err error
+		branchMetaConflicts, err = branchMeta(s, vsid)
+		if err != nil {
+			return MetaConflicts{}, err
+		}
+
+		for _, c := range branchMetaConflicts {
+			for _, kind := range c.Conflicts {
+				if kind != metastore.BranchRenamed {
+					skip[c.Init.ID] = true
+				}
+			}
+		}
+	}
+
 	if errCur == nil && !pullOnly {
 		log.Println("Pushing meta data to remote ...")
-		err := NewObjects(storeCur, storeTgt, vsid)
+		err := newObjects(storeCur, storeTgt, vsid, skip)
 		if err != nil {
 			return MetaConflicts{}, err
 		}
@@ -356,7 +396,7 @@ func Do(
 
 	if errTgt == nil {
 		log.Println("Pulling meta data from remote ...")
-		err := NewObjects(storeTgt, storeCur, vsid)
+		err := newObjects(storeTgt, storeCur, vsid, skip)
 		if err != nil {
 			return MetaConflicts{}, err
 		}
@@ -364,29 +404,18 @@ func Do(
 
 	// Bring all the new objects within vs from cur to init
 	log.Println("Syncing meta data locally ...")
-	err := NewObjects(storeCur, storeInit, vsid)
+	err := newObjects(storeCur, storeInit, vsid, skip)
 	if err != nil {
 		return MetaConflicts{}, err
 	}
 
 	log.Println("Syncing meta data of existing objects ...")
-	s := metastore.MdsTriplet{
-		Tgt:  storeTgt,
-		Cur:  storeCur,
-		Init: storeInit,
-	}
-
-	vsMetaConflicts, err := volSetMeta(s, vsid, pullOnly)
-	if err != nil {
-		return MetaConflicts{}, err
-	}
-
-	snapMetaConflicts, err := snapshotMeta(s, vsid, pullOnly)
+	vsMetaConflicts, err := volSetMeta(s, vsid, pullOnly, r)
 	if err != nil {
 		return MetaConflicts{}, err
 	}
 
-	branchMetaConflicts, err := branchMeta(s, vsid)
+	snapMetaConflicts, err := snapshotMeta(s, vsid, pullOnly, r)
 	if err != nil {
 		return MetaConflicts{}, err
 	}
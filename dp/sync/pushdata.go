@@ -27,6 +27,14 @@ import (
 	"github.com/ClusterHQ/fli/meta/volumeset"
 )
 
+// negotiated is a blob diff transfer agreed on with a peer
+type negotiated struct {
+	sn       *snapshot.Snapshot
+	baseID   *snapshot.ID
+	token    string
+	dspuburl string
+}
+
 // BlobAccepter is an entity which can negotiate about which blob diffs it would like to receive.
 type BlobAccepter interface {
 	// OfferBlobDiff suggests to a peer that we might have some data they
@@ -55,18 +63,11 @@ func PushDataForCertainSnapshots(mds metastore.Store, sender dataplane.BlobUploa
 		// Nothing to push
 		return nil
 	}
-	// Figure out which volumeset this snapshot belongs to
-	vsid, err := metastore.GetVolumeSetBySnapID(mds, pushSnapshots[0])
+	snapshots, err := newCertainSnapshotIterator(mds, pushSnapshots)
 	if err != nil {
 		return err
 	}
-
-	// Reverse the snapshot slice so LazySnapshotLoader can use it like a stack.
-	snapshots := make([]snapshot.ID, 0, len(pushSnapshots))
-	for i := len(pushSnapshots) - 1; i > -1; i-- {
-		snapshots = append(snapshots, pushSnapshots[i])
-	}
-	return pushData(mds, sender, target, NewLazyLoadSnapshotIterator(mds, vsid, snapshots))
+	return pushData(mds, sender, target, snapshots)
 }
 
 // PushDataForQualifyingSnapshots sends all blobs associated with snapshots
@@ -83,19 +84,41 @@ func PushDataForQualifyingSnapshots(mds metastore.Store, vsid volumeset.ID, send
 // pushData sends all blobs associated with snapshots in the given iterator and
 // which the target is willing to take.
 func pushData(mds metastore.Store, sender dataplane.BlobUploader, target BlobAccepter, snapshots SnapshotIterator) error {
+	for {
+		n, err := nextOffer(mds, target, snapshots)
+		if err != nil {
+			return err
+		}
+		if n == nil {
+			// All done
+			break
+		}
+
+		err = dataplane.UploadBlobDiff(mds, sender, n.sn.VolSetID, n.baseID, n.sn.ID, n.token, n.dspuburl)
+		if err != nil {
+			return errors.Errorf("Upload snapshot %s failed: %v", n.sn.ID, err)
+		}
+
+		log.Printf("Uploaded snapshot %s\n", n.sn.ID.String())
+	}
+	return nil
+}
+
+// nextOffer offers the blob of the next snapshot in the iterator which has a blob locally to the target. Snapshots
+// whose blob the target already has are skipped, nil is returned after the last snapshot.
+func nextOffer(mds metastore.Store, target BlobAccepter, snapshots SnapshotIterator) (*negotiated, error) {
 	for {
 		sn, err := snapshots.Next()
 		if err != nil {
 			if IsStopIteration(err) {
-				// All done
-				break
+				return nil, nil
 			}
-			return err
+			return nil, err
 		}
 
 		blobID, err := metastore.GetBlobID(mds, sn.ID)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if blobID.IsNilID() {
 			// can't push if have no blob locally
@@ -104,7 +127,7 @@ func pushData(mds metastore.Store, sender dataplane.BlobUploader, target BlobAcc
 
 		blobs, err := blobsAlreadyHave(mds, sn)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		baseID, token, dspuburl, err := target.OfferBlobDiff(sn.VolSetID, sn.ID, blobs)
@@ -113,17 +136,11 @@ func pushData(mds metastore.Store, sender dataplane.BlobUploader, target BlobAcc
 				log.Printf("Snapshot %s offer rejected by target, already has blob", sn.ID)
 				continue
 			}
-			return err
-		}
-
-		err = dataplane.UploadBlobDiff(mds, sender, sn.VolSetID, baseID, sn.ID, token, dspuburl)
-		if err != nil {
-			return errors.Errorf("Upload snapshot %s failed: %v", sn.ID, err)
+			return nil, err
 		}
 
-		log.Printf("Uploaded snapshot %s\n", sn.ID.String())
+		return &negotiated{sn: sn, baseID: baseID, token: token, dspuburl: dspuburl}, nil
 	}
-	return nil
 }
 
 // blobsAlreadyHave returns all snapshots the MDS already have
@@ -0,0 +1,202 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"time"
+
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/meta/attrs"
+)
+
+type (
+	// Strategy is how meta data changed both locally and on the target is resolved
+	Strategy string
+
+	// Prompter asks how to resolve a conflict between the initial, current and target versions of a volume set or
+	// snapshot, kind names the object. Interactive is not a valid answer.
+	Prompter func(kind string, init, cur, tgt interface{}) (Strategy, error)
+
+	// Resolver resolves the conflicts found by a sync
+	Resolver struct {
+		Strategy Strategy
+
+		// Prompt is used by the Interactive strategy
+		Prompt Prompter
+	}
+)
+
+const (
+	// KeepRemote overwrites the local version with the target's, this is the default
+	KeepRemote Strategy = "keep-remote"
+
+	// KeepLocal overwrites the target's version with the local one
+	KeepLocal Strategy = "keep-local"
+
+	// Merge merges attributes and description field by field, the target's value is used for fields changed on
+	// both sides and for all other fields
+	Merge Strategy = "merge"
+
+	// Interactive asks for a strategy for each conflict
+	Interactive Strategy = "interactive"
+)
+
+// ParseStrategy returns the strategy with the given name, an empty name is KeepRemote.
+func ParseStrategy(name string) (Strategy, error) {
+	switch s := Strategy(name); s {
+	case "":
+		return KeepRemote, nil
+	case KeepRemote, KeepLocal, Merge, Interactive:
+		return s, nil
+	}
+
+	return "", errors.Errorf("Unknown conflict resolution strategy '%s', valid strategies are %s, %s, %s and %s",
+		name, KeepRemote, KeepLocal, Merge, Interactive)
+}
+
+// strategy returns the strategy used for one conflict
+func (r Resolver) strategy(kind string, init, cur, tgt interface{}) (Strategy, error) {
+	switch r.Strategy {
+	case "":
+		return KeepRemote, nil
+	case KeepRemote, KeepLocal, Merge:
+		return r.Strategy, nil
+	case Interactive:
+		if r.Prompt == nil {
+			return "", errors.New("Interactive conflict resolution needs a prompt")
+		}
+
+		s, err := r.Prompt(kind, init, cur, tgt)
+		if err != nil {
+			return "", err
+		}
+		if s == Interactive {
+			return "", errors.Errorf("Invalid answer %s", s)
+		}
+		return ParseStrategy(string(s))
+	}
+
+	return "", errors.Errorf("Unknown conflict resolution strategy '%s'", r.Strategy)
+}
+
+// resolveVolumeSet records the version of a conflicting volume set which is kept in c
+func (r Resolver) resolveVolumeSet(c *metastore.VSMetaConflict) error {
+	s, err := r.strategy("volume set", c.Init, c.Cur, c.Tgt)
+	if err != nil {
+		return err
+	}
+
+	// Fields maintained by the target, such as owner and creator, are always the target's
+	resolved := c.Tgt.Copy()
+	switch s {
+	case KeepLocal:
+		resolved.Name = c.Cur.Name
+		resolved.Prefix = c.Cur.Prefix
+		resolved.Description = c.Cur.Description
+		resolved.Retention = c.Cur.Retention
+		resolved.Hooks = c.Cur.Hooks
+		resolved.Attrs = c.Cur.Attrs.Copy()
+	case Merge:
+		resolved.Name = merge(c.Init.Name, c.Cur.Name, c.Tgt.Name)
+		resolved.Prefix = merge(c.Init.Prefix, c.Cur.Prefix, c.Tgt.Prefix)
+		resolved.Description = merge(c.Init.Description, c.Cur.Description, c.Tgt.Description)
+		resolved.Retention = merge(c.Init.Retention, c.Cur.Retention, c.Tgt.Retention)
+		resolved.Hooks = merge(c.Init.Hooks, c.Cur.Hooks, c.Tgt.Hooks)
+		resolved.Attrs = mergeAttrs(c.Init.Attrs, c.Cur.Attrs, c.Tgt.Attrs)
+	}
+
+	c.Resolved = resolved
+	c.Resolution = string(s)
+	return nil
+}
+
+// resolveSnapshot records the version of a conflicting snapshot which is kept in c
+func (r Resolver) resolveSnapshot(c *metastore.SnapMetaConflict) error {
+	s, err := r.strategy("snapshot", c.Init, c.Cur, c.Tgt)
+	if err != nil {
+		return err
+	}
+
+	resolved := c.Tgt.Copy()
+	switch s {
+	case KeepLocal:
+		resolved.Name = c.Cur.Name
+		resolved.Description = c.Cur.Description
+		resolved.Attrs = c.Cur.Attrs.Copy()
+	case Merge:
+		resolved.Name = merge(c.Init.Name, c.Cur.Name, c.Tgt.Name)
+		resolved.Description = merge(c.Init.Description, c.Cur.Description, c.Tgt.Description)
+		resolved.Attrs = mergeAttrs(c.Init.Attrs, c.Cur.Attrs, c.Tgt.Attrs)
+	}
+	if !resolved.Equals(c.Tgt) {
+		resolved.LastModifiedTime = time.Now()
+	}
+
+	c.Resolved = resolved
+	c.Resolution = string(s)
+	return nil
+}
+
+// merge returns the current value if only it changed since init, otherwise the target's
+func merge(init, cur, tgt string) string {
+	if tgt == init {
+		return cur
+	}
+	return tgt
+}
+
+// mergeAttrs merges the attributes key by key, a key changed or removed on both sides gets the target's value
+func mergeAttrs(init, cur, tgt attrs.Attrs) attrs.Attrs {
+	keys := make(map[string]bool)
+	for _, a := range []attrs.Attrs{init, cur, tgt} {
+		for k := range a {
+			keys[k] = true
+		}
+	}
+
+	merged := make(attrs.Attrs)
+	for k := range keys {
+		i, iok := init[k]
+		c, cok := cur[k]
+		t, tok := tgt[k]
+
+		v, ok := t, tok
+		if i == t && iok == tok {
+			v, ok = c, cok
+		}
+		if ok {
+			merged[k] = v
+		}
+	}
+
+	// Keep a missing map missing, volume sets compare them with reflect.DeepEqual
+	if len(merged) == 0 && tgt == nil {
+		return nil
+	}
+	return merged
+}
+
+// isVSConflict returns true if the volume set conflict has changes on both sides
+func isVSConflict(c metastore.VSMetaConflict) bool {
+	return c.Init != nil && CheckVSConflict(c.Tgt, c.Cur, c.Init) == metastore.UseTgtConflict
+}
+
+// isSnapConflict returns true if the snapshot conflict has changes on both sides
+func isSnapConflict(c metastore.SnapMetaConflict) bool {
+	return c.Init != nil && CheckSnapConflict(c.Tgt, c.Cur, c.Init) == metastore.UseTgtConflict
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/dp/metastore/testutil"
+	"github.com/ClusterHQ/fli/dp/sync"
+	"github.com/ClusterHQ/fli/mdsimpls/sqlite3storage"
+	"github.com/ClusterHQ/fli/meta/attrs"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+	"github.com/ClusterHQ/fli/securefilepath"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMds(t *testing.T, dir string, name string) *sqlite3storage.Sqlite3Storage {
+	p, err := securefilepath.New(filepath.Join(dir, name))
+	require.NoError(t, err)
+	mds, err := sqlite3storage.Create(p)
+	require.NoError(t, err)
+	return mds
+}
+
+// updateVolumeSet changes the description and one attribute of the volume set
+func updateVolumeSet(t *testing.T, mds metastore.Syncable, vsid volumeset.ID, desc string, key string) {
+	vs, err := metastore.GetVolumeSet(mds, vsid)
+	require.NoError(t, err)
+	vs.Description = desc
+	vs.Attrs.SetKey(key, "2")
+	require.NoError(t, metastore.UpdateVolumeSet(mds, vs))
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		strategy sync.Strategy
+		prompt   sync.Prompter
+		desc     string
+		attrs    attrs.Attrs
+	}{
+		{strategy: sync.KeepRemote, desc: "init", attrs: attrs.Attrs{"a": "1", "b": "2"}},
+		{strategy: sync.KeepLocal, desc: "local", attrs: attrs.Attrs{"a": "2", "b": "1"}},
+		{strategy: sync.Merge, desc: "local", attrs: attrs.Attrs{"a": "2", "b": "2"}},
+		{
+			strategy: sync.Interactive,
+			prompt: func(kind string, init, cur, tgt interface{}) (sync.Strategy, error) {
+				return sync.KeepLocal, nil
+			},
+			desc:  "local",
+			attrs: attrs.Attrs{"a": "2", "b": "1"},
+		},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "resolve")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		cur := newMds(t, dir, "cur")
+		tgt := newMds(t, dir, "tgt")
+		init := newMds(t, dir, "init")
+
+		vs, err := testutil.VolumeSetTest(cur, "vs", "", attrs.Attrs{"a": "1", "b": "1"}, "init")
+		require.NoError(t, err)
+		require.NoError(t, sync.NewObjects(cur, tgt, vs.ID))
+		require.NoError(t, sync.NewObjects(cur, init, vs.ID))
+
+		// The description and a are changed locally, b on the target
+		updateVolumeSet(t, cur, vs.ID, "local", "a")
+		updateVolumeSet(t, tgt, vs.ID, "init", "b")
+
+		r := sync.Resolver{Strategy: test.strategy, Prompt: test.prompt}
+		conflicts, err := sync.Do(tgt, cur, init, vs.ID, false, r)
+		require.NoError(t, err, string(test.strategy))
+		require.True(t, conflicts.HasConflicts())
+		require.Len(t, conflicts.VsC, 1)
+		c := conflicts.VsC[0]
+		assert.NotEqual(t, string(sync.Interactive), c.Resolution)
+		assert.Equal(t, test.desc, c.Resolved.Description, string(test.strategy))
+		assert.Equal(t, test.attrs, c.Resolved.Attrs, string(test.strategy))
+
+		// All three stores have the resolved version
+		for _, mds := range []metastore.Syncable{tgt, cur, init} {
+			got, err := metastore.GetVolumeSet(mds, vs.ID)
+			require.NoError(t, err)
+			assert.True(t, got.MetaEqual(c.Resolved), string(test.strategy))
+		}
+	}
+}
+
+func TestParseStrategy(t *testing.T) {
+	s, err := sync.ParseStrategy("")
+	require.NoError(t, err)
+	assert.Equal(t, sync.KeepRemote, s)
+
+	s, err = sync.ParseStrategy("merge")
+	require.NoError(t, err)
+	assert.Equal(t, sync.Merge, s)
+
+	_, err = sync.ParseStrategy("newest")
+	assert.Error(t, err)
+}
@@ -296,6 +296,23 @@ func NewLazyLoadSnapshotIterator(mds metastore.Store, vsid volumeset.ID, snapsho
 // NewFilterSnapshotIterator returns an iterator over all of the snapshots which
 // are in the history of a specified branch, starting at the tip and
 // proceeding to the root.
+// newCertainSnapshotIterator returns a SnapshotIterator which produces the snapshots with the given IDs in order,
+// they must belong to the same volume set.
+func newCertainSnapshotIterator(mds metastore.Store, snapshotIDs []snapshot.ID) (SnapshotIterator, error) {
+	// Figure out which volumeset this snapshot belongs to
+	vsid, err := metastore.GetVolumeSetBySnapID(mds, snapshotIDs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// Reverse the snapshot slice so LazySnapshotLoader can use it like a stack.
+	stack := make([]snapshot.ID, 0, len(snapshotIDs))
+	for i := len(snapshotIDs) - 1; i > -1; i-- {
+		stack = append(stack, snapshotIDs[i])
+	}
+	return NewLazyLoadSnapshotIterator(mds, vsid, stack), nil
+}
+
 func NewFilterSnapshotIterator(snapshots SnapshotIterator, predicate SnapshotPredicate) SnapshotIterator {
 	return &FilterIterator{Snapshots: snapshots, Predicate: predicate}
 }
@@ -21,22 +21,24 @@ import (
 
 	"github.com/ClusterHQ/fli/dp/metastore"
 	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/meta/branch"
 	"github.com/ClusterHQ/fli/meta/snapshot"
 	"github.com/ClusterHQ/fli/meta/volumeset"
 )
 
 // MetaConflicts - list of conflicts for vs, snaps, branches.
-// Used for reporting to the user.
+// Used for reporting to the user, conflicts changed on both sides record how they were resolved.
 type MetaConflicts struct {
-	VsC []metastore.VSMetaConflict
-	SnC []metastore.SnapMetaConflict
-	BrC []metastore.BranchMetaConflict
+	VsC []metastore.VSMetaConflict     `json:"volumesets"`
+	SnC []metastore.SnapMetaConflict   `json:"snapshots"`
+	BrC []metastore.BranchMetaConflict `json:"branches"`
 }
 
 func volSetMeta(
 	s metastore.MdsTriplet,
 	vsid volumeset.ID,
 	pullOnly bool,
+	r Resolver,
 ) ([]metastore.VSMetaConflict, error) {
 	var (
 		vsCur, vsInit *volumeset.VolumeSet
@@ -78,12 +80,33 @@ func volSetMeta(
 		return nil, err
 	}
 
-	_, err = s.Cur.UpdateVolumeSet(c.Tgt, nil)
+	resolved := c.Tgt
+	if isVSConflict(c) {
+		err = r.resolveVolumeSet(&c)
+		if err != nil {
+			return nil, err
+		}
+		resolved = c.Resolved
+
+		if !pullOnly && !resolved.MetaEqual(c.Tgt) {
+			err = metastore.UpdateVolumeSet(s.Tgt, resolved)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	_, err = s.Cur.UpdateVolumeSet(resolved, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = s.Init.UpdateVolumeSet(c.Tgt, nil)
+	// A fetch doesn't update the target, initial gets the target's version so the local changes kept are pushed by
+	// the next sync
+	if pullOnly {
+		resolved = c.Tgt
+	}
+	_, err = s.Init.UpdateVolumeSet(resolved, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -96,6 +119,7 @@ func snapshotMeta(
 	s metastore.MdsTriplet,
 	vsid volumeset.ID,
 	pullOnly bool,
+	r Resolver,
 ) ([]metastore.SnapMetaConflict, error) {
 	// Note: There is different cases for meta sync:
 	//       1. Source and target are quiet different in term of snapshots.
@@ -187,22 +211,48 @@ func snapshotMeta(
 
 	// Collect all snapshots needs to be updated first and then go to DB once in one batch update
 	var (
+		updatePairTgt  []*metastore.SnapshotPair
 		updatePairCur  []*metastore.SnapshotPair
 		updatePairInit []*metastore.SnapshotPair
 	)
 
-	for _, c := range conflicts {
+	for idx := range conflicts {
+		c := &conflicts[idx]
+		resolved := c.Tgt
+		if isSnapConflict(*c) {
+			err = r.resolveSnapshot(c)
+			if err != nil {
+				return nil, err
+			}
+			resolved = c.Resolved
+
+			if !pullOnly && !resolved.Equals(c.Tgt) {
+				updatePairTgt = append(
+					updatePairTgt,
+					&metastore.SnapshotPair{
+						Cur:  resolved,
+						Init: nil,
+					},
+				)
+			}
+		}
+
 		updatePairCur = append(
 			updatePairCur,
 			&metastore.SnapshotPair{
-				Cur:  c.Tgt,
+				Cur:  resolved,
 				Init: nil,
 			},
 		)
+
+		// See volSetMeta() for why a fetch keeps the target's version on initial
+		if pullOnly {
+			resolved = c.Tgt
+		}
 		updatePairInit = append(
 			updatePairInit,
 			&metastore.SnapshotPair{
-				Cur:  c.Tgt,
+				Cur:  resolved,
 				Init: nil,
 			},
 		)
@@ -226,6 +276,13 @@ func snapshotMeta(
 		}
 	}
 
+	if len(updatePairTgt) != 0 {
+		_, err = s.Tgt.UpdateSnapshots(updatePairTgt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if len(updatePairCur) != 0 {
 		_, err = s.Cur.UpdateSnapshots(updatePairCur)
 		if err != nil {
@@ -243,12 +300,108 @@ func snapshotMeta(
 	return conflicts, nil
 }
 
+// branchMeta compares the branches of the three stores and returns the branches changed on both current and target
+// since the last sync. It is called before new objects are synced as syncing them would hide deletions.
 func branchMeta(
 	s metastore.MdsTriplet,
 	vsid volumeset.ID,
 ) ([]metastore.BranchMetaConflict, error) {
-	// TODO: to be implemented
-	return []metastore.BranchMetaConflict{}, nil
+	if s.Init == nil {
+		return []metastore.BranchMetaConflict{}, nil
+	}
+
+	branchesTgt, err := getBranchMap(s.Tgt, vsid)
+	if err != nil {
+		return nil, err
+	}
+
+	branchesCur, err := getBranchMap(s.Cur, vsid)
+	if err != nil {
+		return nil, err
+	}
+
+	branchesInit, err := getBranchMap(s.Init, vsid)
+	if err != nil {
+		return nil, err
+	}
+
+	// A branch only on target is new there, branch IDs are unique so there is nothing to conflict with
+	ids := make(map[branch.ID]bool)
+	for id := range branchesCur {
+		ids[id] = true
+	}
+	for id := range branchesInit {
+		ids[id] = true
+	}
+
+	conflicts := []metastore.BranchMetaConflict{}
+	for id := range ids {
+		brTgt, brCur, brInit := branchesTgt[id], branchesCur[id], branchesInit[id]
+		c := CheckBranchConflict(brTgt, brCur, brInit)
+
+		if brTgt != nil && brCur != nil && tipMoved(brTgt, brCur) {
+			diverged, err := divergedTips(s, brTgt, brCur)
+			if err != nil {
+				return nil, err
+			}
+			if diverged {
+				c = append(c, metastore.BranchTipMoved)
+			}
+		}
+
+		if len(c) == 0 {
+			continue
+		}
+
+		conflicts = append(
+			conflicts,
+			metastore.BranchMetaConflict{
+				Tgt:       brTgt,
+				Cur:       brCur,
+				Init:      brInit,
+				Conflicts: c,
+			},
+		)
+	}
+
+	return conflicts, nil
+}
+
+// getBranchMap returns the branches of the volume set by their IDs
+func getBranchMap(mds metastore.Syncable, vsid volumeset.ID) (map[branch.ID]*branch.Branch, error) {
+	branches, err := metastore.GetBranches(mds, branch.Query{VolSetID: vsid})
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[branch.ID]*branch.Branch)
+	for _, b := range branches {
+		m[b.ID] = b
+	}
+	return m, nil
+}
+
+// divergedTips returns true if neither branch's tip is in the other's history. A tip in the other's history only fell
+// behind, it is fast forwarded by the sync.
+func divergedTips(s metastore.MdsTriplet, brTgt, brCur *branch.Branch) (bool, error) {
+	for _, h := range []struct {
+		mds metastore.Syncable
+		tip *snapshot.Snapshot
+		id  snapshot.ID
+	}{
+		{mds: s.Tgt, tip: brTgt.Tip, id: brCur.Tip.ID},
+		{mds: s.Cur, tip: brCur.Tip, id: brTgt.Tip.ID},
+	} {
+		_, err := listSnapshots(h.mds, h.tip, &h.id)
+		if err == nil {
+			return false, nil
+		}
+		if err != errSnapshotNotInBranch {
+			return false, err
+		}
+	}
+
+	return true, nil
 }
 
 // CheckVSConflict checks and returns action code for sync based on the set of volume set objects
@@ -279,6 +432,41 @@ func CheckVSConflict(vsTgt, vsCur, vsInit *volumeset.VolumeSet) metastore.Resolv
 	return metastore.UseTgtConflict
 }
 
+// CheckBranchConflict returns the changes made on both target and current to a branch since the initial version.
+// A nil branch doesn't exist in the store, a deletion only conflicts with the branch being extended on the other side.
+// Tips moved on both sides are not checked here because telling them apart from a fast forward needs the histories of
+// the branch, see divergedTips().
+func CheckBranchConflict(brTgt, brCur, brInit *branch.Branch) []metastore.BranchConflict {
+	if brInit == nil {
+		return nil
+	}
+
+	var conflicts []metastore.BranchConflict
+	switch {
+	case brTgt == nil && brCur == nil:
+		// Deleted on both sides
+	case brTgt == nil:
+		if tipMoved(brCur, brInit) {
+			conflicts = append(conflicts, metastore.BranchDeleted)
+		}
+	case brCur == nil:
+		if tipMoved(brTgt, brInit) {
+			conflicts = append(conflicts, metastore.BranchDeleted)
+		}
+	default:
+		if brTgt.Name != brInit.Name && brCur.Name != brInit.Name && brTgt.Name != brCur.Name {
+			conflicts = append(conflicts, metastore.BranchRenamed)
+		}
+	}
+
+	return conflicts
+}
+
+// tipMoved returns true if the branches end at different snapshots
+func tipMoved(a, b *branch.Branch) bool {
+	return a.Tip.ID != b.Tip.ID
+}
+
 // CheckSnapConflict ...
 func CheckSnapConflict(snapTgt, snapCur, snapInit *snapshot.Snapshot) metastore.ResolveStatus {
 	if snapCur.Equals(snapInit) {
@@ -312,8 +500,9 @@ func (c *MetaConflicts) Report() {
 		}
 		log.Println("Volume set conflict: ")
 		log.Println("  Initial version:", v.Init)
-		log.Println("  Current version (overwritten by target one): ", v.Cur)
+		log.Println("  Current version:", v.Cur)
 		log.Println("  Target version:", v.Tgt)
+		log.Printf("  Resolved version (%s): %v", v.Resolution, v.Resolved)
 	}
 
 	for _, s := range c.SnC {
@@ -322,11 +511,17 @@ func (c *MetaConflicts) Report() {
 		}
 		log.Println("Snapshot conflict: ")
 		log.Println("  Initial version:", s.Init)
-		log.Println("  Current version (overwritten by target one): ", s.Cur)
+		log.Println("  Current version:", s.Cur)
 		log.Println("  Target version:", s.Tgt)
+		log.Printf("  Resolved version (%s): %v", s.Resolution, s.Resolved)
 	}
 
-	// TODO: Branch conflicts
+	for _, b := range c.BrC {
+		log.Println("Branch conflict: ", b.Conflicts)
+		log.Println("  Initial version:", b.Init)
+		log.Println("  Current version:", b.Cur)
+		log.Println("  Target version:", b.Tgt)
+	}
 }
 
 // HasConflicts returns true if there are conflicts.
@@ -344,6 +539,6 @@ func (c *MetaConflicts) HasConflicts() bool {
 		}
 	}
 
-	// TODO: Branch conflicts
-	return false
+	// Branches are only reported when they conflict
+	return len(c.BrC) != 0
 }
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/dp/metastore/testutil"
+	"github.com/ClusterHQ/fli/dp/sync"
+	"github.com/ClusterHQ/fli/meta/attrs"
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/branch"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// extend adds a snapshot to the tip of the only branch of the volume set
+func extend(t *testing.T, mds metastore.Store, vsid volumeset.ID) *snapshot.Snapshot {
+	branches, err := metastore.GetBranches(mds, branch.Query{VolSetID: vsid})
+	require.NoError(t, err)
+	require.Len(t, branches, 1)
+	sn, err := metastore.SnapshotExtend(mds, snapshot.NewRandomID(), &branches[0].Tip.ID, blob.NilID(),
+		attrs.Attrs{}, "", 0, "")
+	require.NoError(t, err)
+	return sn
+}
+
+func TestBranchConflicts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "branches")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cur := newMds(t, dir, "cur")
+	tgt := newMds(t, dir, "tgt")
+	init := newMds(t, dir, "init")
+
+	vs, err := testutil.VolumeSetTest(cur, "vs", "", attrs.Attrs{}, "")
+	require.NoError(t, err)
+	_, err = metastore.SnapshotFork(cur, vs.ID, snapshot.NewRandomID(), "master", nil, blob.NilID(), attrs.Attrs{},
+		"", 0, "")
+	require.NoError(t, err)
+	require.NoError(t, sync.NewObjects(cur, tgt, vs.ID))
+	require.NoError(t, sync.NewObjects(cur, init, vs.ID))
+
+	// Extending the branch only locally is pushed
+	extend(t, cur, vs.ID)
+	conflicts, err := sync.Do(tgt, cur, init, vs.ID, false, sync.Resolver{})
+	require.NoError(t, err)
+	assert.False(t, conflicts.HasConflicts())
+
+	// The branch is renamed and extended on both sides
+	require.NoError(t, metastore.RenameBranch(cur, vs.ID, "master", "local"))
+	require.NoError(t, metastore.RenameBranch(tgt, vs.ID, "master", "remote"))
+	snCur := extend(t, cur, vs.ID)
+	snTgt := extend(t, tgt, vs.ID)
+
+	for _, pullOnly := range []bool{false, true} {
+		conflicts, err = sync.Do(tgt, cur, init, vs.ID, pullOnly, sync.Resolver{})
+		require.NoError(t, err)
+		require.True(t, conflicts.HasConflicts())
+		require.Len(t, conflicts.BrC, 1)
+		c := conflicts.BrC[0]
+		assert.Equal(t, []metastore.BranchConflict{metastore.BranchRenamed, metastore.BranchTipMoved}, c.Conflicts)
+		assert.Equal(t, "local", c.Cur.Name)
+		assert.Equal(t, "remote", c.Tgt.Name)
+		assert.Equal(t, "master", c.Init.Name)
+
+		// Diverged branches are left as they are
+		_, err = metastore.GetSnapshot(tgt, snCur.ID)
+		assert.Error(t, err)
+		_, err = metastore.GetSnapshot(cur, snTgt.ID)
+		assert.Error(t, err)
+	}
+}
+
+func TestCheckBranchConflict(t *testing.T) {
+	vsid := volumeset.NewRandomID()
+	br := func(name string, tip string) *branch.Branch {
+		return &branch.Branch{ID: "b", Name: name, Tip: &snapshot.Snapshot{VolSetID: vsid, ID: snapshot.NewID(tip)}}
+	}
+
+	// Deleted on one side and extended on the other
+	assert.Equal(t, []metastore.BranchConflict{metastore.BranchDeleted},
+		sync.CheckBranchConflict(nil, br("a", "2"), br("a", "1")))
+	assert.Equal(t, []metastore.BranchConflict{metastore.BranchDeleted},
+		sync.CheckBranchConflict(br("a", "2"), nil, br("a", "1")))
+
+	// Deleted on one side only
+	assert.Empty(t, sync.CheckBranchConflict(nil, br("a", "1"), br("a", "1")))
+
+	// Renamed on one side only or to the same name
+	assert.Empty(t, sync.CheckBranchConflict(br("b", "1"), br("a", "1"), br("a", "1")))
+	assert.Empty(t, sync.CheckBranchConflict(br("b", "1"), br("b", "1"), br("a", "1")))
+
+	// New branches don't conflict
+	assert.Empty(t, sync.CheckBranchConflict(br("a", "1"), br("b", "2"), nil))
+}
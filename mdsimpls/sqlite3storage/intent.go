@@ -0,0 +1,221 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlite3storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/meta/attrs"
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volume"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+	"github.com/ClusterHQ/fli/securefilepath"
+	"github.com/pborman/uuid"
+)
+
+type (
+	// intentData is the JSON encoded part of an intent
+	intentData struct {
+		VolSetID   volumeset.ID  `json:"volset_id"`
+		SnapshotID snapshot.ID   `json:"snapshot_id"`
+		Volume     *intentVolume `json:"volume,omitempty"`
+		BlobIDs    []blob.ID     `json:"blob_ids,omitempty"`
+	}
+
+	// intentVolume is a volume with its mount path as a string
+	intentVolume struct {
+		ID           volume.ID    `json:"id"`
+		BaseID       *snapshot.ID `json:"base_id"`
+		MntPath      string       `json:"mount_path"`
+		Attrs        attrs.Attrs  `json:"attrs"`
+		CreationTime time.Time    `json:"creation_time"`
+		Size         uint64       `json:"size"`
+		Name         string       `json:"name"`
+	}
+)
+
+var _ metastore.Journal = &Sqlite3Storage{}
+
+// createIntentSchema creates the intent table, databases created before intents were journaled don't have it
+func createIntentSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+CREATE TABLE IF NOT EXISTS [intent] (
+    [id] text,
+    [op] text NOT NULL,
+    [creation_time] integer,
+    [data] text NOT NULL,
+    PRIMARY KEY([id])
+)`)
+	if err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+func encodeIntent(i *metastore.Intent) (string, error) {
+	data := intentData{
+		VolSetID:   i.VolSetID,
+		SnapshotID: i.SnapshotID,
+		BlobIDs:    i.BlobIDs,
+	}
+
+	if i.Volume != nil {
+		data.Volume = &intentVolume{
+			ID:           i.Volume.ID,
+			BaseID:       i.Volume.BaseID,
+			MntPath:      i.Volume.MntPath.Path(),
+			Attrs:        i.Volume.Attrs,
+			CreationTime: i.Volume.CreationTime,
+			Size:         i.Volume.Size,
+			Name:         i.Volume.Name,
+		}
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return "", errors.New(err)
+	}
+	return string(b), nil
+}
+
+func decodeIntent(i *metastore.Intent, s string) error {
+	var data intentData
+	err := json.Unmarshal([]byte(s), &data)
+	if err != nil {
+		return errors.Errorf("Failed to decode intent %v: %v", i.ID, err)
+	}
+
+	i.VolSetID = data.VolSetID
+	i.SnapshotID = data.SnapshotID
+	i.BlobIDs = data.BlobIDs
+
+	if data.Volume != nil {
+		mntPath, err := securefilepath.New(data.Volume.MntPath)
+		if err != nil {
+			return err
+		}
+
+		i.Volume = &volume.Volume{
+			ID:           data.Volume.ID,
+			VolSetID:     data.VolSetID,
+			BaseID:       data.Volume.BaseID,
+			MntPath:      mntPath,
+			Attrs:        data.Volume.Attrs,
+			CreationTime: data.Volume.CreationTime,
+			Size:         data.Volume.Size,
+			Name:         data.Volume.Name,
+		}
+	}
+
+	return nil
+}
+
+// AddIntent implements metastore interface
+func (store *Sqlite3Storage) AddIntent(i *metastore.Intent) error {
+	i.ID = metastore.IntentID(uuid.New())
+	i.CreationTime = time.Now()
+
+	data, err := encodeIntent(i)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.db.Exec(`
+INSERT INTO [intent] ([id], [op], [creation_time], [data]) VALUES (?, ?, ?, ?)
+`, i.ID.String(), string(i.Op), i.CreationTime.UnixNano(), data)
+	if err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// UpdateIntent implements metastore interface
+func (store *Sqlite3Storage) UpdateIntent(i *metastore.Intent) error {
+	data, err := encodeIntent(i)
+	if err != nil {
+		return err
+	}
+
+	result, err := store.db.Exec(`
+UPDATE [intent] SET [data] = ? WHERE [id] = ?
+`, data, i.ID.String())
+	if err != nil {
+		return errors.New(err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.New(err)
+	}
+	if rowsAffected == 0 {
+		return errors.Errorf("Failed to update intent(%v): no such intent", i.ID)
+	}
+	return nil
+}
+
+// RemoveIntent implements metastore interface
+func (store *Sqlite3Storage) RemoveIntent(id metastore.IntentID) error {
+	_, err := store.db.Exec(`
+DELETE FROM [intent] WHERE [id] = ?
+`, id.String())
+	if err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// GetIntents implements metastore interface
+func (store *Sqlite3Storage) GetIntents() ([]*metastore.Intent, error) {
+	rows, err := store.db.Query(`
+SELECT [id], [op], [creation_time], [data] FROM [intent] ORDER BY [creation_time]
+`)
+	if err != nil {
+		return nil, errors.New(err)
+	}
+	defer rows.Close()
+
+	intents := []*metastore.Intent{}
+	for rows.Next() {
+		var (
+			id, op, data string
+			creationTime int64
+		)
+		err = rows.Scan(&id, &op, &creationTime, &data)
+		if err != nil {
+			return nil, errors.Errorf("Failed to scan rows: %v", err)
+		}
+
+		i := &metastore.Intent{
+			ID:           metastore.IntentID(id),
+			Op:           metastore.IntentOp(op),
+			CreationTime: time.Unix(0, creationTime),
+		}
+		err = decodeIntent(i, data)
+		if err != nil {
+			return nil, err
+		}
+
+		intents = append(intents, i)
+	}
+
+	return intents, rows.Err()
+}
@@ -52,6 +52,7 @@ var (
 	sqlDriverName = "sqlite3"
 
 	_ metastore.Store    = &Sqlite3Storage{}
+	_ metastore.Server   = &Sqlite3Storage{}
 	_ datasrvstore.Store = &Sqlite3Storage{}
 )
 
@@ -86,6 +87,11 @@ func Create(path securefilepath.SecureFilePath) (*Sqlite3Storage, error) {
 		return nil, err
 	}
 
+	err = createIntentSchema(db)
+	if err != nil {
+		return nil, err
+	}
+
 	err = configDB(db)
 	if err != nil {
 		return nil, err
@@ -223,12 +229,22 @@ func Open(path securefilepath.SecureFilePath) (metastore.Client, error) {
 		return nil, err
 	}
 
+	err = createIntentSchema(db)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Sqlite3Storage{
 		path: path,
 		db:   db,
 	}, nil
 }
 
+// Close closes the database, it is locked exclusively until it is closed
+func (store *Sqlite3Storage) Close() error {
+	return store.db.Close()
+}
+
 // DeleteVolumeSet implements metastore interface
 func (store *Sqlite3Storage) DeleteVolumeSet(id volumeset.ID) error {
 	tx, err := store.db.Begin()
@@ -2662,6 +2678,40 @@ UPDATE [snapshot] SET [size] = ?, [blob_id] = ? WHERE [id] = ?
 	return nil
 }
 
+// DiskSpaceUsage implements metastore.Server interface
+func (store *Sqlite3Storage) DiskSpaceUsage(vsids []volumeset.ID) (uint64, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, errors.New(err)
+	}
+	defer tx.Rollback()
+
+	sel, err := tx.Prepare(`
+SELECT [size]
+FROM [volumeset]
+WHERE [id] = ?
+`)
+	if err != nil {
+		return 0, errors.New(err)
+	}
+	defer sel.Close()
+
+	var total uint64
+	for _, vsid := range vsids {
+		var size uint64
+		err = sel.QueryRow(vsid.String()).Scan(&size)
+		if err == sql.ErrNoRows {
+			return 0, &metastore.ErrVolumeSetNotFound{}
+		}
+		if err != nil {
+			return 0, errors.New(err)
+		}
+		total += size
+	}
+
+	return total, nil
+}
+
 // Implementation of data server manager
 
 // Add ...
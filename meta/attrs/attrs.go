@@ -32,6 +32,12 @@ const (
 
 	// Prefix is the key for prefix used by volume set
 	Prefix = "$$$CHQ$$$PREFIX"
+
+	// Retention is the key for the retention policy used by volume set
+	Retention = "$$$CHQ$$$RETENTION"
+
+	// Hooks is the key for the snapshot hooks used by volume set
+	Hooks = "$$$CHQ$$$HOOKS"
 )
 
 type (
@@ -49,6 +49,8 @@ type (
 		NumSnapshots     int         `json:"num_snapshots"`
 		NumBranches      int         `json:"num_branches"`
 		Description      string      `json:"description"`
+		Retention        string      `json:"retention,omitempty"` // retention policy of the snapshots
+		Hooks            string      `json:"hooks,omitempty"`     // hooks run around snapshots of the volumes
 	}
 
 	// Query ..
@@ -183,6 +185,8 @@ func (vs *VolumeSet) MetaEqual(that *VolumeSet) bool {
 		vs.Name == that.Name &&
 		vs.Prefix == that.Prefix &&
 		vs.Description == that.Description &&
+		vs.Retention == that.Retention &&
+		vs.Hooks == that.Hooks &&
 		vs.ID.Equals(that.ID) &&
 		vs.Creator == that.Creator &&
 		vs.Owner == that.Owner &&
@@ -295,6 +299,22 @@ func (vs *VolumeSet) StoreKnownKeys() {
 		}
 		vs.Attrs.SetKey(attrs.Prefix, vs.Prefix)
 	}
+
+	delete(vs.Attrs, attrs.Retention)
+	if !util.IsEmptyString(vs.Retention) {
+		if vs.Attrs == nil {
+			vs.Attrs = make(attrs.Attrs, 0)
+		}
+		vs.Attrs.SetKey(attrs.Retention, vs.Retention)
+	}
+
+	delete(vs.Attrs, attrs.Hooks)
+	if !util.IsEmptyString(vs.Hooks) {
+		if vs.Attrs == nil {
+			vs.Attrs = make(attrs.Attrs, 0)
+		}
+		vs.Attrs.SetKey(attrs.Hooks, vs.Hooks)
+	}
 }
 
 // RetrieveKnownKeys retrives all known keys from attributes
@@ -316,6 +336,18 @@ func (vs *VolumeSet) RetrieveKnownKeys() {
 		vs.Prefix = v
 	}
 	delete(vs.Attrs, attrs.Prefix)
+
+	v, exist = vs.Attrs[attrs.Retention]
+	if exist {
+		vs.Retention = v
+	}
+	delete(vs.Attrs, attrs.Retention)
+
+	v, exist = vs.Attrs[attrs.Hooks]
+	if exist {
+		vs.Hooks = v
+	}
+	delete(vs.Attrs, attrs.Hooks)
 }
 
 // SetOwnerUUID sets owner uuid from name and current client and creator
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ClusterHQ/fli/miscutils/cron"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	for _, spec := range []string{"* * * * *", "*/15 0-6,22 1 */2 1-5", "5/10 * * * 7", "@daily"} {
+		_, err := cron.Parse(spec)
+		assert.NoError(t, err, spec)
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		_, err := cron.Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestNext(t *testing.T) {
+	from := time.Date(2016, time.December, 14, 10, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2016, time.December, 14, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2016, time.December, 14, 10, 15, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2016, time.December, 14, 11, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2016, time.December, 15, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2016, time.December, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches if both are restricted
+		{"0 0 31 * 5", time.Date(2016, time.December, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 12 29 2 *", time.Date(2020, time.February, 29, 12, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		s, err := cron.Parse(test.spec)
+		require.NoError(t, err, test.spec)
+		assert.Equal(t, test.next, s.Next(from), test.spec)
+	}
+
+	s, err := cron.Parse("0 0 30 2 *")
+	require.NoError(t, err)
+	assert.True(t, s.Next(from).IsZero())
+}
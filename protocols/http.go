@@ -17,6 +17,7 @@
 package protocols
 
 import (
+	"github.com/ClusterHQ/fli/dl/progress"
 	"github.com/ClusterHQ/fli/dp/metastore"
 	"github.com/ClusterHQ/fli/meta/blob"
 	"github.com/ClusterHQ/fli/meta/branch"
@@ -116,20 +117,59 @@ type (
 	RespToken struct {
 		Token               string
 		DataServerPublicURL string
+
+		// Full is true if the download is the diff from the empty blob whatever base was requested, blobs of
+		// encrypted records are only sent this way
+		Full bool
 	}
 
 	// ReqUploadTokenStatus ..
 	ReqUploadTokenStatus struct {
-		Token  string
-		BlobID blob.ID
-		Size   uint64
-		Status string
+		Token string
+		// SnapshotID is the snapshot of the verified upload token, set with the blob of a completed upload
+		SnapshotID snapshot.ID
+		BlobID     blob.ID
+		Size       uint64
+		Status     string
+		Progress   *progress.Stats `json:",omitempty"`
 	}
 
 	// ReqDownloadTokenStatus ..
 	ReqDownloadTokenStatus struct {
-		Token  string
-		Status string
+		Token    string
+		Status   string
+		Progress *progress.Stats `json:",omitempty"`
+		// Error is why a failed download failed
+		Error string `json:",omitempty"`
+	}
+
+	// RespTransferStatus is the last status a data server reported for the upload or download of a token, with
+	// the transfer's counters if it started.
+	RespTransferStatus struct {
+		Status   string
+		Progress *progress.Stats `json:",omitempty"`
+	}
+
+	// RespUploadCheckpoint is the response from DS to client with the number of records of an interrupted upload
+	// already applied, the client resumes the upload from there.
+	// Native is set if the DS accepts the upload as a native stream of its storage.
+	RespUploadCheckpoint struct {
+		Offset uint64
+		Native *NativeOffer `json:",omitempty"`
+	}
+
+	// NativeOffer is what a receiver tells a sender about the native streams, for example ZFS send streams, its
+	// storage can receive.
+	NativeOffer struct {
+		// Stream is the name of the stream format
+		Stream string
+
+		// BaseGUID identifies the receiver's base blob, a native stream can only be received on top of the blob it
+		// was sent from. It is empty if the base is an empty blob.
+		BaseGUID string
+
+		// ResumeToken continues an interrupted native stream, empty if there is none
+		ResumeToken string
 	}
 
 	// ReqSyncBlob ..
@@ -281,6 +321,20 @@ const (
 	HTTPReqDownloadBlob = "download"
 	// HTTPFieldToken token field use as a parameter in blob upload/download requests
 	HTTPFieldToken = "token"
+	// HTTPReqUploadCheckpoint get the checkpoint of an interrupted upload with token
+	HTTPReqUploadCheckpoint = "upload/checkpoint"
+	// HTTPFieldOffset offset field use as a parameter in blob download requests to resume from
+	HTTPFieldOffset = "offset"
+	// HTTPFieldCompression compression field use as a parameter in blob download requests to select the compression
+	HTTPFieldCompression = "compression"
+	// HTTPFieldHash hash field use as a parameter in blob download requests to select the hash of record checksums
+	HTTPFieldHash = "hash"
+	// HTTPFieldStream stream field use as a parameter in blob download requests to ask for a native stream
+	HTTPFieldStream = "stream"
+	// HTTPFieldBaseGUID base guid field use as a parameter in blob download requests with a native stream
+	HTTPFieldBaseGUID = "guid"
+	// HTTPFieldResumeToken resume token field use as a parameter in blob download requests with a native stream
+	HTTPFieldResumeToken = "resume"
 
 	// Requests from data plane to data server
 
@@ -288,8 +342,11 @@ const (
 	HTTPPathUploadToken = "upload/token"
 	// HTTPPathDownloadToken get download token
 	HTTPPathDownloadToken = "download/token"
+	// HTTPHeaderSignature header of requests between data plane and data server signed with their shared secret
+	HTTPHeaderSignature = "X-Fli-Signature"
 
-	// Requests from data server to data plane(upload/download status)
+	// Requests from data server to data plane(upload/download status), a GET with the token field returns the
+	// last status reported
 
 	// HTTPPathUploadStatus upload status
 	HTTPPathUploadStatus = "upload/status"
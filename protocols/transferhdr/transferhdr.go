@@ -17,8 +17,12 @@
 package transferhdr
 
 import (
+	"fmt"
+
+	"github.com/ClusterHQ/fli/dl/compress"
 	"github.com/ClusterHQ/fli/dl/encdec"
 	dlhash "github.com/ClusterHQ/fli/dl/hash"
+	"github.com/ClusterHQ/fli/meta/blob"
 )
 
 type (
@@ -34,10 +38,57 @@ type (
 
 		// EncDec is the type of hash
 		EncDec encdec.Type
+
+		// Offset is the sequence number of the first record in the stream, records before it were applied by the
+		// receiver in an interrupted transfer. Version 2 and above.
+		Offset uint64
+
+		// BaseBlobID and TargetBlobID are the sender's blobs the stream is the diff of, the receiver uses them to
+		// check that a resumed stream is the continuation of the interrupted one. Version 2 and above.
+		BaseBlobID   blob.ID
+		TargetBlobID blob.ID
+
+		// Compression is the type of compression of the encoded records. Version 3 and above.
+		Compression compress.Type
+
+		// KeyID is the ID of the key records are encrypted with if EncDec is encdec.AESGCM. Version 4 and above.
+		KeyID string
+
+		// Stream is the format of the transfer after the header. Version 5 and above.
+		Stream Stream
+
+		// ResumeToken is the token a native stream continues an interrupted one from, empty if it starts from the
+		// beginning. Version 5 and above.
+		ResumeToken string
 	}
+
+	// Stream is the format of a transfer
+	Stream int
 )
 
 const (
 	// CurVer is the currently supported software version
-	CurVer int = 1
+	CurVer int = 5
+
+	// MinVer is the oldest version a receiver accepts, version 1 streams can't be resumed
+	MinVer int = 1
 )
+
+const (
+	// StreamRecords is a stream of encoded records, every storage can receive it
+	StreamRecords Stream = iota
+
+	// StreamZFS is a ZFS send stream, only ZFS storages can receive it
+	StreamZFS
+)
+
+func (s Stream) String() string {
+	switch s {
+	case StreamRecords:
+		return "records"
+	case StreamZFS:
+		return "zfs"
+	default:
+		return fmt.Sprintf("stream(%d)", int(s))
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+
+	"github.com/ClusterHQ/fli/dl/blobdiffer"
+	"github.com/ClusterHQ/fli/dl/btrfs"
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dl/filediffer/variableblk"
+	"github.com/ClusterHQ/fli/dl/fs"
+	"github.com/ClusterHQ/fli/dl/linkfs"
+	"github.com/ClusterHQ/fli/dl/zfs"
+	"github.com/ClusterHQ/fli/securefilepath"
+	"github.com/ClusterHQ/fli/vh/dataserver"
+)
+
+var (
+	// flags of fli-dataserver
+	addr      = flag.String("addr", ":8081", "address to listen on")
+	hubURL    = flag.String("hub", "", "URL of the hub this data server registers with")
+	zpool     = flag.String("zpool", "", "zpool used to store blobs")
+	btrfsPath = flag.String("btrfs", "", "directory on a btrfs file system used to store blobs when no zpool is given")
+	linkPath  = flag.String("linkfs", "", "directory used to store blobs as reflinked or hard linked trees when no zpool "+
+		"is given")
+	storePath = flag.String("store", "", "directory used to store blobs when no zpool is given")
+	cpPath    = flag.String("checkpoints", "", "directory used to keep interrupted uploads across restarts, "+
+		"they are kept in memory if not given")
+	publicURL = flag.String("public-url", "", "URL clients and the hub use to reach this data server "+
+		"(default http://localhost<addr>/)")
+	digests = flag.Bool("digests", false, "send a digest of each file with downloads, clients verify the files "+
+		"with it (not with -store)")
+	secretPath = flag.String("secret", "", "file holding the secret shared with the hub, requests between them are "+
+		"signed with it")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func getStorage() (datalayer.Storage, error) {
+	bdf := blobdiffer.Factory{FileDiffer: variableblk.Factory{}, Digests: *digests}
+	if *zpool != "" {
+		return zfs.New(*zpool, bdf)
+	}
+
+	if *btrfsPath != "" {
+		return btrfs.New(*btrfsPath, bdf)
+	}
+
+	if *linkPath != "" {
+		path, err := securefilepath.New(*linkPath)
+		if err != nil {
+			return nil, err
+		}
+		return linkfs.New(path, bdf)
+	}
+
+	path, err := securefilepath.New(*storePath)
+	if err != nil {
+		return nil, err
+	}
+	return fs.New(path)
+}
+
+func getSecret() ([]byte, error) {
+	if *secretPath == "" {
+		return nil, nil
+	}
+
+	secret, err := ioutil.ReadFile(*secretPath)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(secret), nil
+}
+
+func getCheckpointStore() (datalayer.CheckpointStore, error) {
+	if *cpPath == "" {
+		return nil, nil
+	}
+
+	path, err := securefilepath.New(*cpPath)
+	if err != nil {
+		return nil, err
+	}
+	return datalayer.NewFileCheckpointStore(path)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	// validate flags
+	if len(*hubURL) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if len(*secretPath) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if len(*zpool) == 0 && len(*btrfsPath) == 0 && len(*linkPath) == 0 && len(*storePath) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if len(*publicURL) == 0 {
+		host, port, err := net.SplitHostPort(*addr)
+		if err != nil {
+			log.Fatalf("Invalid address %s: %v", *addr, err)
+		}
+		if host == "" || host == "0.0.0.0" {
+			host = "localhost"
+		}
+		*publicURL = "http://" + net.JoinHostPort(host, port) + "/"
+	}
+
+	s, err := getStorage()
+	if err != nil {
+		log.Fatalf("Failed to open storage: %v", err)
+	}
+
+	secret, err := getSecret()
+	if err != nil {
+		log.Fatalf("Failed to read secret: %v", err)
+	}
+	if len(secret) == 0 {
+		log.Fatalf("Secret %s is empty", *secretPath)
+	}
+
+	reporter, err := dataserver.NewHubReporter(*hubURL, secret)
+	if err != nil {
+		log.Fatalf("Invalid hub URL %s: %v", *hubURL, err)
+	}
+
+	cps, err := getCheckpointStore()
+	if err != nil {
+		log.Fatalf("Failed to open checkpoint store: %v", err)
+	}
+
+	ds, err := dataserver.New(s, *publicURL, reporter, cps, secret)
+	if err != nil {
+		log.Fatalf("Failed to create data server: %v", err)
+	}
+
+	// Register before serving so the hub always asks the running instance for tokens
+	err = dataserver.Register(*hubURL, *publicURL, secret)
+	if err != nil {
+		log.Fatalf("Failed to register with hub %s: %v", *hubURL, err)
+	}
+
+	log.Fatal(ds.ListenAndServe(*addr))
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+
+	"github.com/ClusterHQ/fli/dl/blobdiffer"
+	"github.com/ClusterHQ/fli/dl/btrfs"
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dl/filediffer/variableblk"
+	"github.com/ClusterHQ/fli/dl/fs"
+	"github.com/ClusterHQ/fli/dl/linkfs"
+	"github.com/ClusterHQ/fli/dl/zfs"
+	"github.com/ClusterHQ/fli/securefilepath"
+	"github.com/ClusterHQ/fli/vh/hub"
+)
+
+var (
+	// flags of fli-hub
+	addr      = flag.String("addr", ":8080", "address to listen on")
+	mdsPath   = flag.String("mds", "", "path of the sqlite3 meta data store, created if it doesn't exist")
+	zpool     = flag.String("zpool", "", "zpool used to store blobs")
+	btrfsPath = flag.String("btrfs", "", "directory on a btrfs file system used to store blobs when no zpool is given")
+	linkPath  = flag.String("linkfs", "", "directory used to store blobs as reflinked or hard linked trees when no zpool "+
+		"is given")
+	storePath = flag.String("store", "", "directory used to store blobs when no zpool is given, blobs are only kept "+
+		"on registered data servers if neither is given")
+	cpPath = flag.String("checkpoints", "", "directory used to keep interrupted uploads across restarts, "+
+		"they are kept in memory if not given")
+	publicURL = flag.String("public-url", "", "URL clients use to reach this hub (default http://localhost<addr>/)")
+	digests   = flag.Bool("digests", false, "send a digest of each file with downloads, clients verify the files "+
+		"with it (not with -store)")
+	secretPath = flag.String("secret", "", "file holding the secret shared with data servers, requests between them "+
+		"are signed with it; data servers can't register without it")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func getStorage() (datalayer.Storage, error) {
+	bdf := blobdiffer.Factory{FileDiffer: variableblk.Factory{}, Digests: *digests}
+	if *zpool != "" {
+		return zfs.New(*zpool, bdf)
+	}
+
+	if *btrfsPath != "" {
+		return btrfs.New(*btrfsPath, bdf)
+	}
+
+	if *linkPath != "" {
+		path, err := securefilepath.New(*linkPath)
+		if err != nil {
+			return nil, err
+		}
+		return linkfs.New(path, bdf)
+	}
+
+	if *storePath == "" {
+		return nil, nil
+	}
+
+	path, err := securefilepath.New(*storePath)
+	if err != nil {
+		return nil, err
+	}
+	return fs.New(path)
+}
+
+func getSecret() ([]byte, error) {
+	if *secretPath == "" {
+		return nil, nil
+	}
+
+	secret, err := ioutil.ReadFile(*secretPath)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(secret), nil
+}
+
+func getCheckpointStore() (datalayer.CheckpointStore, error) {
+	if *cpPath == "" {
+		return nil, nil
+	}
+
+	path, err := securefilepath.New(*cpPath)
+	if err != nil {
+		return nil, err
+	}
+	return datalayer.NewFileCheckpointStore(path)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	// validate flags
+	if len(*mdsPath) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if len(*publicURL) == 0 {
+		host, port, err := net.SplitHostPort(*addr)
+		if err != nil {
+			log.Fatalf("Invalid address %s: %v", *addr, err)
+		}
+		if host == "" || host == "0.0.0.0" {
+			host = "localhost"
+		}
+		*publicURL = "http://" + net.JoinHostPort(host, port) + "/"
+	}
+
+	mds, err := hub.OpenStore(*mdsPath)
+	if err != nil {
+		log.Fatalf("Failed to open meta data store %s: %v", *mdsPath, err)
+	}
+
+	s, err := getStorage()
+	if err != nil {
+		log.Fatalf("Failed to open storage: %v", err)
+	}
+
+	cps, err := getCheckpointStore()
+	if err != nil {
+		log.Fatalf("Failed to open checkpoint store: %v", err)
+	}
+
+	secret, err := getSecret()
+	if err != nil {
+		log.Fatalf("Failed to read secret: %v", err)
+	}
+
+	h, err := hub.New(mds, s, *publicURL, cps, secret)
+	if err != nil {
+		log.Fatalf("Failed to create hub: %v", err)
+	}
+
+	log.Fatal(h.ListenAndServe(*addr))
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dataserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ClusterHQ/fli/dl/token"
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/protocols"
+	"github.com/ClusterHQ/fli/rest"
+)
+
+type (
+	// Client talks to a remote data server over HTTP.
+	Client struct {
+		url    *url.URL
+		secret []byte
+	}
+
+	// hubReporter reports upload/download status to a hub over HTTP.
+	hubReporter struct {
+		url    *url.URL
+		secret []byte
+	}
+)
+
+var (
+	_ Service        = &Client{}
+	_ StatusReporter = &hubReporter{}
+)
+
+// NewClient returns a client of the data server at the given URL, requests are signed with the secret shared with the
+// data server.
+func NewClient(dsURL string, secret []byte) (*Client, error) {
+	u, err := parseBase(dsURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{url: u, secret: secret}, nil
+}
+
+// NewHubReporter returns a status reporter which sends upload/download status to the hub at the given URL, requests
+// are signed with the secret shared with the hub.
+func NewHubReporter(hubURL string, secret []byte) (StatusReporter, error) {
+	u, err := parseBase(hubURL)
+	if err != nil {
+		return nil, err
+	}
+	return &hubReporter{url: u, secret: secret}, nil
+}
+
+// Register adds the data server's public URL to the hub, new bushes are placed on the last registered data server.
+// The request is signed with the secret shared with the hub.
+func Register(hubURL string, publicURL string, secret []byte) error {
+	u, err := parseBase(hubURL)
+	if err != nil {
+		return err
+	}
+
+	status, err := do("PUT", u, protocols.HTTPPathNewDataServer, protocols.ReqURL{URL: publicURL}, nil, secret)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusCreated && status != http.StatusOK {
+		return errors.Errorf("Failed to register data server with %s, status %d", hubURL, status)
+	}
+	return nil
+}
+
+// UploadToken implements Service interface
+func (c *Client) UploadToken(req protocols.ReqUploadToken) (protocols.RespToken, error) {
+	var resp protocols.RespToken
+	_, err := do("POST", c.url, protocols.HTTPPathUploadToken, req, &resp, c.secret)
+	return resp, err
+}
+
+// DownloadToken implements Service interface
+func (c *Client) DownloadToken(req protocols.ReqDownloadToken) (protocols.RespToken, error) {
+	var resp protocols.RespToken
+	_, err := do("POST", c.url, protocols.HTTPPathDownloadToken, req, &resp, c.secret)
+	return resp, err
+}
+
+// Stats implements Service interface
+func (c *Client) Stats(req protocols.ReqDataServerStats) (protocols.RespDataServerStats, error) {
+	var resp protocols.RespDataServerStats
+	_, err := do("POST", c.url, protocols.HTTPPathStats, req, &resp, c.secret)
+	return resp, err
+}
+
+// UploadStatus implements StatusReporter interface
+func (h *hubReporter) UploadStatus(req protocols.ReqUploadTokenStatus) error {
+	_, err := do("POST", h.url, protocols.HTTPPathUploadStatus, req, nil, h.secret)
+	return err
+}
+
+// DownloadStatus implements StatusReporter interface
+func (h *hubReporter) DownloadStatus(req protocols.ReqDownloadTokenStatus) error {
+	_, err := do("POST", h.url, protocols.HTTPPathDownloadStatus, req, nil, h.secret)
+	return err
+}
+
+// parseBase parses a base URL, a trailing '/' is added so paths are resolved under it.
+func parseBase(s string) (*url.URL, error) {
+	if len(s) == 0 || s[len(s)-1] != '/' {
+		s += "/"
+	}
+	return url.Parse(s)
+}
+
+// do sends the JSON encoded payload to the path under the base URL and decodes the result of a successful response
+// into result if it is not nil. Status codes other than 2xx are returned as errors. The request is signed if a secret is
+// given.
+func do(method string, base *url.URL, path string, payload interface{}, result interface{}, secret []byte) (int,
+	error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	u, err := base.Parse(path)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(secret) != 0 {
+		req.Header.Set(protocols.HTTPHeaderSignature, token.SignRequest(secret, method, path, body, time.Now()))
+	}
+
+	httpResp, err := protocols.GetClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer httpResp.Body.Close()
+
+	var resp rest.Response
+	err = json.NewDecoder(httpResp.Body).Decode(&resp)
+	if err != nil {
+		return httpResp.StatusCode, errors.Errorf("%s %s failed, status %d: %v", method, u, httpResp.StatusCode, err)
+	}
+
+	if httpResp.StatusCode < 200 || httpResp.StatusCode > 299 {
+		return httpResp.StatusCode, errors.Errorf("%s %s failed, status %d: %s", method, u, httpResp.StatusCode,
+			resp.ErrorMessage)
+	}
+
+	if result != nil {
+		err = resp.GetResult(result)
+		if err != nil {
+			return httpResp.StatusCode, err
+		}
+	}
+
+	return httpResp.StatusCode, nil
+}
@@ -0,0 +1,749 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package dataserver is a data server, it stores blobs and serves blob uploads/downloads authorized by tokens.
+// Tokens are issued to a data plane(hub) which hands them out to clients, upload/download status is reported back
+// to the data plane.
+package dataserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ClusterHQ/fli/dl/compress"
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dl/encdec"
+	dlbin "github.com/ClusterHQ/fli/dl/encdec/binary"
+	"github.com/ClusterHQ/fli/dl/executor"
+	dlhash "github.com/ClusterHQ/fli/dl/hash"
+	"github.com/ClusterHQ/fli/dl/progress"
+	"github.com/ClusterHQ/fli/dl/token"
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/volume"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+	"github.com/ClusterHQ/fli/protocols"
+	"github.com/ClusterHQ/fli/protocols/transferhdr"
+	"github.com/ClusterHQ/fli/rest"
+	"github.com/ClusterHQ/fli/securefilepath"
+)
+
+type (
+	// Service is the interface a data plane uses to talk to a data server, either in process or over HTTP.
+	Service interface {
+		// UploadToken returns a token which authorizes a single blob upload
+		UploadToken(protocols.ReqUploadToken) (protocols.RespToken, error)
+
+		// DownloadToken returns a token which authorizes a single blob download
+		DownloadToken(protocols.ReqDownloadToken) (protocols.RespToken, error)
+
+		// Stats returns disk space usage of the storage or of a volume set
+		Stats(protocols.ReqDataServerStats) (protocols.RespDataServerStats, error)
+	}
+
+	// StatusReporter receives upload/download status from a data server, it is implemented by the data plane.
+	StatusReporter interface {
+		UploadStatus(protocols.ReqUploadTokenStatus) error
+		DownloadStatus(protocols.ReqDownloadTokenStatus) error
+	}
+
+	// Server is a data server backed by a data layer storage.
+	Server struct {
+		storage   datalayer.Storage
+		secret    []byte
+		publicURL string
+		reporter  StatusReporter
+
+		// auth is the secret shared with the data plane, it signs token and stats requests
+		auth []byte
+
+		// expiration is how long a token stays valid, in seconds
+		expiration time.Duration
+
+		// checkpoints keeps interrupted uploads, inFlight are the uploads being received
+		checkpoints datalayer.CheckpointStore
+		inFlight    map[string]bool
+		lock        *sync.Mutex
+	}
+
+	// errRejected is returned when the records of an upload can't be decoded, applied or verified, sending them
+	// again fails the same way
+	errRejected struct {
+		err error
+	}
+)
+
+const (
+	// DefaultTokenExpiration is how long an upload/download token stays valid, in seconds
+	DefaultTokenExpiration = 3600
+
+	// StatusStarted is reported when a transfer starts
+	StatusStarted = "started"
+	// StatusCompleted is reported when a transfer is completed
+	StatusCompleted = "completed"
+	// StatusFailed is reported when a transfer failed
+	StatusFailed = "failed"
+	// StatusInterrupted is reported when a transfer stopped before it completed, it can be resumed with the
+	// same token
+	StatusInterrupted = "interrupted"
+	// StatusProgress is reported every ProgressInterval while a transfer runs, with the transfer's counters
+	StatusProgress = "progress"
+
+	// ProgressInterval is how often the counters of a running transfer are reported
+	ProgressInterval = 5 * time.Second
+
+	// tokenLabel is signed with the auth secret to derive the token key, so the key differs from the auth secret
+	tokenLabel = "fli data server tokens"
+)
+
+var (
+	_ Service = &Server{}
+
+	errMethodNotAllowed = errors.New("Method not allowed")
+	errBlobNotFound     = errors.New("Blob not found")
+	errInFlight         = errors.New("Upload is in progress")
+)
+
+// New creates a data server. Tokens are signed by a key derived from the auth secret, they survive a restart of the
+// data server, or by a random key which doesn't survive it if the auth secret is empty. Clients reach the data server through the public URL given. Interrupted uploads are kept in the checkpoint store,
+// they are kept in memory if it is nil. Token and stats requests are only served if they are signed with the auth
+// secret shared with the data plane, none are served if it is empty.
+func New(s datalayer.Storage, publicURL string, reporter StatusReporter,
+	checkpoints datalayer.CheckpointStore, auth []byte) (*Server, error) {
+	secret, err := tokenSecret(auth)
+	if err != nil {
+		return nil, err
+	}
+
+	if checkpoints == nil {
+		checkpoints = datalayer.NewMemCheckpointStore()
+	}
+
+	return &Server{
+		storage:     s,
+		secret:      secret,
+		publicURL:   publicURL,
+		reporter:    reporter,
+		auth:        auth,
+		expiration:  DefaultTokenExpiration,
+		checkpoints: checkpoints,
+		inFlight:    make(map[string]bool),
+		lock:        &sync.Mutex{},
+	}, nil
+}
+
+// tokenSecret returns the key tokens are signed with. It is derived from the auth secret so tokens, and the interrupted
+// uploads checkpointed with them, are still valid after a restart; it is random if the auth secret is empty.
+func tokenSecret(auth []byte) ([]byte, error) {
+	if len(auth) == 0 {
+		secret := make([]byte, 32)
+		_, err := rand.Read(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		return secret, nil
+	}
+
+	mac := hmac.New(sha256.New, auth)
+	mac.Write([]byte(tokenLabel))
+	return mac.Sum(nil), nil
+}
+
+// UploadToken implements Service interface
+func (s *Server) UploadToken(req protocols.ReqUploadToken) (protocols.RespToken, error) {
+	k, err := token.SignUpload(s.secret,
+		token.NewUploadToken(req.VolumeSetID, req.SnapshotID, req.BaseBlobID, s.expiration))
+	if err != nil {
+		return protocols.RespToken{}, err
+	}
+
+	return protocols.RespToken{Token: k.String(), DataServerPublicURL: s.publicURL}, nil
+}
+
+// DownloadToken implements Service interface. A nil base blob means the diff is based on the volume set's empty blob.
+func (s *Server) DownloadToken(req protocols.ReqDownloadToken) (protocols.RespToken, error) {
+	base := req.BaseBlobID
+	if base.IsNilID() {
+		var err error
+		base, err = s.storage.EmptyBlobID(req.VolumeSetID)
+		if err != nil {
+			return protocols.RespToken{}, err
+		}
+	}
+
+	// Sealed blobs are sent as they were uploaded, the diff from the empty blob
+	sealed, err := s.isSealed(req.TargetBlobID)
+	if err != nil {
+		return protocols.RespToken{}, err
+	}
+	if sealed {
+		base, err = s.storage.EmptyBlobID(req.VolumeSetID)
+		if err != nil {
+			return protocols.RespToken{}, err
+		}
+	}
+
+	k, err := token.SignDownload(s.secret, token.NewDownloadToken(base, req.TargetBlobID, s.expiration))
+	if err != nil {
+		return protocols.RespToken{}, err
+	}
+
+	return protocols.RespToken{Token: k.String(), DataServerPublicURL: s.publicURL, Full: sealed}, nil
+}
+
+// Stats implements Service interface
+func (s *Server) Stats(req protocols.ReqDataServerStats) (protocols.RespDataServerStats, error) {
+	var (
+		space datalayer.DiskSpace
+		err   error
+	)
+	if req.VolumeSetID.IsNilID() {
+		space, err = s.storage.GetTotalSpace()
+	} else {
+		space, err = s.storage.GetVolumesetSpace(req.VolumeSetID)
+	}
+	if err != nil {
+		return protocols.RespDataServerStats{}, err
+	}
+
+	return protocols.RespDataServerStats{
+		DiskSize: space.Used + space.Available,
+		Used:     space.Used,
+	}, nil
+}
+
+// Handler returns the HTTP handler of the blob and token end points. End points are served both with and without the
+// API version prefix. Token and stats end points only serve requests signed by the data plane.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+protocols.HTTPReqUploadBlob, method("PUT", s.upload))
+	mux.HandleFunc("/"+protocols.HTTPReqDownloadBlob, method("GET", s.download))
+	mux.HandleFunc("/"+protocols.HTTPReqUploadCheckpoint, method("GET", s.uploadCheckpoint))
+	mux.HandleFunc("/"+protocols.HTTPPathUploadToken,
+		method("POST", Signed(s.auth, protocols.HTTPPathUploadToken, s.uploadToken)))
+	mux.HandleFunc("/"+protocols.HTTPPathDownloadToken,
+		method("POST", Signed(s.auth, protocols.HTTPPathDownloadToken, s.downloadToken)))
+	mux.HandleFunc("/"+protocols.HTTPPathStats, method("POST", Signed(s.auth, protocols.HTTPPathStats, s.stats)))
+
+	root := http.NewServeMux()
+	prefix := "/" + protocols.HTTPPathVersion
+	root.Handle(prefix+"/", http.StripPrefix(prefix, mux))
+	root.Handle("/", mux)
+	return root
+}
+
+// ListenAndServe serves the data server on the given address.
+func (s *Server) ListenAndServe(addr string) error {
+	log.Printf("Data server listening on %s, public URL %s", addr, s.publicURL)
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+// method rejects requests not using the given HTTP method.
+func method(m string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != m {
+			writeError(w, r, http.StatusMethodNotAllowed, errMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Signed only passes requests to the end point path which are signed with the given secret to the handler, it is used
+// for requests between a data plane and a data server. Requests are rejected if the secret is empty.
+func Signed(secret []byte, path string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		err = token.VerifyRequest(secret, r.Header.Get(protocols.HTTPHeaderSignature), r.Method, path, body)
+		if err != nil {
+			tokenError(w, r, err)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h(w, r)
+	}
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	log.Printf("%s %s failed: %v", r.Method, r.URL.Path, err)
+	resp := rest.NewResponse(r)
+	resp.SetError(err.Error())
+	resp.Write(status, w)
+}
+
+func writeResult(w http.ResponseWriter, r *http.Request, result interface{}) {
+	resp := rest.NewResponse(r)
+	if result != nil {
+		err := resp.SetResult(result)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	resp.Write(http.StatusOK, w)
+}
+
+// decode reads the JSON request body into the given value, an empty body leaves the value untouched.
+func decode(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// tokenError converts a token verification error to a HTTP status
+func tokenError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err.(type) {
+	case *token.ErrInvalidToken, *token.ErrTokenExpired:
+		writeError(w, r, http.StatusForbidden, err)
+	default:
+		writeError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+// Error implements error interface
+func (e *errRejected) Error() string {
+	return e.err.Error()
+}
+
+func (s *Server) uploadToken(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqUploadToken
+	if err := decode(r, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	resp, err := s.UploadToken(req)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeResult(w, r, resp)
+}
+
+func (s *Server) downloadToken(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqDownloadToken
+	if err := decode(r, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	resp, err := s.DownloadToken(req)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeResult(w, r, resp)
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqDataServerStats
+	if err := decode(r, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	resp, err := s.Stats(req)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeResult(w, r, resp)
+}
+
+// uploadKey is the key of an upload's checkpoint. Uploads of the same snapshot on top of the same base resume each
+// other even with different tokens.
+func uploadKey(t *token.UploadToken) string {
+	return "upload/" + t.VolSetID.String() + "/" + t.SnapshotID.String() + "/" + t.BaseBlobID.String()
+}
+
+// uploadCheckpoint returns the number of records applied by an interrupted upload, or the native streams the storage
+// can receive if no records were applied.
+func (s *Server) uploadCheckpoint(w http.ResponseWriter, r *http.Request) {
+	t, err := token.VerifyUpload(s.secret, token.Key(r.URL.Query().Get(protocols.HTTPFieldToken)))
+	if err != nil {
+		tokenError(w, r, err)
+		return
+	}
+
+	cp, err := s.checkpoints.Get(uploadKey(t))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	var resp protocols.RespUploadCheckpoint
+	if cp != nil && cp.Applied > 0 {
+		resp.Offset = cp.Applied
+		writeResult(w, r, resp)
+		return
+	}
+
+	base, err := s.uploadBase(t)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp.Native, err = datalayer.OfferNative(s.storage, t.VolSetID, t.SnapshotID, base)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeResult(w, r, resp)
+}
+
+// uploadBase returns the blob an upload is applied on top of.
+func (s *Server) uploadBase(t *token.UploadToken) (blob.ID, error) {
+	if t.BaseBlobID.IsNilID() {
+		return s.storage.EmptyBlobID(t.VolSetID)
+	}
+	return t.BaseBlobID, nil
+}
+
+// upload receives a blob diff, applies it on top of the base blob in the token and takes a snapshot. The new blob
+// is reported to the data plane before the client is answered, so the client sees the blob once the upload returns.
+// An interrupted upload is kept and resumed by the next upload with the same token.
+func (s *Server) upload(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	key := r.URL.Query().Get(protocols.HTTPFieldToken)
+	t, err := token.VerifyUpload(s.secret, token.Key(key))
+	if err != nil {
+		tokenError(w, r, err)
+		return
+	}
+
+	// The same upload can't be applied twice at the same time
+	s.lock.Lock()
+	if s.inFlight[uploadKey(t)] {
+		s.lock.Unlock()
+		writeError(w, r, http.StatusConflict, errInFlight)
+		return
+	}
+	s.inFlight[uploadKey(t)] = true
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.inFlight, uploadKey(t))
+		s.lock.Unlock()
+	}()
+
+	s.uploadStatus(protocols.ReqUploadTokenStatus{Token: key, Status: StatusStarted})
+
+	tr := progress.Start(t.SnapshotID.String(), 0, s.progressReporter(func(st *progress.Stats) {
+		s.uploadStatus(protocols.ReqUploadTokenStatus{Token: key, Status: StatusProgress, Progress: st})
+	}))
+	blobid, size, err := s.receive(t, tr.Reader(r.Body), tr)
+	st := tr.Finish()
+	if err != nil {
+		status := StatusFailed
+		if _, ok := err.(*datalayer.ErrInterrupted); ok {
+			status = StatusInterrupted
+		}
+		s.uploadStatus(protocols.ReqUploadTokenStatus{Token: key, Status: status, Progress: &st})
+		code := http.StatusInternalServerError
+		if e, ok := err.(*errRejected); ok {
+			code = http.StatusUnprocessableEntity
+			err = e.err
+		}
+		writeError(w, r, code, err)
+		return
+	}
+
+	err = s.uploadStatus(protocols.ReqUploadTokenStatus{
+		Token:      key,
+		SnapshotID: t.SnapshotID,
+		BlobID:     blobid,
+		Size:       size,
+		Status:     StatusCompleted,
+		Progress:   &st,
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Printf("Received blob %v for volumeset %v snapshot %v", blobid, t.VolSetID, t.SnapshotID)
+	writeResult(w, r, nil)
+}
+
+// receive applies the records read from src to the upload's volume and returns the blob id and logical size of the
+// snapshot taken from it. If src ends early, the volume and the number of records applied are checkpointed.
+func (s *Server) receive(t *token.UploadToken, src io.Reader, tr *progress.Tracker) (blob.ID, uint64, error) {
+	hdr, src, err := datalayer.PeekTransferHdr(src)
+	if err != nil {
+		return blob.NilID(), 0, err
+	}
+
+	base, err := s.uploadBase(t)
+	if err != nil {
+		return blob.NilID(), 0, err
+	}
+
+	if hdr.Stream != transferhdr.StreamRecords {
+		return s.receiveNative(t, base, src)
+	}
+	if hdr.EncDec == encdec.AESGCM {
+		return s.receiveSealed(t, src)
+	}
+
+	key := uploadKey(t)
+	cp, err := datalayer.OpenCheckpoint(s.storage, s.checkpoints, key, t.VolSetID, base)
+	if err != nil {
+		return blob.NilID(), 0, err
+	}
+
+	mntPath, err := securefilepath.New(cp.MntPath)
+	if err != nil {
+		return blob.NilID(), 0, err
+	}
+
+	if cp.Applied > 0 {
+		log.Printf("Resuming upload of volumeset %v snapshot %v from record %d", t.VolSetID, t.SnapshotID,
+			cp.Applied)
+	}
+
+	err = datalayer.ReceiveDiffFrom(src, mntPath, executor.NewCommonExecutor(), cp.Progress, nil, tr)
+	if ei, ok := err.(*datalayer.ErrInterrupted); ok {
+		cp.Progress = ei.Progress
+		errCp := s.checkpoints.Put(key, cp)
+		if errCp != nil {
+			log.Printf("Failed to save checkpoint of volumeset %v snapshot %v upload: %v", t.VolSetID,
+				t.SnapshotID, errCp)
+		}
+		return blob.NilID(), 0, err
+	}
+
+	// Either completed or can't be resumed, the volume is not needed any more
+	defer s.destroyVolume(t.VolSetID, cp.VolumeID)
+	errCp := s.checkpoints.Delete(key)
+	if errCp != nil {
+		log.Printf("Failed to remove checkpoint of volumeset %v snapshot %v upload: %v", t.VolSetID, t.SnapshotID,
+			errCp)
+	}
+	if err != nil {
+		return blob.NilID(), 0, &errRejected{err: err}
+	}
+
+	blobid, err := s.storage.CreateSnapshot(t.VolSetID, t.SnapshotID, cp.VolumeID)
+	if err != nil {
+		return blob.NilID(), 0, err
+	}
+
+	space, err := s.storage.GetSnapshotSpace(blobid)
+	if err != nil {
+		return blob.NilID(), 0, err
+	}
+
+	return blobid, space.LogicalSize, nil
+}
+
+// receiveNative receives a native stream of the upload's snapshot on top of base.
+func (s *Server) receiveNative(t *token.UploadToken, base blob.ID, src io.Reader) (blob.ID, uint64, error) {
+	blobid, err := datalayer.ReceiveNative(s.storage, src, t.VolSetID, t.SnapshotID, base)
+	if err != nil {
+		return blob.NilID(), 0, err
+	}
+
+	space, err := s.storage.GetSnapshotSpace(blobid)
+	if err != nil {
+		return blob.NilID(), 0, err
+	}
+
+	return blobid, space.LogicalSize, nil
+}
+
+// destroyVolume removes the temporary volume used by an upload, errors are only logged.
+func (s *Server) destroyVolume(vsid volumeset.ID, vid volume.ID) {
+	err := s.storage.DestroyVolume(vsid, vid)
+	if err != nil {
+		log.Printf("Delete volume error %v after upload volume set %v volume %v.", err, vsid, vid)
+	}
+}
+
+// download sends the diff between the base and target blobs in the token, starting from the offset requested by a
+// client resuming an interrupted download, compressed and checksummed the way the client asked for.
+func (s *Server) download(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get(protocols.HTTPFieldToken)
+	t, err := token.VerifyDownload(s.secret, token.Key(key))
+	if err != nil {
+		tokenError(w, r, err)
+		return
+	}
+
+	var offset uint64
+	if v := r.URL.Query().Get(protocols.HTTPFieldOffset); v != "" {
+		offset, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	ct, err := compress.ParseType(r.URL.Query().Get(protocols.HTTPFieldCompression))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	cf, err := datalayer.CompressionFactory(ct)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	ht, err := dlhash.ParseType(r.URL.Query().Get(protocols.HTTPFieldHash))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	hf, err := datalayer.HashFactory(ht)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	for _, b := range []blob.ID{t.RemoteBaseBlobID, t.RemoteTargetBlobID} {
+		exists, err := s.storage.SnapshotExists(b)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if !exists {
+			writeError(w, r, http.StatusNotFound, errBlobNotFound)
+			return
+		}
+	}
+
+	sealed, err := s.isSealed(t.RemoteTargetBlobID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.downloadStatus(protocols.ReqDownloadTokenStatus{Token: key, Status: StatusStarted})
+
+	// Sealed blobs are sent as they were uploaded, they are not counted
+	tr := progress.Start(t.RemoteTargetBlobID.String(), 0, s.progressReporter(func(st *progress.Stats) {
+		s.downloadStatus(protocols.ReqDownloadTokenStatus{Token: key, Status: StatusProgress, Progress: st})
+	}))
+	if sealed {
+		err = s.sendSealed(w, t.RemoteTargetBlobID)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		tw := tr.Writer(w)
+		var native bool
+		native, err = datalayer.SendNative(s.storage, t.RemoteBaseBlobID, t.RemoteTargetBlobID, nativeOffer(r), tw)
+		if err == nil && !native {
+			err = datalayer.SendDiffFrom(s.storage, t.RemoteBaseBlobID, t.RemoteTargetBlobID,
+				compress.Wrap(dlbin.Factory{}, cf), hf, tw, offset, tr)
+		}
+		if err != nil {
+			// Header is already sent, the client finds out through a truncated stream(missing EOT)
+			log.Printf("Send blob %v failed: %v", t.RemoteTargetBlobID, err)
+		}
+	}
+
+	st := tr.Finish()
+	if err != nil {
+		s.downloadStatus(protocols.ReqDownloadTokenStatus{
+			Token:    key,
+			Status:   StatusFailed,
+			Progress: &st,
+			Error:    err.Error(),
+		})
+		return
+	}
+
+	s.downloadStatus(protocols.ReqDownloadTokenStatus{Token: key, Status: StatusCompleted, Progress: &st})
+}
+
+// nativeOffer returns the native streams a client downloading a blob can receive, nil if it didn't ask for one.
+func nativeOffer(r *http.Request) *protocols.NativeOffer {
+	q := r.URL.Query()
+	if q.Get(protocols.HTTPFieldStream) == "" {
+		return nil
+	}
+
+	return &protocols.NativeOffer{
+		Stream:      q.Get(protocols.HTTPFieldStream),
+		BaseGUID:    q.Get(protocols.HTTPFieldBaseGUID),
+		ResumeToken: q.Get(protocols.HTTPFieldResumeToken),
+	}
+}
+
+// progressReporter returns a reporter which passes the counters of a running transfer to report every
+// ProgressInterval. The final counters are left to the transfer's completed or failed status.
+func (s *Server) progressReporter(report func(*progress.Stats)) progress.Reporter {
+	if s.reporter == nil {
+		return nil
+	}
+
+	return progress.Throttle(progress.ReporterFunc(func(st progress.Stats) {
+		if !st.Done {
+			report(&st)
+		}
+	}), ProgressInterval)
+}
+
+// uploadStatus reports upload status to the data plane, errors are logged and returned.
+func (s *Server) uploadStatus(status protocols.ReqUploadTokenStatus) error {
+	if s.reporter == nil {
+		return nil
+	}
+
+	err := s.reporter.UploadStatus(status)
+	if err != nil {
+		log.Printf("Failed to report upload status %s: %v", status.Status, err)
+	}
+	return err
+}
+
+// downloadStatus reports download status to the data plane, errors are logged only.
+func (s *Server) downloadStatus(status protocols.ReqDownloadTokenStatus) {
+	if s.reporter == nil {
+		return
+	}
+
+	err := s.reporter.DownloadStatus(status)
+	if err != nil {
+		log.Printf("Failed to report download status %s: %v", status.Status, err)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dataserver
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dl/token"
+	"github.com/ClusterHQ/fli/meta/blob"
+)
+
+// Encrypted records can't be applied by a data server, it doesn't have the key. They are kept sealed instead, the
+// whole transfer is stored as a file in a blob of its own and sent back as it is. Clients always upload encrypted
+// records as the diff from the empty blob so a sealed blob can be downloaded without a base.
+
+const (
+	// sealedFile is the file of a sealed blob which holds the transfer
+	sealedFile = ".fli-sealed"
+)
+
+// isSealed returns true if the blob holds encrypted records.
+func (s *Server) isSealed(b blob.ID) (bool, error) {
+	path, err := s.storage.MountBlob(b)
+	if err != nil {
+		return false, err
+	}
+	defer s.storage.Unmount(b.String())
+
+	_, err = os.Stat(filepath.Join(path, sealedFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// receiveSealed stores a transfer of encrypted records in a new blob and returns the blob id and logical size of the
+// snapshot taken from it. An interrupted transfer is not kept, it can't be resumed without reading the records.
+func (s *Server) receiveSealed(t *token.UploadToken, src io.Reader) (blob.ID, uint64, error) {
+	empty, err := s.storage.EmptyBlobID(t.VolSetID)
+	if err != nil {
+		return blob.NilID(), 0, err
+	}
+
+	vid, mntPath, err := s.storage.CreateVolume(t.VolSetID, empty, datalayer.NoAutoMount)
+	if err != nil {
+		return blob.NilID(), 0, err
+	}
+	defer s.destroyVolume(t.VolSetID, vid)
+
+	f, err := os.OpenFile(filepath.Join(mntPath.Path(), sealedFile), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return blob.NilID(), 0, err
+	}
+
+	_, err = io.Copy(f, src)
+	if err != nil {
+		f.Close()
+		return blob.NilID(), 0, err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return blob.NilID(), 0, err
+	}
+
+	blobid, err := s.storage.CreateSnapshot(t.VolSetID, t.SnapshotID, vid)
+	if err != nil {
+		return blob.NilID(), 0, err
+	}
+
+	space, err := s.storage.GetSnapshotSpace(blobid)
+	if err != nil {
+		return blob.NilID(), 0, err
+	}
+
+	return blobid, space.LogicalSize, nil
+}
+
+// sendSealed sends the transfer kept in a sealed blob. The whole transfer is sent even if the client resumes an
+// interrupted download, the client skips the records it has applied.
+func (s *Server) sendSealed(w http.ResponseWriter, b blob.ID) error {
+	path, err := s.storage.MountBlob(b)
+	if err != nil {
+		return err
+	}
+	defer s.storage.Unmount(b.String())
+
+	f, err := os.Open(filepath.Join(path, sealedFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	_, err = io.Copy(w, f)
+	if err != nil {
+		log.Printf("Send sealed blob %v failed: %v", b, err)
+	}
+	return err
+}
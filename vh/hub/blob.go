@@ -0,0 +1,461 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hub
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ClusterHQ/fli/dl/progress"
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/meta/branch"
+	"github.com/ClusterHQ/fli/meta/bush"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+	"github.com/ClusterHQ/fli/protocols"
+	"github.com/ClusterHQ/fli/rest"
+	"github.com/ClusterHQ/fli/vh/dataserver"
+)
+
+type (
+	// pendingTransfer is an upload or download token handed out to a client which is not completed yet, it is
+	// dropped at expires unless the data server reports the transfer's status
+	pendingTransfer struct {
+		vsid    volumeset.ID
+		snapid  snapshot.ID
+		dsid    int
+		expires time.Time
+	}
+
+	// transferStatus is the last status a data server reported for a token, updated is when it was reported
+	transferStatus struct {
+		resp    protocols.RespTransferStatus
+		updated time.Time
+	}
+)
+
+const (
+	// localDataServer is the data server ID of the hub's own storage
+	localDataServer = 0
+
+	// statusRetention is how long the status of a transfer which is not running is kept
+	statusRetention = time.Hour
+
+	// pendingExpiration is how long a transfer token is kept without a status report, as long as the token is valid
+	pendingExpiration = dataserver.DefaultTokenExpiration * time.Second
+)
+
+// service returns the data server with the given ID.
+func (s *Server) service(dsid int) (dataserver.Service, error) {
+	if dsid == localDataServer {
+		if s.local == nil {
+			return nil, errors.New("Hub has no local storage and no data server is registered")
+		}
+		return s.local, nil
+	}
+
+	url, err := s.dsmgr.GetURL(dsid)
+	if err != nil {
+		return nil, err
+	}
+	return dataserver.NewClient(url, s.secret)
+}
+
+// nextDataServer returns the data server ID new bushes are placed on, the last registered data server is used or
+// the hub's own storage if there is none.
+// Note: Caller holds the mds lock.
+func (s *Server) nextDataServer() (int, error) {
+	srvs, err := s.dsmgr.GetAllServers()
+	if err != nil {
+		return 0, err
+	}
+	if len(srvs) == 0 {
+		return localDataServer, nil
+	}
+	return s.dsmgr.GetNextAvailable()
+}
+
+// placement returns the data server ID which holds the blobs of the snapshot's bush. If create is true and the
+// bush doesn't exist yet, a new bush is placed on the next available data server.
+// Note: Caller holds the mds lock.
+func (s *Server) placement(snapid snapshot.ID, create bool) (int, error) {
+	root, err := metastore.GetSnapshot(s.mds, snapid)
+	if err != nil {
+		return 0, err
+	}
+	for root.ParentID != nil {
+		root, err = metastore.GetSnapshot(s.mds, *root.ParentID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	b, err := s.mds.GetBush(root.ID)
+	if err == nil {
+		return b.DataSrvID, nil
+	}
+
+	// Blobs stored before data servers were introduced have no bush, they are on the hub's own storage
+	if !create {
+		return localDataServer, nil
+	}
+
+	dsid, err := s.nextDataServer()
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.mds.ImportBush(&bush.Bush{VolSetID: root.VolSetID, Root: root.ID, DataSrvID: dsid})
+	if err != nil {
+		return 0, err
+	}
+
+	return dsid, nil
+}
+
+// volumeSetSize returns the space used by a volume set on all data servers which hold its bushes.
+// Note: Caller holds the mds lock.
+func (s *Server) volumeSetSize(vsid volumeset.ID) (uint64, error) {
+	branches, err := s.mds.GetBranches(branch.Query{VolSetID: vsid})
+	if err != nil {
+		return 0, err
+	}
+
+	dsids := make(map[int]bool)
+	for _, br := range branches {
+		// Branches whose blobs are not uploaded yet have no bush
+		b, err := s.mds.GetBush(br.Tip.ID)
+		if err == nil {
+			dsids[b.DataSrvID] = true
+		}
+	}
+
+	var size uint64
+	for dsid := range dsids {
+		ds, err := s.service(dsid)
+		if err != nil {
+			return 0, err
+		}
+
+		stats, err := ds.Stats(protocols.ReqDataServerStats{VolumeSetID: vsid})
+		if err != nil {
+			return 0, err
+		}
+		size += stats.Used
+	}
+
+	return size, nil
+}
+
+// offerBlob negotiates a blob upload, the client uploads the diff between the returned base and the target to the
+// data server the snapshot's bush is placed on. An empty token is returned if the hub already has the blob.
+func (s *Server) offerBlob(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqSyncBlob
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	base, baseBlobID, err := metastore.FindNonMissingSnapshot(s.mds, req.TargetID, req.BaseCandidateIDs)
+	if err != nil {
+		s.mdsLock.Unlock()
+		if _, ok := err.(*metastore.ErrAlreadyHaveBlob); ok {
+			writeJSON(w, r, protocols.RespSyncBlob{})
+			return
+		}
+		writeError(w, r, err)
+		return
+	}
+	dsid, err := s.placement(req.TargetID, true)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	ds, err := s.service(dsid)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	t, err := ds.UploadToken(protocols.ReqUploadToken{
+		VolumeSetID: req.VolSetID,
+		SnapshotID:  req.TargetID,
+		BaseBlobID:  baseBlobID,
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	s.pendingLock.Lock()
+	s.expirePending()
+	s.pending[t.Token] = pendingTransfer{
+		vsid:    req.VolSetID,
+		snapid:  req.TargetID,
+		dsid:    dsid,
+		expires: time.Now().Add(pendingExpiration),
+	}
+	s.pendingLock.Unlock()
+
+	resp := protocols.RespSyncBlob{
+		Token:               t.Token,
+		DataServerPublicURL: t.DataServerPublicURL,
+	}
+	if base != nil {
+		resp.BaseSnapshotID = *base
+	}
+
+	writeJSON(w, r, resp)
+}
+
+// requestBlob negotiates a blob download, the client downloads the diff between the returned base and the target
+// from the data server the snapshot's bush is placed on.
+func (s *Server) requestBlob(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqSyncBlob
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	base, baseBlobID, targetBlobID, err := metastore.RequestBlobDiff(s.mds, req.TargetID, req.BaseCandidateIDs)
+	if err != nil {
+		s.mdsLock.Unlock()
+		writeError(w, r, err)
+		return
+	}
+	dsid, err := s.placement(req.TargetID, false)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	ds, err := s.service(dsid)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// A nil base blob is resolved to the volume set's empty blob by the data server
+	t, err := ds.DownloadToken(protocols.ReqDownloadToken{
+		VolumeSetID:  req.VolSetID,
+		BaseBlobID:   baseBlobID,
+		TargetBlobID: targetBlobID,
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	s.pendingLock.Lock()
+	s.expirePending()
+	s.downloads[t.Token] = pendingTransfer{
+		vsid:    req.VolSetID,
+		snapid:  req.TargetID,
+		dsid:    dsid,
+		expires: time.Now().Add(pendingExpiration),
+	}
+	s.pendingLock.Unlock()
+
+	resp := protocols.RespSyncBlob{
+		Token:               t.Token,
+		DataServerPublicURL: t.DataServerPublicURL,
+	}
+	if base != nil && !t.Full {
+		resp.BaseSnapshotID = *base
+	}
+
+	writeJSON(w, r, resp)
+}
+
+// UploadStatus records the blob of a completed upload against its snapshot, it implements dataserver.StatusReporter.
+// The blob is only recorded if the data server reports it for the snapshot the token was handed out for.
+func (s *Server) UploadStatus(req protocols.ReqUploadTokenStatus) error {
+	// An interrupted upload is resumed with the same token, each report keeps the token for another expiration period
+	s.pendingLock.Lock()
+	s.expirePending()
+	p, ok := s.pending[req.Token]
+	if ok {
+		s.setTransferStatus(req.Token, req.Status, req.Progress)
+		if req.Status == dataserver.StatusCompleted || req.Status == dataserver.StatusFailed {
+			delete(s.pending, req.Token)
+		} else {
+			p.expires = time.Now().Add(pendingExpiration)
+			s.pending[req.Token] = p
+		}
+	}
+	s.pendingLock.Unlock()
+	if !ok {
+		return errors.New("Unknown upload token")
+	}
+
+	switch req.Status {
+	case dataserver.StatusStarted, dataserver.StatusProgress:
+		return nil
+	case dataserver.StatusInterrupted:
+		log.Printf("Upload of volumeset %v snapshot %v interrupted", p.vsid, p.snapid)
+		return nil
+	case dataserver.StatusFailed:
+		log.Printf("Upload of volumeset %v snapshot %v failed", p.vsid, p.snapid)
+		return nil
+	case dataserver.StatusCompleted:
+	default:
+		return errors.Errorf("Unknown upload status %s", req.Status)
+	}
+
+	if req.SnapshotID != p.snapid || req.BlobID.IsNilID() {
+		return errors.Errorf("Upload of volumeset %v snapshot %v completed with blob %v of snapshot %v", p.vsid,
+			p.snapid, req.BlobID, req.SnapshotID)
+	}
+
+	s.mdsLock.Lock()
+	defer s.mdsLock.Unlock()
+
+	err := s.mds.SetBlobIDAndSize(p.snapid, req.BlobID, req.Size)
+	if err != nil {
+		return err
+	}
+
+	size, err := s.volumeSetSize(p.vsid)
+	if err != nil {
+		return err
+	}
+
+	return s.mds.SetVolumeSetSize(p.vsid, size)
+}
+
+// DownloadStatus implements dataserver.StatusReporter, downloads don't change meta data so the status is only kept
+// for queries.
+func (s *Server) DownloadStatus(req protocols.ReqDownloadTokenStatus) error {
+	s.pendingLock.Lock()
+	s.expirePending()
+	p, ok := s.downloads[req.Token]
+	if ok {
+		if req.Status == dataserver.StatusCompleted || req.Status == dataserver.StatusFailed {
+			delete(s.downloads, req.Token)
+		} else {
+			p.expires = time.Now().Add(pendingExpiration)
+			s.downloads[req.Token] = p
+		}
+	}
+	s.setTransferStatus(req.Token, req.Status, req.Progress)
+	s.pendingLock.Unlock()
+
+	if req.Status == dataserver.StatusFailed {
+		if ok {
+			log.Printf("Download of volumeset %v snapshot %v failed: %s", p.vsid, p.snapid, req.Error)
+		} else {
+			log.Printf("Download with unknown token failed: %s", req.Error)
+		}
+	}
+	return nil
+}
+
+// expirePending drops transfer tokens which were not used before they expired.
+// Note: Caller holds the pending lock.
+func (s *Server) expirePending() {
+	now := time.Now()
+	for _, m := range []map[string]pendingTransfer{s.pending, s.downloads} {
+		for k, p := range m {
+			if now.After(p.expires) {
+				delete(m, k)
+			}
+		}
+	}
+}
+
+// setTransferStatus keeps the status reported for a token, the counters of an earlier report are kept if the status
+// has none. Statuses of transfers which stopped running more than statusRetention ago are dropped.
+// Note: Caller holds the pending lock.
+func (s *Server) setTransferStatus(token string, status string, p *progress.Stats) {
+	now := time.Now()
+	for k, ts := range s.transfers {
+		running := ts.resp.Status == dataserver.StatusStarted || ts.resp.Status == dataserver.StatusProgress
+		if !running && now.Sub(ts.updated) > statusRetention {
+			delete(s.transfers, k)
+		}
+	}
+
+	ts, ok := s.transfers[token]
+	if !ok {
+		ts = &transferStatus{}
+		s.transfers[token] = ts
+	}
+	ts.resp.Status = status
+	if p != nil {
+		ts.resp.Progress = p
+	}
+	ts.updated = now
+}
+
+// getTransferStatus returns the last status reported for an upload or download token.
+func (s *Server) getTransferStatus(w http.ResponseWriter, r *http.Request) {
+	s.pendingLock.Lock()
+	ts, ok := s.transfers[r.URL.Query().Get(protocols.HTTPFieldToken)]
+	var resp protocols.RespTransferStatus
+	if ok {
+		resp = ts.resp
+	}
+	s.pendingLock.Unlock()
+
+	if !ok {
+		rr := rest.NewResponse(r)
+		rr.SetError("Unknown token")
+		rr.Write(http.StatusNotFound, w)
+		return
+	}
+
+	writeResult(w, r, http.StatusOK, resp)
+}
+
+func (s *Server) uploadStatus(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqUploadTokenStatus
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	err := s.UploadStatus(req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusOK, nil)
+}
+
+func (s *Server) downloadStatus(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqDownloadTokenStatus
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	err := s.DownloadStatus(req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusOK, nil)
+}
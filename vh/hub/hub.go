@@ -0,0 +1,288 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package hub is a self hostable volume hub. It serves the protocols HTTP API on top of a sqlite3 meta data store
+// and a data layer storage, so push, pull and sync can be exercised without the hosted service.
+package hub
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dp/datasrvmgr"
+	"github.com/ClusterHQ/fli/dp/datasrvstore"
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/errors"
+	"github.com/ClusterHQ/fli/mdsimpls/sqlite3storage"
+	"github.com/ClusterHQ/fli/protocols"
+	"github.com/ClusterHQ/fli/rest"
+	"github.com/ClusterHQ/fli/securefilepath"
+	"github.com/ClusterHQ/fli/vh/dataserver"
+)
+
+type (
+	// Store is the meta data store used by the hub; it also persists the known data servers.
+	Store interface {
+		metastore.Server
+		datasrvstore.Store
+	}
+
+	// Server is a volume hub which serves meta data end points and hands out blob transfer tokens issued by data
+	// servers. If the hub has its own storage, it also acts as a data server.
+	Server struct {
+		mds     Store
+		storage datalayer.Storage
+		dsmgr   *datasrvmgr.Manager
+
+		// local is the data server embedded in the hub, nil if the hub has no storage
+		local *dataserver.Server
+
+		// publicURL is the URL clients use to reach the hub
+		publicURL string
+
+		// secret is shared with the registered data servers, requests between them are signed with it
+		secret []byte
+
+		// mdsLock serializes access to the meta data store(sqlite3 storage is opened in exclusive locking mode)
+		mdsLock *sync.Mutex
+
+		// pending and downloads keep upload and download tokens handed out to clients until the data server reports
+		// the transfer's result, transfers keeps the last status reported for each token. All are guarded by
+		// pendingLock.
+		pending     map[string]pendingTransfer
+		downloads   map[string]pendingTransfer
+		transfers   map[string]*transferStatus
+		pendingLock *sync.Mutex
+	}
+)
+
+var (
+	_ dataserver.StatusReporter = &Server{}
+)
+
+// OpenStore opens the sqlite3 meta data store at the given path, the store is created if it doesn't exist.
+func OpenStore(path string) (Store, error) {
+	p, err := securefilepath.New(path)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := p.Exists()
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		store, err := sqlite3storage.Create(p)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+
+	mds, err := sqlite3storage.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	store, ok := mds.(*sqlite3storage.Sqlite3Storage)
+	if !ok {
+		return nil, errors.Errorf("Unexpected meta data store type %T", mds)
+	}
+
+	return store, nil
+}
+
+// New creates a new hub server. If a storage is given, the hub stores blobs itself until a data server is registered
+// and clients upload/download blobs through the public URL given. The storage can be nil if blobs are kept on data
+// servers only. Interrupted uploads to the hub's storage are kept in the checkpoint store, or in memory if it is nil.
+// Data servers sign their requests with the secret given, they can't register or report transfers if it is empty.
+// Tokens for the hub's storage are signed by a key derived from the secret, they don't survive a restart if it is empty.
+func New(mds Store, s datalayer.Storage, publicURL string, checkpoints datalayer.CheckpointStore,
+	secret []byte) (*Server, error) {
+	srv := &Server{
+		mds:         mds,
+		storage:     s,
+		dsmgr:       datasrvmgr.New(mds),
+		publicURL:   publicURL,
+		secret:      secret,
+		mdsLock:     &sync.Mutex{},
+		pending:     make(map[string]pendingTransfer),
+		downloads:   make(map[string]pendingTransfer),
+		transfers:   make(map[string]*transferStatus),
+		pendingLock: &sync.Mutex{},
+	}
+
+	if s != nil {
+		// The embedded data server's token end points are not served, the hub calls it directly. Its tokens are
+		// signed by a key derived from the secret.
+		local, err := dataserver.New(s, publicURL, srv, checkpoints, secret)
+		if err != nil {
+			return nil, err
+		}
+		srv.local = local
+	}
+
+	return srv, nil
+}
+
+// Handler returns the HTTP handler of all end points. End points are served both with and without the API version
+// prefix.
+func (s *Server) Handler() http.Handler {
+	// Requests from data servers are signed with the shared secret
+	uploadStatus := dataserver.Signed(s.secret, protocols.HTTPPathUploadStatus, s.uploadStatus)
+	downloadStatus := dataserver.Signed(s.secret, protocols.HTTPPathDownloadStatus, s.downloadStatus)
+	addDataServer := dataserver.Signed(s.secret, protocols.HTTPPathNewDataServer, s.addDataServer)
+
+	routes := map[string]map[string]http.HandlerFunc{
+		protocols.HTTPPathVolumeSet: {
+			"PUT":    s.importVolumeSet,
+			"DELETE": s.deleteVolumeSet,
+		},
+		protocols.HTTPPathVolumeSets:       {"POST": s.getVolumeSets},
+		protocols.HTTPPathSnapshots:        {"POST": s.getSnapshots},
+		protocols.HTTPPathSnapshotIDs:      {"POST": s.getSnapshotIDs},
+		protocols.HTTPPathBranches:         {"POST": s.getBranches},
+		protocols.HTTPPathTip:              {"GET": s.getTip},
+		protocols.HTTPPathSnapshotByBranch: {"GET": s.getSnapshotsByBranch, "POST": s.getSnapshotsByBranch},
+		protocols.HTTPPathImportBranch:     {"PUT": s.importBranch},
+		protocols.HTTPPathForkBranch:       {"PUT": s.forkBranch},
+		protocols.HTTPPathExtendBranch:     {"PUT": s.extendBranch},
+		protocols.HTTPPathUpdateVolumeSet:  {"POST": s.updateVolumeSet},
+		protocols.HTTPPathPullVolumeSet:    {"GET": s.pullVolumeSet},
+		protocols.HTTPPathUpdateSnapshot:   {"POST": s.updateSnapshot},
+		protocols.HTTPPathUpdateSnapshots:  {"POST": s.updateSnapshots},
+		protocols.HTTPPathPullSnapshots:    {"GET": s.pullSnapshots},
+		protocols.HTTPPathOfferBlob:        {"GET": s.offerBlob},
+		protocols.HTTPPathRequestBlob:      {"GET": s.requestBlob},
+		protocols.HTTPPathUploadStatus:     {"GET": s.getTransferStatus, "POST": uploadStatus},
+		protocols.HTTPPathDownloadStatus:   {"GET": s.getTransferStatus, "POST": downloadStatus},
+		protocols.HTTPPathStats:            {"GET": s.stats, "POST": s.stats},
+		protocols.HTTPPathUsage:            {"GET": s.usage, "POST": s.usage},
+		protocols.HTTPPathNewDataServer:    {"PUT": addDataServer},
+		protocols.HTTPPathAnalytics:        {"POST": s.analytics},
+	}
+
+	mux := http.NewServeMux()
+	for path, methods := range routes {
+		mux.HandleFunc("/"+path, dispatch(methods))
+	}
+
+	// Blob transfers with tokens issued by the embedded data server
+	if s.local != nil {
+		ds := s.local.Handler()
+		mux.Handle("/"+protocols.HTTPReqUploadBlob, ds)
+		mux.Handle("/"+protocols.HTTPReqDownloadBlob, ds)
+		mux.Handle("/"+protocols.HTTPReqUploadCheckpoint, ds)
+	}
+
+	root := http.NewServeMux()
+	prefix := "/" + protocols.HTTPPathVersion
+	root.Handle(prefix+"/", http.StripPrefix(prefix, mux))
+	root.Handle("/", mux)
+	return root
+}
+
+// ListenAndServe serves the hub on the given address.
+func (s *Server) ListenAndServe(addr string) error {
+	log.Printf("Volume hub listening on %s, public URL %s", addr, s.publicURL)
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+// dispatch routes a request to the handler registered for the request's method.
+func dispatch(methods map[string]http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h, ok := methods[r.Method]
+		if !ok {
+			resp := rest.NewResponse(r)
+			resp.SetError("Method not allowed")
+			resp.Write(http.StatusMethodNotAllowed, w)
+			return
+		}
+
+		h(w, r)
+		log.Printf("[HTTP-Serve] %s %s %s %s", protocols.GetCorrelationID(r), r.Method, r.URL.Path,
+			time.Now().Sub(start).String())
+	}
+}
+
+// decode reads the JSON request body into the given value, an empty body leaves the value untouched.
+func decode(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// writeResult sends back a successful response with the given result.
+func writeResult(w http.ResponseWriter, r *http.Request, status int, result interface{}) {
+	resp := rest.NewResponse(r)
+	if result != nil {
+		err := resp.SetResult(result)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	err := resp.Write(status, w)
+	if err != nil {
+		log.Printf("Failed to write response for %s %s: %v", r.Method, r.URL.Path, err)
+	}
+}
+
+// writeJSON sends back the given value as is, without the rest.Response envelope.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Failed to write response for %s %s: %v", r.Method, r.URL.Path, err)
+	}
+}
+
+// writeError converts an error to a response, meta data store errors are mapped to the status code the client expects.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var status int
+	resp := rest.NewResponse(r)
+	switch err.(type) {
+	case *metastore.ErrVolumeSetNotFound, *metastore.ErrSnapshotNotFound, *metastore.ErrBranchNotFound:
+		status = http.StatusNotFound
+	case *metastore.ErrVolumeSetAlreadyExists, *metastore.ErrSnapshotImportMismatch:
+		status = http.StatusConflict
+	default:
+		status = http.StatusInternalServerError
+	}
+	resp.SetError(err.Error())
+
+	log.Printf("%s %s failed: %v", r.Method, r.URL.Path, err)
+	resp.Write(status, w)
+}
+
+// badRequest responds to a request that can't be decoded.
+func badRequest(w http.ResponseWriter, r *http.Request, err error) {
+	resp := rest.NewResponse(r)
+	resp.SetError(err.Error())
+	resp.Write(http.StatusBadRequest, w)
+}
@@ -0,0 +1,355 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hub_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"testing"
+
+	"github.com/ClusterHQ/fli/dl/compress"
+	"github.com/ClusterHQ/fli/dl/compress/zstd"
+	"github.com/ClusterHQ/fli/dl/datalayer"
+	"github.com/ClusterHQ/fli/dl/encdec"
+	"github.com/ClusterHQ/fli/dl/encdec/aesgcm"
+	dlbin "github.com/ClusterHQ/fli/dl/encdec/binary"
+	"github.com/ClusterHQ/fli/dl/executor"
+	"github.com/ClusterHQ/fli/dl/fs"
+	dlhash "github.com/ClusterHQ/fli/dl/hash"
+	"github.com/ClusterHQ/fli/dl/hash/adler32"
+	"github.com/ClusterHQ/fli/dl/progress"
+	"github.com/ClusterHQ/fli/dl/record"
+	"github.com/ClusterHQ/fli/dp/dataplane"
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/dp/metastore/testutil"
+	"github.com/ClusterHQ/fli/dp/sync"
+	"github.com/ClusterHQ/fli/mdsimpls/restfulstorage"
+	"github.com/ClusterHQ/fli/mdsimpls/sqlite3storage"
+	"github.com/ClusterHQ/fli/meta/attrs"
+	"github.com/ClusterHQ/fli/meta/blob"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/meta/volumeset"
+	"github.com/ClusterHQ/fli/protocols"
+	"github.com/ClusterHQ/fli/securefilepath"
+	"github.com/ClusterHQ/fli/vh/dataserver"
+	"github.com/ClusterHQ/fli/vh/hub"
+	"github.com/stretchr/testify/require"
+)
+
+// blobDiff moves blobs between a local storage and the hub
+type blobDiff struct {
+	s  datalayer.Storage
+	ed encdec.Factory
+	tr *progress.Tracker
+}
+
+func (b blobDiff) UploadBlobDiff(vsid volumeset.ID, ssid snapshot.ID, base blob.ID, target blob.ID, token string,
+	dspuburl string) error {
+	return datalayer.UploadBlobDiff(b.s, b.ed, adler32.Factory{}, vsid, base, target, token, dspuburl, b.tr)
+}
+
+func (b blobDiff) DownloadBlobDiff(vsid volumeset.ID, ssid snapshot.ID, base blob.ID, token string,
+	dspuburl string) (blob.ID, uint64, uint64, error) {
+	return datalayer.DownloadBlobDiff(b.s, b.ed, vsid, ssid, base, token, executor.NewCommonExecutor(),
+		adler32.Factory{}, dspuburl, nil, b.tr)
+}
+
+func (b blobDiff) EstimateBlobDiff(vsid volumeset.ID, base blob.ID, target blob.ID) (uint64, uint64, error) {
+	return datalayer.EstimateBlobDiff(b.s, b.ed, adler32.Factory{}, vsid, base, target)
+}
+
+// badDigest is a storage whose blob differ sends a wrong digest of a file before the end of the transfer
+type badDigest struct {
+	datalayer.Storage
+}
+
+type badDigestDiffer struct {
+	datalayer.BlobDifferFactory
+}
+
+func (s badDigest) BlobDiffer() datalayer.BlobDifferFactory {
+	return badDigestDiffer{s.Storage.BlobDiffer()}
+}
+
+func (f badDigestDiffer) New(path1, path2 string, hf dlhash.Factory, exErrCh chan<- error, cancel <-chan bool,
+	wg *gosync.WaitGroup) <-chan record.Record {
+	in := f.BlobDifferFactory.New(path1, path2, hf, exErrCh, cancel, wg)
+	out := make(chan record.Record)
+	go func() {
+		defer close(out)
+		for r := range in {
+			if r.Type() == record.TypeEOT {
+				record.Send(record.NewDigest("file", make([]byte, 32)), out, hf)
+			}
+			out <- r
+		}
+	}()
+	return out
+}
+
+func newNode(t *testing.T, dir string) (*sqlite3storage.Sqlite3Storage, datalayer.Storage) {
+	mdsPath, err := securefilepath.New(filepath.Join(dir, "mds"))
+	require.NoError(t, err)
+	err = os.MkdirAll(dir, 0700)
+	require.NoError(t, err)
+	mds, err := sqlite3storage.Create(mdsPath)
+	require.NoError(t, err)
+
+	p, err := securefilepath.New(filepath.Join(dir, "blobs"))
+	require.NoError(t, err)
+	s, err := fs.New(p)
+	require.NoError(t, err)
+
+	return mds, s
+}
+
+// newRemote returns a client of the hub served by srv
+func newRemote(t *testing.T, srv *httptest.Server) *restfulstorage.MetadataStorage {
+	hubURL, err := url.Parse(srv.URL + "/" + protocols.HTTPPathVersion + "/")
+	require.NoError(t, err)
+	remote, err := restfulstorage.Create(protocols.GetClient(), hubURL, nil)
+	require.NoError(t, err)
+	return remote
+}
+
+// pushPull pushes a snapshot from one client to the hub and pulls it to another client, records are encoded with ed.
+// Returns the snapshot's ID.
+func pushPull(t *testing.T, dir string, hubMds metastore.Store, remote *restfulstorage.MetadataStorage,
+	ed encdec.Factory) snapshot.ID {
+	// Create a snapshot with a file on the first client
+	mds1, s1 := newNode(t, filepath.Join(dir, "client1"))
+	vs, err := testutil.VolumeSetTest(mds1, "vs", "", attrs.Attrs{}, "")
+	require.NoError(t, err)
+	vol, err := dataplane.CreateEmptyVolume(mds1, s1, vs.ID, "vol")
+	require.NoError(t, err)
+	data := []byte("hello hub")
+	err = ioutil.WriteFile(filepath.Join(vol.MntPath.Path(), "file"), data, 0600)
+	require.NoError(t, err)
+	sn, err := dataplane.Snapshot(mds1, s1, vol.ID, "master", metastore.AutoSync, "snap", attrs.Attrs{}, "")
+	require.NoError(t, err)
+
+	// Push, estimating doesn't upload anything
+	err = sync.NewObjects(mds1, remote, vs.ID)
+	require.NoError(t, err)
+	estimates, err := sync.EstimatePushForAllSnapshots(mds1, vs.ID, blobDiff{s: s1, ed: ed}, remote)
+	require.NoError(t, err)
+	require.Len(t, estimates, 1)
+	require.Equal(t, sn.ID, estimates[0].Snapshot.ID)
+	require.True(t, estimates[0].Exact)
+	require.NotZero(t, estimates[0].Bytes)
+	require.NotZero(t, estimates[0].Records)
+	hubSnap, err := metastore.GetSnapshot(hubMds, sn.ID)
+	require.NoError(t, err)
+	require.True(t, hubSnap.BlobID.IsNilID())
+
+	tr := progress.Start("push", 0, nil)
+	err = sync.PushDataForAllSnapshots(mds1, vs.ID, blobDiff{s: s1, ed: ed, tr: tr}, remote)
+	require.NoError(t, err)
+	st := tr.Finish()
+	require.NotZero(t, st.Records)
+	require.NotZero(t, st.Bytes)
+	require.NotZero(t, st.Files)
+
+	hubSnap, err = metastore.GetSnapshot(hubMds, sn.ID)
+	require.NoError(t, err)
+	require.False(t, hubSnap.BlobID.IsNilID())
+
+	tip, err := remote.GetTip(vs.ID, "master")
+	require.NoError(t, err)
+	require.Equal(t, sn.ID, tip.ID)
+
+	// Pushing again is a no-op since the hub already has the blob
+	err = sync.PushDataForAllSnapshots(mds1, vs.ID, blobDiff{s: s1, ed: ed}, remote)
+	require.NoError(t, err)
+
+	// Pull to the second client
+	mds2, s2 := newNode(t, filepath.Join(dir, "client2"))
+	err = sync.NewObjects(remote, mds2, vs.ID)
+	require.NoError(t, err)
+	estimates, err = sync.EstimatePullForAllSnapshots(remote, mds2, vs.ID)
+	require.NoError(t, err)
+	require.Len(t, estimates, 1)
+	require.Equal(t, sn.ID, estimates[0].Snapshot.ID)
+	require.False(t, estimates[0].Exact)
+	tr = progress.Start("pull", 0, nil)
+	err = sync.PullDataForAllSnapshots(remote, mds2, vs.ID, blobDiff{s: s2, ed: ed, tr: tr})
+	require.NoError(t, err)
+	st = tr.Finish()
+	require.NotZero(t, st.Records)
+	require.NotZero(t, st.Bytes)
+
+	pulled, err := metastore.GetSnapshot(mds2, sn.ID)
+	require.NoError(t, err)
+	require.False(t, pulled.BlobID.IsNilID())
+
+	path, err := s2.MountBlob(pulled.BlobID)
+	require.NoError(t, err)
+	got, err := ioutil.ReadFile(filepath.Join(path, "file"))
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	return sn.ID
+}
+
+// TestPushPull pushes and pulls through a hub which stores blobs itself.
+func TestPushPull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hub")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	hubMds, hubStorage := newNode(t, filepath.Join(dir, "hub"))
+	srv := httptest.NewUnstartedServer(nil)
+	h, err := hub.New(hubMds, hubStorage, "http://"+srv.Listener.Addr().String()+"/", nil, nil)
+	require.NoError(t, err)
+	srv.Config.Handler = h.Handler()
+	srv.Start()
+	defer srv.Close()
+
+	pushPull(t, dir, hubMds, newRemote(t, srv), dlbin.Factory{})
+}
+
+// TestPushPullDataServer pushes and pulls through a hub without storage, blobs go to a registered data server.
+func TestPushPullDataServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hub")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	hubMds, _ := newNode(t, filepath.Join(dir, "hub"))
+	secret := []byte("secret")
+	h, err := hub.New(hubMds, nil, "", nil, secret)
+	require.NoError(t, err)
+	srv := httptest.NewServer(h.Handler())
+	defer srv.Close()
+
+	_, dsStorage := newNode(t, filepath.Join(dir, "dataserver"))
+	dsSrv := httptest.NewUnstartedServer(nil)
+	reporter, err := dataserver.NewHubReporter(srv.URL, secret)
+	require.NoError(t, err)
+	ds, err := dataserver.New(dsStorage, "http://"+dsSrv.Listener.Addr().String()+"/", reporter, nil, secret)
+	require.NoError(t, err)
+	dsSrv.Config.Handler = ds.Handler()
+	dsSrv.Start()
+	defer dsSrv.Close()
+
+	// Data servers can't register without the shared secret
+	err = dataserver.Register(srv.URL, "http://forged/", []byte("forged"))
+	require.Error(t, err)
+
+	err = dataserver.Register(srv.URL, dsSrv.URL, secret)
+	require.NoError(t, err)
+
+	snapid := pushPull(t, dir, hubMds, newRemote(t, srv), compress.Wrap(dlbin.Factory{}, zstd.Factory{}))
+
+	// Tokens issued before a restart are still valid if the data server restarts with the same secret
+	snap, err := metastore.GetSnapshot(hubMds, snapid)
+	require.NoError(t, err)
+	tok, err := ds.UploadToken(protocols.ReqUploadToken{VolumeSetID: snap.VolSetID, SnapshotID: snapid})
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		secret []byte
+		status int
+	}{
+		{secret, http.StatusOK},
+		{[]byte("other"), http.StatusForbidden},
+	} {
+		restarted, err := dataserver.New(dsStorage, dsSrv.URL, reporter, nil, tc.secret)
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/"+protocols.HTTPReqUploadCheckpoint+"?"+protocols.HTTPFieldToken+"="+
+			url.QueryEscape(tok.Token), nil)
+		restarted.Handler().ServeHTTP(rec, req)
+		require.Equal(t, tc.status, rec.Code, rec.Body.String())
+	}
+
+	// A forged token is rejected by the data server
+	resp, err := http.Get(dsSrv.URL + "/" + protocols.HTTPReqDownloadBlob + "?" + protocols.HTTPFieldToken + "=forged")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Tokens are only handed out to the hub
+	resp, err = http.Post(dsSrv.URL+"/"+protocols.HTTPPathUploadToken, "application/json", strings.NewReader("{}"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+// TestPushPullEncrypted pushes and pulls encrypted records, the hub keeps them without being able to read them.
+func TestPushPullEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hub")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	hubMds, hubStorage := newNode(t, filepath.Join(dir, "hub"))
+	srv := httptest.NewUnstartedServer(nil)
+	h, err := hub.New(hubMds, hubStorage, "http://"+srv.Listener.Addr().String()+"/", nil, nil)
+	require.NoError(t, err)
+	srv.Config.Handler = h.Handler()
+	srv.Start()
+	defer srv.Close()
+
+	key, err := aesgcm.NewKey()
+	require.NoError(t, err)
+	ed := aesgcm.Factory{Inner: dlbin.Factory{}, KeyID: "k1", Keys: aesgcm.Keyring{"k1": key}}
+	snapid := pushPull(t, dir, hubMds, newRemote(t, srv), ed)
+
+	hubSnap, err := metastore.GetSnapshot(hubMds, snapid)
+	require.NoError(t, err)
+	path, err := hubStorage.MountBlob(hubSnap.BlobID)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(path, "file"))
+	require.True(t, os.IsNotExist(err))
+}
+
+// TestPushRejected fails a push whose records don't match their digests with the receiver's error, it is not retried.
+func TestPushRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hub")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	hubMds, hubStorage := newNode(t, filepath.Join(dir, "hub"))
+	srv := httptest.NewUnstartedServer(nil)
+	h, err := hub.New(hubMds, hubStorage, "http://"+srv.Listener.Addr().String()+"/", nil, nil)
+	require.NoError(t, err)
+	srv.Config.Handler = h.Handler()
+	srv.Start()
+	defer srv.Close()
+	remote := newRemote(t, srv)
+
+	mds, s := newNode(t, filepath.Join(dir, "client"))
+	vs, err := testutil.VolumeSetTest(mds, "vs", "", attrs.Attrs{}, "")
+	require.NoError(t, err)
+	vol, err := dataplane.CreateEmptyVolume(mds, s, vs.ID, "vol")
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(vol.MntPath.Path(), "file"), []byte("hello hub"), 0600)
+	require.NoError(t, err)
+	_, err = dataplane.Snapshot(mds, s, vol.ID, "master", metastore.AutoSync, "snap", attrs.Attrs{}, "")
+	require.NoError(t, err)
+
+	err = sync.NewObjects(mds, remote, vs.ID)
+	require.NoError(t, err)
+	err = sync.PushDataForAllSnapshots(mds, vs.ID, blobDiff{s: badDigest{s}, ed: dlbin.Factory{}}, remote)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "status 422")
+	require.Contains(t, err.Error(), "Content of file doesn't match the sender's")
+}
@@ -0,0 +1,427 @@
+/*
+ * Copyright 2016 ClusterHQ
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hub
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/ClusterHQ/fli/dp/metastore"
+	"github.com/ClusterHQ/fli/meta/snapshot"
+	"github.com/ClusterHQ/fli/protocols"
+)
+
+// Meta data end points, these are the server side of restfulstorage.
+
+func (s *Server) importVolumeSet(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqVolSet
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	err := s.mds.ImportVolumeSet(req.VolSet)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusCreated, nil)
+}
+
+func (s *Server) deleteVolumeSet(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqVolSetID
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	err := s.mds.DeleteVolumeSet(req.ID)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Blobs on registered data servers are left behind, data servers have no volume set clean up end point
+	if s.storage != nil {
+		err = s.storage.DestroyVolumeSet(req.ID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	writeResult(w, r, http.StatusOK, nil)
+}
+
+func (s *Server) getVolumeSets(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqGetVolumeSets
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	vss, err := s.mds.GetVolumeSets(req.Query)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusOK, protocols.RespGetVolumeSets{Total: len(vss), VolumeSets: vss})
+}
+
+func (s *Server) getSnapshots(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqGetSnapshots
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	snaps, err := s.mds.GetSnapshots(req.Query)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusOK, protocols.RespGetSnapshots{Total: len(snaps), Snapshots: snaps})
+}
+
+func (s *Server) getSnapshotIDs(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqGetSnapshotIDs
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	ids, err := s.mds.GetSnapshotIDs(req.VolSetID)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusOK, protocols.RespGetSnapshotIDs{IDs: ids})
+}
+
+func (s *Server) getBranches(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqGetBranches
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	branches, err := s.mds.GetBranches(req.Query)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusOK, protocols.RespGetBranches{Total: len(branches), Branches: branches})
+}
+
+func (s *Server) getTip(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqBranch
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	tip, err := s.mds.GetTip(req.VolSetID, req.Branch)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusOK, protocols.RespGetTip{Snapshot: tip})
+}
+
+// getSnapshotsByBranch returns all snapshots of a branch, from the tip to the root.
+func (s *Server) getSnapshotsByBranch(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqBranch
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	defer s.mdsLock.Unlock()
+
+	sn, err := s.mds.GetTip(req.VolSetID, req.Branch)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	snaps := []*snapshot.Snapshot{sn}
+	for sn.ParentID != nil {
+		sn, err = metastore.GetSnapshot(s.mds, *sn.ParentID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		snaps = append(snaps, sn)
+	}
+
+	writeResult(w, r, http.StatusOK, protocols.RespGetSnapshots{Total: len(snaps), Snapshots: snaps})
+}
+
+func (s *Server) importBranch(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqImportBranch
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	err := s.mds.ImportBranch(req.ID, req.Branch, req.Snapshots...)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusCreated, nil)
+}
+
+func (s *Server) forkBranch(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqForkBranch
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	err := s.mds.ForkBranch(req.Branch, req.Snapshots...)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusCreated, nil)
+}
+
+func (s *Server) extendBranch(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqExtendBranch
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	defer s.mdsLock.Unlock()
+
+	// The branch may have grown since the client looked at it, report it as a mismatch so the client retries.
+	if len(req.Snapshots) > 0 && req.Snapshots[0].ParentID != nil {
+		parent, err := metastore.GetSnapshot(s.mds, *req.Snapshots[0].ParentID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if !parent.IsTip {
+			writeError(w, r, &metastore.ErrSnapshotImportMismatch{})
+			return
+		}
+	}
+
+	err := s.mds.ExtendBranch(req.Snapshots...)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusCreated, nil)
+}
+
+func (s *Server) updateVolumeSet(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqUpdateVolumeSet
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	confl, err := s.mds.UpdateVolumeSet(req.VolSetCur, req.VolSetInit)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusOK, protocols.RespUpdateVolumeSet{VSMetaConfl: confl})
+}
+
+func (s *Server) pullVolumeSet(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqUpdateVolumeSet
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	confl, err := s.mds.PullVolumeSet(req.VolSetCur, req.VolSetInit)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusOK, protocols.RespUpdateVolumeSet{VSMetaConfl: confl})
+}
+
+func (s *Server) updateSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqUpdateSnapshot
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	confl, err := s.mds.UpdateSnapshot(req.SnapCur, req.SnapInit)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusOK, protocols.RespUpdateSnapshot{SnapMetaConfl: confl})
+}
+
+func (s *Server) updateSnapshots(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqUpdateSnapshots
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	confls, err := s.mds.UpdateSnapshots(req.Snaps)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusOK, protocols.RespUpdateSnapshots{SnapMetaConfls: confls})
+}
+
+func (s *Server) pullSnapshots(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqUpdateSnapshots
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	confls, err := s.mds.PullSnapshots(req.Snaps)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusOK, protocols.RespUpdateSnapshots{SnapMetaConfls: confls})
+}
+
+// usage returns the disk space used by the given volume sets.
+func (s *Server) usage(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqUsage
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	total, err := s.mds.DiskSpaceUsage(req.Volumesets)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusOK, protocols.RespUsage{TotalBytes: strconv.FormatUint(total, 10)})
+}
+
+// stats returns the disk space of a volume set if one is given, or of the whole storage otherwise. Stats come from
+// the data server new bushes are placed on.
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqDataServerStats
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	dsid, err := s.nextDataServer()
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	ds, err := s.service(dsid)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	resp, err := ds.Stats(req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusOK, resp)
+}
+
+// addDataServer registers a data server, new bushes are placed on the most recently added server.
+func (s *Server) addDataServer(w http.ResponseWriter, r *http.Request) {
+	var req protocols.ReqURL
+	if err := decode(r, &req); err != nil {
+		badRequest(w, r, err)
+		return
+	}
+
+	s.mdsLock.Lock()
+	err := s.dsmgr.AddServer(req.URL)
+	s.mdsLock.Unlock()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeResult(w, r, http.StatusCreated, nil)
+}
+
+// analytics accepts and drops analytics events, there is no analytics collection on a self hosted hub.
+func (s *Server) analytics(w http.ResponseWriter, r *http.Request) {
+	r.Body.Close()
+	w.WriteHeader(http.StatusOK)
+}